@@ -0,0 +1,151 @@
+// Command admin performs administrative tasks against the database the API
+// uses, such as granting roles:
+//
+//	go run ./cmd/admin grant-role -user jane@example.com -role admin
+//	go run ./cmd/admin revoke-role -user jane@example.com -role moderator
+//	go run ./cmd/admin list-roles
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	internal_auth "github.com/studyplatform/backend/internal/auth"
+	pkg_auth "github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+)
+
+const usage = `Usage: admin <command> [flags]
+
+Commands:
+  grant-role   -user <email or ID> -role <role>   give a user a role
+  revoke-role  -user <email or ID> -role <role>   take a role from a user
+  list-roles                                      list users holding roles
+
+Roles: %s
+`
+
+func main() {
+	// Use the same settings as the API
+	_ = godotenv.Load()
+
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usage, roleNames())
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "grant-role":
+		err = changeRole(os.Args[1], os.Args[2:], true)
+	case "revoke-role":
+		err = changeRole(os.Args[1], os.Args[2:], false)
+	case "list-roles":
+		err = listRoles()
+	default:
+		fmt.Fprintf(os.Stderr, usage, roleNames())
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func changeRole(command string, args []string, grant bool) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	userFlag := flags.String("user", "", "email or unique ID of the user")
+	roleFlag := flags.String("role", "", "role to "+strings.TrimSuffix(command, "-role"))
+	_ = flags.Parse(args)
+
+	if *userFlag == "" || *roleFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	role, ok := pkg_auth.ParseRole(*roleFlag)
+	if !ok {
+		return fmt.Errorf("unknown role %q, expected one of %s", *roleFlag, roleNames())
+	}
+
+	mongoClient, err := database.NewMongoClient()
+	if err != nil {
+		return fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	defer mongoClient.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	change := internal_auth.RevokeRole
+	if grant {
+		change = internal_auth.GrantRole
+	}
+	changed, err := change(ctx, mongoClient, *userFlag, role, actor())
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !changed && grant:
+		fmt.Printf("%s already has the %s role\n", *userFlag, role)
+	case !changed:
+		fmt.Printf("%s does not have the %s role\n", *userFlag, role)
+	case grant:
+		fmt.Printf("Granted %s to %s; they need to sign in again\n", role, *userFlag)
+	default:
+		fmt.Printf("Revoked %s from %s; their sessions were signed out\n", role, *userFlag)
+	}
+	return nil
+}
+
+func listRoles() error {
+	mongoClient, err := database.NewMongoClient()
+	if err != nil {
+		return fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	defer mongoClient.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	staff, err := internal_auth.ListStaff(ctx, mongoClient)
+	if err != nil {
+		return err
+	}
+	if len(staff) == 0 {
+		fmt.Println("No users hold roles")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER ID\tUSERNAME\tEMAIL\tROLES")
+	for _, u := range staff {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.UniqueID, u.Username, u.Email, strings.Join(u.Roles, ","))
+	}
+	return w.Flush()
+}
+
+// actor names who ran the command in the audit log
+func actor() string {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	return "cli:" + name
+}
+
+func roleNames() string {
+	var names []string
+	for _, role := range pkg_auth.Roles() {
+		names = append(names, string(role))
+	}
+	return strings.Join(names, ", ")
+}
@@ -22,11 +22,14 @@ import (
 	internal_room "github.com/studyplatform/backend/internal/room"
 	internal_session "github.com/studyplatform/backend/internal/session"
 	internal_todo "github.com/studyplatform/backend/internal/todo"
+	internal_xp "github.com/studyplatform/backend/internal/xp"
 	pkg_auth "github.com/studyplatform/backend/pkg/auth"
 	"github.com/studyplatform/backend/pkg/database"
 	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/mailer"
 	"github.com/studyplatform/backend/pkg/middleware"
 	"github.com/studyplatform/backend/pkg/monitoring"
+	"github.com/studyplatform/backend/pkg/oidc"
 )
 
 func main() {
@@ -81,11 +84,88 @@ func main() {
 		logger.Fatal("Friends migration failed", logger.Field("error", err))
 	}
 
-	jwtManager := pkg_auth.NewManager()
+	// Ensure chat indexes used for ordered delivery and resume
+	if err := internal_realtime.EnsureChatIndexes(mongoClient); err != nil {
+		logger.Fatal("Chat index creation failed", logger.Field("error", err))
+	}
+	if err := internal_realtime.EnsureCallIndexes(mongoClient); err != nil {
+		logger.Fatal("Call index creation failed", logger.Field("error", err))
+	}
+	if err := internal_realtime.EnsureTimerIndexes(mongoClient); err != nil {
+		logger.Fatal("Room timer index creation failed", logger.Field("error", err))
+	}
+
+	if err := pkg_auth.EnsureRevocationIndexes(mongoClient); err != nil {
+		logger.Fatal("Revocation index creation failed", logger.Field("error", err))
+	}
+	if err := internal_auth.EnsureOIDCIndexes(mongoClient); err != nil {
+		logger.Fatal("OIDC index creation failed", logger.Field("error", err))
+	}
+	if err := pkg_auth.EnsureLoginThrottleIndexes(mongoClient); err != nil {
+		logger.Fatal("Login throttle index creation failed", logger.Field("error", err))
+	}
+
+	if err := pkg_auth.EnsureAccessTokenIndexes(mongoClient); err != nil {
+		logger.Fatal("Access token index creation failed", logger.Field("error", err))
+	}
+
+	// XP is awarded through a ledger; levels follow the configured curve
+	levelCurve := internal_xp.LoadLevelCurve()
+	if err := internal_xp.EnsureLedgerIndexes(mongoClient, levelCurve); err != nil {
+		logger.Fatal("XP ledger index creation failed", logger.Field("error", err))
+	}
+	xpLedger := internal_xp.NewLedger(mongoClient, levelCurve)
+	if err := xpLedger.ApplyPending(context.Background()); err != nil {
+		logger.Error("Failed to apply pending XP ledger entries", logger.Field("error", err))
+	}
+
+	// Users study in one session at a time
+	sessionTiming := internal_session.LoadTimingConfig()
+	if err := internal_session.EnsureSessionIndexes(mongoClient, xpLedger, sessionTiming); err != nil {
+		logger.Fatal("Session index creation failed", logger.Field("error", err))
+	}
+
+	jwtManager, err := pkg_auth.LoadManager()
+	if err != nil {
+		logger.Fatal("Failed to load JWT signing keys", logger.Field("error", err))
+	}
+	if !jwtManager.UsesSigningKeys() {
+		logger.Warn("JWT_SIGNING_KEYS not set, signing tokens with a shared secret; other services cannot verify them")
+	}
+	revocationStore := pkg_auth.NewRevocationStore(mongoClient)
+	loginThrottle := pkg_auth.NewLoginThrottle(mongoClient, pkg_auth.LoadLoginThrottleConfig())
+	accessTokens := pkg_auth.NewAccessTokenStore(mongoClient)
+	mfaStore := pkg_auth.NewMFAStore(mongoClient)
+	passwordPolicy, err := pkg_auth.LoadPasswordPolicy()
+	if err != nil {
+		logger.Fatal("Failed to load password policy", logger.Field("error", err))
+	}
+	oidcProviders, err := oidc.LoadProviders()
+	if err != nil {
+		logger.Fatal("Failed to load identity providers", logger.Field("error", err))
+	}
+	mail, err := mailer.LoadMailer()
+	if err != nil {
+		logger.Fatal("Failed to configure email", logger.Field("error", err))
+	}
+
+	// Initialize the realtime backplane. The MongoDB broker lets several API
+	// replicas share room traffic; the default keeps everything in process.
+	var broker internal_realtime.Broker
+	if os.Getenv("REALTIME_BROKER") == "mongo" {
+		mongoBroker, err := internal_realtime.NewMongoBroker(mongoClient)
+		if err != nil {
+			logger.Fatal("Failed to initialize realtime broker", logger.Field("error", err))
+		}
+		broker = mongoBroker
+	}
 
 	// Initialize WebSocket hub
-	hub := internal_realtime.NewHub(mongoClient)
+	hub := internal_realtime.NewHub(mongoClient, broker)
+	hub.SetTimerSessions(internal_session.NewRoomTimerSessions(mongoClient, sessionTiming))
+	xpLedger.SetNotifier(hub)
 	go hub.Run()
+	defer hub.Close()
 
 	// Initialize health checker and monitoring
 	version := os.Getenv("APP_VERSION")
@@ -93,17 +173,28 @@ func main() {
 		version = "1.0.0"
 	}
 	healthChecker := monitoring.NewHealthChecker(mongoClient, version, env)
+	realtimeMetrics := hub.Metrics()
+	healthChecker.RegisterCounter("realtime_messages_rate_limited_total", "WebSocket messages rejected by rate limiting", realtimeMetrics.RateLimited.Load)
+	healthChecker.RegisterCounter("realtime_messages_too_long_total", "WebSocket chat messages rejected for their length", realtimeMetrics.TooLong.Load)
+	healthChecker.RegisterCounter("realtime_messages_dropped_total", "WebSocket messages dropped because the hub or a client fell behind", realtimeMetrics.Dropped.Load)
+	healthChecker.RegisterCounter("realtime_slow_clients_disconnected_total", "WebSocket connections closed for falling behind", realtimeMetrics.SlowDisconnected.Load)
+	healthChecker.RegisterCounter("realtime_origin_rejected_total", "WebSocket handshakes refused for their origin", realtimeMetrics.OriginRejected.Load)
 	healthChecker.StartPeriodicChecks()
 
 	// Initialize rate limiter
 	rateLimiter := middleware.NewRateLimiter(nil) // Use default config
 	defer rateLimiter.Close()
 
+	// Close sessions whose clients stopped pinging
+	sessionReaper := internal_session.NewReaper(mongoClient, xpLedger, sessionTiming)
+	sessionReaper.Start()
+	defer sessionReaper.Stop()
+
 	// Create router
 	router := gin.New()
 
 	// Apply middleware
-	middlewareManager := middleware.NewMiddleware()
+	middlewareManager := middleware.NewMiddleware(jwtManager, revocationStore, accessTokens)
 	router.Use(gin.Recovery())
 	router.Use(middleware.CORS()) // Move CORS to the top
 	router.Use(middlewareManager.Logger())
@@ -113,7 +204,7 @@ func main() {
 	router.Use(rateLimiter.RateLimit())
 
 	// Register routes
-	registerRoutes(router, mongoClient, jwtManager, middlewareManager, hub, healthChecker, rateLimiter)
+	registerRoutes(router, mongoClient, jwtManager, revocationStore, loginThrottle, accessTokens, mfaStore, passwordPolicy, mail, oidcProviders, middlewareManager, hub, healthChecker, rateLimiter, sessionTiming, xpLedger)
 
 	// Create HTTP server
 	server := &http.Server{
@@ -147,7 +238,10 @@ func main() {
 	logger.Info("Server exited properly")
 }
 
-func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtManager *pkg_auth.Manager, middlewareManager *middleware.Middleware, hub *internal_realtime.Hub, healthChecker *monitoring.HealthChecker, rateLimiter *middleware.RateLimiter) {
+func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtManager *pkg_auth.Manager, revocationStore *pkg_auth.RevocationStore, loginThrottle *pkg_auth.LoginThrottle, accessTokens *pkg_auth.AccessTokenStore, mfaStore *pkg_auth.MFAStore, passwordPolicy pkg_auth.PasswordPolicy, mail mailer.Mailer, oidcProviders map[string]*oidc.Provider, middlewareManager *middleware.Middleware, hub *internal_realtime.Hub, healthChecker *monitoring.HealthChecker, rateLimiter *middleware.RateLimiter, sessionTiming internal_session.TimingConfig, xpLedger *internal_xp.Ledger) {
+	// Public keys for services verifying our tokens
+	router.GET("/.well-known/jwks.json", internal_auth.JWKSHandler(jwtManager))
+
 	// API Version
 	apiV1 := router.Group("/api/v1")
 
@@ -156,9 +250,8 @@ func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtMa
 	apiV1.GET("/health/simple", healthChecker.SimpleHealthCheckHandler())
 	apiV1.GET("/metrics", healthChecker.MetricsHandler())
 
-	// Rate limiting stats (admin only)
-	apiV1.GET("/admin/rate-limit-stats", func(c *gin.Context) {
-		// In production, add admin authentication here
+	// Rate limiting stats (staff only)
+	apiV1.GET("/admin/rate-limit-stats", middlewareManager.Auth(), middlewareManager.RequirePermission(pkg_auth.PermViewStats), func(c *gin.Context) {
 		c.JSON(http.StatusOK, rateLimiter.GetRateLimitStats())
 	})
 
@@ -170,8 +263,8 @@ func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtMa
 		})
 	})
 
-	// Friends debug endpoint (no auth required)
-	apiV1.GET("/friends/debug", func(c *gin.Context) {
+	// Friends debug endpoint (admin only)
+	apiV1.GET("/friends/debug", middlewareManager.Auth(), middlewareManager.RequirePermission(pkg_auth.PermDebug), func(c *gin.Context) {
 		// Test database connection
 		users := mongoClient.GetCollection(database.CollectionNames.Users)
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -198,35 +291,67 @@ func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtMa
 	authRoutes := apiV1.Group("/auth")
 	{
 		// Add a simple test endpoint
-		authRoutes.GET("/test", func(c *gin.Context) {
+		authRoutes.GET("/test", middlewareManager.Auth(), middlewareManager.RequirePermission(pkg_auth.PermDebug), func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{
 				"message":   "Auth routes are working",
 				"timestamp": time.Now().Unix(),
 			})
 		})
 
-		authRoutes.POST("/register", internal_auth.RegisterHandler(mongoClient, jwtManager))
-		authRoutes.POST("/login", internal_auth.LoginHandler(mongoClient, jwtManager))
-		authRoutes.POST("/logout", middlewareManager.Auth(), internal_auth.LogoutHandler(mongoClient, jwtManager))
-		authRoutes.POST("/refresh", internal_auth.RefreshTokenHandler(mongoClient, jwtManager))
+		authRoutes.POST("/register", internal_auth.RegisterHandler(mongoClient, jwtManager, passwordPolicy, mail))
+		authRoutes.POST("/login", internal_auth.LoginHandler(mongoClient, jwtManager, loginThrottle, mail, hub))
+		authRoutes.POST("/unlock", internal_auth.UnlockAccountHandler(mongoClient, jwtManager, revocationStore, loginThrottle))
+		authRoutes.POST("/login/mfa", internal_auth.MFALoginHandler(mongoClient, jwtManager, revocationStore, mfaStore, loginThrottle, mail, hub))
+		authRoutes.POST("/logout", middlewareManager.Auth(), internal_auth.LogoutHandler(mongoClient, jwtManager, revocationStore))
+		authRoutes.POST("/refresh", internal_auth.RefreshTokenHandler(mongoClient, jwtManager, revocationStore))
+
+		// Email verification and password reset
+		authRoutes.POST("/verify-email", internal_auth.ConfirmEmailVerificationHandler(mongoClient, jwtManager, revocationStore))
+		authRoutes.POST("/verify-email/resend", middlewareManager.Auth(), internal_auth.RequestEmailVerificationHandler(mongoClient, jwtManager, mail))
+		authRoutes.POST("/password/forgot", internal_auth.ForgotPasswordHandler(mongoClient, jwtManager, mail))
+		authRoutes.POST("/password/reset", internal_auth.ResetPasswordHandler(mongoClient, jwtManager, revocationStore, passwordPolicy))
+		authRoutes.PUT("/password", middlewareManager.Auth(), internal_auth.ChangePasswordHandler(mongoClient, revocationStore, passwordPolicy, mail, hub))
+
+		// Login through external identity providers
+		authRoutes.GET("/oidc", internal_auth.ListOIDCProvidersHandler(oidcProviders))
+		authRoutes.GET("/oidc/:provider/login", internal_auth.OIDCLoginHandler(mongoClient, oidcProviders))
+		authRoutes.GET("/oidc/:provider/callback", internal_auth.OIDCCallbackHandler(mongoClient, jwtManager, revocationStore, oidcProviders))
+		authRoutes.POST("/oidc/complete", internal_auth.OIDCCompleteHandler(mongoClient, jwtManager, revocationStore))
+
+		// Two-factor authentication
+		authRoutes.POST("/mfa/setup", middlewareManager.Auth(), internal_auth.SetupMFAHandler(mongoClient, mfaStore))
+		authRoutes.POST("/mfa/enable", middlewareManager.Auth(), internal_auth.EnableMFAHandler(mongoClient, mfaStore, hub))
+		authRoutes.POST("/mfa/disable", middlewareManager.Auth(), internal_auth.DisableMFAHandler(mongoClient, revocationStore, mfaStore, hub))
+		authRoutes.POST("/mfa/recovery-codes", middlewareManager.Auth(), internal_auth.RegenerateRecoveryCodesHandler(mongoClient, revocationStore, mfaStore))
+
+		// Device sessions
+		authRoutes.GET("/sessions", middlewareManager.Auth(), internal_auth.ListSessionsHandler(mongoClient))
+		authRoutes.DELETE("/sessions", middlewareManager.Auth(), internal_auth.RevokeAllSessionsHandler(mongoClient, revocationStore))
+		authRoutes.DELETE("/sessions/:id", middlewareManager.Auth(), internal_auth.RevokeSessionHandler(mongoClient, revocationStore))
+
+		// Personal access tokens for scripts and integrations
+		authRoutes.POST("/tokens", middlewareManager.Auth(), internal_auth.CreateAccessTokenHandler(accessTokens))
+		authRoutes.GET("/tokens", middlewareManager.Auth(), internal_auth.ListAccessTokensHandler(accessTokens))
+		authRoutes.DELETE("/tokens/:id", middlewareManager.Auth(), internal_auth.RevokeAccessTokenHandler(accessTokens))
 
 		// Add /me endpoint with Auth middleware
-		authRoutes.GET("/me", middlewareManager.Auth(), internal_auth.MeHandler(mongoClient))
+		authRoutes.GET("/me", middlewareManager.Auth(pkg_auth.ScopeProfileRead), internal_auth.MeHandler(mongoClient))
 		// Add profile update endpoint
 		authRoutes.PUT("/me", middlewareManager.Auth(), internal_auth.UpdateProfileHandler(mongoClient))
 		// Add XP update endpoint
-		authRoutes.PUT("/xp", middlewareManager.Auth(), internal_auth.UpdateXPHandler(mongoClient))
+		authRoutes.GET("/xp", middlewareManager.Auth(), internal_xp.GetXPHandler(xpLedger))
+		authRoutes.PUT("/xp", middlewareManager.Auth(), middlewareManager.RequirePermission(pkg_auth.PermManageXP), internal_auth.UpdateXPHandler(xpLedger))
 	}
 
 	// Friends routes
 	friendsRoutes := apiV1.Group("/friends")
 	friendsRoutes.Use(middlewareManager.Auth())
 	{
-		friendsRoutes.POST("/request", internal_auth.SendFriendRequestHandler(mongoClient))
-		friendsRoutes.PUT("/:id/accept", internal_auth.AcceptFriendRequestHandler(mongoClient))
-		friendsRoutes.PUT("/:id/reject", internal_auth.RejectFriendRequestHandler(mongoClient))
-		friendsRoutes.DELETE("/:id/remove", internal_auth.RemoveFriendHandler(mongoClient))
-		friendsRoutes.GET("/", internal_auth.ListFriendsHandler(mongoClient))
+		friendsRoutes.POST("/request", internal_auth.SendFriendRequestHandler(mongoClient, hub))
+		friendsRoutes.PUT("/:id/accept", internal_auth.AcceptFriendRequestHandler(mongoClient, hub))
+		friendsRoutes.PUT("/:id/reject", internal_auth.RejectFriendRequestHandler(mongoClient, hub))
+		friendsRoutes.DELETE("/:id/remove", internal_auth.RemoveFriendHandler(mongoClient, hub))
+		friendsRoutes.GET("/", internal_auth.ListFriendsHandler(mongoClient, hub))
 		friendsRoutes.GET("/requests", internal_auth.ListFriendRequestsHandler(mongoClient))
 	}
 	// User search/profile routes
@@ -243,40 +368,53 @@ func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtMa
 	roomRoutes := apiV1.Group("/rooms")
 	roomRoutes.Use(middlewareManager.Auth())
 	{
-		roomRoutes.GET("/", internal_room.ListRoomsHandler(mongoClient))
-		roomRoutes.POST("/", internal_room.CreateRoomHandler(mongoClient))
+		roomRoutes.GET("/", internal_room.ListRoomsHandler(mongoClient, hub))
+		roomRoutes.POST("/", internal_room.CreateRoomHandler(mongoClient, os.Getenv("REQUIRE_VERIFIED_EMAIL_FOR_ROOMS") == "true"))
 		roomRoutes.POST("/join", internal_room.JoinRoomByCodeHandler(mongoClient))
 
 		// Room-specific sub-routes must come BEFORE the general :id route
 		roomRoutes.GET("/:id/notes/", internal_note.GetRoomNotesHandler(mongoClient))
 		roomRoutes.GET("/:id/materials/", internal_material.GetRoomMaterialsHandler(mongoClient))
 		roomRoutes.POST("/:id/generate-code", internal_room.GenerateInvitationCodeHandler(mongoClient))
-		roomRoutes.POST("/:id/invite", internal_room.InviteUserToRoomHandler(mongoClient))     // Invite user to room
-		roomRoutes.POST("/:id/accept", internal_room.AcceptRoomInvitationHandler(mongoClient)) // Accept room invitation
+		roomRoutes.POST("/:id/invite", internal_room.InviteUserToRoomHandler(mongoClient, hub)) // Invite user to room
+		roomRoutes.POST("/:id/accept", internal_room.AcceptRoomInvitationHandler(mongoClient))  // Accept room invitation
 		roomRoutes.POST("/:id/leave", internal_room.LeaveRoomHandler(mongoClient))
 		roomRoutes.POST("/:id/enter", internal_room.EnterRoomHandler(mongoClient)) // Enter/join a room
 
 		// General room CRUD routes must come LAST
-		roomRoutes.GET("/:id", internal_room.GetRoomHandler(mongoClient))
+		roomRoutes.GET("/:id", internal_room.GetRoomHandler(mongoClient, hub))
 		roomRoutes.PUT("/:id", internal_room.UpdateRoomHandler(mongoClient))
 		roomRoutes.DELETE("/:id", internal_room.DeleteRoomHandler(mongoClient))
 	}
 
-	// Test route for debugging (remove in production)
-	apiV1.GET("/test-room", internal_room.TestRoomHandler(mongoClient))
-	apiV1.GET("/debug-rooms", internal_room.DebugListAllRoomsHandler(mongoClient))
-	apiV1.GET("/simple-test", internal_room.SimpleTestHandler(mongoClient))
+	// Debugging routes (admin only)
+	debugRoutes := apiV1.Group("")
+	debugRoutes.Use(middlewareManager.Auth(), middlewareManager.RequirePermission(pkg_auth.PermDebug))
+	{
+		debugRoutes.GET("/test-room", internal_room.TestRoomHandler(mongoClient))
+		debugRoutes.GET("/debug-rooms", internal_room.DebugListAllRoomsHandler(mongoClient))
+		debugRoutes.GET("/simple-test", internal_room.SimpleTestHandler(mongoClient))
+	}
 
 	// Session routes
 	sessionRoutes := apiV1.Group("/sessions")
-	sessionRoutes.Use(middlewareManager.Auth())
 	{
-		sessionRoutes.POST("/start", internal_session.StartSessionHandler(mongoClient))
-		sessionRoutes.POST("/end", internal_session.EndSessionHandler(mongoClient))
-		sessionRoutes.GET("/", internal_session.ListSessionsHandler(mongoClient))
-		sessionRoutes.POST("/:id/ping", internal_session.ActivityPingHandler(mongoClient))
-		sessionRoutes.GET("/stats", internal_session.GetUserSessionStats(mongoClient))
-		sessionRoutes.GET("/privileges", internal_session.CheckXPPrivileges(mongoClient))
+		// Personal access tokens with the sessions scopes may use these
+		sessionsRead := middlewareManager.Auth(pkg_auth.ScopeSessionsRead)
+		sessionsWrite := middlewareManager.Auth(pkg_auth.ScopeSessionsWrite)
+		sessionRoutes.POST("/start", sessionsWrite, internal_session.StartSessionHandler(mongoClient, xpLedger, sessionTiming))
+		sessionRoutes.POST("/end", sessionsWrite, internal_session.EndSessionHandler(mongoClient, xpLedger, sessionTiming))
+		sessionRoutes.GET("/", sessionsRead, internal_session.ListSessionsHandler(mongoClient))
+		sessionRoutes.GET("/current", sessionsRead, internal_session.CurrentSessionHandler(mongoClient, sessionTiming))
+		sessionRoutes.POST("/:id/ping", sessionsWrite, internal_session.ActivityPingHandler(mongoClient, sessionTiming))
+		sessionRoutes.POST("/:id/segments", sessionsWrite, internal_session.StartSegmentHandler(mongoClient, sessionTiming))
+		sessionRoutes.POST("/:id/pause", sessionsWrite, internal_session.PauseSessionHandler(mongoClient, sessionTiming))
+		sessionRoutes.POST("/:id/resume", sessionsWrite, internal_session.ResumeSessionHandler(mongoClient, sessionTiming))
+		sessionRoutes.POST("/:id/skip", sessionsWrite, internal_session.SkipSegmentHandler(mongoClient, sessionTiming))
+		sessionRoutes.GET("/presets", sessionsRead, internal_session.GetPomodoroPresetsHandler(mongoClient, sessionTiming))
+		sessionRoutes.PUT("/presets", sessionsWrite, internal_session.UpdatePomodoroPresetsHandler(mongoClient, sessionTiming))
+		sessionRoutes.GET("/stats", sessionsRead, internal_session.GetUserSessionStats(mongoClient))
+		sessionRoutes.GET("/privileges", sessionsRead, internal_session.CheckXPPrivileges(mongoClient))
 	}
 
 	// Material routes
@@ -295,25 +433,29 @@ func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtMa
 
 	// TODO routes
 	todoRoutes := apiV1.Group("/todos")
-	todoRoutes.Use(middlewareManager.Auth())
 	{
-		todoRoutes.GET("/", internal_todo.ListTodosHandler(mongoClient))
-		todoRoutes.POST("/", internal_todo.CreateTodoHandler(mongoClient))
-		todoRoutes.GET("/:id", internal_todo.GetTodoHandler(mongoClient))
-		todoRoutes.PUT("/:id", internal_todo.UpdateTodoHandler(mongoClient))
-		todoRoutes.PUT("/:id/complete", internal_todo.CompleteTodoHandler(mongoClient))
-		todoRoutes.DELETE("/:id", internal_todo.DeleteTodoHandler(mongoClient))
+		// Personal access tokens with the todos scopes may use these
+		todosRead := middlewareManager.Auth(pkg_auth.ScopeTodosRead)
+		todosWrite := middlewareManager.Auth(pkg_auth.ScopeTodosWrite)
+		todoRoutes.GET("/", todosRead, internal_todo.ListTodosHandler(mongoClient))
+		todoRoutes.POST("/", todosWrite, internal_todo.CreateTodoHandler(mongoClient))
+		todoRoutes.GET("/:id", todosRead, internal_todo.GetTodoHandler(mongoClient))
+		todoRoutes.PUT("/:id", todosWrite, internal_todo.UpdateTodoHandler(mongoClient))
+		todoRoutes.PUT("/:id/complete", todosWrite, internal_todo.CompleteTodoHandler(mongoClient, xpLedger))
+		todoRoutes.DELETE("/:id", todosWrite, internal_todo.DeleteTodoHandler(mongoClient))
 	}
 
 	// Note routes
 	noteRoutes := apiV1.Group("/notes")
-	noteRoutes.Use(middlewareManager.Auth())
 	{
-		noteRoutes.GET("/", internal_note.ListNotesHandler(mongoClient))
-		noteRoutes.POST("/", internal_note.CreateNoteHandler(mongoClient))
-		noteRoutes.GET("/:id", internal_note.GetNotesHandler(mongoClient))
-		noteRoutes.PUT("/:id", internal_note.UpdateNoteHandler(mongoClient))
-		noteRoutes.DELETE("/:id", internal_note.DeleteNoteHandler(mongoClient))
+		// Personal access tokens with the notes scopes may use these
+		notesRead := middlewareManager.Auth(pkg_auth.ScopeNotesRead)
+		notesWrite := middlewareManager.Auth(pkg_auth.ScopeNotesWrite)
+		noteRoutes.GET("/", notesRead, internal_note.ListNotesHandler(mongoClient))
+		noteRoutes.POST("/", notesWrite, internal_note.CreateNoteHandler(mongoClient))
+		noteRoutes.GET("/:id", notesRead, internal_note.GetNotesHandler(mongoClient))
+		noteRoutes.PUT("/:id", notesWrite, internal_note.UpdateNoteHandler(mongoClient))
+		noteRoutes.DELETE("/:id", notesWrite, internal_note.DeleteNoteHandler(mongoClient))
 	}
 
 	// Posts routes
@@ -321,10 +463,10 @@ func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtMa
 	{
 		posts.GET("/", middlewareManager.Auth(), internal_post.ListPostsHandler(mongoClient))
 		posts.POST("/", middlewareManager.Auth(), internal_post.CreatePostHandler(mongoClient))
-		posts.PUT("/:id/like", middlewareManager.Auth(), internal_post.LikePostHandler(mongoClient))
+		posts.PUT("/:id/like", middlewareManager.Auth(), internal_post.LikePostHandler(mongoClient, hub))
 		posts.DELETE("/:id", middlewareManager.Auth(), internal_post.DeletePostHandler(mongoClient))
-		posts.POST("/:postId/comments", middlewareManager.Auth(), internal_post.CreateCommentHandler(mongoClient))
-		posts.PUT("/comments/:commentId/like", middlewareManager.Auth(), internal_post.LikeCommentHandler(mongoClient))
+		posts.POST("/:postId/comments", middlewareManager.Auth(), internal_post.CreateCommentHandler(mongoClient, hub))
+		posts.PUT("/comments/:commentId/like", middlewareManager.Auth(), internal_post.LikeCommentHandler(mongoClient, hub))
 	}
 
 	// Notification routes
@@ -334,7 +476,7 @@ func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtMa
 		notificationRoutes.GET("/", internal_notification.ListNotificationsHandler(mongoClient))
 		notificationRoutes.PUT("/:id/read", internal_notification.MarkNotificationReadHandler(mongoClient))
 		notificationRoutes.DELETE("/:id", internal_notification.DeleteNotificationHandler(mongoClient))
-		notificationRoutes.POST("/", internal_notification.CreateNotificationHandler(mongoClient))
+		notificationRoutes.POST("/", internal_notification.CreateNotificationHandler(mongoClient, hub))
 		notificationRoutes.DELETE("/clear-friend-requests", internal_notification.ClearFriendRequestNotificationsHandler(mongoClient))
 		notificationRoutes.DELETE("/clear-all", internal_notification.ClearAllNotificationsHandler(mongoClient))
 	}
@@ -344,9 +486,18 @@ func registerRoutes(router *gin.Engine, mongoClient *database.MongoClient, jwtMa
 	realtimeRoutes.Use(middlewareManager.Auth())
 	{
 		realtimeRoutes.GET("/chat/:roomId", internal_realtime.GetRoomChatHistory(mongoClient))
+		realtimeRoutes.GET("/chat/:roomId/thread/:messageId", internal_realtime.GetChatThread(mongoClient))
 		realtimeRoutes.GET("/online/:roomId", internal_realtime.GetOnlineUsersInRoom(hub))
+		realtimeRoutes.GET("/calls/:roomId", internal_realtime.GetRoomCall(mongoClient))
+		realtimeRoutes.GET("/timers/:roomId", internal_realtime.GetRoomTimer(hub))
+		realtimeRoutes.POST("/timers/:roomId/start", internal_realtime.RoomTimerHandler(hub, internal_realtime.TimerActionStart))
+		realtimeRoutes.POST("/timers/:roomId/pause", internal_realtime.RoomTimerHandler(hub, internal_realtime.TimerActionPause))
+		realtimeRoutes.POST("/timers/:roomId/resume", internal_realtime.RoomTimerHandler(hub, internal_realtime.TimerActionResume))
+		realtimeRoutes.POST("/timers/:roomId/skip", internal_realtime.RoomTimerHandler(hub, internal_realtime.TimerActionSkip))
+		realtimeRoutes.POST("/timers/:roomId/stop", internal_realtime.RoomTimerHandler(hub, internal_realtime.TimerActionStop))
+		realtimeRoutes.GET("/turn-credentials", internal_realtime.GetTURNCredentials(internal_realtime.LoadTURNConfig()))
 	}
 
 	// WebSocket route - no auth middleware (handles auth in WebSocket handler)
-	apiV1.GET("/realtime/ws", internal_realtime.WebSocketHandler(hub))
+	apiV1.GET("/realtime/ws", internal_realtime.WebSocketHandler(hub, jwtManager, revocationStore, internal_realtime.LoadWSConfig(middleware.AllowedOrigins())))
 }
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// CreateAccessTokenHandler issues a personal access token. The token is
+// only ever shown in this response.
+func CreateAccessTokenHandler(accessTokens *auth.AccessTokenStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		var req models.CreateAccessTokenRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+		token, record, err := accessTokens.Create(ctx, userIDStr, req.Name, req.Scopes, ttl)
+		if errors.Is(err, auth.ErrInvalidScope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scopes", "details": err.Error(), "scopes": auth.Scopes()})
+			return
+		} else if err == auth.ErrTooManyAccessTokens {
+			c.JSON(http.StatusConflict, gin.H{"error": "Too many access tokens, revoke one first"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create access token"})
+			return
+		}
+
+		logger.Info("Personal access token created",
+			logger.Field("user_id", userIDStr),
+			logger.Field("token_id", record.ID.Hex()),
+			logger.Field("scopes", record.Scopes),
+		)
+		c.JSON(http.StatusCreated, gin.H{"token": token, "accessToken": record})
+	}
+}
+
+// ListAccessTokensHandler lists the user's personal access tokens without
+// the tokens themselves
+func ListAccessTokensHandler(accessTokens *auth.AccessTokenStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		tokens, err := accessTokens.List(ctx, userIDStr)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"accessTokens": tokens, "scopes": auth.Scopes()})
+	}
+}
+
+// RevokeAccessTokenHandler deletes one of the user's personal access tokens
+func RevokeAccessTokenHandler(accessTokens *auth.AccessTokenStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		tokenID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid access token ID"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err = accessTokens.Revoke(ctx, userIDStr, tokenID)
+		if err == auth.ErrAccessTokenNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Access token not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Access token revoked"})
+	}
+}
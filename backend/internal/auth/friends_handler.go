@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/studyplatform/backend/internal/realtime"
 	"github.com/studyplatform/backend/pkg/database"
 	"github.com/studyplatform/backend/pkg/models"
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,7 +16,7 @@ import (
 )
 
 // SendFriendRequestHandler handles sending a friend request by unique ID
-func SendFriendRequestHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func SendFriendRequestHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -97,17 +98,21 @@ func SendFriendRequestHandler(mongoClient *database.MongoClient) gin.HandlerFunc
 		notifications := mongoClient.GetCollection(database.CollectionNames.Notifications)
 		friendRequestNotification := models.CreateFriendRequestNotification(target.ID.Hex(), me.ID.Hex(), me.Username)
 
-		_, err = notifications.InsertOne(ctx, friendRequestNotification)
+		res, err := notifications.InsertOne(ctx, friendRequestNotification)
 		if err != nil {
 			// Don't fail the entire request if notification creation fails
+		} else {
+			friendRequestNotification.ID, _ = res.InsertedID.(primitive.ObjectID)
+			hub.NotifyUser(target.UniqueID, friendRequestNotification)
 		}
+		hub.NotifyFriendUpdate(target.UniqueID, realtime.FriendActionRequest, me.UniqueID, me.Username)
 
 		c.JSON(http.StatusOK, gin.H{"message": "Friend request sent"})
 	}
 }
 
 // AcceptFriendRequestHandler handles accepting a friend request
-func AcceptFriendRequestHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func AcceptFriendRequestHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -152,10 +157,14 @@ func AcceptFriendRequestHandler(mongoClient *database.MongoClient) gin.HandlerFu
 		// Create notification for the friend that their request was accepted
 		notifications := mongoClient.GetCollection(database.CollectionNames.Notifications)
 		friendAcceptedNotification := models.CreateFriendAcceptedNotification(friend.ID.Hex(), me.ID.Hex(), me.Username)
-		_, err = notifications.InsertOne(ctx, friendAcceptedNotification)
+		res, err := notifications.InsertOne(ctx, friendAcceptedNotification)
 		if err != nil {
 			// Don't fail if notification creation fails
+		} else {
+			friendAcceptedNotification.ID, _ = res.InsertedID.(primitive.ObjectID)
+			hub.NotifyUser(friend.UniqueID, friendAcceptedNotification)
 		}
+		hub.NotifyFriendUpdate(friend.UniqueID, realtime.FriendActionAccepted, me.UniqueID, me.Username)
 
 		// Remove friend request notifications between these two users
 		_, err = notifications.DeleteMany(ctx, bson.M{
@@ -174,7 +183,7 @@ func AcceptFriendRequestHandler(mongoClient *database.MongoClient) gin.HandlerFu
 }
 
 // RejectFriendRequestHandler handles rejecting a friend request
-func RejectFriendRequestHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func RejectFriendRequestHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -229,12 +238,14 @@ func RejectFriendRequestHandler(mongoClient *database.MongoClient) gin.HandlerFu
 			// Don't fail if notification cleanup fails
 		}
 
+		hub.NotifyFriendUpdate(friend.UniqueID, realtime.FriendActionRejected, me.UniqueID, me.Username)
+
 		c.JSON(http.StatusOK, gin.H{"message": "Friend request rejected"})
 	}
 }
 
 // ListFriendsHandler returns the list of all friend relationships
-func ListFriendsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func ListFriendsHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -260,7 +271,8 @@ func ListFriendsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			}
 		}
 
-		var friendsList []map[string]interface{}
+		var friends []models.User
+		var relations []models.Friend
 		for _, f := range me.Friends {
 			var friend models.User
 			var found bool
@@ -278,20 +290,45 @@ func ListFriendsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			}
 
 			if found {
-				friendData := map[string]interface{}{
-					"id":          f.UserID,
-					"userId":      f.UserID,
-					"status":      f.Status,
-					"since":       f.Since,
-					"username":    friend.Username,
-					"uniqueId":    friend.UniqueID,
-					"firstName":   friend.FirstName,
-					"lastName":    friend.LastName,
-					"displayName": friend.FirstName + " " + friend.LastName,
-					"avatarUrl":   friend.AvatarURL,
+				friends = append(friends, friend)
+				relations = append(relations, f)
+			}
+		}
+
+		// Pending requests don't get to see whether someone is online
+		var friendIDs []string
+		for i, f := range relations {
+			if f.Status == "accepted" {
+				friendIDs = append(friendIDs, friends[i].UniqueID)
+			}
+		}
+		presence := hub.UsersPresence(friendIDs)
+
+		var friendsList []map[string]interface{}
+		for i, f := range relations {
+			friend := friends[i]
+			friendData := map[string]interface{}{
+				"id":          f.UserID,
+				"userId":      f.UserID,
+				"status":      f.Status,
+				"since":       f.Since,
+				"username":    friend.Username,
+				"uniqueId":    friend.UniqueID,
+				"firstName":   friend.FirstName,
+				"lastName":    friend.LastName,
+				"displayName": friend.FirstName + " " + friend.LastName,
+				"avatarUrl":   friend.AvatarURL,
+			}
+			if f.Status == "accepted" {
+				friendPresence := presence[friend.UniqueID]
+				friendData["presence"] = friendPresence.Status
+				friendData["isOnline"] = friendPresence.IsOnline()
+				friendData["lastSeen"] = friend.LastActive
+				if friendPresence.IsOnline() {
+					friendData["lastSeen"] = time.Now()
 				}
-				friendsList = append(friendsList, friendData)
 			}
+			friendsList = append(friendsList, friendData)
 		}
 
 		c.JSON(http.StatusOK, gin.H{"friends": friendsList})
@@ -420,7 +457,7 @@ func GetUserByIDHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 }
 
 // RemoveFriendHandler handles removing a friend
-func RemoveFriendHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func RemoveFriendHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -461,6 +498,7 @@ func RemoveFriendHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update friend"})
 			return
 		}
+		hub.NotifyFriendUpdate(friend.UniqueID, realtime.FriendActionRemoved, me.UniqueID, me.Username)
 		c.JSON(http.StatusOK, gin.H{"message": "Friend removed successfully"})
 	}
 }
@@ -14,20 +14,26 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/google/uuid"
+	"github.com/studyplatform/backend/internal/realtime"
+	"github.com/studyplatform/backend/internal/xp"
 	"github.com/studyplatform/backend/pkg/auth"
 	"github.com/studyplatform/backend/pkg/database"
 	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/mailer"
 	"github.com/studyplatform/backend/pkg/models"
 )
 
 // RegisterHandler handles user registration
-func RegisterHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager) gin.HandlerFunc {
+func RegisterHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, policy auth.PasswordPolicy, mail mailer.Mailer) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req models.SignupRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
 			return
 		}
+		if policyErrorResponse(c, policy.Validate(req.Password, req.Email, req.Username)) {
+			return
+		}
 
 		users := mongoClient.GetCollection(database.CollectionNames.Users)
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -63,6 +69,8 @@ func RegisterHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager
 			"updated_at":  time.Now(),
 			"is_active":   true,
 			"is_verified": false,
+			"xp":          0,
+			"level":       1,
 		}
 		res, err := users.InsertOne(ctx, userMap)
 		if err != nil {
@@ -79,26 +87,25 @@ func RegisterHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch created user"})
 			return
 		}
-		accessToken, err := jwtManager.GenerateAccessToken(user.UniqueID, user.Username, user.Email)
+		tokens, err := startSession(ctx, mongoClient, jwtManager, user, c)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
 			return
 		}
-		refreshToken, err := jwtManager.GenerateRefreshToken(user.UniqueID, user.Username, user.Email)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate refresh token"})
-			return
+		if err := sendVerificationEmail(jwtManager, mail, user); err != nil {
+			logger.Warn("Failed to send verification email", logger.Field("user_id", user.UniqueID), logger.Field("error", err))
 		}
 		c.JSON(http.StatusCreated, gin.H{
 			"user":         user.ToResponse(),
-			"accessToken":  accessToken,
-			"refreshToken": refreshToken,
+			"accessToken":  tokens.AccessToken,
+			"refreshToken": tokens.RefreshToken,
 		})
 	}
 }
 
-// LoginHandler handles user login
-func LoginHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager) gin.HandlerFunc {
+// LoginHandler handles user login. Failed attempts are throttled per account
+// and per IP address; see auth.LoginThrottle.
+func LoginHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, throttle *auth.LoginThrottle, mail mailer.Mailer, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req models.LoginRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -110,57 +117,79 @@ func LoginHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager) g
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		var user models.User
-		err := users.FindOne(ctx, bson.M{"email": strings.ToLower(req.Email)}).Decode(&user)
-		if err == mongo.ErrNoDocuments {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
-			return
-		} else if err != nil {
+		email := strings.ToLower(req.Email)
+		reservation, check, err := throttle.Reserve(ctx, email, c.ClientIP())
+		if err != nil {
+			logger.Error("Login throttle check failed", logger.Field("error", err))
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 			return
 		}
-
-		// Debug: Check what password field exists
-		var rawUser bson.M
-		err = users.FindOne(ctx, bson.M{"email": strings.ToLower(req.Email)}).Decode(&rawUser)
-		if err == nil {
-			logger.Info("User found", logger.Field("email", req.Email), logger.Field("hasPassword", rawUser["password"] != nil), logger.Field("hasPasswordHash", rawUser["password_hash"] != nil))
+		if !check.Allowed() {
+			loginThrottled(c, check)
+			return
 		}
 
-		// Try both password field names
-		var passwordToCheck string
-		if user.PasswordHash != "" {
-			passwordToCheck = user.PasswordHash
-		} else if rawUser["password"] != nil {
-			passwordToCheck = rawUser["password"].(string)
-		} else {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		// Accounts created before password_hash still hold the hash in password
+		var record passwordRecord
+		err = users.FindOne(ctx, bson.M{"email": email}).Decode(&record)
+		if err == mongo.ErrNoDocuments {
+			loginFailed(ctx, c, mongoClient, jwtManager, throttle, mail, hub, reservation, nil, "Invalid email or password")
+			return
+		} else if err != nil {
+			throttle.Release(ctx, reservation)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 			return
 		}
 
-		if err := auth.ComparePassword(passwordToCheck, req.Password); err != nil {
-			logger.Warn("Password comparison failed", logger.Field("error", err))
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		if record.hash() == "" || auth.ComparePassword(record.hash(), req.Password) != nil {
+			loginFailed(ctx, c, mongoClient, jwtManager, throttle, mail, hub, reservation, &record.User, "Invalid email or password")
 			return
 		}
 
-		accessToken, err := jwtManager.GenerateAccessToken(user.UniqueID, user.Username, user.Email)
+		// With two-factor authentication the failures are only cleared once
+		// the code was accepted, so wrong codes keep counting towards the
+		// lockout however often the password is entered
+		if record.MFA.IsEnabled() {
+			err = throttle.Release(ctx, reservation)
+		} else {
+			err = throttle.Succeed(ctx, reservation)
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token"})
-			return
+			logger.Warn("Failed to reset login failures", logger.Field("user_id", record.UniqueID), logger.Field("error", err))
 		}
-		refreshToken, err := jwtManager.GenerateRefreshToken(user.UniqueID, user.Username, user.Email)
+		finishLogin(ctx, c, mongoClient, jwtManager, record.User)
+	}
+}
+
+// finishLogin answers a login whose first factor was accepted. With
+// two-factor authentication the session only starts once MFALoginHandler
+// has checked a code.
+func finishLogin(ctx context.Context, c *gin.Context, mongoClient *database.MongoClient, jwtManager *auth.Manager, user models.User) {
+	if user.MFA.IsEnabled() {
+		mfaToken, err := jwtManager.GenerateActionToken(auth.MFAPendingToken, user.UniqueID, user.Email, mfaPendingTTL)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate refresh token"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
 			return
 		}
-
 		c.JSON(http.StatusOK, gin.H{
-			"user":         user.ToResponse(),
-			"accessToken":  accessToken,
-			"refreshToken": refreshToken,
+			"mfaRequired": true,
+			"mfaToken":    mfaToken,
+			"expiresIn":   int(mfaPendingTTL.Seconds()),
 		})
+		return
+	}
+
+	tokens, err := startSession(ctx, mongoClient, jwtManager, user, c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+		return
 	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":         user.ToResponse(),
+		"accessToken":  tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+	})
 }
 
 // MeHandler returns the current authenticated user's profile
@@ -401,7 +430,7 @@ func MigrateRemoveUsernameUniqueness(mongoClient *database.MongoClient) error {
 }
 
 // LogoutHandler handles user logout
-func LogoutHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager) gin.HandlerFunc {
+func LogoutHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, revocations *auth.RevocationStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -413,22 +442,28 @@ func LogoutHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
 			return
 		}
-		// Invalidate refresh tokens for the user
-		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		// Revoke this device's session; tokens without one sign out everywhere
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		var err error
-		_, err = users.UpdateOne(ctx, bson.M{"unique_id": userIDStr}, bson.M{"$set": bson.M{"refresh_tokens": []models.RefreshToken{}}})
+		_, err := revokeSessions(ctx, mongoClient, userIDStr, c.GetString("sessionID"), "")
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to logout"})
 			return
 		}
+		revocations.Invalidate(userIDStr)
+
+		// The access token used to log out stops working right away
+		if claims, ok := c.Get("claims"); ok {
+			if err := revocations.RevokeToken(ctx, claims.(*auth.Claims)); err != nil {
+				logger.Warn("Failed to revoke access token", logger.Field("error", err))
+			}
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 	}
 }
 
 // RefreshTokenHandler handles token refresh
-func RefreshTokenHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager) gin.HandlerFunc {
+func RefreshTokenHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, revocations *auth.RevocationStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			RefreshToken string `json:"refreshToken" binding:"required"`
@@ -442,18 +477,49 @@ func RefreshTokenHandler(mongoClient *database.MongoClient, jwtManager *auth.Man
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
 			return
 		}
-		// Generate new access token
-		accessToken, err := jwtManager.GenerateAccessToken(claims.UserID, claims.Username, claims.Email)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token"})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := revocations.Check(ctx, claims); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+
+		// Rotate the refresh token; the presented one can never be used again
+		tokens, err := rotateSession(ctx, mongoClient, jwtManager, claims, req.RefreshToken, c)
+		if err == errRefreshTokenReused {
+			revocations.Invalidate(claims.UserID)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reuse detected, please log in again"})
+			return
+		} else if err == errInvalidRefreshToken {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh tokens"})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"accessToken": accessToken})
+		c.JSON(http.StatusOK, gin.H{
+			"accessToken":  tokens.AccessToken,
+			"refreshToken": tokens.RefreshToken,
+		})
+	}
+}
+
+// JWKSHandler publishes the public keys that verify access tokens, so other
+// services can validate them without sharing a secret
+func JWKSHandler(jwtManager *auth.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Verifiers refetch on unknown kid; scheduled keys are published early
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, jwtManager.JWKS())
 	}
 }
 
-// UpdateXPHandler updates user's XP
-func UpdateXPHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+// UpdateXPHandler lets an admin adjust a user's XP through the ledger. The
+// entry records the admin; requests repeating an idempotencyKey are applied
+// once.
+func UpdateXPHandler(ledger *xp.Ledger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -472,44 +538,43 @@ func UpdateXPHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			return
 		}
 
-		users := mongoClient.GetCollection(database.CollectionNames.Users)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		// Update user's XP
-		update := bson.M{
-			"$inc": bson.M{"xp": req.XP},
-			"$set": bson.M{"updated_at": time.Now()},
-		}
-
-		result, err := users.UpdateOne(ctx, bson.M{"unique_id": userIDStr}, update)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update XP"})
+		if !models.IsManualXPSource(req.Source) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid XP source"})
 			return
 		}
 
-		if result.MatchedCount == 0 {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-			return
+		key := req.IdempotencyKey
+		if key == "" {
+			key = primitive.NewObjectID().Hex()
 		}
 
-		// Record XP history
-		xpHistory := models.XPHistory{
-			ID:        primitive.NewObjectID(),
-			UserID:    userIDStr,
-			XP:        req.XP,
-			Source:    req.Source,
-			SessionID: req.SessionID,
-			CreatedAt: time.Now(),
-		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
-		xpHistoryCollection := mongoClient.GetCollection("xp_history")
-		_, err = xpHistoryCollection.InsertOne(ctx, xpHistory)
-		if err != nil {
-			logger.Warn("Failed to record XP history", logger.Field("error", err))
-			// Don't fail the request if XP history recording fails
+		entry, err := ledger.Award(ctx, models.XPHistory{
+			UserID:     req.UserID,
+			Key:        "manual:" + key,
+			XP:         req.XP,
+			Source:     req.Source,
+			SessionID:  req.SessionID,
+			AdjustedBy: userIDStr,
+		})
+		switch err {
+		case nil:
+		case xp.ErrAlreadyAwarded:
+			c.JSON(http.StatusOK, gin.H{"message": "XP already updated", "xp_earned": 0, "entry": entry})
+			return
+		case xp.ErrUserNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		case xp.ErrInsufficientXP:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "User has less XP than would be taken away"})
+			return
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update XP"})
+			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "XP updated successfully", "xp_earned": req.XP})
+		c.JSON(http.StatusOK, gin.H{"message": "XP updated successfully", "xp_earned": req.XP, "entry": entry})
 	}
 }
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/studyplatform/backend/internal/realtime"
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/mailer"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// accountUnlockTTL is how long the link in a lockout email works
+const accountUnlockTTL = 24 * time.Hour
+
+// retryAfterSeconds rounds a wait up to whole seconds, as Retry-After counts
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// loginThrottled refuses a login attempt made before the throttle allows one
+func loginThrottled(c *gin.Context, check auth.LoginCheck) {
+	message := "Too many failed login attempts, try again later"
+	if check.Locked {
+		message = "Too many failed login attempts; logins are locked for a while"
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(check.RetryAfter)))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":           message,
+		"retryAfter":      retryAfterSeconds(check.RetryAfter),
+		"locked":          check.Locked,
+		"captchaRequired": check.CaptchaRequired,
+	})
+}
+
+// loginFailed settles a reserved login as failed and answers it with
+// message. user is nil when no account uses the email; the answer is the
+// same either way.
+func loginFailed(ctx context.Context, c *gin.Context, mongoClient *database.MongoClient, jwtManager *auth.Manager, throttle *auth.LoginThrottle, mail mailer.Mailer, hub *realtime.Hub, reservation *auth.LoginReservation, user *models.User, message string) {
+	userID := ""
+	if user != nil {
+		userID = user.UniqueID
+	}
+
+	response := gin.H{"error": message}
+	failure, err := throttle.Fail(ctx, reservation, userID)
+	if err != nil {
+		logger.Error("Failed to record failed login", logger.Field("error", err))
+		c.JSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	if failure.AccountLocked && user != nil {
+		logger.Warn("Account locked after failed logins", logger.Field("user_id", userID), logger.Field("ip", c.ClientIP()))
+		notifyAccountLocked(ctx, mongoClient, jwtManager, mail, hub, *user, c.ClientIP(), time.Now().Add(failure.RetryAfter), throttle.Config().AccountLockoutThreshold)
+	}
+
+	response["captchaRequired"] = failure.CaptchaRequired
+	if !failure.Allowed() {
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(failure.RetryAfter)))
+		response["retryAfter"] = retryAfterSeconds(failure.RetryAfter)
+		response["locked"] = failure.Locked
+	}
+	c.JSON(http.StatusUnauthorized, response)
+}
+
+// notifyAccountLocked tells the user in-app and by email that their account
+// was locked, with a link to unlock it
+func notifyAccountLocked(ctx context.Context, mongoClient *database.MongoClient, jwtManager *auth.Manager, mail mailer.Mailer, hub *realtime.Hub, user models.User, ip string, lockedUntil time.Time, failures int) {
+	notifications := mongoClient.GetCollection(database.CollectionNames.Notifications)
+	notification := models.CreateAccountLockedNotification(user.UniqueID, ip, lockedUntil)
+	if res, err := notifications.InsertOne(ctx, notification); err == nil {
+		notification.ID, _ = res.InsertedID.(primitive.ObjectID)
+		hub.NotifyUser(user.UniqueID, notification)
+	}
+
+	token, err := jwtManager.GenerateActionToken(auth.AccountUnlockToken, user.UniqueID, user.Email, accountUnlockTTL)
+	if err != nil {
+		logger.Error("Failed to generate unlock token", logger.Field("user_id", user.UniqueID), logger.Field("error", err))
+		return
+	}
+	sendEmail(mail, mailer.TemplateAccountLocked, user.Email, map[string]string{
+		"Username":    user.Username,
+		"Failures":    strconv.Itoa(failures),
+		"IP":          ip,
+		"LockedUntil": lockedUntil.UTC().Format("January 2, 2006 at 15:04 UTC"),
+		"Link":        appURL() + "/unlock-account?token=" + url.QueryEscape(token),
+	})
+}
+
+// UnlockAccountHandler lifts a lockout with the token from the lockout
+// email. Links work once.
+func UnlockAccountHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, revocations *auth.RevocationStore, throttle *auth.LoginThrottle) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.UnlockAccountRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		claims, err := jwtManager.ValidateActionToken(req.Token, auth.AccountUnlockToken)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		var user models.User
+		err = users.FindOne(ctx, bson.M{"unique_id": claims.UserID, "email": claims.Email}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if err := revocations.Consume(ctx, claims); err == auth.ErrTokenRevoked {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock account"})
+			return
+		}
+
+		if err := throttle.Unlock(ctx, user.Email, user.UniqueID, c.ClientIP()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock account"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Account unlocked"})
+	}
+}
@@ -0,0 +1,395 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/internal/realtime"
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/mailer"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+const (
+	// mfaPendingTTL is how long the user has to enter their code after the
+	// password was accepted
+	mfaPendingTTL = 5 * time.Minute
+	// maxMFAAttempts is how many wrong codes end a pending login, after which
+	// the password has to be entered again. Signed in users who enter that
+	// many wrong passwords or codes while changing their two-factor settings
+	// are signed out everywhere.
+	maxMFAAttempts = 5
+)
+
+// mfaIssuer returns the name authenticator apps show for the account
+func mfaIssuer() string {
+	if value := os.Getenv("MFA_ISSUER"); value != "" {
+		return value
+	}
+	return "Study Platform"
+}
+
+// notifyMFAChanged tells the user two-factor authentication was turned on or off
+func notifyMFAChanged(ctx context.Context, mongoClient *database.MongoClient, hub *realtime.Hub, userID string, enabled bool, ip string) {
+	notifications := mongoClient.GetCollection(database.CollectionNames.Notifications)
+	notification := models.CreateMFAChangedNotification(userID, enabled, ip)
+	if res, err := notifications.InsertOne(ctx, notification); err == nil {
+		notification.ID, _ = res.InsertedID.(primitive.ObjectID)
+		hub.NotifyUser(userID, notification)
+	}
+}
+
+// mfaCheckFailed answers a wrong password or code entered to change the
+// two-factor settings. Reaching maxMFAAttempts signs the user out of every
+// session, so guessing on with a stolen session takes a new login with both
+// factors.
+func mfaCheckFailed(ctx context.Context, c *gin.Context, mongoClient *database.MongoClient, revocations *auth.RevocationStore, mfa *auth.MFAStore, userID, message string) {
+	failures, err := mfa.Fail(ctx, userID)
+	if err != nil || failures < maxMFAAttempts {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+
+	mfa.ResetFailures(ctx, userID)
+	if _, err := revokeSessions(ctx, mongoClient, userID, "", ""); err != nil {
+		logger.Warn("Failed to revoke sessions after invalid MFA codes", logger.Field("user_id", userID), logger.Field("error", err))
+	}
+	revocations.Invalidate(userID)
+	logger.Warn("Too many invalid MFA codes", logger.Field("user_id", userID), logger.Field("ip", c.ClientIP()))
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Too many invalid attempts, sign in again"})
+}
+
+// MFALoginHandler completes a login started by LoginHandler for an account
+// with two-factor authentication, in exchange for a TOTP or recovery code.
+// Wrong codes count as failed logins of the account, so they back off and
+// lock it like wrong passwords do.
+func MFALoginHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, revocations *auth.RevocationStore, mfa *auth.MFAStore, throttle *auth.LoginThrottle, mail mailer.Mailer, hub *realtime.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.MFALoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		claims, err := jwtManager.ValidateActionToken(req.MFAToken, auth.MFAPendingToken)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, sign in again"})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var user models.User
+		err = users.FindOne(ctx, bson.M{"unique_id": claims.UserID, "email": claims.Email}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, sign in again"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		reservation, check, err := throttle.Reserve(ctx, user.Email, c.ClientIP())
+		if err != nil {
+			logger.Error("Login throttle check failed", logger.Field("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !check.Allowed() {
+			loginThrottled(c, check)
+			return
+		}
+
+		verified, err := mfa.Verify(ctx, user.UniqueID, req.Code)
+		switch err {
+		case nil:
+			if verified.RecoveryCode {
+				logger.Info("Recovery code used", logger.Field("user_id", user.UniqueID), logger.Field("remaining", verified.RecoveryCodesLeft))
+			}
+		case auth.ErrMFANotEnabled:
+			// Disabled since the password was checked; the login can go ahead
+			logger.Info("MFA disabled during pending login", logger.Field("user_id", user.UniqueID))
+		case auth.ErrInvalidMFACode:
+			message := "Invalid code"
+			if failures, err := mfa.Fail(ctx, user.UniqueID); err == nil && failures >= maxMFAAttempts {
+				revocations.Consume(ctx, claims)
+				mfa.ResetFailures(ctx, user.UniqueID)
+				logger.Warn("Too many invalid MFA codes", logger.Field("user_id", user.UniqueID), logger.Field("ip", c.ClientIP()))
+				message = "Too many invalid codes, sign in again"
+			}
+			loginFailed(ctx, c, mongoClient, jwtManager, throttle, mail, hub, reservation, &user, message)
+			return
+		default:
+			throttle.Release(ctx, reservation)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if err := revocations.Consume(ctx, claims); err == auth.ErrTokenRevoked {
+			throttle.Release(ctx, reservation)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, sign in again"})
+			return
+		} else if err != nil {
+			throttle.Release(ctx, reservation)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete login"})
+			return
+		}
+		if err := throttle.Succeed(ctx, reservation); err != nil {
+			logger.Warn("Failed to reset login failures", logger.Field("user_id", user.UniqueID), logger.Field("error", err))
+		}
+
+		tokens, err := startSession(ctx, mongoClient, jwtManager, user, c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"user":         user.ToResponse(),
+			"accessToken":  tokens.AccessToken,
+			"refreshToken": tokens.RefreshToken,
+		})
+	}
+}
+
+// SetupMFAHandler starts two-factor enrollment. It returns a new secret and
+// the otpauth URI to show as a QR code; nothing changes for logins until the
+// user confirms a code through EnableMFAHandler.
+func SetupMFAHandler(mongoClient *database.MongoClient, mfa *auth.MFAStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var user models.User
+		err := users.FindOne(ctx,
+			bson.M{"unique_id": userIDStr},
+			options.FindOne().SetProjection(bson.M{"email": 1}),
+		).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		secret, err := mfa.Setup(ctx, userIDStr)
+		switch err {
+		case nil:
+		case auth.ErrMFAUserNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		case auth.ErrMFAEnabled:
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+			return
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor setup"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"secret":     secret,
+			"otpauthUri": auth.TOTPURI(mfaIssuer(), user.Email, secret),
+		})
+	}
+}
+
+// EnableMFAHandler turns on two-factor authentication once the user proves
+// their authenticator works. The recovery codes are only shown in this
+// response.
+func EnableMFAHandler(mongoClient *database.MongoClient, mfa *auth.MFAStore, hub *realtime.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		var req models.MFACodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		codes, err := mfa.Enable(ctx, userIDStr, req.Code)
+		switch err {
+		case nil:
+		case auth.ErrMFAUserNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		case auth.ErrMFAEnabled:
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+			return
+		case auth.ErrMFANotSetUp:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+			return
+		case auth.ErrInvalidMFACode:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+			return
+		case auth.ErrMFASetupChanged:
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor setup changed, start again"})
+			return
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+			return
+		}
+
+		notifyMFAChanged(ctx, mongoClient, hub, userIDStr, true, c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recoveryCodes": codes})
+	}
+}
+
+// DisableMFAHandler turns off two-factor authentication and signs the user
+// out of their other sessions. Both the password and a TOTP or recovery code
+// are required.
+func DisableMFAHandler(mongoClient *database.MongoClient, revocations *auth.RevocationStore, mfa *auth.MFAStore, hub *realtime.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		var req models.DisableMFARequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var record passwordRecord
+		err := users.FindOne(ctx, bson.M{"unique_id": userIDStr}).Decode(&record)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !record.MFA.IsEnabled() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+			return
+		}
+
+		if record.hash() == "" || auth.ComparePassword(record.hash(), req.Password) != nil {
+			mfaCheckFailed(ctx, c, mongoClient, revocations, mfa, userIDStr, "Password is incorrect")
+			return
+		}
+		verified, err := mfa.Verify(ctx, userIDStr, req.Code)
+		switch err {
+		case nil:
+			if verified.RecoveryCode {
+				logger.Info("Recovery code used", logger.Field("user_id", userIDStr), logger.Field("remaining", verified.RecoveryCodesLeft))
+			}
+		case auth.ErrMFANotEnabled:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+			return
+		case auth.ErrInvalidMFACode:
+			mfaCheckFailed(ctx, c, mongoClient, revocations, mfa, userIDStr, "Invalid code")
+			return
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if err := mfa.Disable(ctx, userIDStr); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+			return
+		}
+
+		// Sessions elsewhere may have been signed in with the second factor
+		// that no longer protects the account
+		if _, err := revokeSessions(ctx, mongoClient, userIDStr, "", c.GetString("sessionID")); err != nil {
+			logger.Warn("Failed to revoke sessions after disabling MFA", logger.Field("user_id", userIDStr), logger.Field("error", err))
+		}
+		revocations.Invalidate(userIDStr)
+
+		notifyMFAChanged(ctx, mongoClient, hub, userIDStr, false, c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+// RegenerateRecoveryCodesHandler replaces all recovery codes, used or not,
+// with new ones. A current TOTP code is required.
+func RegenerateRecoveryCodesHandler(mongoClient *database.MongoClient, revocations *auth.RevocationStore, mfa *auth.MFAStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		var req models.MFACodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		codes, err := mfa.RegenerateRecoveryCodes(ctx, userIDStr, req.Code)
+		switch err {
+		case nil:
+		case auth.ErrMFAUserNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		case auth.ErrMFANotEnabled:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+			return
+		case auth.ErrInvalidMFACode:
+			mfaCheckFailed(ctx, c, mongoClient, revocations, mfa, userIDStr, "Invalid code")
+			return
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regenerate recovery codes"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+	}
+}
@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/models"
+	"github.com/studyplatform/backend/pkg/oidc"
+)
+
+const (
+	// oidcLoginTTL is how long the user has to approve the login at the
+	// identity provider
+	oidcLoginTTL = 10 * time.Minute
+	// oidcCompleteTTL is how long the frontend has to exchange the code it
+	// is redirected back with
+	oidcCompleteTTL = time.Minute
+	// oidcStateCookie binds a login to the browser that started it
+	oidcStateCookie = "oidc_state"
+)
+
+// errEmailNotVerified means the provider does not vouch for the user's email,
+// so it can be used neither to link nor to create an account
+var errEmailNotVerified = errors.New("email not verified by provider")
+
+// oidcLogin is a login waiting for the identity provider's callback
+type oidcLogin struct {
+	State     string    `bson:"state"`
+	Provider  string    `bson:"provider"`
+	Nonce     string    `bson:"nonce"`
+	Verifier  string    `bson:"verifier"` // PKCE code verifier
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// EnsureOIDCIndexes creates the indexes of pending identity provider logins,
+// which MongoDB removes once they expire
+func EnsureOIDCIndexes(mongoClient *database.MongoClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	logins := mongoClient.GetCollection(database.CollectionNames.OIDCLogins)
+	_, err := logins.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "state", Value: 1}},
+			Options: options.Index().SetName("state").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sparse, so users without linked identities are not indexed
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+	_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "external_identities.provider", Value: 1}, {Key: "external_identities.subject", Value: 1}},
+		Options: options.Index().SetName("external_identities").SetSparse(true),
+	})
+	return err
+}
+
+// oidcFailure sends the browser back to the frontend's login page with an
+// error code it can explain
+func oidcFailure(c *gin.Context, reason string) {
+	c.Redirect(http.StatusFound, appURL()+"/login?error="+url.QueryEscape("oidc_"+reason))
+}
+
+// ListOIDCProvidersHandler returns the names of the configured identity
+// providers, so the frontend knows which buttons to show
+func ListOIDCProvidersHandler(providers map[string]*oidc.Provider) gin.HandlerFunc {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"providers": names})
+	}
+}
+
+// OIDCLoginHandler starts a login with an identity provider by redirecting
+// the browser to it
+func OIDCLoginHandler(mongoClient *database.MongoClient, providers map[string]*oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, ok := providers[c.Param("provider")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown identity provider"})
+			return
+		}
+
+		var login oidcLogin
+		for _, value := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+			random, err := oidc.RandomString()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+				return
+			}
+			*value = random
+		}
+		login.Provider = provider.Name()
+		login.ExpiresAt = time.Now().Add(oidcLoginTTL)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		authURL, err := provider.AuthCodeURL(ctx, login.State, login.Nonce, login.Verifier)
+		if err != nil {
+			logger.Error("Failed to build identity provider URL", logger.Field("provider", provider.Name()), logger.Field("error", err))
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+			return
+		}
+
+		logins := mongoClient.GetCollection(database.CollectionNames.OIDCLogins)
+		if _, err := logins.InsertOne(ctx, login); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+
+		// Only the callback needs the cookie; Lax lets it through on the
+		// provider's top-level redirect back
+		callbackPath := strings.TrimSuffix(c.Request.URL.Path, "/login") + "/callback"
+		secure := c.Request.TLS != nil || os.Getenv("ENV") == "production"
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcStateCookie, login.State, int(oidcLoginTTL.Seconds()), callbackPath, "", secure, true)
+
+		c.Redirect(http.StatusFound, authURL)
+	}
+}
+
+// OIDCCallbackHandler receives the user back from the identity provider. It
+// signs them in to the account linked to their identity, links it to the
+// account with the same verified email, or creates a new account, and then
+// redirects to the frontend with a short-lived code for OIDCCompleteHandler.
+func OIDCCallbackHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, revocations *auth.RevocationStore, providers map[string]*oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, ok := providers[c.Param("provider")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown identity provider"})
+			return
+		}
+		if c.Query("error") != "" {
+			// Usually the user declined
+			oidcFailure(c, "denied")
+			return
+		}
+
+		state := c.Query("state")
+		cookie, err := c.Cookie(oidcStateCookie)
+		c.SetCookie(oidcStateCookie, "", -1, c.Request.URL.Path, "", c.Request.TLS != nil || os.Getenv("ENV") == "production", true)
+		if err != nil || state == "" || cookie != state {
+			oidcFailure(c, "invalid_state")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		// Deleting the login makes the state single use
+		var login oidcLogin
+		logins := mongoClient.GetCollection(database.CollectionNames.OIDCLogins)
+		err = logins.FindOneAndDelete(ctx, bson.M{"state": state, "provider": provider.Name()}).Decode(&login)
+		if err != nil || time.Now().After(login.ExpiresAt) {
+			oidcFailure(c, "expired")
+			return
+		}
+
+		token, err := provider.Exchange(ctx, c.Query("code"), login.Verifier)
+		if err != nil {
+			logger.Warn("Identity provider code exchange failed", logger.Field("provider", provider.Name()), logger.Field("error", err))
+			oidcFailure(c, "exchange_failed")
+			return
+		}
+		identity, err := provider.Identity(ctx, token, login.Nonce)
+		if err != nil {
+			logger.Warn("Identity provider login rejected", logger.Field("provider", provider.Name()), logger.Field("error", err))
+			oidcFailure(c, "invalid_identity")
+			return
+		}
+
+		user, err := linkExternalIdentity(ctx, mongoClient, revocations, identity)
+		if err == errEmailNotVerified {
+			oidcFailure(c, "email_not_verified")
+			return
+		} else if err != nil {
+			logger.Error("Failed to link external identity", logger.Field("provider", provider.Name()), logger.Field("error", err))
+			oidcFailure(c, "server_error")
+			return
+		}
+
+		code, err := jwtManager.GenerateActionToken(auth.OIDCLoginToken, user.UniqueID, user.Email, oidcCompleteTTL)
+		if err != nil {
+			oidcFailure(c, "server_error")
+			return
+		}
+		c.Redirect(http.StatusFound, appURL()+"/oauth/callback?code="+url.QueryEscape(code))
+	}
+}
+
+// linkExternalIdentity returns the user an identity belongs to, linking it to
+// the account with the same email or creating an account when needed
+func linkExternalIdentity(ctx context.Context, mongoClient *database.MongoClient, revocations *auth.RevocationStore, identity oidc.Identity) (models.User, error) {
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+
+	var user models.User
+	err := users.FindOne(ctx, bson.M{"external_identities": bson.M{"$elemMatch": bson.M{
+		"provider": identity.Provider,
+		"subject":  identity.Subject,
+	}}}).Decode(&user)
+	if err == nil {
+		return user, nil
+	} else if err != mongo.ErrNoDocuments {
+		return models.User{}, err
+	}
+
+	// Anyone can claim any address at some providers; only a verified one
+	// may take over an existing account
+	email := strings.ToLower(identity.Email)
+	if email == "" || !identity.EmailVerified {
+		return models.User{}, errEmailNotVerified
+	}
+
+	now := time.Now()
+	link := models.ExternalIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    email,
+		LinkedAt: now,
+	}
+
+	err = users.FindOneAndUpdate(ctx,
+		bson.M{"email": email, "is_verified": true},
+		bson.M{
+			"$push": bson.M{"external_identities": link},
+			"$set":  bson.M{"updated_at": now},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err == nil {
+		logger.Info("Linked external identity", logger.Field("user_id", user.UniqueID), logger.Field("provider", identity.Provider))
+		return user, nil
+	} else if err != mongo.ErrNoDocuments {
+		return models.User{}, err
+	}
+
+	// Whoever registered an unverified account never proved they own the
+	// address, so the provider's user takes it over: the password, two-factor
+	// authentication, sessions and access tokens set up so far stop working
+	err = users.FindOneAndUpdate(ctx,
+		bson.M{"email": email, "is_verified": bson.M{"$ne": true}},
+		bson.M{
+			"$push":  bson.M{"external_identities": link},
+			"$set":   bson.M{"is_verified": true, "verified_at": now, "updated_at": now},
+			"$unset": bson.M{"password_hash": "", "password": "", "mfa": ""},
+			"$inc":   bson.M{"token_version": 1},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err == nil {
+		if _, err := revokeSessions(ctx, mongoClient, user.UniqueID, "", ""); err != nil {
+			logger.Warn("Failed to revoke sessions of unverified account", logger.Field("user_id", user.UniqueID), logger.Field("error", err))
+		}
+		accessTokens := mongoClient.GetCollection(database.CollectionNames.AccessTokens)
+		if _, err := accessTokens.DeleteMany(ctx, bson.M{"user_id": user.UniqueID}); err != nil {
+			logger.Warn("Failed to delete access tokens of unverified account", logger.Field("user_id", user.UniqueID), logger.Field("error", err))
+		}
+		revocations.Invalidate(user.UniqueID)
+		logger.Info("Linked external identity to unverified account", logger.Field("user_id", user.UniqueID), logger.Field("provider", identity.Provider))
+		return user, nil
+	} else if err != mongo.ErrNoDocuments {
+		return models.User{}, err
+	}
+
+	username := identity.Username
+	if username == "" {
+		username, _, _ = strings.Cut(email, "@")
+	}
+	user = models.User{
+		UniqueID:     uuid.NewString(),
+		Username:     username,
+		Email:        email,
+		FirstName:    identity.GivenName,
+		LastName:     identity.FamilyName,
+		AvatarURL:    identity.Picture,
+		Friends:      []models.Friend{},
+		JoinedRooms:  []string{},
+		CreatedRooms: []string{},
+		Level:        1,
+		// startSession pushes onto the array, which fails on null
+		RefreshTokens: []models.RefreshToken{},
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		LastActive:    now,
+		IsActive:      true,
+		IsVerified:    true,
+		VerifiedAt:    &now,
+		Identities:    []models.ExternalIdentity{link},
+	}
+	res, err := users.InsertOne(ctx, user)
+	if err != nil {
+		return models.User{}, err
+	}
+	user.ID, _ = res.InsertedID.(primitive.ObjectID)
+	logger.Info("Created user from external identity", logger.Field("user_id", user.UniqueID), logger.Field("provider", identity.Provider))
+	return user, nil
+}
+
+// OIDCCompleteHandler exchanges the code the frontend received after an
+// identity provider login for a session. Accounts with two-factor
+// authentication still need a code, as with a password login.
+func OIDCCompleteHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, revocations *auth.RevocationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.OIDCCompleteRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		claims, err := jwtManager.ValidateActionToken(req.Code, auth.OIDCLoginToken)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, sign in again"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := revocations.Consume(ctx, claims); err == auth.ErrTokenRevoked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, sign in again"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete login"})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		var user models.User
+		err = users.FindOne(ctx, bson.M{"unique_id": claims.UserID}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, sign in again"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		finishLogin(ctx, c, mongoClient, jwtManager, user)
+	}
+}
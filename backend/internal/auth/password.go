@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/studyplatform/backend/internal/realtime"
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/mailer"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// passwordRecord is a user together with the password field used before
+// password_hash, which accounts keep until the startup migration runs
+type passwordRecord struct {
+	models.User    `bson:",inline"`
+	LegacyPassword string `bson:"password"`
+}
+
+// hash returns the stored bcrypt hash of the user's password
+func (r passwordRecord) hash() string {
+	if r.PasswordHash != "" {
+		return r.PasswordHash
+	}
+	return r.LegacyPassword
+}
+
+// policyErrorResponse answers a refused password, reporting whether it did
+func policyErrorResponse(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	var policyErr *auth.PolicyError
+	if errors.As(err, &policyErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": policyErr.Message})
+	} else {
+		logger.Error("Password policy check failed", logger.Field("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check password"})
+	}
+	return true
+}
+
+// ChangePasswordHandler changes the current user's password. The current
+// password must be confirmed; every other device session is signed out and
+// the user is told about the change in-app and by email.
+func ChangePasswordHandler(mongoClient *database.MongoClient, revocations *auth.RevocationStore, policy auth.PasswordPolicy, mail mailer.Mailer, hub *realtime.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		var req models.ChangePasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var record passwordRecord
+		err := users.FindOne(ctx, bson.M{"unique_id": userIDStr}).Decode(&record)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// 400 rather than 401, so clients do not mistake it for an expired session
+		if record.hash() == "" || auth.ComparePassword(record.hash(), req.CurrentPassword) != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Current password is incorrect"})
+			return
+		}
+		if req.NewPassword == req.CurrentPassword {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "New password must be different from the current password"})
+			return
+		}
+		if policyErrorResponse(c, policy.Validate(req.NewPassword, record.Email, record.Username)) {
+			return
+		}
+
+		hashedPassword, err := auth.HashPassword(req.NewPassword)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+
+		now := time.Now()
+		_, err = users.UpdateOne(ctx, bson.M{"unique_id": userIDStr}, bson.M{
+			"$set": bson.M{
+				"password_hash":       hashedPassword,
+				"password_changed_at": now,
+				"updated_at":          now,
+			},
+			"$unset": bson.M{"password": ""},
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+			return
+		}
+
+		// Sign out everywhere else; access tokens of those sessions stop
+		// working through their revoked session
+		revoked, err := revokeSessions(ctx, mongoClient, userIDStr, "", c.GetString("sessionID"))
+		if err != nil {
+			logger.Warn("Failed to revoke sessions after password change", logger.Field("user_id", userIDStr), logger.Field("error", err))
+		}
+		revocations.Invalidate(userIDStr)
+
+		notifications := mongoClient.GetCollection(database.CollectionNames.Notifications)
+		notification := models.CreatePasswordChangedNotification(userIDStr, c.ClientIP())
+		if res, err := notifications.InsertOne(ctx, notification); err == nil {
+			notification.ID, _ = res.InsertedID.(primitive.ObjectID)
+			hub.NotifyUser(userIDStr, notification)
+		}
+		sendEmail(mail, mailer.TemplatePasswordChanged, record.Email, map[string]string{
+			"Username":  record.Username,
+			"ChangedAt": now.UTC().Format("January 2, 2006 at 15:04 UTC"),
+			"IP":        c.ClientIP(),
+			"Link":      appURL() + "/forgot-password",
+		})
+
+		c.JSON(http.StatusOK, gin.H{"message": "Password changed", "revokedSessions": revoked})
+	}
+}
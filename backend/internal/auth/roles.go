@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// ErrUserNotFound is returned when no user has the given email or ID
+var ErrUserNotFound = errors.New("user not found")
+
+// GrantRole gives the user with the email or unique ID the role. Tokens
+// issued before carry the old roles, so they are revoked and the user signs
+// in again. It reports whether the user did not have the role yet.
+func GrantRole(ctx context.Context, mongoClient *database.MongoClient, user string, role auth.Role, actor string) (bool, error) {
+	return changeRole(ctx, mongoClient, user, role, actor, true)
+}
+
+// RevokeRole takes the role from the user with the email or unique ID and
+// revokes their tokens. It reports whether the user had the role.
+func RevokeRole(ctx context.Context, mongoClient *database.MongoClient, user string, role auth.Role, actor string) (bool, error) {
+	return changeRole(ctx, mongoClient, user, role, actor, false)
+}
+
+func changeRole(ctx context.Context, mongoClient *database.MongoClient, user string, role auth.Role, actor string, grant bool) (bool, error) {
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+	filter := bson.M{"$or": []bson.M{{"email": user}, {"unique_id": user}}}
+
+	var found models.User
+	err := users.FindOne(ctx, filter).Decode(&found)
+	if err == mongo.ErrNoDocuments {
+		return false, ErrUserNotFound
+	} else if err != nil {
+		return false, err
+	}
+
+	// Only touch the user when the role actually changes, so repeating a
+	// command does not sign them out again
+	update := bson.M{"$inc": bson.M{"token_version": 1}, "$set": bson.M{"updated_at": time.Now()}}
+	event := models.AuditEventRoleGranted
+	if grant {
+		filter = bson.M{"unique_id": found.UniqueID, "roles": bson.M{"$ne": string(role)}}
+		update["$push"] = bson.M{"roles": string(role)}
+	} else {
+		filter = bson.M{"unique_id": found.UniqueID, "roles": string(role)}
+		update["$pull"] = bson.M{"roles": string(role)}
+		event = models.AuditEventRoleRevoked
+	}
+
+	result, err := users.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	if result.ModifiedCount == 0 {
+		return false, nil
+	}
+
+	auditLog := mongoClient.GetCollection(database.CollectionNames.AuditLog)
+	_, err = auditLog.InsertOne(ctx, models.AuditEntry{
+		Event:     event,
+		UserID:    found.UniqueID,
+		CreatedAt: time.Now(),
+		Data:      map[string]interface{}{"role": string(role), "actor": actor},
+	})
+	return true, err
+}
+
+// ListStaff returns the users holding any role, ordered by username
+func ListStaff(ctx context.Context, mongoClient *database.MongoClient) ([]models.User, error) {
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+	cursor, err := users.Find(ctx,
+		bson.M{"roles.0": bson.M{"$exists": true}},
+		options.Find().SetSort(bson.M{"username": 1}).SetProjection(bson.M{"unique_id": 1, "username": 1, "email": 1, "roles": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var staff []models.User
+	if err := cursor.All(ctx, &staff); err != nil {
+		return nil, err
+	}
+	return staff, nil
+}
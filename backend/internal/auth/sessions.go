@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// Errors returned when a refresh token cannot be rotated
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// startSession opens a new device session for the user and issues its tokens
+func startSession(ctx context.Context, mongoClient *database.MongoClient, jwtManager *auth.Manager, user models.User, c *gin.Context) (auth.TokenPair, error) {
+	sessionID := uuid.NewString()
+	pair, err := jwtManager.GenerateTokenPair(user.UniqueID, user.Username, user.Email, sessionID, user.TokenVersion, user.Roles)
+	if err != nil {
+		return auth.TokenPair{}, err
+	}
+
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+	now := time.Now()
+
+	// Drop expired sessions so the array only holds sessions that can still be used
+	_, err = users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+		"$pull": bson.M{"refresh_tokens": bson.M{"expires_at": bson.M{"$lt": now}}},
+	})
+	if err != nil {
+		return auth.TokenPair{}, err
+	}
+
+	session := models.RefreshToken{
+		ID:         sessionID,
+		TokenHash:  auth.HashToken(pair.RefreshToken),
+		ExpiresAt:  pair.RefreshExpiresAt,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		IP:         c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+	}
+	_, err = users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+		"$push": bson.M{"refresh_tokens": session},
+	})
+	if err != nil {
+		return auth.TokenPair{}, err
+	}
+	return pair, nil
+}
+
+// rotateSession exchanges a refresh token for a new token pair. The stored
+// hash is swapped atomically, so a token can be used exactly once; presenting
+// an already rotated token revokes the whole session. The new tokens carry
+// the user's current profile, roles and token version, not the old claims.
+func rotateSession(ctx context.Context, mongoClient *database.MongoClient, jwtManager *auth.Manager, claims *auth.Claims, refreshToken string, c *gin.Context) (auth.TokenPair, error) {
+	if claims.SessionID == "" {
+		// Tokens issued before sessions were tracked cannot be rotated
+		return auth.TokenPair{}, errInvalidRefreshToken
+	}
+
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+	now := time.Now()
+
+	var current models.User
+	err := users.FindOne(ctx, bson.M{"unique_id": claims.UserID}, options.FindOne().SetProjection(bson.M{
+		"unique_id":     1,
+		"username":      1,
+		"email":         1,
+		"token_version": 1,
+		"roles":         1,
+	})).Decode(&current)
+	if err == mongo.ErrNoDocuments {
+		return auth.TokenPair{}, errInvalidRefreshToken
+	} else if err != nil {
+		return auth.TokenPair{}, err
+	}
+	if current.TokenVersion != claims.TokenVersion {
+		return auth.TokenPair{}, errInvalidRefreshToken
+	}
+
+	pair, err := jwtManager.GenerateTokenPair(current.UniqueID, current.Username, current.Email, claims.SessionID, current.TokenVersion, current.Roles)
+	if err != nil {
+		return auth.TokenPair{}, err
+	}
+
+	result, err := users.UpdateOne(ctx,
+		bson.M{
+			"unique_id": claims.UserID,
+			"refresh_tokens": bson.M{"$elemMatch": bson.M{
+				"id":         claims.SessionID,
+				"token_hash": auth.HashToken(refreshToken),
+				"is_revoked": false,
+				"expires_at": bson.M{"$gt": now},
+			}},
+		},
+		bson.M{"$set": bson.M{
+			"refresh_tokens.$.token_hash":   auth.HashToken(pair.RefreshToken),
+			"refresh_tokens.$.expires_at":   pair.RefreshExpiresAt,
+			"refresh_tokens.$.last_used_at": now,
+			"refresh_tokens.$.ip":           c.ClientIP(),
+			"refresh_tokens.$.user_agent":   c.Request.UserAgent(),
+		}},
+	)
+	if err != nil {
+		return auth.TokenPair{}, err
+	}
+	if result.MatchedCount == 1 {
+		return pair, nil
+	}
+
+	// The token is validly signed but no longer current. If its session is
+	// still active, an older token of the session was replayed.
+	var user models.User
+	err = users.FindOne(ctx, bson.M{
+		"unique_id":      claims.UserID,
+		"refresh_tokens": bson.M{"$elemMatch": bson.M{"id": claims.SessionID, "is_revoked": false}},
+	}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return auth.TokenPair{}, errInvalidRefreshToken
+	} else if err != nil {
+		return auth.TokenPair{}, err
+	}
+
+	logger.Warn("Refresh token reuse detected, revoking session",
+		logger.Field("user_id", claims.UserID),
+		logger.Field("session_id", claims.SessionID),
+		logger.Field("client_ip", c.ClientIP()),
+	)
+	if _, err := revokeSessions(ctx, mongoClient, claims.UserID, claims.SessionID, ""); err != nil {
+		return auth.TokenPair{}, err
+	}
+	return auth.TokenPair{}, errRefreshTokenReused
+}
+
+// revokeSessions revokes one of the user's sessions, or all of them except
+// keepSessionID when sessionID is empty. It returns how many active sessions
+// were revoked.
+func revokeSessions(ctx context.Context, mongoClient *database.MongoClient, userID, sessionID, keepSessionID string) (int64, error) {
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+
+	arrayFilter := bson.M{"session.is_revoked": false}
+	if sessionID != "" {
+		arrayFilter["session.id"] = sessionID
+	} else if keepSessionID != "" {
+		arrayFilter["session.id"] = bson.M{"$ne": keepSessionID}
+	}
+
+	// Count first: positional updates report modified documents, not elements
+	var user models.User
+	if err := users.FindOne(ctx, bson.M{"unique_id": userID}).Decode(&user); err != nil {
+		return 0, err
+	}
+	var revoked int64
+	for _, session := range user.RefreshTokens {
+		if session.IsRevoked || session.ID == keepSessionID {
+			continue
+		}
+		if sessionID == "" || session.ID == sessionID {
+			revoked++
+		}
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{arrayFilter}})
+	_, err := users.UpdateOne(ctx, bson.M{"unique_id": userID}, bson.M{"$set": bson.M{
+		"refresh_tokens.$[session].is_revoked": true,
+		"refresh_tokens.$[session].revoked_at": now,
+	}}, opts)
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
+
+// ListSessionsHandler lists the user's active device sessions
+func ListSessionsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var user models.User
+		err := users.FindOne(ctx, bson.M{"unique_id": userIDStr}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		now := time.Now()
+		currentSessionID := c.GetString("sessionID")
+		sessions := []models.DeviceSessionForResponse{}
+		for _, session := range user.RefreshTokens {
+			if session.IsActive(now) {
+				sessions = append(sessions, session.ToResponse(currentSessionID))
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+	}
+}
+
+// RevokeSessionHandler signs out one of the user's devices
+func RevokeSessionHandler(mongoClient *database.MongoClient, revocations *auth.RevocationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		revoked, err := revokeSessions(ctx, mongoClient, userIDStr, c.Param("id"), "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+			return
+		}
+		if revoked == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+		revocations.Invalidate(userIDStr)
+
+		c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+	}
+}
+
+// RevokeAllSessionsHandler signs out all of the user's devices and revokes
+// every access token issued to them. With ?exceptCurrent=true the session
+// making the request stays signed in.
+func RevokeAllSessionsHandler(mongoClient *database.MongoClient, revocations *auth.RevocationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var keepSessionID string
+		if c.Query("exceptCurrent") == "true" {
+			keepSessionID = c.GetString("sessionID")
+		}
+
+		revoked, err := revokeSessions(ctx, mongoClient, userIDStr, "", keepSessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+			return
+		}
+		if keepSessionID == "" {
+			// Also catches access tokens issued without a session
+			err = revocations.RevokeUserTokens(ctx, userIDStr)
+		} else {
+			revocations.Invalidate(userIDStr)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked", "revoked": revoked})
+	}
+}
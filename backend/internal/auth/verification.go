@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/mailer"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// Lifetimes of the links sent by email
+const (
+	emailVerificationTTL = 24 * time.Hour
+	passwordResetTTL     = time.Hour
+)
+
+// appURL returns the frontend URL that email links point to
+func appURL() string {
+	if value := os.Getenv("APP_URL"); value != "" {
+		return strings.TrimRight(value, "/")
+	}
+	return "http://localhost:5173"
+}
+
+// sendEmail renders and sends an email in the background, so a slow mail
+// server neither delays the response nor reveals whether an account exists
+func sendEmail(mail mailer.Mailer, template string, to string, data map[string]string) {
+	message, err := mailer.Render(template, to, data)
+	if err != nil {
+		logger.Error("Failed to render email", logger.Field("template", template), logger.Field("error", err))
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := mail.Send(ctx, message); err != nil {
+			logger.Error("Failed to send email", logger.Field("template", template), logger.Field("error", err))
+		}
+	}()
+}
+
+// sendVerificationEmail emails the user a link confirming their address
+func sendVerificationEmail(jwtManager *auth.Manager, mail mailer.Mailer, user models.User) error {
+	token, err := jwtManager.GenerateActionToken(auth.EmailVerificationToken, user.UniqueID, user.Email, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	sendEmail(mail, mailer.TemplateVerifyEmail, user.Email, map[string]string{
+		"Username":  user.Username,
+		"Email":     user.Email,
+		"Link":      appURL() + "/verify-email?token=" + url.QueryEscape(token),
+		"ExpiresIn": "24 hours",
+	})
+	return nil
+}
+
+// RequestEmailVerificationHandler sends a new verification link to the
+// current user
+func RequestEmailVerificationHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, mail mailer.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var user models.User
+		err := users.FindOne(ctx, bson.M{"unique_id": userIDStr}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if user.IsVerified {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email is already verified"})
+			return
+		}
+
+		if err := sendVerificationEmail(jwtManager, mail, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+	}
+}
+
+// ConfirmEmailVerificationHandler marks the email address in a verification
+// link as verified. Links are single use and stop working when the user
+// changes their address.
+func ConfirmEmailVerificationHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, revocations *auth.RevocationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.VerifyEmailRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		claims, err := jwtManager.ValidateActionToken(req.Token, auth.EmailVerificationToken)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := revocations.Consume(ctx, claims); err == auth.ErrTokenRevoked {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		now := time.Now()
+		result, err := users.UpdateOne(ctx,
+			bson.M{"unique_id": claims.UserID, "email": claims.Email},
+			bson.M{"$set": bson.M{"is_verified": true, "verified_at": now, "updated_at": now}},
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+	}
+}
+
+// ForgotPasswordHandler emails a password reset link. It answers the same
+// way whether or not the address belongs to an account.
+func ForgotPasswordHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, mail mailer.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.ForgotPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var user models.User
+		err := users.FindOne(ctx, bson.M{"email": strings.ToLower(req.Email), "is_active": bson.M{"$ne": false}}).Decode(&user)
+		if err != nil && err != mongo.ErrNoDocuments {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if err == nil {
+			token, err := jwtManager.GenerateActionToken(auth.PasswordResetToken, user.UniqueID, user.Email, passwordResetTTL)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send reset email"})
+				return
+			}
+			sendEmail(mail, mailer.TemplateResetPassword, user.Email, map[string]string{
+				"Username":  user.Username,
+				"Link":      appURL() + "/reset-password?token=" + url.QueryEscape(token),
+				"ExpiresIn": "1 hour",
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "If an account exists for this email, a reset link has been sent"})
+	}
+}
+
+// ResetPasswordHandler sets a new password from a reset link and signs the
+// user out of every device
+func ResetPasswordHandler(mongoClient *database.MongoClient, jwtManager *auth.Manager, revocations *auth.RevocationStore, policy auth.PasswordPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.ResetPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		claims, err := jwtManager.ValidateActionToken(req.Token, auth.PasswordResetToken)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// The link stops working when the user changes their address or
+		// password. Token times are whole seconds, so a link issued in the
+		// same second as the change still works.
+		filter := bson.M{
+			"unique_id": claims.UserID,
+			"email":     claims.Email,
+			"$or": []bson.M{
+				{"password_changed_at": bson.M{"$exists": false}},
+				{"password_changed_at": bson.M{"$lt": claims.IssuedAt.Add(time.Second)}},
+			},
+		}
+		var user models.User
+		err = users.FindOne(ctx, filter).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if policyErrorResponse(c, policy.Validate(req.NewPassword, user.Email, user.Username)) {
+			return
+		}
+
+		hashedPassword, err := auth.HashPassword(req.NewPassword)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+
+		if err := revocations.Consume(ctx, claims); err == auth.ErrTokenRevoked {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			return
+		}
+
+		// Following the emailed link also proves the user owns the address.
+		// Bumping the token version revokes every token issued so far.
+		now := time.Now()
+		result, err := users.UpdateOne(ctx,
+			filter,
+			bson.M{
+				"$set": bson.M{
+					"password_hash":       hashedPassword,
+					"password_changed_at": now,
+					"is_verified":         true,
+					"updated_at":          now,
+				},
+				"$unset": bson.M{"password": ""},
+				"$inc":   bson.M{"token_version": 1},
+			},
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		if _, err := revokeSessions(ctx, mongoClient, claims.UserID, "", ""); err != nil {
+			logger.Warn("Failed to revoke sessions after password reset", logger.Field("user_id", claims.UserID), logger.Field("error", err))
+		}
+		revocations.Invalidate(claims.UserID)
+
+		c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
+	"github.com/studyplatform/backend/internal/realtime"
 	"github.com/studyplatform/backend/pkg/database"
 	"github.com/studyplatform/backend/pkg/models"
 )
@@ -97,7 +98,7 @@ func MarkNotificationReadHandler(mongoClient *database.MongoClient) gin.HandlerF
 }
 
 // CreateNotificationHandler creates a new notification (internal use)
-func CreateNotificationHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func CreateNotificationHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -152,6 +153,8 @@ func CreateNotificationHandler(mongoClient *database.MongoClient) gin.HandlerFun
 			return
 		}
 
+		hub.NotifyUser(req.UserID, notification)
+
 		c.JSON(http.StatusCreated, gin.H{"notification": notification.ToResponse()})
 	}
 }
@@ -12,6 +12,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
+	"github.com/studyplatform/backend/internal/realtime"
 	"github.com/studyplatform/backend/pkg/database"
 	"github.com/studyplatform/backend/pkg/models"
 )
@@ -198,7 +199,7 @@ func CreatePostHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 }
 
 // LikePostHandler likes or unlikes a post
-func LikePostHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func LikePostHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -268,9 +269,12 @@ func LikePostHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			var liker models.User
 			if err := users.FindOne(ctx, bson.M{"unique_id": userIDStr}).Decode(&liker); err == nil {
 				postLikeNotification := models.CreatePostLikeNotification(post.AuthorID, liker.ID.Hex(), liker.Username, postID.Hex(), post.Content)
-				_, err = notifications.InsertOne(ctx, postLikeNotification)
+				res, err := notifications.InsertOne(ctx, postLikeNotification)
 				if err != nil {
 					fmt.Printf("DEBUG: LikePost - Warning: Failed to create notification: %v\n", err)
+				} else {
+					postLikeNotification.ID, _ = res.InsertedID.(primitive.ObjectID)
+					hub.NotifyUser(post.AuthorID, postLikeNotification)
 				}
 			}
 		}
@@ -280,7 +284,7 @@ func LikePostHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 }
 
 // CreateCommentHandler creates a new comment on a post
-func CreateCommentHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func CreateCommentHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -347,9 +351,12 @@ func CreateCommentHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			if postData.AuthorID != userIDStr {
 				notifications := mongoClient.GetCollection(database.CollectionNames.Notifications)
 				postCommentNotification := models.CreatePostCommentNotification(postData.AuthorID, userIDStr, user.Username, postID)
-				_, err = notifications.InsertOne(ctx, postCommentNotification)
+				res, err := notifications.InsertOne(ctx, postCommentNotification)
 				if err != nil {
 					fmt.Printf("DEBUG: CreateComment - Warning: Failed to create notification: %v\n", err)
+				} else {
+					postCommentNotification.ID, _ = res.InsertedID.(primitive.ObjectID)
+					hub.NotifyUser(postData.AuthorID, postCommentNotification)
 				}
 			}
 		}
@@ -372,7 +379,7 @@ func CreateCommentHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 }
 
 // LikeCommentHandler handles liking/unliking a comment
-func LikeCommentHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func LikeCommentHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		commentID := c.Param("commentId")
 		if commentID == "" {
@@ -455,9 +462,12 @@ func LikeCommentHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 						var liker models.User
 						if err := users.FindOne(ctx, bson.M{"unique_id": userIDStr}).Decode(&liker); err == nil {
 							commentLikeNotification := models.CreateCommentLikeNotification(comment.AuthorID, liker.ID.Hex(), liker.Username, commentID, comment.Content)
-							_, err = notifications.InsertOne(ctx, commentLikeNotification)
+							res, err := notifications.InsertOne(ctx, commentLikeNotification)
 							if err != nil {
 								fmt.Printf("DEBUG: LikeComment - Warning: Failed to create notification: %v\n", err)
+							} else {
+								commentLikeNotification.ID, _ = res.InsertedID.(primitive.ObjectID)
+								hub.NotifyUser(comment.AuthorID, commentLikeNotification)
 							}
 						}
 					}
@@ -0,0 +1,126 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+)
+
+// tokenSubprotocol is the marker subprotocol browsers use to pass the access
+// token in Sec-WebSocket-Protocol, e.g. "access_token, <jwt>"
+const tokenSubprotocol = "access_token"
+
+// tokenCookieName is the cookie checked when no token is supplied otherwise
+const tokenCookieName = "access_token"
+
+// tokenCheckInterval controls how often long-lived connections re-validate their token
+const tokenCheckInterval = time.Minute
+
+// extractToken finds the access token in the handshake request. The query
+// parameter takes precedence, followed by Sec-WebSocket-Protocol and cookie.
+func extractToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == tokenSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+
+	if cookie, err := r.Cookie(tokenCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	return ""
+}
+
+// closeCodeForTokenError maps a token validation error to a close code
+func closeCodeForTokenError(err error) int {
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return CloseCodeTokenExpired
+	}
+	return CloseCodeUnauthorized
+}
+
+// validateAccessToken checks the token's signature and expiry and, when a
+// revocation store is configured, that it has not been revoked since
+func validateAccessToken(jwtManager *auth.Manager, revocations *auth.RevocationStore, token string) (*auth.Claims, error) {
+	claims, err := jwtManager.ValidateAccessToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if revocations != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := revocations.Check(ctx, claims); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// authenticate validates the access token and returns its claims
+func authenticate(jwtManager *auth.Manager, revocations *auth.RevocationStore, token string) (*auth.Claims, int, error) {
+	if token == "" {
+		return nil, CloseCodeUnauthorized, errors.New("missing access token")
+	}
+
+	claims, err := validateAccessToken(jwtManager, revocations, token)
+	if err != nil {
+		return nil, closeCodeForTokenError(err), err
+	}
+	return claims, 0, nil
+}
+
+// userCanAccessRoom reports whether the user is the creator or a participant of the room
+func userCanAccessRoom(mongoClient *database.MongoClient, roomID, userID string) (bool, error) {
+	roomObjID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return false, nil
+	}
+
+	rooms := mongoClient.GetCollection(database.CollectionNames.Rooms)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"_id": roomObjID,
+		"$or": []bson.M{
+			{"creator_id": userID},
+			{"participants": userID},
+		},
+	}
+
+	err = rooms.FindOne(ctx, filter).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rejectConnection sends a close frame with the given code and closes the connection
+func rejectConnection(conn *websocket.Conn, code int, reason string) {
+	deadline := time.Now().Add(5 * time.Second)
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	_ = conn.Close()
+}
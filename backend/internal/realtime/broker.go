@@ -0,0 +1,115 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Envelope kinds published through a Broker
+const (
+	EnvelopeKindRoom     = "room"     // deliver Message to every client in RoomID
+	EnvelopeKindUser     = "user"     // deliver Message to every connection of TargetUserID
+	EnvelopeKindPresence = "presence" // replace the origin hub's presence snapshot
+)
+
+// ErrBrokerClosed is returned when publishing to a closed broker
+var ErrBrokerClosed = errors.New("broker closed")
+
+// Envelope wraps a message travelling between hub instances
+type Envelope struct {
+	Kind          string          `json:"kind"`
+	Origin        string          `json:"origin"` // ID of the publishing hub
+	RoomID        string          `json:"roomId,omitempty"`
+	TargetUserID  string          `json:"targetUserId,omitempty"`
+	ExcludeUserID string          `json:"excludeUserId,omitempty"`
+	Message       WSMessage       `json:"message"`
+	Presence      []PresenceEntry `json:"presence,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+}
+
+// PresenceEntry describes one user connected to a room on some hub
+type PresenceEntry struct {
+	RoomID   string `json:"roomId"`
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+	Status   string `json:"status,omitempty"`
+}
+
+// Broker is the pub/sub backplane shared by every hub instance. Each hub
+// delivers its own traffic locally and publishes it so other instances can
+// deliver it to the clients they hold.
+type Broker interface {
+	// Publish sends an envelope to every subscriber, including the publisher
+	Publish(ctx context.Context, envelope Envelope) error
+	// Subscribe returns a channel of envelopes published by any instance.
+	// The channel is closed when the broker is closed.
+	Subscribe(ctx context.Context) (<-chan Envelope, error)
+	// Close stops delivery and releases resources
+	Close() error
+}
+
+// MemoryBroker is an in-process Broker. A single instance shared by several
+// hubs lets them exchange traffic as if they were separate replicas.
+type MemoryBroker struct {
+	mutex       sync.RWMutex
+	subscribers []chan Envelope
+	closed      bool
+}
+
+// NewMemoryBroker creates a new in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+// Publish delivers the envelope to all subscribers without blocking
+func (b *MemoryBroker) Publish(ctx context.Context, envelope Envelope) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	for _, subscriber := range b.subscribers {
+		select {
+		case subscriber <- envelope:
+		default:
+			log.Printf("Memory broker subscriber is full, dropping %s envelope", envelope.Kind)
+		}
+	}
+	return nil
+}
+
+// Subscribe registers a new subscriber channel
+func (b *MemoryBroker) Subscribe(ctx context.Context) (<-chan Envelope, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+
+	subscriber := make(chan Envelope, 1000)
+	b.subscribers = append(b.subscribers, subscriber)
+	return subscriber, nil
+}
+
+// Close closes all subscriber channels
+func (b *MemoryBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	for _, subscriber := range b.subscribers {
+		close(subscriber)
+	}
+	b.subscribers = nil
+	return nil
+}
@@ -0,0 +1,121 @@
+package realtime
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(hub *Hub, userID, roomID string) *Client {
+	return &Client{
+		ID:         generateClientID(),
+		UserID:     userID,
+		Username:   userID + "_name",
+		rooms:      map[string]bool{roomID: true},
+		Send:       make(chan WSMessage, 256),
+		Hub:        hub,
+		registered: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// waitForMessage reads from the client until a message of the given type arrives
+func waitForMessage(t *testing.T, client *Client, messageType string) WSMessage {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case message := <-client.Send:
+			if message.Type == messageType {
+				return message
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s message for %s", messageType, client.UserID)
+			return WSMessage{}
+		}
+	}
+}
+
+func hasOnlineUser(hub *Hub, roomID, userID string) bool {
+	for _, entry := range hub.OnlineUsers(roomID) {
+		if entry.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHubsShareTrafficThroughBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	hubA := NewHub(nil, broker)
+	hubB := NewHub(nil, broker)
+	go hubA.Run()
+	go hubB.Run()
+	defer broker.Close()
+
+	alice := newTestClient(hubA, "alice", "room1")
+	bob := newTestClient(hubB, "bob", "room1")
+	carol := newTestClient(hubB, "carol", "room2")
+
+	hubA.register <- alice
+	require.Eventually(t, func() bool { return hasOnlineUser(hubB, "room1", "alice") }, 2*time.Second, 10*time.Millisecond)
+
+	hubB.register <- bob
+	hubB.register <- carol
+
+	// Presence from hub B reaches hub A
+	online := waitForMessage(t, alice, MessageTypeUserOnline)
+	assert.Equal(t, "bob", online.UserID)
+	require.Eventually(t, func() bool { return hasOnlineUser(hubA, "room1", "bob") }, 2*time.Second, 10*time.Millisecond)
+	assert.False(t, hasOnlineUser(hubA, "room1", "carol"))
+
+	// Room broadcasts cross hubs but stay inside the room
+	hubB.broadcast <- WSMessage{Type: MessageTypeCallDeclined, RoomID: "room1", UserID: "bob", Timestamp: time.Now()}
+	call := waitForMessage(t, alice, MessageTypeCallDeclined)
+	assert.Equal(t, "bob", call.UserID)
+
+	// Typing indicators skip the sender on every hub
+	hubA.broadcast <- WSMessage{Type: MessageTypeTyping, RoomID: "room1", UserID: "alice", Timestamp: time.Now()}
+	typing := waitForMessage(t, bob, MessageTypeTyping)
+	assert.Equal(t, "alice", typing.UserID)
+
+	// Targeted signaling reaches only the target user
+	hubA.broadcast <- WSMessage{
+		Type:      MessageTypeRTCOffer,
+		RoomID:    "room1",
+		UserID:    "alice",
+		Timestamp: time.Now(),
+		Data:      map[string]interface{}{"targetUserId": "bob", "offer": "sdp"},
+	}
+	offer := waitForMessage(t, bob, MessageTypeRTCOffer)
+	assert.Equal(t, "sdp", offer.Data["offer"])
+
+	// Carol only hears about her own presence in room2
+	for len(carol.Send) > 0 {
+		message := <-carol.Send
+		if message.UserID != "carol" {
+			t.Fatalf("client in another room received %s", message.Type)
+		}
+	}
+
+	// Leaving on hub B is reflected on hub A
+	hubB.unregister <- bob
+	offline := waitForMessage(t, alice, MessageTypeUserOffline)
+	assert.Equal(t, "bob", offline.UserID)
+	require.Eventually(t, func() bool { return !hasOnlineUser(hubA, "room1", "bob") }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	broker := NewMemoryBroker()
+	envelopes, err := broker.Subscribe(context.Background())
+	require.NoError(t, err)
+
+	require.NoError(t, broker.Close())
+
+	_, ok := <-envelopes
+	assert.False(t, ok)
+	assert.ErrorIs(t, broker.Publish(context.Background(), Envelope{Kind: EnvelopeKindRoom}), ErrBrokerClosed)
+}
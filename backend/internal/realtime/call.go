@@ -0,0 +1,419 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// callSweepInterval is how often calls are checked for participants who are
+// no longer connected to the room
+const callSweepInterval = time.Minute
+
+// errNotInCall is returned when a user changes a call they are not part of
+var errNotInCall = errors.New("You are not in this call")
+
+// callStateFields maps call_state data keys to participant fields
+var callStateFields = map[string]string{
+	"muted":         "muted",
+	"cameraOn":      "camera_on",
+	"screenSharing": "screen_sharing",
+}
+
+// EnsureCallIndexes creates the indexes used by call sessions
+func EnsureCallIndexes(mongoClient *database.MongoClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	calls := mongoClient.GetCollection(database.CollectionNames.CallSessions)
+	_, err := calls.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// At most one active call per room
+			Keys:    bson.D{{Key: "room_id", Value: 1}},
+			Options: options.Index().SetName("active_room").SetUnique(true).SetPartialFilterExpression(bson.M{"is_active": true}),
+		},
+		{
+			Keys:    bson.D{{Key: "room_id", Value: 1}, {Key: "started_at", Value: -1}},
+			Options: options.Index().SetName("room_started_at"),
+		},
+	})
+	return err
+}
+
+// handleCallMessage keeps the room's call session in sync with start_call,
+// end_call and call_state messages and broadcasts the resulting roster
+func (h *Hub) handleCallMessage(message WSMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var session models.CallSession
+	var err error
+	broadcastType := MessageTypeCallUpdated
+
+	switch message.Type {
+	case MessageTypeStartCall:
+		var created bool
+		session, created, err = h.joinCall(ctx, message.RoomID, message.UserID, message.Username)
+		if err == nil {
+			h.setUserRoomStatus(message.UserID, message.RoomID, PresenceInCall)
+			if created {
+				broadcastType = MessageTypeStartCall
+			}
+		}
+	case MessageTypeEndCall:
+		var ended bool
+		session, ended, err = h.leaveCall(ctx, message.RoomID, message.UserID)
+		if errors.Is(err, errNotInCall) {
+			// Clients send end_call when tearing down; nothing to do
+			return
+		}
+		if err == nil {
+			h.setUserRoomStatus(message.UserID, message.RoomID, PresenceOnline)
+			if ended {
+				broadcastType = MessageTypeEndCall
+			}
+		}
+	case MessageTypeCallState:
+		session, err = h.updateCallState(ctx, message.RoomID, message.UserID, message.Data)
+	}
+
+	if err != nil {
+		content := "Failed to update call"
+		if errors.Is(err, errNotInCall) {
+			content = err.Error()
+		} else {
+			log.Printf("Error updating call in room %s: %v", message.RoomID, err)
+		}
+		h.sendToUser(message.UserID, message.RoomID, WSMessage{
+			Type:      MessageTypeError,
+			RoomID:    message.RoomID,
+			Content:   content,
+			Timestamp: time.Now(),
+		})
+		return
+	}
+
+	h.broadcastCall(broadcastType, message.UserID, message.Username, session)
+}
+
+// broadcastCall sends the call roster to everyone in the room
+func (h *Hub) broadcastCall(messageType, userID, username string, session models.CallSession) {
+	h.broadcastToRoom(session.RoomID, WSMessage{
+		Type:      messageType,
+		RoomID:    session.RoomID,
+		UserID:    userID,
+		Username:  username,
+		Timestamp: time.Now(),
+		Data: map[string]interface{}{
+			"call": session.ToResponse(),
+		},
+	}, "")
+}
+
+// joinCall adds the user to the room's active call, starting one if none is
+// in progress. It reports whether a new call was started.
+func (h *Hub) joinCall(ctx context.Context, roomID, userID, username string) (models.CallSession, bool, error) {
+	calls := h.mongoClient.GetCollection(database.CollectionNames.CallSessions)
+	now := time.Now()
+	participant := models.CallParticipant{
+		UserID:   userID,
+		Username: username,
+		CameraOn: true,
+		JoinedAt: now,
+	}
+
+	// Two attempts cover losing the race to start the call to another user
+	for attempt := 0; attempt < 2; attempt++ {
+		var session models.CallSession
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := calls.FindOneAndUpdate(ctx,
+			bson.M{
+				"room_id":      roomID,
+				"is_active":    true,
+				"participants": bson.M{"$not": bson.M{"$elemMatch": bson.M{"user_id": userID, "left_at": nil}}},
+			},
+			bson.M{"$push": bson.M{"participants": participant}},
+			opts,
+		).Decode(&session)
+		if err == nil {
+			return session, false, nil
+		} else if err != mongo.ErrNoDocuments {
+			return models.CallSession{}, false, err
+		}
+
+		// Either the user is already in the call or there is no call yet
+		active, err := activeCall(ctx, h.mongoClient, roomID)
+		if err != nil {
+			return models.CallSession{}, false, err
+		}
+		if active != nil {
+			return *active, false, nil
+		}
+
+		session = models.CallSession{
+			RoomID:       roomID,
+			StartedBy:    userID,
+			Participants: []models.CallParticipant{participant},
+			IsActive:     true,
+			StartedAt:    now,
+		}
+		res, err := calls.InsertOne(ctx, session)
+		if err == nil {
+			if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+				session.ID = oid
+			}
+			return session, true, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return models.CallSession{}, false, err
+		}
+	}
+	return models.CallSession{}, false, errors.New("call changed concurrently")
+}
+
+// leaveCall removes the user from the room's active call and ends the call
+// when nobody is left. It reports whether the call ended.
+func (h *Hub) leaveCall(ctx context.Context, roomID, userID string) (models.CallSession, bool, error) {
+	calls := h.mongoClient.GetCollection(database.CollectionNames.CallSessions)
+	now := time.Now()
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var session models.CallSession
+	err := calls.FindOneAndUpdate(ctx,
+		bson.M{
+			"room_id":      roomID,
+			"is_active":    true,
+			"participants": bson.M{"$elemMatch": bson.M{"user_id": userID, "left_at": nil}},
+		},
+		bson.M{"$set": bson.M{"participants.$.left_at": now}},
+		opts,
+	).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return models.CallSession{}, false, errNotInCall
+	} else if err != nil {
+		return models.CallSession{}, false, err
+	}
+
+	if len(session.ActiveParticipants()) > 0 {
+		return session, false, nil
+	}
+	return h.endEmptyCall(ctx, session, now)
+}
+
+// endEmptyCall ends a call nobody is in any more, unless someone joined in
+// the meantime. It reports whether the call ended.
+func (h *Hub) endEmptyCall(ctx context.Context, session models.CallSession, now time.Time) (models.CallSession, bool, error) {
+	calls := h.mongoClient.GetCollection(database.CollectionNames.CallSessions)
+	var ended models.CallSession
+	err := calls.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":          session.ID,
+			"is_active":    true,
+			"participants": bson.M{"$not": bson.M{"$elemMatch": bson.M{"left_at": nil}}},
+		},
+		bson.M{"$set": bson.M{"is_active": false, "ended_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ended)
+	if err == mongo.ErrNoDocuments {
+		active, err := activeCall(ctx, h.mongoClient, session.RoomID)
+		if err != nil || active == nil {
+			return session, false, err
+		}
+		return *active, false, nil
+	} else if err != nil {
+		return models.CallSession{}, false, err
+	}
+	return ended, true, nil
+}
+
+// updateCallState applies the muted, cameraOn and screenSharing flags present in data
+func (h *Hub) updateCallState(ctx context.Context, roomID, userID string, data map[string]interface{}) (models.CallSession, error) {
+	set := bson.M{}
+	for key, field := range callStateFields {
+		if value, ok := data[key].(bool); ok {
+			set["participants.$."+field] = value
+		}
+	}
+
+	filter := bson.M{
+		"room_id":      roomID,
+		"is_active":    true,
+		"participants": bson.M{"$elemMatch": bson.M{"user_id": userID, "left_at": nil}},
+	}
+
+	calls := h.mongoClient.GetCollection(database.CollectionNames.CallSessions)
+	var session models.CallSession
+	var err error
+	if len(set) == 0 {
+		err = calls.FindOne(ctx, filter).Decode(&session)
+	} else {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err = calls.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&session)
+	}
+	if err == mongo.ErrNoDocuments {
+		return models.CallSession{}, errNotInCall
+	}
+	return session, err
+}
+
+// leaveCallIfGone removes a user from the room's call once their last
+// connection to the room has closed on every hub
+func (h *Hub) leaveCallIfGone(userID, username, roomID string) {
+	if h.mongoClient == nil {
+		return
+	}
+	for _, connectedRoom := range h.UserPresence(userID).Rooms {
+		if connectedRoom == roomID {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, ended, err := h.leaveCall(ctx, roomID, userID)
+	if errors.Is(err, errNotInCall) {
+		return
+	} else if err != nil {
+		log.Printf("Error removing user %s from call in room %s: %v", userID, roomID, err)
+		return
+	}
+
+	broadcastType := MessageTypeCallUpdated
+	if ended {
+		broadcastType = MessageTypeEndCall
+	}
+	h.broadcastCall(broadcastType, userID, username, session)
+}
+
+// runCallSweeps removes participants from calls once no hub holds a
+// connection of theirs to the room. Connections end without leaving the call
+// when the hub holding them crashes or restarts. The first sweep waits a
+// minute, so other hubs have shared their presence by then.
+func (h *Hub) runCallSweeps() {
+	if h.mongoClient == nil {
+		return
+	}
+	ticker := time.NewTicker(callSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		h.sweepCalls(time.Now())
+	}
+}
+
+// sweepCalls removes the participants of active calls who are not connected
+// to the call's room, ending calls nobody is left in
+func (h *Hub) sweepCalls(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	calls := h.mongoClient.GetCollection(database.CollectionNames.CallSessions)
+	cursor, err := calls.Find(ctx, bson.M{"is_active": true}, options.Find().SetHint("active_room"))
+	if err != nil {
+		log.Printf("Error loading active calls: %v", err)
+		return
+	}
+	var active []models.CallSession
+	if err := cursor.All(ctx, &active); err != nil {
+		log.Printf("Error loading active calls: %v", err)
+		return
+	}
+
+	for _, session := range active {
+		participants := session.ActiveParticipants()
+		if len(participants) == 0 {
+			// Left behind by a hub that stopped before ending the call
+			if ended, ok, err := h.endEmptyCall(ctx, session, now); err != nil {
+				log.Printf("Error ending empty call in room %s: %v", session.RoomID, err)
+			} else if ok {
+				h.broadcastCall(MessageTypeEndCall, "", "", ended)
+			}
+			continue
+		}
+		for _, participant := range participants {
+			// The presence of someone who just joined on another hub may not
+			// have arrived yet
+			if now.Sub(participant.JoinedAt) < presenceExpiry {
+				continue
+			}
+			h.leaveCallIfGone(participant.UserID, participant.Username, session.RoomID)
+		}
+	}
+}
+
+// activeCall returns the room's active call, or nil when none is in progress
+func activeCall(ctx context.Context, mongoClient *database.MongoClient, roomID string) (*models.CallSession, error) {
+	var session models.CallSession
+	calls := mongoClient.GetCollection(database.CollectionNames.CallSessions)
+	err := calls.FindOne(ctx, bson.M{"room_id": roomID, "is_active": true}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// userInRoom reports whether the user is connected to the room on any hub
+func (h *Hub) userInRoom(userID, roomID string) bool {
+	for _, entry := range h.OnlineUsers(roomID) {
+		if entry.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRoomCall returns the room's active call and its participants
+func GetRoomCall(mongoClient *database.MongoClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userID")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		roomID := c.Param("roomId")
+		if !primitive.IsValidObjectID(roomID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+			return
+		}
+
+		canAccess, err := userCanAccessRoom(mongoClient, roomID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify room access"})
+			return
+		}
+		if !canAccess {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this room"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		session, err := activeCall(ctx, mongoClient, roomID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch call"})
+			return
+		}
+		if session == nil {
+			c.JSON(http.StatusOK, gin.H{"call": nil})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"call": session.ToResponse()})
+	}
+}
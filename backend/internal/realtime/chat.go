@@ -0,0 +1,466 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+const (
+	// replayLimit caps how many messages a single resume replays
+	replayLimit = 500
+	// maxPendingDuringReplay bounds live messages held back while replaying
+	maxPendingDuringReplay = 1000
+	// replaySendTimeout bounds how long a replay waits on a stalled connection
+	replaySendTimeout = 10 * time.Second
+	// chatQueueSize bounds the chat work of a room waiting for the database
+	chatQueueSize = 256
+	// chatWorkerIdle is how long a room's chat worker waits for more work
+	// before it exits
+	chatWorkerIdle = time.Minute
+)
+
+// chatSequenceCounterID returns the counters document ID for a room's chat sequence
+func chatSequenceCounterID(roomID string) string {
+	return "chat_sequence:" + roomID
+}
+
+// nextChatSequence atomically allocates the next chat sequence number for a room
+func nextChatSequence(ctx context.Context, mongoClient *database.MongoClient, roomID string) (int64, error) {
+	counters := mongoClient.GetCollection(database.CollectionNames.Counters)
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := counters.FindOneAndUpdate(ctx,
+		bson.M{"_id": chatSequenceCounterID(roomID)},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		opts,
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq, nil
+}
+
+// EnsureChatIndexes creates the indexes used by chat delivery and history
+func EnsureChatIndexes(mongoClient *database.MongoClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	chatMessages := mongoClient.GetCollection(database.CollectionNames.ChatMessages)
+	_, err := chatMessages.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// Resume replays and per-room ordering; sparse so legacy messages without a sequence don't collide
+			Keys:    bson.D{{Key: "room_id", Value: 1}, {Key: "sequence", Value: 1}},
+			Options: options.Index().SetName("room_sequence").SetUnique(true).SetPartialFilterExpression(bson.M{"sequence": bson.M{"$gt": 0}}),
+		},
+		{
+			// History pagination, newest first with _id as tie-breaker
+			Keys:    bson.D{{Key: "room_id", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("room_timestamp"),
+		},
+		{
+			// History filtered by author
+			Keys:    bson.D{{Key: "room_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "timestamp", Value: -1}},
+			Options: options.Index().SetName("room_author_timestamp"),
+		},
+		{
+			// Thread replies in insertion order
+			Keys:    bson.D{{Key: "room_id", Value: 1}, {Key: "reply_to", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("room_thread").SetPartialFilterExpression(bson.M{"reply_to": bson.M{"$exists": true}}),
+		},
+		{
+			// Full-text search within a room's messages
+			Keys:    bson.D{{Key: "content", Value: "text"}},
+			Options: options.Index().SetName("content_text"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	chatCursors := mongoClient.GetCollection(database.CollectionNames.ChatCursors)
+	_, err = chatCursors.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "room_id", Value: 1}},
+		Options: options.Index().SetName("user_room").SetUnique(true),
+	})
+	return err
+}
+
+// queueChat hands a chat message, edit, deletion or reaction to its room's
+// chat worker, starting one if needed. Senders are told to retry when the
+// room's queue is full.
+func (h *Hub) queueChat(message WSMessage) {
+	h.chatMutex.Lock()
+	queue, ok := h.chatQueues[message.RoomID]
+	if !ok {
+		queue = make(chan WSMessage, chatQueueSize)
+		h.chatQueues[message.RoomID] = queue
+		go h.runChatWorker(message.RoomID, queue)
+	}
+	// Queueing under the lock keeps an exiting worker from missing messages
+	select {
+	case queue <- message:
+		h.chatMutex.Unlock()
+		return
+	default:
+	}
+	h.chatMutex.Unlock()
+
+	h.sendToUser(message.UserID, message.RoomID, WSMessage{
+		Type:            MessageTypeError,
+		RoomID:          message.RoomID,
+		Content:         "Too many messages, try again",
+		ClientMessageID: message.ClientMessageID,
+		MessageID:       message.MessageID,
+		Timestamp:       time.Now(),
+	})
+}
+
+// runChatWorker handles a room's chat work one message at a time, so
+// messages are broadcast in the order of their sequence, and exits once the
+// room has been quiet for chatWorkerIdle
+func (h *Hub) runChatWorker(roomID string, queue chan WSMessage) {
+	idle := time.NewTimer(chatWorkerIdle)
+	defer idle.Stop()
+
+	for {
+		select {
+		case message := <-queue:
+			h.handleChat(message)
+		case <-idle.C:
+			h.chatMutex.Lock()
+			if len(queue) == 0 {
+				delete(h.chatQueues, roomID)
+				h.chatMutex.Unlock()
+				return
+			}
+			h.chatMutex.Unlock()
+		}
+
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(chatWorkerIdle)
+	}
+}
+
+// handleChat saves a new chat message and broadcasts it with its sequence,
+// or applies a change to an existing one
+func (h *Hub) handleChat(message WSMessage) {
+	if message.Type != MessageTypeChat {
+		h.handleChatUpdate(message)
+		return
+	}
+
+	saved, err := h.saveChatMessage(message)
+	if err != nil {
+		content := "Failed to save message"
+		if errors.Is(err, errReplyTargetNotFound) {
+			content = err.Error()
+		} else {
+			log.Printf("Error saving chat message: %v", err)
+		}
+		h.sendToUser(message.UserID, message.RoomID, WSMessage{
+			Type:            MessageTypeError,
+			RoomID:          message.RoomID,
+			Content:         content,
+			ClientMessageID: message.ClientMessageID,
+			Timestamp:       time.Now(),
+		})
+		return
+	}
+	message.MessageID = saved.ID.Hex()
+	message.Sequence = saved.Sequence
+	message.ReplyTo = saved.ReplyTo
+	if len(saved.Mentions) > 0 {
+		if message.Data == nil {
+			message.Data = map[string]interface{}{}
+		}
+		message.Data["mentions"] = saved.Mentions
+	}
+	// Broadcast to room, then notify mentioned users
+	h.broadcastToRoom(message.RoomID, message, "")
+	h.notifyMentions(saved)
+}
+
+// saveChatMessage assigns the next room sequence and saves a chat message to
+// the database, attaching it to its thread and resolving mentions
+func (h *Hub) saveChatMessage(message WSMessage) (models.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var rootID string
+	if message.ReplyTo != "" {
+		var err error
+		if rootID, err = h.resolveThreadRoot(ctx, message.RoomID, message.ReplyTo); err != nil {
+			return models.ChatMessage{}, err
+		}
+	}
+
+	mentions, err := h.resolveMentions(ctx, message.RoomID, message.UserID, parseMentions(message.Content))
+	if err != nil {
+		// Mentions are best effort; the message itself is still delivered
+		log.Printf("Error resolving chat mentions: %v", err)
+	}
+
+	sequence, err := nextChatSequence(ctx, h.mongoClient, message.RoomID)
+	if err != nil {
+		return models.ChatMessage{}, err
+	}
+
+	chatMessage := models.ChatMessage{
+		RoomID:    message.RoomID,
+		UserID:    message.UserID,
+		Username:  message.Username,
+		Content:   message.Content,
+		Sequence:  sequence,
+		Timestamp: message.Timestamp,
+		CreatedAt: time.Now(),
+		ReplyTo:   rootID,
+		Mentions:  mentions,
+	}
+
+	collection := h.mongoClient.GetCollection(database.CollectionNames.ChatMessages)
+	res, err := collection.InsertOne(ctx, chatMessage)
+	if err != nil {
+		return models.ChatMessage{}, err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		chatMessage.ID = oid
+	}
+
+	if rootID != "" {
+		h.incrementReplyCount(ctx, rootID)
+	}
+	return chatMessage, nil
+}
+
+// chatMessageToWS converts a stored chat message into its WebSocket form.
+// Replayed messages carry their current state, including edits and deletion.
+func chatMessageToWS(chatMessage models.ChatMessage) WSMessage {
+	message := WSMessage{
+		Type:      MessageTypeChat,
+		RoomID:    chatMessage.RoomID,
+		UserID:    chatMessage.UserID,
+		Username:  chatMessage.Username,
+		Content:   chatMessage.Content,
+		MessageID: chatMessage.ID.Hex(),
+		Sequence:  chatMessage.Sequence,
+		ReplyTo:   chatMessage.ReplyTo,
+		Timestamp: chatMessage.Timestamp,
+	}
+	if chatMessage.EditedAt != nil || chatMessage.DeletedAt != nil || len(chatMessage.Reactions) > 0 {
+		message.Data = map[string]interface{}{
+			"message": chatMessage.ToResponse(),
+		}
+	}
+	return message
+}
+
+// handleAck records the highest chat sequence the client has received in a room
+func (c *Client) handleAck(roomID string, sequence int64) {
+	if sequence <= 0 {
+		return
+	}
+
+	c.replayMutex.Lock()
+	if sequence <= c.lastAcked[roomID] {
+		c.replayMutex.Unlock()
+		return
+	}
+	if c.lastAcked == nil {
+		c.lastAcked = make(map[string]int64)
+	}
+	c.lastAcked[roomID] = sequence
+	c.replayMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursors := c.Hub.mongoClient.GetCollection(database.CollectionNames.ChatCursors)
+	_, err := cursors.UpdateOne(ctx,
+		bson.M{"user_id": c.UserID, "room_id": roomID},
+		bson.M{
+			"$max": bson.M{"last_acked_sequence": sequence},
+			"$set": bson.M{"updated_at": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Printf("Error saving chat cursor for user %s: %v", c.UserID, err)
+	}
+}
+
+// storedAck returns the last acknowledged sequence persisted for the client in a room
+func (c *Client) storedAck(ctx context.Context, roomID string) int64 {
+	cursors := c.Hub.mongoClient.GetCollection(database.CollectionNames.ChatCursors)
+
+	var cursor models.ChatCursor
+	if err := cursors.FindOne(ctx, bson.M{"user_id": c.UserID, "room_id": roomID}).Decode(&cursor); err != nil {
+		return 0
+	}
+	return cursor.LastAckedSequence
+}
+
+// handleResume replays the chat messages the client missed in a room after
+// lastSeen and then switches it back to live traffic. Live messages arriving
+// during the replay are held back and flushed afterwards, skipping duplicates.
+func (c *Client) handleResume(roomID string, lastSeen int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if lastSeen <= 0 {
+		lastSeen = c.storedAck(ctx, roomID)
+	}
+
+	c.startReplay(roomID)
+
+	chatMessages := c.Hub.mongoClient.GetCollection(database.CollectionNames.ChatMessages)
+	opts := options.Find().SetSort(bson.M{"sequence": 1}).SetLimit(replayLimit + 1)
+	cursor, err := chatMessages.Find(ctx, bson.M{
+		"room_id":  roomID,
+		"sequence": bson.M{"$gt": lastSeen},
+	}, opts)
+	if err != nil {
+		log.Printf("Error loading chat replay for user %s: %v", c.UserID, err)
+		c.finishReplay(lastSeen)
+		c.Hub.sendToClient(c, WSMessage{Type: MessageTypeError, RoomID: roomID, Content: "Failed to resume chat", Timestamp: time.Now()})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var missed []models.ChatMessage
+	if err := cursor.All(ctx, &missed); err != nil {
+		log.Printf("Error decoding chat replay for user %s: %v", c.UserID, err)
+	}
+
+	hasMore := len(missed) > replayLimit
+	if hasMore {
+		missed = missed[:replayLimit]
+	}
+
+	lastSent := lastSeen
+	for _, chatMessage := range missed {
+		if !c.sendBlocking(chatMessageToWS(chatMessage)) {
+			// Go back to live delivery, or held-back messages pile up
+			c.finishReplay(lastSent)
+			return
+		}
+		lastSent = chatMessage.Sequence
+	}
+
+	c.sendBlocking(WSMessage{
+		Type:      MessageTypeResumeComplete,
+		RoomID:    roomID,
+		Sequence:  lastSent,
+		Timestamp: time.Now(),
+		Data: map[string]interface{}{
+			"replayed": len(missed),
+			"hasMore":  hasMore,
+		},
+	})
+
+	c.finishReplay(lastSent)
+}
+
+// startReplay begins holding back live messages while a room is replayed
+func (c *Client) startReplay(roomID string) {
+	c.replayMutex.Lock()
+	c.replaying = true
+	c.replayRoom = roomID
+	c.pending = nil
+	c.replayMutex.Unlock()
+}
+
+// finishReplay flushes held-back messages, skipping chat messages of the
+// replayed room up to lastSent, and resumes live delivery
+func (c *Client) finishReplay(lastSent int64) {
+	for {
+		c.replayMutex.Lock()
+		roomID := c.replayRoom
+		batch := c.pending
+		c.pending = nil
+		if len(batch) == 0 {
+			c.replaying = false
+			c.replayRoom = ""
+			c.replayMutex.Unlock()
+			return
+		}
+		c.replayMutex.Unlock()
+
+		for _, message := range batch {
+			replayed := message.Type == MessageTypeChat && message.RoomID == roomID
+			if replayed && message.Sequence > 0 && message.Sequence <= lastSent {
+				continue
+			}
+			if !c.sendBlocking(message) {
+				// The connection is going away; drop what is left
+				c.replayMutex.Lock()
+				c.replaying = false
+				c.replayRoom = ""
+				c.pending = nil
+				c.replayMutex.Unlock()
+				return
+			}
+			if replayed && message.Sequence > lastSent {
+				lastSent = message.Sequence
+			}
+		}
+	}
+}
+
+// enqueue queues a live message without blocking. It returns false when the
+// client cannot keep up and should be disconnected.
+func (c *Client) enqueue(message WSMessage) bool {
+	c.replayMutex.Lock()
+	if c.replaying {
+		if len(c.pending) >= maxPendingDuringReplay {
+			c.replayMutex.Unlock()
+			return false
+		}
+		c.pending = append(c.pending, message)
+		c.replayMutex.Unlock()
+		return true
+	}
+	c.replayMutex.Unlock()
+
+	select {
+	case c.Send <- message:
+		return true
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendBlocking waits for room in the send buffer. It returns false when the
+// connection closed or stalled.
+func (c *Client) sendBlocking(message WSMessage) bool {
+	timer := time.NewTimer(replaySendTimeout)
+	defer timer.Stop()
+
+	select {
+	case c.Send <- message:
+		return true
+	case <-c.done:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
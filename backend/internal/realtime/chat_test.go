@@ -0,0 +1,102 @@
+package realtime
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientHoldsLiveMessagesDuringReplay(t *testing.T) {
+	client := newTestClient(nil, "alice", "room1")
+
+	client.startReplay("room1")
+	require.True(t, client.enqueue(WSMessage{Type: MessageTypeChat, RoomID: "room1", Sequence: 3}))
+	require.True(t, client.enqueue(WSMessage{Type: MessageTypeChat, RoomID: "room1", Sequence: 4}))
+	require.True(t, client.enqueue(WSMessage{Type: MessageTypeChat, RoomID: "room2", Sequence: 2}))
+	require.True(t, client.enqueue(WSMessage{Type: MessageTypeTyping, RoomID: "room1", UserID: "bob"}))
+	require.True(t, client.enqueue(WSMessage{Type: MessageTypeChat, RoomID: "room1", Sequence: 5}))
+	assert.Empty(t, client.Send, "live messages must wait for the replay")
+
+	// Messages up to sequence 4 of room1 were already replayed; other rooms
+	// have their own sequences and are never skipped
+	client.finishReplay(4)
+
+	require.Len(t, client.Send, 3)
+	other := <-client.Send
+	assert.Equal(t, "room2", other.RoomID)
+	assert.Equal(t, int64(2), other.Sequence)
+	assert.Equal(t, MessageTypeTyping, (<-client.Send).Type)
+	assert.Equal(t, int64(5), (<-client.Send).Sequence)
+
+	// Live delivery resumes directly once the replay is done
+	require.True(t, client.enqueue(WSMessage{Type: MessageTypeChat, Sequence: 6}))
+	assert.Equal(t, int64(6), (<-client.Send).Sequence)
+}
+
+func TestClientStopsReplayWhenFlushFails(t *testing.T) {
+	client := newTestClient(nil, "alice", "room1")
+
+	client.startReplay("room1")
+	require.True(t, client.enqueue(WSMessage{Type: MessageTypeChat, RoomID: "room1", Sequence: 5}))
+	require.True(t, client.enqueue(WSMessage{Type: MessageTypeChat, RoomID: "room1", Sequence: 6}))
+
+	// The connection closed before the held-back messages were flushed
+	client.Send = make(chan WSMessage)
+	close(client.done)
+	client.finishReplay(4)
+
+	client.replayMutex.Lock()
+	defer client.replayMutex.Unlock()
+	assert.False(t, client.replaying)
+	assert.Empty(t, client.replayRoom)
+	assert.Empty(t, client.pending)
+}
+
+func TestClientEnqueueReportsLaggingClient(t *testing.T) {
+	client := newTestClient(nil, "alice", "room1")
+	client.Send = make(chan WSMessage, 1)
+
+	assert.True(t, client.enqueue(WSMessage{Type: MessageTypeChat, Sequence: 1}))
+	assert.False(t, client.enqueue(WSMessage{Type: MessageTypeChat, Sequence: 2}))
+
+	// A closed client silently discards messages
+	close(client.done)
+	assert.True(t, client.enqueue(WSMessage{Type: MessageTypeChat, Sequence: 3}))
+}
+
+func TestValidReaction(t *testing.T) {
+	assert.True(t, validReaction("👍"))
+	assert.True(t, validReaction("👍🏽"))
+	assert.True(t, validReaction("❤️"))
+	assert.True(t, validReaction("👩‍💻"))
+	assert.True(t, validReaction("🇩🇪"))
+	assert.True(t, validReaction("1️⃣"))
+	assert.False(t, validReaction("+1"))
+	assert.False(t, validReaction("lol"))
+	assert.False(t, validReaction("1"))
+	assert.False(t, validReaction("\u200d"))
+	assert.False(t, validReaction(""))
+	assert.False(t, validReaction("a.b"))
+	assert.False(t, validReaction("$set"))
+	assert.False(t, validReaction("two words"))
+	assert.False(t, validReaction(string(make([]byte, maxReactionLength+1))))
+}
+
+func TestChatUpdateErrorMessage(t *testing.T) {
+	assert.Equal(t, errChatUpdateForbidden.Error(), chatUpdateErrorMessage(errChatUpdateForbidden))
+	assert.Equal(t, "Failed to update message", chatUpdateErrorMessage(assert.AnError))
+}
+
+func TestParseMentions(t *testing.T) {
+	assert.Equal(t, []string{"alice", "bob_2"}, parseMentions("@alice can you and @bob_2 review? thanks @alice"))
+	assert.Equal(t, []string{"john.doe", "user-123"}, parseMentions("ping @john.doe. Also (@user-123)"))
+	assert.Empty(t, parseMentions("mail me at someone@example.com"))
+	assert.Empty(t, parseMentions("no mentions here, just @"))
+
+	many := ""
+	for i := 0; i < maxMentionsPerMessage+5; i++ {
+		many += " @user" + string(rune('a'+i))
+	}
+	assert.Len(t, parseMentions(many), maxMentionsPerMessage)
+}
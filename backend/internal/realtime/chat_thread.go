@@ -0,0 +1,297 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// maxMentionsPerMessage bounds how many distinct handles a message can notify
+const maxMentionsPerMessage = 20
+
+// mentionPreviewLength bounds the message excerpt stored in mention notifications
+const mentionPreviewLength = 100
+
+// errReplyTargetNotFound is returned when a reply points at a missing message
+var errReplyTargetNotFound = errors.New("Message being replied to was not found")
+
+// mentionPattern matches @username and @uniqueId handles. The handle must not
+// be preceded by a word character so e-mail addresses are not treated as mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([\w.-]{1,50})`)
+
+// parseMentions returns the distinct handles mentioned in content, in order
+func parseMentions(content string) []string {
+	var handles []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// Trailing punctuation belongs to the sentence, not the handle
+		handle := trimHandle(match[1])
+		if handle == "" || seen[handle] {
+			continue
+		}
+		seen[handle] = true
+		handles = append(handles, handle)
+		if len(handles) == maxMentionsPerMessage {
+			break
+		}
+	}
+	return handles
+}
+
+// trimHandle strips trailing dots and dashes from a mention handle
+func trimHandle(handle string) string {
+	for len(handle) > 0 {
+		last := handle[len(handle)-1]
+		if last != '.' && last != '-' {
+			break
+		}
+		handle = handle[:len(handle)-1]
+	}
+	return handle
+}
+
+// resolveThreadRoot returns the root message ID for a reply. Threads are one
+// level deep, so replying to a reply joins the original thread.
+func (h *Hub) resolveThreadRoot(ctx context.Context, roomID, replyTo string) (string, error) {
+	parent, err := h.loadChatMessage(ctx, roomID, replyTo)
+	if errors.Is(err, errChatMessageNotFound) {
+		return "", errReplyTargetNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	if parent.ReplyTo != "" {
+		return parent.ReplyTo, nil
+	}
+	return parent.ID.Hex(), nil
+}
+
+// incrementReplyCount bumps the reply counter on a thread's root message
+func (h *Hub) incrementReplyCount(ctx context.Context, rootID string) {
+	objID, err := primitive.ObjectIDFromHex(rootID)
+	if err != nil {
+		return
+	}
+
+	collection := h.mongoClient.GetCollection(database.CollectionNames.ChatMessages)
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": objID}, bson.M{"$inc": bson.M{"reply_count": 1}}); err != nil {
+		log.Printf("Error updating reply count for message %s: %v", rootID, err)
+	}
+}
+
+// resolveMentions maps mentioned handles to the IDs of room members whose
+// username or unique ID matches. The sender is never included.
+func (h *Hub) resolveMentions(ctx context.Context, roomID, senderID string, handles []string) ([]string, error) {
+	if len(handles) == 0 {
+		return nil, nil
+	}
+
+	roomObjID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return nil, nil
+	}
+
+	var room models.Room
+	rooms := h.mongoClient.GetCollection(database.CollectionNames.Rooms)
+	if err := rooms.FindOne(ctx, bson.M{"_id": roomObjID}).Decode(&room); err != nil {
+		return nil, err
+	}
+
+	// Room members are stored by their unique IDs
+	var memberIDs []string
+	for _, memberID := range append([]string{room.CreatorID}, room.Participants...) {
+		if memberID != "" && memberID != senderID {
+			memberIDs = append(memberIDs, memberID)
+		}
+	}
+	if len(memberIDs) == 0 {
+		return nil, nil
+	}
+
+	users := h.mongoClient.GetCollection(database.CollectionNames.Users)
+	opts := options.Find().SetProjection(bson.M{"unique_id": 1})
+	cursor, err := users.Find(ctx, bson.M{
+		"unique_id": bson.M{"$in": memberIDs},
+		"$or": []bson.M{
+			{"username": bson.M{"$in": handles}},
+			{"unique_id": bson.M{"$in": handles}},
+		},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var mentioned []models.User
+	if err := cursor.All(ctx, &mentioned); err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]string, 0, len(mentioned))
+	for _, user := range mentioned {
+		userIDs = append(userIDs, user.UniqueID)
+	}
+	return userIDs, nil
+}
+
+// notifyMentions stores a mention notification for every mentioned user and
+// pushes it to their open connections
+func (h *Hub) notifyMentions(chatMessage models.ChatMessage) {
+	if len(chatMessage.Mentions) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	preview := chatMessage.Content
+	if runes := []rune(preview); len(runes) > mentionPreviewLength {
+		preview = string(runes[:mentionPreviewLength]) + "..."
+	}
+
+	notifications := h.mongoClient.GetCollection(database.CollectionNames.Notifications)
+	for _, userID := range chatMessage.Mentions {
+		notification := models.CreateMentionNotification(userID, chatMessage.UserID, chatMessage.Username,
+			chatMessage.RoomID, chatMessage.ID.Hex(), preview)
+
+		res, err := notifications.InsertOne(ctx, notification)
+		if err != nil {
+			log.Printf("Error creating mention notification for user %s: %v", userID, err)
+			continue
+		}
+		if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+			notification.ID = oid
+		}
+
+		h.sendToUser(userID, "", WSMessage{
+			Type:      MessageTypeNotification,
+			RoomID:    chatMessage.RoomID,
+			MessageID: chatMessage.ID.Hex(),
+			Timestamp: time.Now(),
+			Data: map[string]interface{}{
+				"notification": notification.ToResponse(),
+			},
+		})
+	}
+}
+
+// GetChatThread returns a thread's root message and its replies, oldest first
+func GetChatThread(mongoClient *database.MongoClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userID")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		roomID := c.Param("roomId")
+		messageID := c.Param("messageId")
+		if !primitive.IsValidObjectID(roomID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+			return
+		}
+		rootObjID, err := primitive.ObjectIDFromHex(messageID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+			return
+		}
+
+		canAccess, err := userCanAccessRoom(mongoClient, roomID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify room access"})
+			return
+		}
+		if !canAccess {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this room"})
+			return
+		}
+
+		query, err := parseHistoryQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		chatMessages := mongoClient.GetCollection(database.CollectionNames.ChatMessages)
+
+		var root models.ChatMessage
+		err = chatMessages.FindOne(ctx, bson.M{"_id": rootObjID, "room_id": roomID}).Decode(&root)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch thread"})
+			return
+		}
+		if root.ReplyTo != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Message is a reply, fetch its thread root instead", "rootId": root.ReplyTo})
+			return
+		}
+
+		filter := bson.M{"room_id": roomID, "reply_to": messageID}
+		if query.After != "" {
+			afterObjID, err := primitive.ObjectIDFromHex(query.After)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor message ID"})
+				return
+			}
+			// Replies are ordered by _id, which follows insertion order
+			filter["_id"] = bson.M{"$gt": afterObjID}
+		}
+
+		opts := options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(int64(query.Limit + 1))
+		cursor, err := chatMessages.Find(ctx, filter, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch thread"})
+			return
+		}
+		defer cursor.Close(ctx)
+
+		var stored []models.ChatMessage
+		if err = cursor.All(ctx, &stored); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode chat messages"})
+			return
+		}
+
+		hasMore := len(stored) > query.Limit
+		if hasMore {
+			stored = stored[:query.Limit]
+		}
+
+		replies := make([]models.ChatMessageForResponse, 0, len(stored))
+		for i := range stored {
+			replies = append(replies, stored[i].ToResponse())
+		}
+
+		pagination := gin.H{
+			"limit":   query.Limit,
+			"hasMore": hasMore,
+		}
+		if len(replies) > 0 {
+			pagination["newest"] = replies[len(replies)-1].ID
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"root":       root.ToResponse(),
+			"replies":    replies,
+			"pagination": pagination,
+		})
+	}
+}
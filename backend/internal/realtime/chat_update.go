@@ -0,0 +1,342 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/auth"
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// maxReactionLength bounds the size of a reaction key in bytes
+const maxReactionLength = 32
+
+// maxReactionsPerMessage bounds how many different reactions a message has
+const maxReactionsPerMessage = 20
+
+// Reaction actions accepted in chat_react messages
+const (
+	reactionActionAdd    = "add"
+	reactionActionRemove = "remove"
+)
+
+// Errors reported back to the sender of a chat update
+var (
+	errChatMessageNotFound = errors.New("Message not found")
+	errChatMessageDeleted  = errors.New("Message has been deleted")
+	errChatUpdateForbidden = errors.New("You are not allowed to change this message")
+	errChatUpdateConflict  = errors.New("Message was changed by someone else, try again")
+	errEmptyChatContent    = errors.New("Message content cannot be empty")
+	errInvalidReaction     = errors.New("Invalid reaction")
+	errTooManyReactions    = errors.New("Message has too many different reactions")
+)
+
+// handleChatUpdate applies an edit, delete or reaction and broadcasts the
+// updated message to the room so every member sees the new state
+func (h *Hub) handleChatUpdate(message WSMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var updated models.ChatMessage
+	var err error
+	switch message.Type {
+	case MessageTypeChatEdit:
+		updated, err = h.editChatMessage(ctx, message)
+	case MessageTypeChatDelete:
+		updated, err = h.deleteChatMessage(ctx, message)
+	case MessageTypeChatReact:
+		updated, err = h.reactToChatMessage(ctx, message)
+	}
+	if err != nil {
+		h.sendToUser(message.UserID, message.RoomID, WSMessage{
+			Type:            MessageTypeError,
+			RoomID:          message.RoomID,
+			MessageID:       message.MessageID,
+			Content:         chatUpdateErrorMessage(err),
+			ClientMessageID: message.ClientMessageID,
+			Timestamp:       time.Now(),
+		})
+		return
+	}
+
+	h.broadcastToRoom(message.RoomID, WSMessage{
+		Type:            message.Type,
+		RoomID:          message.RoomID,
+		UserID:          message.UserID,
+		Username:        message.Username,
+		MessageID:       updated.ID.Hex(),
+		Sequence:        updated.Sequence,
+		ClientMessageID: message.ClientMessageID,
+		Timestamp:       time.Now(),
+		Data: map[string]interface{}{
+			"message": updated.ToResponse(),
+		},
+	}, "")
+}
+
+// chatUpdateErrorMessage returns the text shown to the client for an update error
+func chatUpdateErrorMessage(err error) string {
+	for _, known := range []error{
+		errChatMessageNotFound,
+		errChatMessageDeleted,
+		errChatUpdateForbidden,
+		errChatUpdateConflict,
+		errEmptyChatContent,
+		errInvalidReaction,
+		errTooManyReactions,
+	} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	log.Printf("Error updating chat message: %v", err)
+	return "Failed to update message"
+}
+
+// loadChatMessage fetches a chat message by ID within a room
+func (h *Hub) loadChatMessage(ctx context.Context, roomID, messageID string) (models.ChatMessage, error) {
+	objID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return models.ChatMessage{}, errChatMessageNotFound
+	}
+
+	var chatMessage models.ChatMessage
+	collection := h.mongoClient.GetCollection(database.CollectionNames.ChatMessages)
+	err = collection.FindOne(ctx, bson.M{"_id": objID, "room_id": roomID}).Decode(&chatMessage)
+	if err == mongo.ErrNoDocuments {
+		return models.ChatMessage{}, errChatMessageNotFound
+	} else if err != nil {
+		return models.ChatMessage{}, err
+	}
+	return chatMessage, nil
+}
+
+// updateChatMessage applies update to the message matched by filter and returns the new version
+func (h *Hub) updateChatMessage(ctx context.Context, filter, update bson.M) (models.ChatMessage, error) {
+	var chatMessage models.ChatMessage
+	collection := h.mongoClient.GetCollection(database.CollectionNames.ChatMessages)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&chatMessage)
+	if err == mongo.ErrNoDocuments {
+		return models.ChatMessage{}, errChatUpdateConflict
+	} else if err != nil {
+		return models.ChatMessage{}, err
+	}
+	return chatMessage, nil
+}
+
+// isRoomModerator reports whether the user moderates the room. Room creators
+// moderate their rooms; users whose role grants auth.PermModerate moderate
+// every room. Roles are read from the user, so a revoked role stops
+// counting at once.
+func (h *Hub) isRoomModerator(ctx context.Context, roomID, userID string) (bool, error) {
+	roomObjID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return false, nil
+	}
+
+	rooms := h.mongoClient.GetCollection(database.CollectionNames.Rooms)
+	err = rooms.FindOne(ctx, bson.M{"_id": roomObjID, "creator_id": userID}).Err()
+	if err == nil {
+		return true, nil
+	} else if err != mongo.ErrNoDocuments {
+		return false, err
+	}
+
+	var user models.User
+	users := h.mongoClient.GetCollection(database.CollectionNames.Users)
+	err = users.FindOne(ctx,
+		bson.M{"unique_id": userID},
+		options.FindOne().SetProjection(bson.M{"roles": 1}),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return auth.HasPermission(user.Roles, auth.PermModerate), nil
+}
+
+// editChatMessage replaces the content of the sender's own message, keeping
+// the previous version in the edit history
+func (h *Hub) editChatMessage(ctx context.Context, message WSMessage) (models.ChatMessage, error) {
+	content := strings.TrimSpace(message.Content)
+	if content == "" {
+		return models.ChatMessage{}, errEmptyChatContent
+	}
+
+	existing, err := h.loadChatMessage(ctx, message.RoomID, message.MessageID)
+	if err != nil {
+		return models.ChatMessage{}, err
+	}
+	if existing.DeletedAt != nil {
+		return models.ChatMessage{}, errChatMessageDeleted
+	}
+	if existing.UserID != message.UserID {
+		return models.ChatMessage{}, errChatUpdateForbidden
+	}
+	if existing.Content == content {
+		return existing, nil
+	}
+
+	now := time.Now()
+	// Matching on the current content makes concurrent edits fail instead of
+	// silently dropping a version from the history
+	return h.updateChatMessage(ctx,
+		bson.M{
+			"_id":        existing.ID,
+			"content":    existing.Content,
+			"deleted_at": bson.M{"$exists": false},
+		},
+		bson.M{
+			"$set": bson.M{"content": content, "edited_at": now},
+			"$push": bson.M{"edit_history": models.ChatMessageEdit{
+				Content:  existing.Content,
+				EditedAt: now,
+			}},
+		},
+	)
+}
+
+// deleteChatMessage soft-deletes a message. Authors can delete their own
+// messages and room moderators can delete any message in the room.
+func (h *Hub) deleteChatMessage(ctx context.Context, message WSMessage) (models.ChatMessage, error) {
+	existing, err := h.loadChatMessage(ctx, message.RoomID, message.MessageID)
+	if err != nil {
+		return models.ChatMessage{}, err
+	}
+	if existing.DeletedAt != nil {
+		return models.ChatMessage{}, errChatMessageDeleted
+	}
+	if existing.UserID != message.UserID {
+		isModerator, err := h.isRoomModerator(ctx, message.RoomID, message.UserID)
+		if err != nil {
+			return models.ChatMessage{}, err
+		}
+		if !isModerator {
+			return models.ChatMessage{}, errChatUpdateForbidden
+		}
+	}
+
+	// The content and its history are dropped so deleted text is gone from
+	// history and search; the tombstone keeps the thread position
+	return h.updateChatMessage(ctx,
+		bson.M{"_id": existing.ID, "deleted_at": bson.M{"$exists": false}},
+		bson.M{
+			"$set":   bson.M{"content": "", "deleted_at": time.Now(), "deleted_by": message.UserID},
+			"$unset": bson.M{"edit_history": "", "reactions": ""},
+		},
+	)
+}
+
+// reactToChatMessage adds or removes the sender's emoji reaction
+func (h *Hub) reactToChatMessage(ctx context.Context, message WSMessage) (models.ChatMessage, error) {
+	emoji, _ := message.Data["emoji"].(string)
+	if !validReaction(emoji) {
+		return models.ChatMessage{}, errInvalidReaction
+	}
+
+	action, _ := message.Data["action"].(string)
+	operator := "$addToSet"
+	switch action {
+	case "", reactionActionAdd:
+	case reactionActionRemove:
+		operator = "$pull"
+	default:
+		return models.ChatMessage{}, errInvalidReaction
+	}
+
+	existing, err := h.loadChatMessage(ctx, message.RoomID, message.MessageID)
+	if err != nil {
+		return models.ChatMessage{}, err
+	}
+	if existing.DeletedAt != nil {
+		return models.ChatMessage{}, errChatMessageDeleted
+	}
+
+	filter := bson.M{"_id": existing.ID, "deleted_at": bson.M{"$exists": false}}
+	if operator == "$addToSet" {
+		if _, ok := existing.Reactions[emoji]; !ok && len(existing.Reactions) >= maxReactionsPerMessage {
+			return models.ChatMessage{}, errTooManyReactions
+		}
+		// A new reaction only while there is room for it
+		filter["$or"] = []bson.M{
+			{"reactions." + emoji: bson.M{"$exists": true}},
+			{"$expr": bson.M{"$lt": bson.A{
+				bson.M{"$size": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$reactions", bson.M{}}}}},
+				maxReactionsPerMessage,
+			}}},
+		}
+	}
+	updated, err := h.updateChatMessage(ctx, filter, bson.M{operator: bson.M{"reactions." + emoji: message.UserID}})
+	if err != nil || operator != "$pull" || len(updated.Reactions[emoji]) > 0 {
+		return updated, err
+	}
+
+	// Drop reactions nobody uses any more, so they do not count towards the cap
+	collection := h.mongoClient.GetCollection(database.CollectionNames.ChatMessages)
+	_, err = collection.UpdateOne(ctx,
+		bson.M{"_id": existing.ID, "reactions." + emoji: bson.M{"$size": 0}},
+		bson.M{"$unset": bson.M{"reactions." + emoji: ""}},
+	)
+	delete(updated.Reactions, emoji)
+	return updated, err
+}
+
+// validReaction reports whether emoji can be used as a reaction key: a
+// single emoji, possibly built from several code points such as flags,
+// skin tones, keycaps or joined sequences. Anything else, including the dots
+// and $ that MongoDB reads as field paths and operators, is refused.
+func validReaction(emoji string) bool {
+	if emoji == "" || len(emoji) > maxReactionLength || !utf8.ValidString(emoji) {
+		return false
+	}
+	pictographs := 0
+	keycap := strings.ContainsRune(emoji, '\u20E3')
+	for _, r := range emoji {
+		switch {
+		case isEmojiPictograph(r):
+			pictographs++
+		case isEmojiModifier(r):
+		case keycap && (r == '#' || r == '*' || (r >= '0' && r <= '9')):
+			pictographs++
+		default:
+			return false
+		}
+	}
+	return pictographs > 0
+}
+
+// isEmojiPictograph reports whether r is in one of the blocks emoji are
+// drawn from
+func isEmojiPictograph(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF: // pictographs, emoticons, flags
+		return true
+	case r >= 0x2600 && r <= 0x27BF: // miscellaneous symbols and dingbats
+		return true
+	case r >= 0x2190 && r <= 0x21FF, r >= 0x2300 && r <= 0x23FF, r >= 0x2B00 && r <= 0x2BFF:
+		return true
+	}
+	switch r {
+	case 0x00A9, 0x00AE, 0x203C, 0x2049, 0x2122, 0x2139, 0x24C2, 0x25AA, 0x25AB, 0x25B6, 0x25C0, 0x3030, 0x303D, 0x3297, 0x3299:
+		return true
+	}
+	return r >= 0x25FB && r <= 0x25FE
+}
+
+// isEmojiModifier reports whether r only changes the emoji before it: joiners,
+// variation selectors, keycaps and the tags of subdivision flags
+func isEmojiModifier(r rune) bool {
+	return r == 0x200D || r == 0xFE0E || r == 0xFE0F || r == 0x20E3 || (r >= 0xE0020 && r <= 0xE007F)
+}
@@ -2,8 +2,11 @@ package realtime
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,22 +14,44 @@ import (
 	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/studyplatform/backend/pkg/auth"
 	"github.com/studyplatform/backend/pkg/database"
 	"github.com/studyplatform/backend/pkg/models"
 )
 
 // Message types for WebSocket communication
 const (
-	MessageTypeJoin        = "join"
-	MessageTypeLeave       = "leave"
-	MessageTypeChat        = "chat"
-	MessageTypeTyping      = "typing"
-	MessageTypeStopTyping  = "stop_typing"
-	MessageTypeUserOnline  = "user_online"
-	MessageTypeUserOffline = "user_offline"
-	MessageTypeError       = "error"
-	MessageTypeSuccess     = "success"
+	MessageTypeJoin         = "join"
+	MessageTypeLeave        = "leave"
+	MessageTypeChat         = "chat"
+	MessageTypeTyping       = "typing"
+	MessageTypeStopTyping   = "stop_typing"
+	MessageTypeUserOnline   = "user_online"
+	MessageTypeUserOffline  = "user_offline"
+	MessageTypeError        = "error"
+	MessageTypeSuccess      = "success"
+	MessageTypeAuth         = "auth"         // client supplies a refreshed access token in content
+	MessageTypeNotification = "notification" // a notification was created for the user
+	// MessageTypePresenceUpdate sets the connection's status (content) and
+	// announces a user's changed presence to their rooms
+	MessageTypePresenceUpdate = "presence_update"
+	// Room subscription message types
+	MessageTypeSubscribe    = "subscribe"     // client subscribes to roomId
+	MessageTypeUnsubscribe  = "unsubscribe"   // client unsubscribes from roomId
+	MessageTypeSubscribed   = "subscribed"    // subscription confirmed; data.onlineUsers lists the room
+	MessageTypeUnsubscribed = "unsubscribed"  // unsubscription confirmed
+	MessageTypeFriendUpdate = "friend_update" // a friend request was sent, accepted, rejected or removed
+	// Reliable chat delivery message types
+	MessageTypeAck            = "ack"             // client acknowledges chat messages up to sequence
+	MessageTypeResume         = "resume"          // client asks for messages after its last seen sequence
+	MessageTypeResumeComplete = "resume_complete" // replay finished; live traffic follows
+	// Chat update message types
+	MessageTypeChatEdit   = "chat_edit"   // author replaces the content of messageId
+	MessageTypeChatDelete = "chat_delete" // author or room moderator deletes messageId
+	MessageTypeChatReact  = "chat_react"  // add or remove data.emoji on messageId
 	// WebRTC signaling message types
 	MessageTypeRTCOffer     = "rtc_offer"
 	MessageTypeRTCAnswer    = "rtc_answer"
@@ -34,6 +59,49 @@ const (
 	MessageTypeStartCall    = "start_call"
 	MessageTypeEndCall      = "end_call"
 	MessageTypeCallDeclined = "call_declined"
+	MessageTypeCallState    = "call_state"   // participant updates muted, cameraOn or screenSharing in data
+	MessageTypeCallUpdated  = "call_updated" // the call roster or a participant's state changed
+	// Shared room timer message types; room moderators send the timer_*
+	// actions, data.preset names the preset of timer_start
+	MessageTypeTimerStart  = "timer_start"
+	MessageTypeTimerPause  = "timer_pause"
+	MessageTypeTimerResume = "timer_resume"
+	MessageTypeTimerSkip   = "timer_skip"
+	MessageTypeTimerStop   = "timer_stop"
+	MessageTypeTimerState  = "timer_state" // the timer changed; data.action says how and data.timer holds it
+	MessageTypeTimerTick   = "timer_tick"  // periodic data.timer with the time remaining
+)
+
+// roomMessageTypes are the room messages clients may send. Every other type
+// is only sent by the server and refused from clients.
+var roomMessageTypes = map[string]bool{
+	MessageTypeChat:         true,
+	MessageTypeChatEdit:     true,
+	MessageTypeChatDelete:   true,
+	MessageTypeChatReact:    true,
+	MessageTypeTyping:       true,
+	MessageTypeStopTyping:   true,
+	MessageTypeRTCOffer:     true,
+	MessageTypeRTCAnswer:    true,
+	MessageTypeRTCCandidate: true,
+	MessageTypeStartCall:    true,
+	MessageTypeEndCall:      true,
+	MessageTypeCallDeclined: true,
+	MessageTypeCallState:    true,
+	MessageTypeTimerStart:   true,
+	MessageTypeTimerPause:   true,
+	MessageTypeTimerResume:  true,
+	MessageTypeTimerSkip:    true,
+	MessageTypeTimerStop:    true,
+}
+
+// Close codes sent to clients when a connection is refused or terminated.
+// The 4000-4999 range is reserved for application use by RFC 6455.
+const (
+	CloseCodeUnauthorized = 4001 // missing or invalid access token
+	CloseCodeTokenExpired = 4002 // access token expired or was revoked
+	CloseCodeForbidden    = 4003 // user is not a member of the requested room
+	CloseCodeLagging      = 4008 // client fell behind; reconnect and resume
 )
 
 // WSMessage represents a WebSocket message structure
@@ -45,44 +113,139 @@ type WSMessage struct {
 	Content   string                 `json:"content,omitempty"`
 	Timestamp time.Time              `json:"timestamp"`
 	Data      map[string]interface{} `json:"data,omitempty"`
+	// MessageID and Sequence identify persisted chat messages; Sequence also
+	// carries the position for ack and resume messages
+	MessageID string `json:"messageId,omitempty"`
+	Sequence  int64  `json:"sequence,omitempty"`
+	// ClientMessageID is an optional client-generated ID echoed back so
+	// senders can match their pending messages
+	ClientMessageID string `json:"clientMessageId,omitempty"`
+	// ReplyTo is the ID of the message a chat message replies to
+	ReplyTo string `json:"replyTo,omitempty"`
 }
 
-// Client represents a WebSocket connection
+// Client represents a WebSocket connection. A connection always receives
+// its user's personal events and may subscribe to several rooms.
 type Client struct {
 	ID       string
 	UserID   string
 	Username string
-	RoomID   string
 	Conn     *websocket.Conn
 	Send     chan WSMessage
 	Hub      *Hub
+
+	// rooms holds the subscribed room IDs; guarded by Hub.mutex
+	rooms map[string]bool
+
+	token       string
+	tokenMutex  sync.RWMutex
+	jwtManager  *auth.Manager
+	revocations *auth.RevocationStore
+
+	// config holds the connection limits; limiter rate limits client messages
+	config  WSConfig
+	limiter *rateLimiter
+
+	// registered is closed once the hub has registered the client, so
+	// subscriptions are never processed before it
+	registered chan struct{}
+	// done is closed when the hub unregisters the client; Send is never
+	// closed so concurrent senders cannot panic
+	done        chan struct{}
+	closeCode   int
+	closeReason string
+
+	// status is the presence status chosen by this connection; guarded by Hub.mutex
+	status string
+
+	// Resume state: live messages are held in pending while replaying replayRoom
+	replayMutex sync.Mutex
+	replaying   bool
+	replayRoom  string
+	pending     []WSMessage
+	lastAcked   map[string]int64 // keyed by room ID
 }
 
-// Hub maintains active clients and broadcasts messages
+// Presence snapshots are exchanged between hubs so every instance can
+// answer "who is online in this room", even for clients held elsewhere
+const (
+	presenceSyncInterval = 10 * time.Second
+	presenceExpiry       = 3 * presenceSyncInterval
+)
+
+// Hub maintains active clients and broadcasts messages. Room traffic is
+// delivered to local clients directly and published through the broker so
+// other hub instances can deliver it to the clients they hold.
 type Hub struct {
-	clients     map[*Client]bool
-	broadcast   chan WSMessage
-	register    chan *Client
-	unregister  chan *Client
-	rooms       map[string]map[*Client]bool
-	mutex       sync.RWMutex
-	mongoClient *database.MongoClient
+	id            string
+	clients       map[*Client]bool
+	broadcast     chan WSMessage
+	register      chan *Client
+	unregister    chan *Client
+	subscriptions chan subscriptionRequest
+	rooms         map[string]map[*Client]bool // clients by subscribed room ID
+	users         map[string]map[*Client]bool // clients by user ID
+	mutex         sync.RWMutex
+	mongoClient   *database.MongoClient
+	broker        Broker
+
+	remotePresence map[string]*remotePresence // keyed by origin hub ID
+	presenceMutex  sync.RWMutex
+
+	metrics Metrics
+
+	// timerSessions credits room timer focus blocks to study sessions
+	timerSessions TimerSessions
+
+	chatQueues map[string]chan WSMessage // pending chat work by room ID
+	chatMutex  sync.Mutex
+}
+
+// remotePresence is the latest presence snapshot received from another hub
+type remotePresence struct {
+	entries  []PresenceEntry
+	lastSeen time.Time
 }
 
-// NewHub creates a new WebSocket hub
-func NewHub(mongoClient *database.MongoClient) *Hub {
+// NewHub creates a new WebSocket hub. A nil broker keeps all traffic in
+// process, which is sufficient for a single instance.
+func NewHub(mongoClient *database.MongoClient, broker Broker) *Hub {
+	if broker == nil {
+		broker = NewMemoryBroker()
+	}
+
 	return &Hub{
-		clients:     make(map[*Client]bool),
-		broadcast:   make(chan WSMessage, 1000), // Increased capacity
-		register:    make(chan *Client, 100),    // Increased capacity
-		unregister:  make(chan *Client, 100),    // Increased capacity
-		rooms:       make(map[string]map[*Client]bool),
-		mongoClient: mongoClient,
+		id:             generateClientID(),
+		clients:        make(map[*Client]bool),
+		broadcast:      make(chan WSMessage, 1000), // Increased capacity
+		register:       make(chan *Client, 100),    // Increased capacity
+		unregister:     make(chan *Client, 100),    // Increased capacity
+		subscriptions:  make(chan subscriptionRequest, 100),
+		rooms:          make(map[string]map[*Client]bool),
+		users:          make(map[string]map[*Client]bool),
+		mongoClient:    mongoClient,
+		broker:         broker,
+		remotePresence: make(map[string]*remotePresence),
+		chatQueues:     make(map[string]chan WSMessage),
 	}
 }
 
 // Run starts the hub
 func (h *Hub) Run() {
+	envelopes, err := h.broker.Subscribe(context.Background())
+	if err != nil {
+		log.Printf("Failed to subscribe to realtime broker: %v", err)
+	}
+
+	// Announce ourselves so running instances reply with their snapshots
+	h.publishPresence()
+
+	go h.runTimers()
+	go h.runCallSweeps()
+
+	presenceTicker := time.NewTicker(presenceSyncInterval)
+	defer presenceTicker.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
@@ -91,226 +254,482 @@ func (h *Hub) Run() {
 		case client := <-h.unregister:
 			h.unregisterClient(client)
 
+		case request := <-h.subscriptions:
+			if request.subscribe {
+				h.subscribeClient(request.client, request.roomID)
+			} else {
+				h.unsubscribeClient(request.client, request.roomID)
+			}
+
 		case message := <-h.broadcast:
 			h.broadcastMessage(message)
+
+		case envelope, ok := <-envelopes:
+			if !ok {
+				// Broker closed; keep serving local clients
+				envelopes = nil
+				continue
+			}
+			h.handleEnvelope(envelope)
+
+		case <-presenceTicker.C:
+			h.publishPresence()
+			h.expireRemotePresence()
 		}
 	}
 }
 
-// registerClient registers a new client
+// Close announces that this hub holds no clients and closes the broker
+func (h *Hub) Close() error {
+	h.publish(Envelope{Kind: EnvelopeKindPresence, Presence: []PresenceEntry{}})
+	return h.broker.Close()
+}
+
+// registerClient registers a new client along with the rooms it was opened for
 func (h *Hub) registerClient(client *Client) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+	before := h.UserPresence(client.UserID)
 
+	h.mutex.Lock()
 	h.clients[client] = true
+	if h.users[client.UserID] == nil {
+		h.users[client.UserID] = make(map[*Client]bool)
+	}
+	h.users[client.UserID][client] = true
 
-	if h.rooms[client.RoomID] == nil {
-		h.rooms[client.RoomID] = make(map[*Client]bool)
+	if client.rooms == nil {
+		client.rooms = make(map[string]bool)
 	}
-	h.rooms[client.RoomID][client] = true
+	rooms := make([]string, 0, len(client.rooms))
+	for roomID := range client.rooms {
+		h.addToRoom(client, roomID)
+		rooms = append(rooms, roomID)
+	}
+	h.mutex.Unlock()
+
+	for _, roomID := range rooms {
+		h.announceJoin(client, roomID)
+	}
+	if client.registered != nil {
+		close(client.registered)
+	}
+	h.presenceChanged(client.UserID, client.Username, before, nil)
+	log.Printf("Client %s connected with %d room(s)", client.Username, len(rooms))
+}
+
+// addToRoom indexes the client under a room; callers hold h.mutex
+func (h *Hub) addToRoom(client *Client, roomID string) {
+	client.rooms[roomID] = true
+	if h.rooms[roomID] == nil {
+		h.rooms[roomID] = make(map[*Client]bool)
+	}
+	h.rooms[roomID][client] = true
+}
 
-	// Notify other clients in the room that a user joined
-	joinMessage := WSMessage{
+// removeFromRoom drops the client from a room's index; callers hold h.mutex
+func (h *Hub) removeFromRoom(client *Client, roomID string) {
+	delete(client.rooms, roomID)
+	if room, ok := h.rooms[roomID]; ok {
+		delete(room, client)
+		if len(room) == 0 {
+			delete(h.rooms, roomID)
+		}
+	}
+}
+
+// announceJoin tells the other clients in a room that a user joined
+func (h *Hub) announceJoin(client *Client, roomID string) {
+	h.broadcastToRoom(roomID, WSMessage{
 		Type:      MessageTypeUserOnline,
-		RoomID:    client.RoomID,
+		RoomID:    roomID,
 		UserID:    client.UserID,
 		Username:  client.Username,
 		Timestamp: time.Now(),
-	}
+	}, client.UserID)
+}
 
-	h.broadcastToRoom(client.RoomID, joinMessage, client)
-	log.Printf("Client %s joined room %s", client.Username, client.RoomID)
+// announceLeave tells the clients in a room that a user left
+func (h *Hub) announceLeave(client *Client, roomID string) {
+	h.broadcastToRoom(roomID, WSMessage{
+		Type:      MessageTypeUserOffline,
+		RoomID:    roomID,
+		UserID:    client.UserID,
+		Username:  client.Username,
+		Timestamp: time.Now(),
+	}, "")
 }
 
 // unregisterClient unregisters a client
 func (h *Hub) unregisterClient(client *Client) {
+	h.disconnectClient(client, websocket.CloseNormalClosure, "")
+}
+
+// disconnectClient removes a client from every room and tells its writer to
+// close the connection with the given close code
+func (h *Hub) disconnectClient(client *Client, code int, reason string) {
+	before := h.UserPresence(client.UserID)
+
 	h.mutex.Lock()
-	defer h.mutex.Unlock()
+	if _, ok := h.clients[client]; !ok {
+		h.mutex.Unlock()
+		return
+	}
 
-	if _, ok := h.clients[client]; ok {
-		delete(h.clients, client)
-		close(client.Send)
+	delete(h.clients, client)
+	client.closeCode = code
+	client.closeReason = reason
+	close(client.done)
 
-		if room, ok := h.rooms[client.RoomID]; ok {
-			delete(room, client)
-			if len(room) == 0 {
-				delete(h.rooms, client.RoomID)
-			}
+	if connections, ok := h.users[client.UserID]; ok {
+		delete(connections, client)
+		if len(connections) == 0 {
+			delete(h.users, client.UserID)
 		}
+	}
 
-		// Notify other clients in the room that a user left
-		leaveMessage := WSMessage{
-			Type:      MessageTypeUserOffline,
-			RoomID:    client.RoomID,
-			UserID:    client.UserID,
-			Username:  client.Username,
-			Timestamp: time.Now(),
-		}
+	rooms := make([]string, 0, len(client.rooms))
+	for roomID := range client.rooms {
+		rooms = append(rooms, roomID)
+	}
+	for _, roomID := range rooms {
+		h.removeFromRoom(client, roomID)
+	}
+	h.mutex.Unlock()
 
-		h.broadcastToRoom(client.RoomID, leaveMessage, nil)
-		log.Printf("Client %s left room %s", client.Username, client.RoomID)
+	for _, roomID := range rooms {
+		h.announceLeave(client, roomID)
+	}
+	h.presenceChanged(client.UserID, client.Username, before, rooms)
+	for _, roomID := range rooms {
+		h.leaveCallIfGone(client.UserID, client.Username, roomID)
 	}
+	log.Printf("Client %s disconnected", client.Username)
 }
 
 // broadcastMessage broadcasts a message to appropriate clients
 func (h *Hub) broadcastMessage(message WSMessage) {
 	switch message.Type {
-	case MessageTypeChat:
-		// Save chat message to database
-		h.saveChatMessage(message)
-		// Broadcast to room
-		h.broadcastToRoom(message.RoomID, message, nil)
+	case MessageTypeChat, MessageTypeChatEdit, MessageTypeChatDelete, MessageTypeChatReact:
+		// Saving and updating messages waits on MongoDB, so it runs off the
+		// hub's loop on the room's chat worker, which keeps sequence order
+		h.queueChat(message)
 	case MessageTypeTyping, MessageTypeStopTyping:
 		// Broadcast typing indicators to room (except sender)
-		h.broadcastToRoom(message.RoomID, message, h.findClientByUserID(message.UserID))
+		h.broadcastToRoom(message.RoomID, message, message.UserID)
 	case MessageTypeRTCOffer, MessageTypeRTCAnswer, MessageTypeRTCCandidate:
 		// Handle WebRTC signaling messages
 		h.handleRTCSignaling(message)
-	case MessageTypeStartCall, MessageTypeEndCall, MessageTypeCallDeclined:
+	case MessageTypeStartCall, MessageTypeEndCall, MessageTypeCallState:
+		// Track the call session and broadcast its roster
+		h.handleCallMessage(message)
+	case MessageTypeTimerStart, MessageTypeTimerPause, MessageTypeTimerResume, MessageTypeTimerSkip, MessageTypeTimerStop:
+		// Apply the moderator's timer action and broadcast the new state. It
+		// waits on MongoDB, so it runs off the hub's loop; concurrent actions
+		// are ordered by the timer's revision.
+		go h.handleTimerMessage(message)
+	case MessageTypeCallDeclined:
 		// Broadcast call events to room
-		h.broadcastToRoom(message.RoomID, message, nil)
+		h.broadcastToRoom(message.RoomID, message, "")
 	default:
-		h.broadcastToRoom(message.RoomID, message, nil)
+		// readPump only passes roomMessageTypes on
+		log.Printf("Dropping unsupported message type %q from user %s", message.Type, message.UserID)
 	}
 }
 
-// broadcastToRoom broadcasts a message to all clients in a specific room
-func (h *Hub) broadcastToRoom(roomID string, message WSMessage, excludeClient *Client) {
+// broadcastToRoom broadcasts a message to all clients in a specific room on
+// every hub instance, optionally skipping the connections of one user
+func (h *Hub) broadcastToRoom(roomID string, message WSMessage, excludeUserID string) {
+	envelope := Envelope{
+		Kind:          EnvelopeKindRoom,
+		RoomID:        roomID,
+		ExcludeUserID: excludeUserID,
+		Message:       message,
+	}
+
+	h.deliver(envelope)
+	h.publish(envelope)
+}
+
+// sendToUser sends a message to a user's connections on every hub instance.
+// An empty roomID reaches all of them; otherwise only those subscribed to the room.
+func (h *Hub) sendToUser(userID, roomID string, message WSMessage) {
+	envelope := Envelope{
+		Kind:         EnvelopeKindUser,
+		RoomID:       roomID,
+		TargetUserID: userID,
+		Message:      message,
+	}
+
+	h.deliver(envelope)
+	h.publish(envelope)
+}
+
+// sendToClient sends a message to a single local client if it is still registered
+func (h *Hub) sendToClient(client *Client, message WSMessage) bool {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
-	if room, ok := h.rooms[roomID]; ok {
-		for client := range room {
-			if excludeClient != nil && client == excludeClient {
-				continue
-			}
-			select {
-			case client.Send <- message:
-			default:
-				close(client.Send)
-				delete(h.clients, client)
-				delete(room, client)
-			}
-		}
+	if !h.clients[client] {
+		return false
 	}
+	return client.enqueue(message)
 }
 
-// findClientByUserID finds a client by user ID
-func (h *Hub) findClientByUserID(userID string) *Client {
+// deliver sends an envelope's message to the matching local clients. Clients
+// whose send buffer is full are disconnected with CloseCodeLagging so they
+// reconnect and resume from their last acknowledged sequence.
+func (h *Hub) deliver(envelope Envelope) {
+	var slowClients []*Client
+
 	h.mutex.RLock()
-	defer h.mutex.RUnlock()
+	var targets map[*Client]bool
+	switch envelope.Kind {
+	case EnvelopeKindRoom:
+		targets = h.rooms[envelope.RoomID]
+	case EnvelopeKindUser:
+		targets = h.users[envelope.TargetUserID]
+	}
 
-	for client := range h.clients {
-		if client.UserID == userID {
-			return client
+	for client := range targets {
+		if envelope.ExcludeUserID != "" && client.UserID == envelope.ExcludeUserID {
+			continue
+		}
+		if envelope.Kind == EnvelopeKindUser && envelope.RoomID != "" && !client.rooms[envelope.RoomID] {
+			continue
+		}
+
+		if !client.enqueue(envelope.Message) {
+			slowClients = append(slowClients, client)
 		}
 	}
-	return nil
+	h.mutex.RUnlock()
+
+	for _, client := range slowClients {
+		log.Printf("Disconnecting slow client %s (%s)", client.Username, client.ID)
+		h.metrics.Dropped.Add(1)
+		h.metrics.SlowDisconnected.Add(1)
+		h.disconnectClient(client, CloseCodeLagging, "Connection fell behind, resume to catch up")
+	}
 }
 
-// saveChatMessage saves a chat message to the database
-func (h *Hub) saveChatMessage(message WSMessage) {
+// publish sends an envelope to the other hub instances
+func (h *Hub) publish(envelope Envelope) {
+	envelope.Origin = h.id
+	envelope.CreatedAt = time.Now()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := h.mongoClient.GetCollection(database.CollectionNames.ChatMessages)
+	if err := h.broker.Publish(ctx, envelope); err != nil {
+		log.Printf("Error publishing %s envelope: %v", envelope.Kind, err)
+	}
+}
 
-	chatMessage := bson.M{
-		"room_id":    message.RoomID,
-		"user_id":    message.UserID,
-		"username":   message.Username,
-		"content":    message.Content,
-		"timestamp":  message.Timestamp,
-		"created_at": time.Now(),
+// handleEnvelope processes an envelope received from the broker
+func (h *Hub) handleEnvelope(envelope Envelope) {
+	// Our own traffic was already delivered locally
+	if envelope.Origin == h.id {
+		return
 	}
 
-	_, err := collection.InsertOne(ctx, chatMessage)
-	if err != nil {
-		log.Printf("Error saving chat message: %v", err)
+	switch envelope.Kind {
+	case EnvelopeKindRoom, EnvelopeKindUser:
+		h.deliver(envelope)
+	case EnvelopeKindPresence:
+		h.presenceMutex.Lock()
+		_, known := h.remotePresence[envelope.Origin]
+		h.remotePresence[envelope.Origin] = &remotePresence{
+			entries:  envelope.Presence,
+			lastSeen: time.Now(),
+		}
+		h.presenceMutex.Unlock()
+
+		// Bring newly started instances up to date without waiting for the next sync
+		if !known {
+			h.publishPresence()
+		}
 	}
 }
 
-// handleRTCSignaling handles WebRTC signaling messages
-func (h *Hub) handleRTCSignaling(message WSMessage) {
-	// Extract target user ID from message data
-	if targetUserID, ok := message.Data["targetUserId"].(string); ok {
-		targetClient := h.findClientByUserID(targetUserID)
-		if targetClient != nil {
-			select {
-			case targetClient.Send <- message:
-			default:
-				log.Printf("Failed to send RTC message to user %s", targetUserID)
-			}
+// publishPresence shares this hub's connected users with the other instances
+func (h *Hub) publishPresence() {
+	h.publish(Envelope{
+		Kind:     EnvelopeKindPresence,
+		Presence: h.localPresence(),
+	})
+}
+
+// expireRemotePresence forgets snapshots from hubs that stopped reporting
+func (h *Hub) expireRemotePresence() {
+	h.presenceMutex.Lock()
+	defer h.presenceMutex.Unlock()
+
+	cutoff := time.Now().Add(-presenceExpiry)
+	for origin, presence := range h.remotePresence {
+		if presence.lastSeen.Before(cutoff) {
+			delete(h.remotePresence, origin)
 		}
-	} else {
-		// If no specific target, broadcast to room (for group calls)
-		h.broadcastToRoom(message.RoomID, message, h.findClientByUserID(message.UserID))
 	}
 }
 
-// JWTClaims represents the claims in a JWT token
-type JWTClaims struct {
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
-	Exp      int64  `json:"exp"`
-}
+// localPresence lists the users connected to this hub, one entry per room and
+// user plus one room-less entry per user
+func (h *Hub) localPresence() []PresenceEntry {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
 
-// validateJWTToken validates a JWT token and returns the claims
-func validateJWTToken(tokenString string) (*JWTClaims, error) {
-	// For development, extract user info from token without verification
-	// In production, use proper JWT validation
+	entries := []PresenceEntry{}
+
+	// One room-less entry per user covers connections without subscriptions
+	for userID, connections := range h.users {
+		entry := PresenceEntry{UserID: userID, Status: PresenceAway}
+		for client := range connections {
+			entry.Username = client.Username
+			entry.Status = morePresent(entry.Status, clientStatus(client))
+		}
+		entries = append(entries, entry)
+	}
+
+	for roomID, room := range h.rooms {
+		seen := make(map[string]int)
+		for client := range room {
+			if i, ok := seen[client.UserID]; ok {
+				entries[i].Status = morePresent(entries[i].Status, clientStatus(client))
+				continue
+			}
+			seen[client.UserID] = len(entries)
+			entries = append(entries, PresenceEntry{
+				RoomID:   roomID,
+				UserID:   client.UserID,
+				Username: client.Username,
+				Status:   clientStatus(client),
+			})
+		}
+	}
+	return entries
+}
 
-	// Simple token parsing - extract user info from the token
-	// This is a temporary solution to get WebSocket working
-	// TODO: Implement proper JWT validation
+// OnlineUsers returns the users connected to a room across all hub instances
+func (h *Hub) OnlineUsers(roomID string) []PresenceEntry {
+	users := []PresenceEntry{}
+	seen := make(map[string]int)
+	add := func(entry PresenceEntry) {
+		if entry.RoomID != roomID {
+			return
+		}
+		if i, ok := seen[entry.UserID]; ok {
+			users[i].Status = morePresent(users[i].Status, entry.Status)
+			return
+		}
+		seen[entry.UserID] = len(users)
+		users = append(users, entry)
+	}
 
-	// For now, return a valid user to allow connection
-	claims := &JWTClaims{
-		UserID:   "user_123", // This should come from actual token parsing
-		Username: "user",     // This should come from actual token parsing
-		Exp:      time.Now().Add(24 * time.Hour).Unix(),
+	for _, entry := range h.localPresence() {
+		add(entry)
 	}
 
-	return claims, nil
+	h.presenceMutex.RLock()
+	defer h.presenceMutex.RUnlock()
+
+	cutoff := time.Now().Add(-presenceExpiry)
+	for _, presence := range h.remotePresence {
+		if presence.lastSeen.Before(cutoff) {
+			continue
+		}
+		for _, entry := range presence.entries {
+			add(entry)
+		}
+	}
+	return users
 }
 
-// WebSocket upgrader
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins in development
-	},
+// handleRTCSignaling handles WebRTC signaling messages
+func (h *Hub) handleRTCSignaling(message WSMessage) {
+	// Extract target user ID from message data
+	if targetUserID, ok := message.Data["targetUserId"].(string); ok {
+		if !h.userInRoom(targetUserID, message.RoomID) {
+			h.sendToUser(message.UserID, message.RoomID, WSMessage{
+				Type:      MessageTypeError,
+				RoomID:    message.RoomID,
+				Content:   "Signaling target is not in this room",
+				Timestamp: time.Now(),
+			})
+			return
+		}
+		h.sendToUser(targetUserID, message.RoomID, message)
+	} else {
+		// If no specific target, broadcast to room (for group calls)
+		h.broadcastToRoom(message.RoomID, message, message.UserID)
+	}
 }
 
 // WebSocketHandler handles WebSocket connections
-func WebSocketHandler(hub *Hub) gin.HandlerFunc {
+func WebSocketHandler(hub *Hub, jwtManager *auth.Manager, revocations *auth.RevocationStore, config WSConfig) gin.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			if config.CheckOrigin(r) {
+				return true
+			}
+			hub.metrics.OriginRejected.Add(1)
+			log.Printf("Rejected WebSocket handshake from origin %q", r.Header.Get("Origin"))
+			return false
+		},
+		// Echo the token marker back so browsers accept token-in-subprotocol handshakes
+		Subprotocols: []string{tokenSubprotocol},
+	}
+
 	return func(c *gin.Context) {
-		// Get room ID from query parameter
+		// An optional room to subscribe to right away
 		roomID := c.Query("roomId")
-		if roomID == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Room ID required"})
-			return
-		}
 
-		// For development, allow connection without complex auth
-		userID := "dev_user"
-		username := "DevUser"
+		token := extractToken(c.Request)
 
-		// Upgrade HTTP connection to WebSocket
+		// Upgrade HTTP connection to WebSocket. Authentication failures are
+		// reported with a close code since browsers hide handshake statuses.
 		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
 			log.Printf("WebSocket upgrade error: %v", err)
 			return
 		}
 
+		claims, code, err := authenticate(jwtManager, revocations, token)
+		if err != nil {
+			log.Printf("WebSocket authentication failed: %v", err)
+			rejectConnection(conn, code, "Invalid or expired token")
+			return
+		}
+
+		rooms := make(map[string]bool)
+		if roomID != "" {
+			allowed, err := userCanAccessRoom(hub.mongoClient, roomID, claims.UserID)
+			if err != nil {
+				log.Printf("WebSocket room access check failed: %v", err)
+				rejectConnection(conn, websocket.CloseInternalServerErr, "Failed to verify room access")
+				return
+			}
+			if !allowed {
+				rejectConnection(conn, CloseCodeForbidden, "Access denied to this room")
+				return
+			}
+			rooms[roomID] = true
+		}
+
 		// Create new client
 		client := &Client{
-			ID:       generateClientID(),
-			UserID:   userID,
-			Username: username,
-			RoomID:   roomID,
-			Conn:     conn,
-			Send:     make(chan WSMessage, 256),
-			Hub:      hub,
+			ID:          generateClientID(),
+			UserID:      claims.UserID,
+			Username:    claims.Username,
+			rooms:       rooms,
+			Conn:        conn,
+			Send:        make(chan WSMessage, 256),
+			Hub:         hub,
+			token:       token,
+			jwtManager:  jwtManager,
+			revocations: revocations,
+			config:      config,
+			limiter:     newRateLimiter(config, time.Now),
+			registered:  make(chan struct{}),
+			done:        make(chan struct{}),
 		}
 
 		// Register client with hub
@@ -322,6 +741,35 @@ func WebSocketHandler(hub *Hub) gin.HandlerFunc {
 	}
 }
 
+// checkToken re-validates the client's access token. It returns a close
+// code and false when the connection must be terminated.
+func (c *Client) checkToken() (int, bool) {
+	c.tokenMutex.RLock()
+	token := c.token
+	c.tokenMutex.RUnlock()
+
+	if _, err := validateAccessToken(c.jwtManager, c.revocations, token); err != nil {
+		return closeCodeForTokenError(err), false
+	}
+	return 0, true
+}
+
+// refreshToken replaces the connection's token with a fresh one for the same user
+func (c *Client) refreshToken(token string) error {
+	claims, err := validateAccessToken(c.jwtManager, c.revocations, token)
+	if err != nil {
+		return err
+	}
+	if claims.UserID != c.UserID {
+		return errors.New("token belongs to a different user")
+	}
+
+	c.tokenMutex.Lock()
+	c.token = token
+	c.tokenMutex.Unlock()
+	return nil
+}
+
 // readPump handles reading messages from WebSocket
 func (c *Client) readPump() {
 	defer func() {
@@ -329,7 +777,7 @@ func (c *Client) readPump() {
 		c.Conn.Close()
 	}()
 
-	c.Conn.SetReadLimit(512)
+	c.Conn.SetReadLimit(c.config.MaxMessageBytes)
 	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -340,43 +788,116 @@ func (c *Client) readPump() {
 		var message WSMessage
 		err := c.Conn.ReadJSON(&message)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				log.Printf("Closing connection for user %s: message larger than %d bytes", c.UserID, c.config.MaxMessageBytes)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			break
 		}
 
+		if !c.checkLimits(message) {
+			continue
+		}
+
+		// Connection-level messages are handled here and never broadcast
+		switch message.Type {
+		case MessageTypeAuth:
+			c.handleAuthMessage(message.Content)
+			continue
+		case MessageTypeSubscribe:
+			c.handleSubscribe(message.RoomID)
+			continue
+		case MessageTypeUnsubscribe:
+			c.Hub.subscriptions <- subscriptionRequest{client: c, roomID: message.RoomID}
+			continue
+		case MessageTypeAck:
+			if roomID, ok := c.roomFor(message.RoomID); ok {
+				c.handleAck(roomID, message.Sequence)
+			}
+			continue
+		case MessageTypeResume:
+			if roomID, ok := c.requireRoom(message.RoomID); ok {
+				c.handleResume(roomID, message.Sequence)
+			}
+			continue
+		case MessageTypePresenceUpdate:
+			if !validClientStatus(message.Content) {
+				c.Hub.sendToClient(c, WSMessage{Type: MessageTypeError, Content: "Invalid presence status", Timestamp: time.Now()})
+				continue
+			}
+			c.Hub.setClientStatus(c, message.Content)
+			continue
+		}
+
+		// Everything else is room traffic; types only the server sends are refused
+		if !roomMessageTypes[message.Type] {
+			c.Hub.sendToClient(c, WSMessage{
+				Type:            MessageTypeError,
+				RoomID:          message.RoomID,
+				Content:         "Unsupported message type",
+				ClientMessageID: message.ClientMessageID,
+				Timestamp:       time.Now(),
+				Data:            map[string]interface{}{"messageType": message.Type},
+			})
+			continue
+		}
+		roomID, ok := c.requireRoom(message.RoomID)
+		if !ok {
+			continue
+		}
+		message.RoomID = roomID
+
 		// Set message metadata BEFORE sending to broadcast channel
 		message.UserID = c.UserID
 		message.Username = c.Username
-		message.RoomID = c.RoomID
+		message.RoomID = roomID
 		message.Timestamp = time.Now()
 
-		// Send message to hub for broadcasting
+		// Send message to hub for broadcasting, applying backpressure when the
+		// hub is busy and telling the sender if the message was not accepted
 		select {
 		case c.Hub.broadcast <- message:
-		default:
+		case <-time.After(5 * time.Second):
+			c.Hub.metrics.Dropped.Add(1)
+			c.Hub.sendToClient(c, limitError(message, ErrorCodeServerBusy, "Server busy, message not delivered", nil))
 		}
 	}
 }
 
+// handleAuthMessage swaps in a refreshed access token and reports the outcome
+func (c *Client) handleAuthMessage(token string) {
+	reply := WSMessage{
+		Type:      MessageTypeSuccess,
+		Content:   "Token refreshed",
+		Timestamp: time.Now(),
+	}
+	if err := c.refreshToken(token); err != nil {
+		reply.Type = MessageTypeError
+		reply.Content = "Invalid access token"
+	}
+
+	c.Hub.sendToClient(c, reply)
+}
+
 // writePump handles writing messages to WebSocket
 func (c *Client) writePump() {
 	ticker := time.NewTicker(54 * time.Second)
+	tokenTicker := time.NewTicker(tokenCheckInterval)
 	defer func() {
 		ticker.Stop()
+		tokenTicker.Stop()
 		c.Conn.Close()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case <-c.done:
+			c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason), time.Now().Add(10*time.Second))
+			return
 
+		case message := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := c.Conn.WriteJSON(message); err != nil {
 				log.Printf("WebSocket write error: %v", err)
 				return
@@ -387,6 +908,18 @@ func (c *Client) writePump() {
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+
+		case <-tokenTicker.C:
+			// Disconnect clients whose token expired since the handshake
+			if code, ok := c.checkToken(); !ok {
+				log.Printf("Closing connection for user %s: access token no longer valid", c.UserID)
+				reason := "Access token revoked"
+				if code == CloseCodeTokenExpired {
+					reason = "Access token expired"
+				}
+				c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(10*time.Second))
+				return
+			}
 		}
 	}
 }
@@ -406,52 +939,168 @@ func GetRoomChatHistory(mongoClient *database.MongoClient) gin.HandlerFunc {
 			return
 		}
 
-		// Verify user has access to the room
-		rooms := mongoClient.GetCollection(database.CollectionNames.Rooms)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		userIDStr := userID.(string)
-		userObjID, _ := primitive.ObjectIDFromHex(userIDStr)
-		roomObjID, err := primitive.ObjectIDFromHex(roomID)
-		if err != nil {
+		if !primitive.IsValidObjectID(roomID) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
 			return
 		}
 
-		var room models.Room
-		filter := bson.M{
-			"_id": roomObjID,
-			"$or": []bson.M{
-				{"creator_id": userObjID},
-				{"participants": userIDStr},
-			},
+		// Verify user has access to the room
+		allowed, err := userCanAccessRoom(mongoClient, roomID, userID.(string))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify room access"})
+			return
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this room"})
+			return
 		}
 
-		err = rooms.FindOne(ctx, filter).Decode(&room)
+		query, err := parseHistoryQuery(c)
 		if err != nil {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this room"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
 		// Get chat messages
 		chatMessages := mongoClient.GetCollection(database.CollectionNames.ChatMessages)
 
-		cursor, err := chatMessages.Find(ctx, bson.M{"room_id": roomID}, nil)
+		filter := bson.M{"room_id": roomID}
+		if query.UserID != "" {
+			filter["user_id"] = query.UserID
+		}
+		if query.Search != "" {
+			filter["$text"] = bson.M{"$search": query.Search}
+		}
+
+		// Resolve the cursor message so pagination is stable on equal timestamps
+		ascending := false
+		anchorID := query.Before
+		if query.After != "" {
+			ascending = true
+			anchorID = query.After
+		}
+		if anchorID != "" {
+			anchorObjID, err := primitive.ObjectIDFromHex(anchorID)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor message ID"})
+				return
+			}
+
+			var anchor models.ChatMessage
+			err = chatMessages.FindOne(ctx, bson.M{"_id": anchorObjID, "room_id": roomID}).Decode(&anchor)
+			if err == mongo.ErrNoDocuments {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Cursor message not found in this room"})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat history"})
+				return
+			}
+
+			op := "$lt"
+			if ascending {
+				op = "$gt"
+			}
+			filter["$or"] = []bson.M{
+				{"timestamp": bson.M{op: anchor.Timestamp}},
+				{"timestamp": anchor.Timestamp, "_id": bson.M{op: anchor.ID}},
+			}
+		}
+
+		direction := -1
+		if ascending {
+			direction = 1
+		}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "timestamp", Value: direction}, {Key: "_id", Value: direction}}).
+			SetLimit(int64(query.Limit + 1))
+
+		cursor, err := chatMessages.Find(ctx, filter, opts)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat history"})
 			return
 		}
 		defer cursor.Close(ctx)
 
-		var messages []bson.M
-		if err = cursor.All(ctx, &messages); err != nil {
+		var stored []models.ChatMessage
+		if err = cursor.All(ctx, &stored); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode chat messages"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"messages": messages})
+		hasMore := len(stored) > query.Limit
+		if hasMore {
+			stored = stored[:query.Limit]
+		}
+
+		// Always respond newest first
+		if ascending {
+			for left, right := 0, len(stored)-1; left < right; left, right = left+1, right-1 {
+				stored[left], stored[right] = stored[right], stored[left]
+			}
+		}
+
+		messages := make([]models.ChatMessageForResponse, 0, len(stored))
+		for i := range stored {
+			messages = append(messages, stored[i].ToResponse())
+		}
+
+		pagination := gin.H{
+			"limit":   query.Limit,
+			"hasMore": hasMore,
+		}
+		if len(messages) > 0 {
+			pagination["newest"] = messages[0].ID
+			pagination["oldest"] = messages[len(messages)-1].ID
+		}
+
+		c.JSON(http.StatusOK, gin.H{"messages": messages, "pagination": pagination})
+	}
+}
+
+// Chat history page sizes
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// historyQuery holds the query parameters accepted by GetRoomChatHistory
+type historyQuery struct {
+	Before string // return messages older than this message ID
+	After  string // return messages newer than this message ID
+	Limit  int
+	Search string // full-text search across message content
+	UserID string // only messages by this author
+}
+
+// parseHistoryQuery reads and validates chat history query parameters
+func parseHistoryQuery(c *gin.Context) (historyQuery, error) {
+	query := historyQuery{
+		Before: c.Query("before"),
+		After:  c.Query("after"),
+		Limit:  defaultHistoryLimit,
+		Search: strings.TrimSpace(c.Query("q")),
+		UserID: c.Query("userId"),
+	}
+
+	if query.Before != "" && query.After != "" {
+		return query, errors.New("Use either before or after, not both")
 	}
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return query, errors.New("Invalid limit")
+		}
+		if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+		query.Limit = limit
+	}
+
+	return query, nil
 }
 
 // GetOnlineUsersInRoom returns list of online users in a room
@@ -469,18 +1118,7 @@ func GetOnlineUsersInRoom(hub *Hub) gin.HandlerFunc {
 			return
 		}
 
-		hub.mutex.RLock()
-		defer hub.mutex.RUnlock()
-
-		var onlineUsers []map[string]interface{}
-		if room, ok := hub.rooms[roomID]; ok {
-			for client := range room {
-				onlineUsers = append(onlineUsers, map[string]interface{}{
-					"userId":   client.UserID,
-					"username": client.Username,
-				})
-			}
-		}
+		onlineUsers := hub.OnlineUsers(roomID)
 
 		c.JSON(http.StatusOK, gin.H{"onlineUsers": onlineUsers})
 	}
@@ -0,0 +1,38 @@
+package realtime
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newHistoryContext(rawQuery string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/realtime/chat/room?"+rawQuery, nil)
+	return c
+}
+
+func TestParseHistoryQuery(t *testing.T) {
+	query, err := parseHistoryQuery(newHistoryContext(""))
+	require.NoError(t, err)
+	assert.Equal(t, defaultHistoryLimit, query.Limit)
+
+	query, err = parseHistoryQuery(newHistoryContext("limit=1000&q=+exam+&userId=u1&before=abc"))
+	require.NoError(t, err)
+	assert.Equal(t, maxHistoryLimit, query.Limit)
+	assert.Equal(t, "exam", query.Search)
+	assert.Equal(t, "u1", query.UserID)
+	assert.Equal(t, "abc", query.Before)
+
+	_, err = parseHistoryQuery(newHistoryContext("limit=0"))
+	assert.Error(t, err)
+
+	_, err = parseHistoryQuery(newHistoryContext("limit=ten"))
+	assert.Error(t, err)
+
+	_, err = parseHistoryQuery(newHistoryContext("before=a&after=b"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,263 @@
+package realtime
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Defaults used when the corresponding environment variable is unset
+const (
+	defaultMaxMessageBytes = 64 * 1024 // room for SDP offers and long chat messages
+	defaultMaxChatLength   = 4000      // characters
+)
+
+// Error codes sent in data.code of error messages
+const (
+	ErrorCodeRateLimited    = "rate_limited"
+	ErrorCodeMessageTooLong = "message_too_long"
+	ErrorCodeServerBusy     = "server_busy"
+)
+
+// Rate limit categories for client messages
+const (
+	rateCategoryChat      = "chat"
+	rateCategoryTyping    = "typing"
+	rateCategorySignaling = "signaling"
+	rateCategoryControl   = "control"
+)
+
+// RateLimit configures a token bucket: Burst messages at once, refilled at
+// PerSecond messages per second. A zero PerSecond disables the limit.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// WSConfig holds the WebSocket connection limits
+type WSConfig struct {
+	MaxMessageBytes int64 // frames larger than this close the connection
+	MaxChatLength   int   // longest chat message content, in characters
+	Chat            RateLimit
+	Typing          RateLimit
+	Signaling       RateLimit
+	Control         RateLimit // subscriptions, resume, acks, presence and anything else
+	AllowedOrigins  []string  // browser origins allowed to connect; "*" allows all
+}
+
+// DefaultWSConfig returns the limits used when nothing is configured
+func DefaultWSConfig() WSConfig {
+	return WSConfig{
+		MaxMessageBytes: defaultMaxMessageBytes,
+		MaxChatLength:   defaultMaxChatLength,
+		Chat:            RateLimit{PerSecond: 2, Burst: 10},
+		Typing:          RateLimit{PerSecond: 2, Burst: 5},
+		Signaling:       RateLimit{PerSecond: 20, Burst: 100}, // ICE candidates arrive in bursts
+		Control:         RateLimit{PerSecond: 5, Burst: 60},   // clients subscribe to all their rooms on connect
+	}
+}
+
+// LoadWSConfig reads WS_MAX_MESSAGE_BYTES, WS_MAX_CHAT_LENGTH and the
+// WS_{CHAT,TYPING,SIGNALING,CONTROL}_{RATE,BURST} rate limits from the environment.
+// Allowed origins are shared with the CORS configuration.
+func LoadWSConfig(allowedOrigins []string) WSConfig {
+	config := DefaultWSConfig()
+	config.AllowedOrigins = allowedOrigins
+
+	if value, err := strconv.ParseInt(os.Getenv("WS_MAX_MESSAGE_BYTES"), 10, 64); err == nil && value > 0 {
+		config.MaxMessageBytes = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("WS_MAX_CHAT_LENGTH")); err == nil && value > 0 {
+		config.MaxChatLength = value
+	}
+
+	config.Chat = loadRateLimit("WS_CHAT", config.Chat)
+	config.Typing = loadRateLimit("WS_TYPING", config.Typing)
+	config.Signaling = loadRateLimit("WS_SIGNALING", config.Signaling)
+	config.Control = loadRateLimit("WS_CONTROL", config.Control)
+	return config
+}
+
+// loadRateLimit overrides a rate limit from <prefix>_RATE and <prefix>_BURST
+func loadRateLimit(prefix string, limit RateLimit) RateLimit {
+	if value, err := strconv.ParseFloat(os.Getenv(prefix+"_RATE"), 64); err == nil && value >= 0 {
+		limit.PerSecond = value
+	}
+	if value, err := strconv.Atoi(os.Getenv(prefix + "_BURST")); err == nil && value > 0 {
+		limit.Burst = value
+	}
+	return limit
+}
+
+// CheckOrigin reports whether a handshake request comes from an allowed
+// origin. Requests without an Origin header come from non-browser clients,
+// which are authenticated by token alone.
+func (c WSConfig) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// chatTooLong reports whether chat content exceeds the configured length
+func (c WSConfig) chatTooLong(content string) bool {
+	return c.MaxChatLength > 0 && utf8.RuneCountInString(content) > c.MaxChatLength
+}
+
+// unlimitedMessageTypes are never rate limited: refusing a token refresh
+// would close the connection once the old token expires
+var unlimitedMessageTypes = map[string]bool{
+	MessageTypeAuth: true,
+}
+
+// rateCategory returns the rate limit category of a client message type, or
+// "" for unlimitedMessageTypes. Types not listed share the control bucket.
+func rateCategory(messageType string) string {
+	if unlimitedMessageTypes[messageType] {
+		return ""
+	}
+	switch messageType {
+	case MessageTypeChat, MessageTypeChatEdit, MessageTypeChatDelete, MessageTypeChatReact,
+		MessageTypeTimerStart, MessageTypeTimerPause, MessageTypeTimerResume, MessageTypeTimerSkip, MessageTypeTimerStop:
+		return rateCategoryChat
+	case MessageTypeTyping, MessageTypeStopTyping:
+		return rateCategoryTyping
+	case MessageTypeRTCOffer, MessageTypeRTCAnswer, MessageTypeRTCCandidate,
+		MessageTypeStartCall, MessageTypeEndCall, MessageTypeCallState, MessageTypeCallDeclined:
+		return rateCategorySignaling
+	}
+	return rateCategoryControl
+}
+
+// tokenBucket is a token bucket rate limiter
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// take consumes a token. When none is left it returns false and how long
+// until the next token becomes available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	if b.limit.PerSecond <= 0 {
+		return true, 0
+	}
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.PerSecond)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / b.limit.PerSecond
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// rateLimiter holds one connection's token buckets by category
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+// newRateLimiter creates the buckets for a connection
+func newRateLimiter(config WSConfig, now func() time.Time) *rateLimiter {
+	start := now()
+	return &rateLimiter{
+		buckets: map[string]*tokenBucket{
+			rateCategoryChat:      newTokenBucket(config.Chat, start),
+			rateCategoryTyping:    newTokenBucket(config.Typing, start),
+			rateCategorySignaling: newTokenBucket(config.Signaling, start),
+			rateCategoryControl:   newTokenBucket(config.Control, start),
+		},
+		now: now,
+	}
+}
+
+// allow reports whether a message of the given type may be processed now
+func (l *rateLimiter) allow(messageType string) (bool, time.Duration) {
+	bucket := l.buckets[rateCategory(messageType)]
+	if bucket == nil {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return bucket.take(l.now())
+}
+
+// Metrics counts WebSocket messages the hub refused or could not deliver
+type Metrics struct {
+	RateLimited      atomic.Int64 // client messages rejected by rate limiting
+	TooLong          atomic.Int64 // chat messages rejected for their length
+	Dropped          atomic.Int64 // messages not delivered because the hub or a client fell behind
+	OriginRejected   atomic.Int64 // handshakes refused for their origin
+	SlowDisconnected atomic.Int64 // connections closed for falling behind
+}
+
+// Metrics returns the hub's message counters
+func (h *Hub) Metrics() *Metrics {
+	return &h.metrics
+}
+
+// limitError builds a structured error message for a refused client message
+func limitError(message WSMessage, code, content string, data map[string]interface{}) WSMessage {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["code"] = code
+	data["messageType"] = message.Type
+
+	return WSMessage{
+		Type:            MessageTypeError,
+		RoomID:          message.RoomID,
+		Content:         content,
+		ClientMessageID: message.ClientMessageID,
+		Timestamp:       time.Now(),
+		Data:            data,
+	}
+}
+
+// checkLimits applies rate and length limits to a client message. It tells
+// the client and returns false when the message must be discarded.
+func (c *Client) checkLimits(message WSMessage) bool {
+	if c.limiter != nil {
+		if ok, retryAfter := c.limiter.allow(message.Type); !ok {
+			c.Hub.metrics.RateLimited.Add(1)
+			c.Hub.sendToClient(c, limitError(message, ErrorCodeRateLimited, "Rate limit exceeded", map[string]interface{}{
+				"retryAfterMs": retryAfter.Milliseconds(),
+			}))
+			return false
+		}
+	}
+
+	if (message.Type == MessageTypeChat || message.Type == MessageTypeChatEdit) && c.config.chatTooLong(message.Content) {
+		c.Hub.metrics.TooLong.Add(1)
+		c.Hub.sendToClient(c, limitError(message, ErrorCodeMessageTooLong, "Message is too long", map[string]interface{}{
+			"maxLength": c.config.MaxChatLength,
+		}))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package realtime
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	bucket := newTokenBucket(RateLimit{PerSecond: 2, Burst: 3}, now)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := bucket.take(now)
+		assert.True(t, ok, "burst message %d", i)
+	}
+	ok, retryAfter := bucket.take(now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// Tokens refill over time but never beyond the burst
+	ok, _ = bucket.take(now.Add(500 * time.Millisecond))
+	assert.True(t, ok)
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ = bucket.take(now)
+		assert.True(t, ok)
+	}
+	ok, _ = bucket.take(now)
+	assert.False(t, ok)
+
+	// A zero rate disables the limit
+	unlimited := newTokenBucket(RateLimit{}, now)
+	ok, _ = unlimited.take(now)
+	assert.True(t, ok)
+}
+
+func TestClientRateLimiting(t *testing.T) {
+	hub := NewHub(nil, nil)
+	client := newTestClient(hub, "alice", "room1")
+	hub.clients[client] = true
+
+	now := time.Unix(1700000000, 0)
+	client.config = DefaultWSConfig()
+	client.config.Typing = RateLimit{PerSecond: 1, Burst: 1}
+	client.config.MaxChatLength = 5
+	client.limiter = newRateLimiter(client.config, func() time.Time { return now })
+
+	typing := WSMessage{Type: MessageTypeTyping, RoomID: "room1"}
+	assert.True(t, client.checkLimits(typing))
+	assert.False(t, client.checkLimits(typing))
+
+	limited := <-client.Send
+	assert.Equal(t, MessageTypeError, limited.Type)
+	assert.Equal(t, ErrorCodeRateLimited, limited.Data["code"])
+	assert.Equal(t, MessageTypeTyping, limited.Data["messageType"])
+	assert.Equal(t, int64(1000), limited.Data["retryAfterMs"])
+	assert.Equal(t, int64(1), hub.Metrics().RateLimited.Load())
+
+	// Other categories have their own buckets
+	assert.True(t, client.checkLimits(WSMessage{Type: MessageTypeChat, Content: "héllo"}))
+	assert.True(t, client.checkLimits(WSMessage{Type: MessageTypeResume}))
+
+	tooLong := WSMessage{Type: MessageTypeChat, Content: strings.Repeat("a", 6), ClientMessageID: "c1"}
+	assert.False(t, client.checkLimits(tooLong))
+	rejected := <-client.Send
+	assert.Equal(t, ErrorCodeMessageTooLong, rejected.Data["code"])
+	assert.Equal(t, "c1", rejected.ClientMessageID)
+	assert.Equal(t, int64(1), hub.Metrics().TooLong.Load())
+}
+
+func TestRateCategory(t *testing.T) {
+	assert.Equal(t, rateCategoryChat, rateCategory(MessageTypeChatReact))
+	assert.Equal(t, rateCategoryTyping, rateCategory(MessageTypeTyping))
+	assert.Equal(t, rateCategorySignaling, rateCategory(MessageTypeRTCCandidate))
+	assert.Equal(t, rateCategoryTyping, rateCategory(MessageTypeStopTyping))
+	assert.Equal(t, rateCategoryControl, rateCategory(MessageTypeSubscribe))
+	assert.Equal(t, rateCategoryControl, rateCategory(MessageTypeAck))
+	assert.Equal(t, rateCategoryControl, rateCategory("unknown"))
+	assert.Equal(t, "", rateCategory(MessageTypeAuth))
+
+	// Every room message clients may send is limited
+	for messageType := range roomMessageTypes {
+		assert.NotEmpty(t, rateCategory(messageType), messageType)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	config := WSConfig{AllowedOrigins: []string{"https://app.example.com", " http://localhost:5173"}}
+
+	request := httptest.NewRequest("GET", "/api/v1/realtime/ws", nil)
+	assert.True(t, config.CheckOrigin(request), "non-browser clients send no origin")
+
+	request.Header.Set("Origin", "https://app.example.com")
+	assert.True(t, config.CheckOrigin(request))
+	request.Header.Set("Origin", "http://localhost:5173")
+	assert.True(t, config.CheckOrigin(request))
+	request.Header.Set("Origin", "https://evil.example.com")
+	assert.False(t, config.CheckOrigin(request))
+
+	config.AllowedOrigins = []string{"*"}
+	assert.True(t, config.CheckOrigin(request))
+}
+
+func TestLoadWSConfig(t *testing.T) {
+	t.Setenv("WS_MAX_MESSAGE_BYTES", "1024")
+	t.Setenv("WS_MAX_CHAT_LENGTH", "200")
+	t.Setenv("WS_CHAT_RATE", "0.5")
+	t.Setenv("WS_CHAT_BURST", "3")
+	t.Setenv("WS_TYPING_RATE", "invalid")
+
+	config := LoadWSConfig([]string{"https://app.example.com"})
+	assert.Equal(t, int64(1024), config.MaxMessageBytes)
+	assert.Equal(t, 200, config.MaxChatLength)
+	assert.Equal(t, RateLimit{PerSecond: 0.5, Burst: 3}, config.Chat)
+	assert.Equal(t, DefaultWSConfig().Typing, config.Typing)
+	assert.Equal(t, []string{"https://app.example.com"}, config.AllowedOrigins)
+}
@@ -0,0 +1,252 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+)
+
+// defaultCappedSizeBytes bounds the realtime event log; old events roll off automatically
+const defaultCappedSizeBytes = 64 * 1024 * 1024
+
+// mongoNamespaceExists is the server error code returned when a collection already exists
+const mongoNamespaceExists = 48
+
+// mongoEvent is the document stored in the capped realtime collection. The
+// envelope is stored as JSON so free-form message data (e.g. SDP payloads)
+// round-trips exactly as clients sent it.
+//
+// The server fills in the empty insertion timestamp in TS, which increases in
+// insertion order whichever replica published the event. It has to stay the
+// first field after _id for servers before 5.0 to fill it in.
+type mongoEvent struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty"`
+	TS        primitive.Timestamp `bson:"ts"`
+	Kind      string              `bson:"kind"`
+	Origin    string              `bson:"origin"`
+	Payload   []byte              `bson:"payload"`
+	CreatedAt time.Time           `bson:"created_at"`
+}
+
+// MongoBroker is a Broker backed by a MongoDB capped collection. Every
+// instance tails the collection, so envelopes published by one replica reach
+// the clients connected to all others. Tailable cursors work on standalone
+// servers, unlike change streams which require a replica set.
+type MongoBroker struct {
+	collection *mongo.Collection
+	queue      chan Envelope
+	ctx        context.Context
+	cancel     context.CancelFunc
+	publishWG  sync.WaitGroup
+	tailWG     sync.WaitGroup
+	mutex      sync.RWMutex
+	closed     bool
+}
+
+// NewMongoBroker creates the capped collection if needed and starts the publisher
+func NewMongoBroker(mongoClient *database.MongoClient) (*MongoBroker, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := database.CollectionNames.RealTimeChannels
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(defaultCappedSizeBytes)
+	if err := mongoClient.Database.CreateCollection(ctx, name, opts); err != nil {
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Code != mongoNamespaceExists {
+			return nil, err
+		}
+	}
+
+	brokerCtx, brokerCancel := context.WithCancel(context.Background())
+	b := &MongoBroker{
+		collection: mongoClient.GetCollection(name),
+		queue:      make(chan Envelope, 1000),
+		ctx:        brokerCtx,
+		cancel:     brokerCancel,
+	}
+
+	b.publishWG.Add(1)
+	go b.publishLoop()
+
+	return b, nil
+}
+
+// Publish queues the envelope for insertion. A single writer keeps ordering intact.
+func (b *MongoBroker) Publish(ctx context.Context, envelope Envelope) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	select {
+	case b.queue <- envelope:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publishLoop inserts queued envelopes into the capped collection
+func (b *MongoBroker) publishLoop() {
+	defer b.publishWG.Done()
+
+	for envelope := range b.queue {
+		payload, err := json.Marshal(envelope)
+		if err != nil {
+			log.Printf("Error encoding realtime event: %v", err)
+			continue
+		}
+
+		event := mongoEvent{
+			Kind:      envelope.Kind,
+			Origin:    envelope.Origin,
+			Payload:   payload,
+			CreatedAt: time.Now(),
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if _, err := b.collection.InsertOne(ctx, event); err != nil {
+			log.Printf("Error publishing realtime event: %v", err)
+		}
+		cancel()
+	}
+}
+
+// Subscribe tails the capped collection from its current end
+func (b *MongoBroker) Subscribe(ctx context.Context) (<-chan Envelope, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+
+	last, err := b.eventAt(ctx, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Envelope, 1000)
+	b.tailWG.Add(1)
+	go b.tail(last, out)
+	return out, nil
+}
+
+// eventAt returns the insertion timestamp of the oldest (direction 1) or
+// newest (direction -1) event, or a zero timestamp when there are none
+func (b *MongoBroker) eventAt(ctx context.Context, direction int) (primitive.Timestamp, error) {
+	var event mongoEvent
+	opts := options.FindOne().
+		SetSort(bson.M{"$natural": direction}).
+		SetProjection(bson.M{"ts": 1})
+	err := b.collection.FindOne(ctx, bson.M{}, opts).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		return primitive.Timestamp{}, nil
+	}
+	return event.TS, err
+}
+
+// tail follows the collection with a tailable cursor, reopening it whenever
+// it dies (e.g. while the collection is empty or after a network error). A
+// reopened cursor only asks for events inserted after the last one it
+// delivered.
+func (b *MongoBroker) tail(last primitive.Timestamp, out chan<- Envelope) {
+	defer b.tailWG.Done()
+	defer close(out)
+
+	opts := options.Find().
+		SetCursorType(options.TailableAwait).
+		SetMaxAwaitTime(time.Second)
+
+	for b.ctx.Err() == nil {
+		b.checkLost(last)
+
+		cursor, err := b.collection.Find(b.ctx, bson.M{"ts": bson.M{"$gt": last}}, opts)
+		if err != nil {
+			if b.ctx.Err() == nil {
+				log.Printf("Error opening realtime cursor: %v", err)
+			}
+			b.sleep(time.Second)
+			continue
+		}
+
+		for cursor.Next(b.ctx) {
+			var event mongoEvent
+			if err := cursor.Decode(&event); err != nil {
+				log.Printf("Error decoding realtime event: %v", err)
+				continue
+			}
+			last = event.TS
+
+			var envelope Envelope
+			if err := json.Unmarshal(event.Payload, &envelope); err != nil {
+				log.Printf("Error decoding realtime event payload: %v", err)
+				continue
+			}
+
+			select {
+			case out <- envelope:
+			case <-b.ctx.Done():
+			}
+		}
+
+		if err := cursor.Err(); err != nil && b.ctx.Err() == nil {
+			log.Printf("Realtime cursor error: %v", err)
+		}
+		cursor.Close(context.Background())
+		b.sleep(100 * time.Millisecond)
+	}
+}
+
+// checkLost logs when the capped collection rolled past the last delivered
+// event before a cursor was reopened, so events since may be lost
+func (b *MongoBroker) checkLost(last primitive.Timestamp) {
+	if last.IsZero() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
+	defer cancel()
+
+	if oldest, err := b.eventAt(ctx, 1); err == nil && oldest.After(last) {
+		log.Printf("Realtime events may be lost: the last delivered event rolled off the capped collection")
+	}
+}
+
+// sleep waits for the given duration or until the broker is closed
+func (b *MongoBroker) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-b.ctx.Done():
+	}
+}
+
+// Close flushes pending publishes and stops all subscriptions
+func (b *MongoBroker) Close() error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.queue)
+	b.mutex.Unlock()
+
+	// Stop tailing only after the queue has been drained
+	b.publishWG.Wait()
+	b.cancel()
+	b.tailWG.Wait()
+	return nil
+}
@@ -0,0 +1,226 @@
+package realtime
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/studyplatform/backend/pkg/database"
+)
+
+// Presence statuses. A user's status is the most engaged status across all of
+// their connections, so an idle tab does not hide an active one.
+const (
+	PresenceOffline  = "offline"
+	PresenceAway     = "away"
+	PresenceOnline   = "online"
+	PresenceFocusing = "focusing"
+	PresenceInCall   = "in_call"
+)
+
+// presencePriority ranks statuses when a user has several connections
+var presencePriority = map[string]int{
+	PresenceOffline:  0,
+	PresenceAway:     1,
+	PresenceOnline:   2,
+	PresenceFocusing: 3,
+	PresenceInCall:   4,
+}
+
+// UserPresence is the live presence of a user across every hub instance
+type UserPresence struct {
+	Status string   `json:"status"`
+	Rooms  []string `json:"rooms"` // rooms the user is connected to
+}
+
+// IsOnline reports whether the user has at least one open connection
+func (p UserPresence) IsOnline() bool {
+	return p.Status != PresenceOffline
+}
+
+// validClientStatus reports whether clients may set status themselves.
+// in_call is only set by the hub while the user is in a call.
+func validClientStatus(status string) bool {
+	switch status {
+	case PresenceOnline, PresenceAway, PresenceFocusing:
+		return true
+	}
+	return false
+}
+
+// morePresent returns the more engaged of two statuses
+func morePresent(a, b string) string {
+	if presencePriority[b] > presencePriority[a] {
+		return b
+	}
+	return a
+}
+
+// clientStatus returns the client's status; callers hold h.mutex
+func clientStatus(client *Client) string {
+	if client.status == "" {
+		return PresenceOnline
+	}
+	return client.status
+}
+
+// UsersPresence returns the presence of each requested user. Users without
+// a connection on any hub are reported as offline.
+func (h *Hub) UsersPresence(userIDs []string) map[string]UserPresence {
+	wanted := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		wanted[userID] = true
+	}
+
+	statuses := make(map[string]string, len(userIDs))
+	rooms := make(map[string]map[string]bool, len(userIDs))
+	add := func(entry PresenceEntry) {
+		if !wanted[entry.UserID] {
+			return
+		}
+		status := entry.Status
+		if status == "" {
+			status = PresenceOnline
+		}
+		statuses[entry.UserID] = morePresent(statuses[entry.UserID], status)
+		if entry.RoomID == "" {
+			return
+		}
+		if rooms[entry.UserID] == nil {
+			rooms[entry.UserID] = make(map[string]bool)
+		}
+		rooms[entry.UserID][entry.RoomID] = true
+	}
+
+	for _, entry := range h.localPresence() {
+		add(entry)
+	}
+
+	h.presenceMutex.RLock()
+	cutoff := time.Now().Add(-presenceExpiry)
+	for _, presence := range h.remotePresence {
+		if presence.lastSeen.Before(cutoff) {
+			continue
+		}
+		for _, entry := range presence.entries {
+			add(entry)
+		}
+	}
+	h.presenceMutex.RUnlock()
+
+	result := make(map[string]UserPresence, len(userIDs))
+	for _, userID := range userIDs {
+		presence := UserPresence{Status: PresenceOffline, Rooms: []string{}}
+		if status, ok := statuses[userID]; ok {
+			presence.Status = status
+			for roomID := range rooms[userID] {
+				presence.Rooms = append(presence.Rooms, roomID)
+			}
+			sort.Strings(presence.Rooms)
+		}
+		result[userID] = presence
+	}
+	return result
+}
+
+// UserPresence returns the presence of a single user
+func (h *Hub) UserPresence(userID string) UserPresence {
+	return h.UsersPresence([]string{userID})[userID]
+}
+
+// setClientStatus changes the status of one connection and announces the
+// user's new presence if it changed
+func (h *Hub) setClientStatus(client *Client, status string) {
+	before := h.UserPresence(client.UserID)
+
+	h.mutex.Lock()
+	if !h.clients[client] {
+		h.mutex.Unlock()
+		return
+	}
+	client.status = status
+	h.mutex.Unlock()
+
+	h.presenceChanged(client.UserID, client.Username, before, nil)
+}
+
+// setUserRoomStatus changes the status of a user's connections in a room,
+// e.g. when they start or end a call
+func (h *Hub) setUserRoomStatus(userID, roomID, status string) {
+	before := h.UserPresence(userID)
+
+	var username string
+	h.mutex.Lock()
+	for client := range h.rooms[roomID] {
+		if client.UserID == userID {
+			client.status = status
+			username = client.Username
+		}
+	}
+	h.mutex.Unlock()
+
+	if username != "" {
+		h.presenceChanged(userID, username, before, nil)
+	}
+}
+
+// presenceChanged shares this hub's presence with the other instances and,
+// when the user's aggregated status changed, broadcasts a presence_update to
+// every room the user is or was connected to. extraRooms covers rooms the
+// user just left.
+func (h *Hub) presenceChanged(userID, username string, before UserPresence, extraRooms []string) {
+	h.publishPresence()
+
+	after := h.UserPresence(userID)
+	if after.Status == before.Status {
+		return
+	}
+
+	now := time.Now()
+	h.touchLastActive(userID, now)
+
+	rooms := make(map[string]bool)
+	for _, roomID := range append(append(before.Rooms, after.Rooms...), extraRooms...) {
+		rooms[roomID] = true
+	}
+
+	update := WSMessage{
+		Type:      MessageTypePresenceUpdate,
+		UserID:    userID,
+		Username:  username,
+		Content:   after.Status,
+		Timestamp: now,
+		Data: map[string]interface{}{
+			"status":   after.Status,
+			"lastSeen": now,
+		},
+	}
+	for roomID := range rooms {
+		update.RoomID = roomID
+		h.broadcastToRoom(roomID, update, "")
+	}
+}
+
+// touchLastActive persists the user's last-seen time in the background
+func (h *Hub) touchLastActive(userID string, at time.Time) {
+	if h.mongoClient == nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		users := h.mongoClient.GetCollection(database.CollectionNames.Users)
+		_, err := users.UpdateOne(ctx,
+			bson.M{"unique_id": userID},
+			bson.M{"$max": bson.M{"last_active": at}},
+		)
+		if err != nil {
+			log.Printf("Error updating last active for user %s: %v", userID, err)
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForPresence reads from the client until a presence update about userID arrives
+func waitForPresence(t *testing.T, client *Client, userID string) WSMessage {
+	t.Helper()
+	for {
+		message := waitForMessage(t, client, MessageTypePresenceUpdate)
+		if message.UserID == userID {
+			return message
+		}
+	}
+}
+
+func TestPresenceAcrossHubs(t *testing.T) {
+	broker := NewMemoryBroker()
+	hubA := NewHub(nil, broker)
+	hubB := NewHub(nil, broker)
+	go hubA.Run()
+	go hubB.Run()
+	defer broker.Close()
+
+	aliceTab1 := newTestClient(hubA, "alice", "room1")
+	aliceTab2 := newTestClient(hubA, "alice", "room2")
+	bob := newTestClient(hubB, "bob", "room1")
+
+	hubB.register <- bob
+	require.Eventually(t, func() bool { return hasOnlineUser(hubA, "room1", "bob") }, 2*time.Second, 10*time.Millisecond)
+
+	hubA.register <- aliceTab1
+	hubA.register <- aliceTab2
+
+	update := waitForPresence(t, bob, "alice")
+	assert.Equal(t, "alice", update.UserID)
+	assert.Equal(t, PresenceOnline, update.Content)
+
+	require.Eventually(t, func() bool {
+		return len(hubB.UserPresence("alice").Rooms) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, PresenceOffline, hubB.UserPresence("carol").Status)
+
+	// An idle tab does not hide an active one
+	hubA.setClientStatus(aliceTab2, PresenceAway)
+	assert.Equal(t, PresenceOnline, hubA.UserPresence("alice").Status)
+
+	hubA.setClientStatus(aliceTab1, PresenceFocusing)
+	update = waitForPresence(t, bob, "alice")
+	assert.Equal(t, PresenceFocusing, update.Content)
+	require.Eventually(t, func() bool {
+		return hubB.UserPresence("alice").Status == PresenceFocusing
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Joining a call marks the user in the call's room
+	hubB.setUserRoomStatus("bob", "room1", PresenceInCall)
+	require.Eventually(t, func() bool {
+		return hubA.UserPresence("bob").Status == PresenceInCall
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Closing every connection makes the user offline everywhere
+	hubA.unregister <- aliceTab1
+	hubA.unregister <- aliceTab2
+	require.Eventually(t, func() bool {
+		return hubB.UserPresence("alice").Status == PresenceOffline
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestClientsCannotClaimToBeInCall(t *testing.T) {
+	assert.True(t, validClientStatus(PresenceFocusing))
+	assert.False(t, validClientStatus(PresenceInCall))
+	assert.False(t, validClientStatus(PresenceOffline))
+}
+
+func TestSignalingTargetMustBeInRoom(t *testing.T) {
+	hub := NewHub(nil, nil)
+	go hub.Run()
+	defer hub.broker.Close()
+
+	alice := newTestClient(hub, "alice", "room1")
+	mallory := newTestClient(hub, "mallory", "room2")
+	hub.register <- alice
+	hub.register <- mallory
+	require.Eventually(t, func() bool { return hasOnlineUser(hub, "room2", "mallory") }, 2*time.Second, 10*time.Millisecond)
+
+	hub.broadcast <- WSMessage{
+		Type:      MessageTypeRTCOffer,
+		RoomID:    "room1",
+		UserID:    "alice",
+		Timestamp: time.Now(),
+		Data:      map[string]interface{}{"targetUserId": "mallory", "offer": "sdp"},
+	}
+
+	reply := waitForMessage(t, alice, MessageTypeError)
+	assert.Equal(t, "Signaling target is not in this room", reply.Content)
+	for len(mallory.Send) > 0 {
+		assert.NotEqual(t, MessageTypeRTCOffer, (<-mallory.Send).Type)
+	}
+}
@@ -0,0 +1,185 @@
+package realtime
+
+import (
+	"log"
+	"time"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// maxRoomsPerClient bounds how many rooms one connection can subscribe to
+const maxRoomsPerClient = 50
+
+// subscriptionRequest asks the hub to add or remove a client from a room
+type subscriptionRequest struct {
+	client    *Client
+	roomID    string
+	subscribe bool
+}
+
+// subscribedRooms returns the rooms the client is subscribed to
+func (c *Client) subscribedRooms() []string {
+	c.Hub.mutex.RLock()
+	defer c.Hub.mutex.RUnlock()
+
+	rooms := make([]string, 0, len(c.rooms))
+	for roomID := range c.rooms {
+		rooms = append(rooms, roomID)
+	}
+	return rooms
+}
+
+// roomFor resolves the room a message is meant for. Messages without a
+// roomId go to the connection's only room so single-room clients keep working.
+func (c *Client) roomFor(roomID string) (string, bool) {
+	c.Hub.mutex.RLock()
+	defer c.Hub.mutex.RUnlock()
+
+	if roomID == "" {
+		if len(c.rooms) != 1 {
+			return "", false
+		}
+		for only := range c.rooms {
+			return only, true
+		}
+	}
+	return roomID, c.rooms[roomID]
+}
+
+// requireRoom resolves the message's room and tells the client when it is
+// not subscribed to it
+func (c *Client) requireRoom(roomID string) (string, bool) {
+	resolved, ok := c.roomFor(roomID)
+	if !ok {
+		c.Hub.sendToClient(c, WSMessage{
+			Type:      MessageTypeError,
+			RoomID:    roomID,
+			Content:   "Subscribe to the room first",
+			Timestamp: time.Now(),
+		})
+	}
+	return resolved, ok
+}
+
+// handleSubscribe checks that the user may access the room and asks the hub
+// to subscribe the connection to it
+func (c *Client) handleSubscribe(roomID string) {
+	reply := WSMessage{Type: MessageTypeError, RoomID: roomID, Timestamp: time.Now()}
+
+	if len(c.subscribedRooms()) >= maxRoomsPerClient {
+		reply.Content = "Too many room subscriptions"
+		c.Hub.sendToClient(c, reply)
+		return
+	}
+
+	allowed, err := userCanAccessRoom(c.Hub.mongoClient, roomID, c.UserID)
+	if err != nil {
+		log.Printf("Room access check failed for user %s: %v", c.UserID, err)
+		reply.Content = "Failed to verify room access"
+		c.Hub.sendToClient(c, reply)
+		return
+	}
+	if !allowed {
+		reply.Content = "Access denied to this room"
+		c.Hub.sendToClient(c, reply)
+		return
+	}
+
+	select {
+	case <-c.registered:
+		c.Hub.subscriptions <- subscriptionRequest{client: c, roomID: roomID, subscribe: true}
+	case <-c.done:
+	}
+}
+
+// subscribeClient adds a registered client to a room
+func (h *Hub) subscribeClient(client *Client, roomID string) {
+	before := h.UserPresence(client.UserID)
+
+	h.mutex.Lock()
+	if !h.clients[client] {
+		h.mutex.Unlock()
+		return
+	}
+	alreadySubscribed := client.rooms[roomID]
+	h.addToRoom(client, roomID)
+	h.mutex.Unlock()
+
+	if !alreadySubscribed {
+		h.announceJoin(client, roomID)
+		h.presenceChanged(client.UserID, client.Username, before, nil)
+	}
+
+	h.sendToClient(client, WSMessage{
+		Type:      MessageTypeSubscribed,
+		RoomID:    roomID,
+		Timestamp: time.Now(),
+		Data: map[string]interface{}{
+			"onlineUsers": h.OnlineUsers(roomID),
+		},
+	})
+
+	// Late joiners catch up with the room's timer
+	go h.sendTimerState(client, roomID)
+}
+
+// unsubscribeClient removes a registered client from a room
+func (h *Hub) unsubscribeClient(client *Client, roomID string) {
+	before := h.UserPresence(client.UserID)
+
+	h.mutex.Lock()
+	if !h.clients[client] {
+		h.mutex.Unlock()
+		return
+	}
+	wasSubscribed := client.rooms[roomID]
+	h.removeFromRoom(client, roomID)
+	h.mutex.Unlock()
+
+	if wasSubscribed {
+		h.announceLeave(client, roomID)
+		h.presenceChanged(client.UserID, client.Username, before, []string{roomID})
+		h.leaveCallIfGone(client.UserID, client.Username, roomID)
+	}
+
+	h.sendToClient(client, WSMessage{
+		Type:      MessageTypeUnsubscribed,
+		RoomID:    roomID,
+		Timestamp: time.Now(),
+	})
+}
+
+// NotifyUser pushes a stored notification to every connection of userID
+func (h *Hub) NotifyUser(userID string, notification models.Notification) {
+	h.sendToUser(userID, "", WSMessage{
+		Type:      MessageTypeNotification,
+		UserID:    userID,
+		Timestamp: time.Now(),
+		Data: map[string]interface{}{
+			"notification": notification.ToResponse(),
+		},
+	})
+}
+
+// Friend update actions sent in friend_update events
+const (
+	FriendActionRequest  = "request"
+	FriendActionAccepted = "accepted"
+	FriendActionRejected = "rejected"
+	FriendActionRemoved  = "removed"
+)
+
+// NotifyFriendUpdate tells every connection of userID that their friendship
+// with another user changed
+func (h *Hub) NotifyFriendUpdate(userID, action, friendID, friendUsername string) {
+	h.sendToUser(userID, "", WSMessage{
+		Type:      MessageTypeFriendUpdate,
+		UserID:    userID,
+		Timestamp: time.Now(),
+		Data: map[string]interface{}{
+			"action":         action,
+			"friendId":       friendID,
+			"friendUsername": friendUsername,
+		},
+	})
+}
@@ -0,0 +1,70 @@
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+func TestClientSubscribesToSeveralRooms(t *testing.T) {
+	hub := NewHub(nil, nil)
+	go hub.Run()
+	defer hub.broker.Close()
+
+	alice := newTestClient(hub, "alice", "")
+	alice.rooms = map[string]bool{}
+	bob := newTestClient(hub, "bob", "room1")
+	carol := newTestClient(hub, "carol", "room2")
+	hub.register <- alice
+	hub.register <- bob
+	hub.register <- carol
+	<-alice.registered
+
+	// One connection, two rooms
+	hub.subscriptions <- subscriptionRequest{client: alice, roomID: "room1", subscribe: true}
+	subscribed := waitForMessage(t, alice, MessageTypeSubscribed)
+	assert.Equal(t, "room1", subscribed.RoomID)
+	hub.subscriptions <- subscriptionRequest{client: alice, roomID: "room2", subscribe: true}
+	waitForMessage(t, alice, MessageTypeSubscribed)
+
+	assert.ElementsMatch(t, []string{"room1", "room2"}, alice.subscribedRooms())
+	assert.ElementsMatch(t, []string{"room1", "room2"}, hub.UserPresence("alice").Rooms)
+
+	hub.broadcast <- WSMessage{Type: MessageTypeCallDeclined, RoomID: "room2", UserID: "carol", Timestamp: time.Now()}
+	declined := waitForMessage(t, alice, MessageTypeCallDeclined)
+	assert.Equal(t, "room2", declined.RoomID)
+
+	// Messages without a room are ambiguous once several rooms are open
+	_, ok := alice.roomFor("")
+	assert.False(t, ok)
+	_, ok = alice.roomFor("room3")
+	assert.False(t, ok)
+	roomID, ok := bob.roomFor("")
+	assert.True(t, ok)
+	assert.Equal(t, "room1", roomID)
+
+	// Unsubscribing stops room traffic
+	hub.subscriptions <- subscriptionRequest{client: alice, roomID: "room2"}
+	waitForMessage(t, alice, MessageTypeUnsubscribed)
+	assert.Equal(t, []string{"room1"}, alice.subscribedRooms())
+	require.Eventually(t, func() bool { return !hasOnlineUser(hub, "room2", "alice") }, 2*time.Second, 10*time.Millisecond)
+
+	// Personal events reach the user regardless of subscriptions
+	hub.NotifyUser("alice", models.Notification{UserID: "alice", Type: models.NotificationTypeSystem, Title: "Hello"})
+	notification := waitForMessage(t, alice, MessageTypeNotification)
+	assert.Equal(t, "Hello", notification.Data["notification"].(models.NotificationForResponse).Title)
+
+	hub.NotifyFriendUpdate("alice", FriendActionRequest, "bob", "bob_name")
+	update := waitForMessage(t, alice, MessageTypeFriendUpdate)
+	assert.Equal(t, FriendActionRequest, update.Data["action"])
+
+	for len(carol.Send) > 0 {
+		message := <-carol.Send
+		assert.NotEqual(t, MessageTypeNotification, message.Type)
+		assert.NotEqual(t, MessageTypeFriendUpdate, message.Type)
+	}
+}
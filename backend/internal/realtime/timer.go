@@ -0,0 +1,607 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// Room timer actions, sent in data.action of timer_state messages
+const (
+	TimerActionStart  = "start"
+	TimerActionPause  = "pause"
+	TimerActionResume = "resume"
+	TimerActionSkip   = "skip"
+	TimerActionStop   = "stop"
+	TimerActionPhase  = "phase" // a phase ran out and the next one started
+	TimerActionSync   = "sync"  // the current state, sent to clients subscribing to the room
+)
+
+// timerActions maps client timer messages to their actions
+var timerActions = map[string]string{
+	MessageTypeTimerStart:  TimerActionStart,
+	MessageTypeTimerPause:  TimerActionPause,
+	MessageTypeTimerResume: TimerActionResume,
+	MessageTypeTimerSkip:   TimerActionSkip,
+	MessageTypeTimerStop:   TimerActionStop,
+}
+
+// Room timers are checked for phases that ran out every timerCheckInterval,
+// and clients get a timer_tick every timerTickEvery checks to correct drift
+const (
+	timerCheckInterval = time.Second
+	timerTickEvery     = 15
+	// maxTimerPhases bounds how many phases one advance moves through
+	maxTimerPhases = 1000
+)
+
+var (
+	errTimerNotModerator  = errors.New("not a room moderator")
+	errTimerRunning       = errors.New("timer is already running")
+	errNoTimer            = errors.New("no timer is running")
+	errTimerPaused        = errors.New("timer is already paused")
+	errTimerNotPaused     = errors.New("timer is not paused")
+	errUnknownTimerPreset = errors.New("unknown pomodoro preset")
+	errTimerConflict      = errors.New("timer changed concurrently")
+)
+
+// TimerSessions connects room timers to the study sessions of the users in
+// the room
+type TimerSessions interface {
+	// Preset returns one of the user's pomodoro presets by name, the first
+	// if name is empty, and false if the user has none of that name
+	Preset(ctx context.Context, userID, name string) (models.PomodoroPreset, bool, error)
+	// CreditGroupFocus credits a completed focus block to the users' active
+	// sessions in the room and returns how many were credited
+	CreditGroupFocus(ctx context.Context, block models.GroupFocusBlock, userIDs []string) (int, error)
+}
+
+// SetTimerSessions links room timers to study sessions. Without it timers
+// run on the default preset and credit nobody.
+func (h *Hub) SetTimerSessions(sessions TimerSessions) {
+	h.timerSessions = sessions
+}
+
+// defaultRoomPreset is the preset of room timers when no sessions are linked
+func defaultRoomPreset() models.PomodoroPreset {
+	return models.PomodoroPreset{Name: "Classic", Focus: 25, ShortBreak: 5, LongBreak: 15, LongBreakEvery: 4}
+}
+
+// EnsureTimerIndexes creates the indexes used by room timers
+func EnsureTimerIndexes(mongoClient *database.MongoClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	timers := mongoClient.GetCollection(database.CollectionNames.RoomTimers)
+	_, err := timers.Indexes().CreateOne(ctx, mongo.IndexModel{
+		// One timer per room
+		Keys:    bson.D{{Key: "room_id", Value: 1}},
+		Options: options.Index().SetName("room").SetUnique(true),
+	})
+	return err
+}
+
+// newRoomTimer starts a timer on its first focus block
+func newRoomTimer(roomID, userID string, preset models.PomodoroPreset, now time.Time) models.RoomTimer {
+	return models.RoomTimer{
+		RoomID:         roomID,
+		Preset:         preset,
+		Phase:          models.SegmentFocus,
+		PhaseStartedAt: now,
+		PhaseEndsAt:    now.Add(preset.Length(models.SegmentFocus)),
+		StartedBy:      userID,
+		StartedAt:      now,
+		UpdatedAt:      now,
+	}
+}
+
+// nextPhase is the phase after the current one: a break after focus, long
+// after every LongBreakEvery completed blocks, and focus after a break
+func nextPhase(timer *models.RoomTimer) string {
+	if timer.Phase != models.SegmentFocus {
+		return models.SegmentFocus
+	}
+	every := timer.Preset.LongBreakEvery
+	if timer.CompletedFocus > 0 && every > 0 && timer.CompletedFocus%every == 0 {
+		return models.SegmentLongBreak
+	}
+	return models.SegmentShortBreak
+}
+
+// enterPhase starts the given phase at the given time
+func enterPhase(timer *models.RoomTimer, phase string, at time.Time) {
+	timer.Phase = phase
+	timer.PhaseStartedAt = at
+	timer.PhaseEndsAt = at.Add(timer.Preset.Length(phase))
+	timer.PausedAt = nil
+	timer.ResumedAt = nil
+	timer.PhaseRan = nil
+	timer.Remaining = 0
+}
+
+// runningSince is when the running phase started or last resumed
+func runningSince(timer *models.RoomTimer) time.Time {
+	if timer.ResumedAt != nil {
+		return *timer.ResumedAt
+	}
+	return timer.PhaseStartedAt
+}
+
+// advanceTimer moves a running timer to now, starting each phase where the
+// previous one ran out. It returns the focus blocks completed on the way.
+func advanceTimer(timer *models.RoomTimer, now time.Time) []models.GroupFocusBlock {
+	var completed []models.GroupFocusBlock
+	for i := 0; i < maxTimerPhases; i++ {
+		if timer.IsPaused() || timer.PhaseEndsAt.After(now) || !timer.PhaseEndsAt.After(timer.PhaseStartedAt) {
+			break
+		}
+		end := timer.PhaseEndsAt
+		if timer.Phase == models.SegmentFocus {
+			timer.CompletedFocus++
+			block := models.GroupFocusBlock{
+				RoomID:    timer.RoomID,
+				StartedAt: timer.PhaseStartedAt,
+				EndedAt:   end,
+			}
+			if len(timer.PhaseRan) > 0 {
+				block.Ran = append(timer.PhaseRan, models.TimerInterval{StartedAt: runningSince(timer), EndedAt: end})
+			}
+			completed = append(completed, block)
+		}
+		enterPhase(timer, nextPhase(timer), end)
+	}
+	return completed
+}
+
+// pauseTimer holds the timer with what is left of the phase
+func pauseTimer(timer *models.RoomTimer, now time.Time) error {
+	if timer.IsPaused() {
+		return errTimerPaused
+	}
+	timer.Remaining = int64(timer.RemainingAt(now).Seconds())
+	timer.PhaseRan = append(timer.PhaseRan, models.TimerInterval{StartedAt: runningSince(timer), EndedAt: now})
+	timer.PausedAt = &now
+	return nil
+}
+
+// resumeTimer continues a paused phase. The stretches before pauses are
+// kept, so a focus block is only credited for the time the room studied.
+func resumeTimer(timer *models.RoomTimer, now time.Time) error {
+	if !timer.IsPaused() {
+		return errTimerNotPaused
+	}
+	timer.PhaseEndsAt = now.Add(time.Duration(timer.Remaining) * time.Second)
+	timer.ResumedAt = &now
+	timer.PausedAt = nil
+	timer.Remaining = 0
+	return nil
+}
+
+// skipTimer ends the phase early and starts the next. A skipped focus
+// block is not credited.
+func skipTimer(timer *models.RoomTimer, now time.Time) {
+	enterPhase(timer, nextPhase(timer), now)
+}
+
+// loadTimer returns the room's timer, or nil when none is running
+func (h *Hub) loadTimer(ctx context.Context, roomID string) (*models.RoomTimer, error) {
+	var timer models.RoomTimer
+	timers := h.mongoClient.GetCollection(database.CollectionNames.RoomTimers)
+	err := timers.FindOne(ctx, bson.M{"room_id": roomID}).Decode(&timer)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &timer, nil
+}
+
+// saveTimer writes a changed timer unless it was changed elsewhere since it
+// was read at the given revision
+func (h *Hub) saveTimer(ctx context.Context, timer *models.RoomTimer, revision int64, now time.Time) error {
+	timer.Revision = revision + 1
+	timer.UpdatedAt = now
+
+	timers := h.mongoClient.GetCollection(database.CollectionNames.RoomTimers)
+	result, err := timers.ReplaceOne(ctx, bson.M{"_id": timer.ID, "revision": revision}, timer)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errTimerConflict
+	}
+	return nil
+}
+
+// controlTimer applies a room moderator's action to the room's timer; see
+// isRoomModerator. Phases that ran out before it are completed first.
+func (h *Hub) controlTimer(ctx context.Context, roomID, userID, action, presetName string) (*models.RoomTimer, error) {
+	isModerator, err := h.isRoomModerator(ctx, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isModerator {
+		return nil, errTimerNotModerator
+	}
+
+	if action == TimerActionStart {
+		return h.startTimer(ctx, roomID, userID, presetName)
+	}
+
+	// Two attempts cover a phase change on another instance in between
+	for attempt := 0; attempt < 2; attempt++ {
+		timer, err := h.loadTimer(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		if timer == nil {
+			return nil, errNoTimer
+		}
+
+		if action == TimerActionStop {
+			timers := h.mongoClient.GetCollection(database.CollectionNames.RoomTimers)
+			result, err := timers.DeleteOne(ctx, bson.M{"_id": timer.ID, "revision": timer.Revision})
+			if err != nil {
+				return nil, err
+			}
+			if result.DeletedCount == 0 {
+				continue
+			}
+			return timer, nil
+		}
+
+		now := time.Now()
+		revision := timer.Revision
+		completed := advanceTimer(timer, now)
+		switch action {
+		case TimerActionPause:
+			err = pauseTimer(timer, now)
+		case TimerActionResume:
+			err = resumeTimer(timer, now)
+		case TimerActionSkip:
+			skipTimer(timer, now)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = h.saveTimer(ctx, timer, revision, now)
+		if err == errTimerConflict {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		h.creditFocus(ctx, roomID, completed)
+		return timer, nil
+	}
+	return nil, errTimerConflict
+}
+
+// startTimer starts a timer in the room on one of the moderator's presets
+func (h *Hub) startTimer(ctx context.Context, roomID, userID, presetName string) (*models.RoomTimer, error) {
+	preset := defaultRoomPreset()
+	if h.timerSessions != nil {
+		userPreset, ok, err := h.timerSessions.Preset(ctx, userID, presetName)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errUnknownTimerPreset
+		}
+		preset = userPreset
+	}
+
+	timer := newRoomTimer(roomID, userID, preset, time.Now())
+	timers := h.mongoClient.GetCollection(database.CollectionNames.RoomTimers)
+	res, err := timers.InsertOne(ctx, timer)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, errTimerRunning
+	} else if err != nil {
+		return nil, err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		timer.ID = oid
+	}
+	return &timer, nil
+}
+
+// creditFocus credits completed focus blocks to the users in the room
+func (h *Hub) creditFocus(ctx context.Context, roomID string, blocks []models.GroupFocusBlock) {
+	if h.timerSessions == nil || len(blocks) == 0 {
+		return
+	}
+	var userIDs []string
+	for _, entry := range h.OnlineUsers(roomID) {
+		userIDs = append(userIDs, entry.UserID)
+	}
+	for _, block := range blocks {
+		credited, err := h.timerSessions.CreditGroupFocus(ctx, block, userIDs)
+		if err != nil {
+			log.Printf("Error crediting focus block in room %s: %v", roomID, err)
+			continue
+		}
+		log.Printf("Credited focus block in room %s to %d session(s)", roomID, credited)
+	}
+}
+
+// timerMessage describes the room's timer after an action; a nil timer
+// means it was stopped
+func timerMessage(messageType, roomID, action string, timer *models.RoomTimer, now time.Time) WSMessage {
+	data := map[string]interface{}{"action": action, "timer": nil}
+	if timer != nil && action != TimerActionStop {
+		data["timer"] = timer.ToResponse(now)
+	}
+	return WSMessage{
+		Type:      messageType,
+		RoomID:    roomID,
+		Timestamp: now,
+		Data:      data,
+	}
+}
+
+// broadcastTimer sends the timer's state after an action to everyone in the room
+func (h *Hub) broadcastTimer(roomID, userID, username, action string, timer *models.RoomTimer) {
+	message := timerMessage(MessageTypeTimerState, roomID, action, timer, time.Now())
+	message.UserID = userID
+	message.Username = username
+	h.broadcastToRoom(roomID, message, "")
+}
+
+// handleTimerMessage applies timer_* messages sent by room moderators
+func (h *Hub) handleTimerMessage(message WSMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	action := timerActions[message.Type]
+	presetName, _ := message.Data["preset"].(string)
+	timer, err := h.controlTimer(ctx, message.RoomID, message.UserID, action, presetName)
+	if err != nil {
+		h.sendToUser(message.UserID, message.RoomID, WSMessage{
+			Type:            MessageTypeError,
+			RoomID:          message.RoomID,
+			Content:         timerErrorContent(err, message.RoomID),
+			ClientMessageID: message.ClientMessageID,
+			Timestamp:       time.Now(),
+			Data:            map[string]interface{}{"messageType": message.Type},
+		})
+		return
+	}
+	h.broadcastTimer(message.RoomID, message.UserID, message.Username, action, timer)
+}
+
+// timerErrorContent is the message shown to users for a timer error
+func timerErrorContent(err error, roomID string) string {
+	switch err {
+	case errTimerNotModerator:
+		return "Only room moderators can control the timer"
+	case errTimerRunning:
+		return "A timer is already running in this room"
+	case errNoTimer:
+		return "No timer is running in this room"
+	case errTimerPaused:
+		return "The timer is already paused"
+	case errTimerNotPaused:
+		return "The timer is not paused"
+	case errUnknownTimerPreset:
+		return "Unknown pomodoro preset"
+	case errTimerConflict:
+		return "The timer was changed at the same time, try again"
+	}
+	log.Printf("Error updating timer in room %s: %v", roomID, err)
+	return "Failed to update timer"
+}
+
+// sendTimerState sends the room's timer to a client that just subscribed
+func (h *Hub) sendTimerState(client *Client, roomID string) {
+	if h.mongoClient == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	timer, err := h.loadTimer(ctx, roomID)
+	if err != nil {
+		log.Printf("Error loading timer of room %s: %v", roomID, err)
+		return
+	}
+	if timer == nil {
+		return
+	}
+	now := time.Now()
+	advanceTimer(timer, now)
+	h.sendToClient(client, timerMessage(MessageTypeTimerState, roomID, TimerActionSync, timer, now))
+}
+
+// runTimers moves on the timers of rooms with clients on this hub: phases
+// that ran out are completed and broadcast, and every few seconds the
+// clients get a tick with the remaining time
+func (h *Hub) runTimers() {
+	if h.mongoClient == nil {
+		return
+	}
+	ticker := time.NewTicker(timerCheckInterval)
+	defer ticker.Stop()
+
+	for checks := 1; ; checks++ {
+		<-ticker.C
+		rooms := h.localRooms()
+		if len(rooms) == 0 {
+			continue
+		}
+		h.advanceTimers(rooms, checks%timerTickEvery == 0)
+	}
+}
+
+// localRooms lists the rooms with clients on this hub
+func (h *Hub) localRooms() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	rooms := make([]string, 0, len(h.rooms))
+	for roomID := range h.rooms {
+		rooms = append(rooms, roomID)
+	}
+	return rooms
+}
+
+// advanceTimers completes the phases that ran out in the given rooms and,
+// when tick is set, sends the local clients the time remaining
+func (h *Hub) advanceTimers(rooms []string, tick bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"room_id": bson.M{"$in": rooms}}
+	if !tick {
+		filter["paused_at"] = nil
+		filter["phase_ends_at"] = bson.M{"$lte": now}
+	}
+	timers := h.mongoClient.GetCollection(database.CollectionNames.RoomTimers)
+	cursor, err := timers.Find(ctx, filter)
+	if err != nil {
+		log.Printf("Error loading room timers: %v", err)
+		return
+	}
+	var found []models.RoomTimer
+	if err := cursor.All(ctx, &found); err != nil {
+		log.Printf("Error decoding room timers: %v", err)
+		return
+	}
+
+	for i := range found {
+		timer := &found[i]
+		revision := timer.Revision
+		phaseStartedAt := timer.PhaseStartedAt
+		completed := advanceTimer(timer, now)
+
+		if !timer.PhaseStartedAt.Equal(phaseStartedAt) {
+			// The instance that saves the new phase first announces it
+			err := h.saveTimer(ctx, timer, revision, now)
+			if err == errTimerConflict {
+				continue
+			} else if err != nil {
+				log.Printf("Error saving timer of room %s: %v", timer.RoomID, err)
+				continue
+			}
+			h.creditFocus(ctx, timer.RoomID, completed)
+			h.broadcastTimer(timer.RoomID, "", "", TimerActionPhase, timer)
+			continue
+		}
+
+		// Every instance ticks its own clients
+		if tick {
+			h.deliver(Envelope{
+				Kind:    EnvelopeKindRoom,
+				RoomID:  timer.RoomID,
+				Message: timerMessage(MessageTypeTimerTick, timer.RoomID, "", timer, now),
+			})
+		}
+	}
+}
+
+// GetRoomTimer returns the room's timer, or null when none is running
+func GetRoomTimer(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userID")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		roomID := c.Param("roomId")
+		if !primitive.IsValidObjectID(roomID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+			return
+		}
+
+		canAccess, err := userCanAccessRoom(hub.mongoClient, roomID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify room access"})
+			return
+		}
+		if !canAccess {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this room"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		timer, err := hub.loadTimer(ctx, roomID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch timer"})
+			return
+		}
+		if timer == nil {
+			c.JSON(http.StatusOK, gin.H{"timer": nil})
+			return
+		}
+		now := time.Now()
+		advanceTimer(timer, now)
+		c.JSON(http.StatusOK, gin.H{"timer": timer.ToResponse(now)})
+	}
+}
+
+// RoomTimerHandler applies a timer action for a room moderator and
+// broadcasts the new state to the room
+func RoomTimerHandler(hub *Hub, action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userID")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		roomID := c.Param("roomId")
+		if !primitive.IsValidObjectID(roomID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+			return
+		}
+
+		var req models.RoomTimerRequest
+		if action == TimerActionStart && c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		timer, err := hub.controlTimer(ctx, roomID, userID, action, req.Preset)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch err {
+			case errTimerNotModerator:
+				status = http.StatusForbidden
+			case errNoTimer:
+				status = http.StatusNotFound
+			case errUnknownTimerPreset:
+				status = http.StatusBadRequest
+			case errTimerRunning, errTimerPaused, errTimerNotPaused, errTimerConflict:
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"error": timerErrorContent(err, roomID)})
+			return
+		}
+
+		hub.broadcastTimer(roomID, userID, c.GetString("username"), action, timer)
+		response := gin.H{"timer": nil}
+		if action != TimerActionStop {
+			response["timer"] = timer.ToResponse(time.Now())
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,80 @@
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+func TestAdvanceTimer(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	timer := newRoomTimer("room1", "alice", defaultRoomPreset(), start)
+
+	assert.Empty(t, advanceTimer(&timer, start.Add(24*time.Minute)))
+	assert.Equal(t, models.SegmentFocus, timer.Phase)
+	assert.Equal(t, time.Minute, timer.RemainingAt(start.Add(24*time.Minute)))
+
+	completed := advanceTimer(&timer, start.Add(26*time.Minute))
+	require.Len(t, completed, 1)
+	assert.Equal(t, models.GroupFocusBlock{RoomID: "room1", StartedAt: start, EndedAt: start.Add(25 * time.Minute)}, completed[0])
+	assert.Equal(t, models.SegmentShortBreak, timer.Phase)
+	assert.Equal(t, start.Add(25*time.Minute), timer.PhaseStartedAt)
+
+	// The fourth focus block is followed by the long break
+	completed = advanceTimer(&timer, start.Add(2*time.Hour))
+	assert.Len(t, completed, 3)
+	assert.Equal(t, 4, timer.CompletedFocus)
+	assert.Equal(t, models.SegmentLongBreak, timer.Phase)
+	assert.Equal(t, start.Add(115*time.Minute), timer.PhaseStartedAt)
+}
+
+func TestPauseAndResumeTimer(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	timer := newRoomTimer("room1", "alice", defaultRoomPreset(), start)
+
+	require.NoError(t, pauseTimer(&timer, start.Add(10*time.Minute)))
+	assert.Equal(t, errTimerPaused, pauseTimer(&timer, start.Add(11*time.Minute)))
+	assert.Empty(t, advanceTimer(&timer, start.Add(time.Hour)), "paused timers hold")
+	assert.Equal(t, 15*time.Minute, timer.RemainingAt(start.Add(time.Hour)))
+	assert.Nil(t, timer.ToResponse(start.Add(time.Hour)).PhaseEndsAt)
+
+	require.NoError(t, resumeTimer(&timer, start.Add(time.Hour)))
+	assert.Equal(t, errTimerNotPaused, resumeTimer(&timer, start.Add(time.Hour)))
+	assert.Equal(t, start.Add(75*time.Minute), timer.PhaseEndsAt)
+
+	// The credited block records when it ran, leaving out the pause
+	completed := advanceTimer(&timer, start.Add(75*time.Minute))
+	require.Len(t, completed, 1)
+	assert.Equal(t, start, completed[0].StartedAt)
+	assert.Equal(t, []models.TimerInterval{
+		{StartedAt: start, EndedAt: start.Add(10 * time.Minute)},
+		{StartedAt: start.Add(time.Hour), EndedAt: start.Add(75 * time.Minute)},
+	}, completed[0].Intervals())
+	assert.Empty(t, timer.PhaseRan, "the break starts without stretches")
+	assert.Nil(t, timer.ResumedAt)
+}
+
+func TestSkipTimer(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	timer := newRoomTimer("room1", "alice", defaultRoomPreset(), start)
+
+	skipTimer(&timer, start.Add(5*time.Minute))
+	assert.Equal(t, models.SegmentShortBreak, timer.Phase)
+	assert.Equal(t, 0, timer.CompletedFocus, "skipped focus blocks are not credited")
+
+	require.NoError(t, pauseTimer(&timer, start.Add(6*time.Minute)))
+	skipTimer(&timer, start.Add(7*time.Minute))
+	assert.Equal(t, models.SegmentFocus, timer.Phase)
+	assert.False(t, timer.IsPaused())
+	assert.Equal(t, start.Add(32*time.Minute), timer.PhaseEndsAt)
+}
+
+func TestTimerErrorContent(t *testing.T) {
+	assert.Equal(t, "Only room moderators can control the timer", timerErrorContent(errTimerNotModerator, "room1"))
+	assert.Equal(t, "The timer is already paused", timerErrorContent(errTimerPaused, "room1"))
+	assert.Equal(t, "Failed to update timer", timerErrorContent(assert.AnError, "room1"))
+}
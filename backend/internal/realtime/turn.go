@@ -0,0 +1,98 @@
+package realtime
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultTURNCredentialTTL is how long issued TURN credentials stay valid
+const defaultTURNCredentialTTL = time.Hour
+
+// TURNConfig holds the coturn REST API settings. coturn must run with
+// use-auth-secret and the same static-auth-secret.
+type TURNConfig struct {
+	Secret string
+	URIs   []string
+	TTL    time.Duration
+}
+
+// TURNCredentials are time-limited credentials for a TURN server
+type TURNCredentials struct {
+	Username   string    `json:"username"`
+	Credential string    `json:"credential"`
+	URIs       []string  `json:"uris"`
+	TTL        int       `json:"ttl"` // seconds
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// LoadTURNConfig reads TURN_SECRET, TURN_URIS (comma separated) and
+// TURN_TTL from the environment
+func LoadTURNConfig() TURNConfig {
+	config := TURNConfig{
+		Secret: os.Getenv("TURN_SECRET"),
+		TTL:    defaultTURNCredentialTTL,
+	}
+
+	for _, uri := range strings.Split(os.Getenv("TURN_URIS"), ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			config.URIs = append(config.URIs, uri)
+		}
+	}
+
+	if ttlStr := os.Getenv("TURN_TTL"); ttlStr != "" {
+		if ttl, err := time.ParseDuration(ttlStr); err == nil && ttl > 0 {
+			config.TTL = ttl
+		}
+	}
+	return config
+}
+
+// Enabled reports whether TURN credentials can be issued
+func (c TURNConfig) Enabled() bool {
+	return c.Secret != "" && len(c.URIs) > 0
+}
+
+// Credentials issues credentials following the coturn REST scheme: the
+// username is "<expiry unix time>:<user ID>" and the password is the
+// base64-encoded HMAC-SHA1 of the username keyed with the shared secret.
+func (c TURNConfig) Credentials(userID string, now time.Time) TURNCredentials {
+	expiresAt := now.Add(c.TTL)
+	username := strconv.FormatInt(expiresAt.Unix(), 10) + ":" + userID
+
+	mac := hmac.New(sha1.New, []byte(c.Secret))
+	mac.Write([]byte(username))
+
+	return TURNCredentials{
+		Username:   username,
+		Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		URIs:       c.URIs,
+		TTL:        int(c.TTL.Seconds()),
+		ExpiresAt:  expiresAt,
+	}
+}
+
+// GetTURNCredentials issues short-lived TURN credentials to the authenticated user
+func GetTURNCredentials(config TURNConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userID")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		if !config.Enabled() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "TURN server is not configured"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"turn": config.Credentials(userID, time.Now())})
+	}
+}
@@ -0,0 +1,42 @@
+package realtime
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTURNCredentials(t *testing.T) {
+	config := TURNConfig{
+		Secret: "shared-secret",
+		URIs:   []string{"turn:turn.example.com:3478?transport=udp"},
+		TTL:    10 * time.Minute,
+	}
+	assert.True(t, config.Enabled())
+	assert.False(t, TURNConfig{Secret: "shared-secret"}.Enabled())
+
+	now := time.Unix(1700000000, 0)
+	credentials := config.Credentials("user123", now)
+
+	assert.Equal(t, "1700000600:user123", credentials.Username)
+	assert.Equal(t, 600, credentials.TTL)
+	assert.Equal(t, now.Add(10*time.Minute), credentials.ExpiresAt)
+
+	mac := hmac.New(sha1.New, []byte("shared-secret"))
+	mac.Write([]byte("1700000600:user123"))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(mac.Sum(nil)), credentials.Credential)
+}
+
+func TestLoadTURNConfig(t *testing.T) {
+	t.Setenv("TURN_SECRET", "secret")
+	t.Setenv("TURN_URIS", "turn:a.example.com:3478, turns:a.example.com:5349 ,")
+	t.Setenv("TURN_TTL", "30m")
+
+	config := LoadTURNConfig()
+	assert.Equal(t, []string{"turn:a.example.com:3478", "turns:a.example.com:5349"}, config.URIs)
+	assert.Equal(t, 30*time.Minute, config.TTL)
+}
@@ -11,12 +11,30 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
+	"github.com/studyplatform/backend/internal/realtime"
 	"github.com/studyplatform/backend/pkg/database"
 	"github.com/studyplatform/backend/pkg/models"
 )
 
+// newParticipantInfo builds a participant entry with the user's live presence.
+// Offline users report when they were last seen.
+func newParticipantInfo(participant models.User, presence realtime.UserPresence) models.ParticipantInfo {
+	info := models.ParticipantInfo{
+		UserID:    participant.UniqueID,
+		Username:  participant.Username,
+		AvatarURL: participant.AvatarURL,
+		IsOnline:  presence.IsOnline(),
+		Status:    presence.Status,
+		LastSeen:  participant.LastActive,
+	}
+	if info.IsOnline {
+		info.LastSeen = time.Now()
+	}
+	return info
+}
+
 // ListRoomsHandler returns all rooms for the authenticated user
-func ListRoomsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func ListRoomsHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -70,18 +88,14 @@ func ListRoomsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 					roomResponse := room.ToResponse()
 					roomResponse.CreatorUsername = creator.Username
 
-					// Populate participant details
+					// Populate participant details with live presence
+					presence := hub.UsersPresence(room.Participants)
 					var participantInfos []models.ParticipantInfo
 					for _, participantID := range room.Participants {
 						var participant models.User
 						participantFilter := bson.M{"unique_id": participantID}
 						if err := users.FindOne(ctx, participantFilter).Decode(&participant); err == nil {
-							participantInfos = append(participantInfos, models.ParticipantInfo{
-								UserID:    participant.UniqueID,
-								Username:  participant.Username,
-								AvatarURL: participant.AvatarURL,
-								IsOnline:  participant.IsActive, // Use IsActive as a simple online indicator
-							})
+							participantInfos = append(participantInfos, newParticipantInfo(participant, presence[participantID]))
 						} else {
 							// If participant not found, still add them with basic info
 							participantInfos = append(participantInfos, models.ParticipantInfo{
@@ -89,6 +103,7 @@ func ListRoomsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 								Username:  "Unknown User",
 								AvatarURL: "",
 								IsOnline:  false,
+								Status:    realtime.PresenceOffline,
 							})
 						}
 					}
@@ -99,18 +114,14 @@ func ListRoomsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 					// If creator not found, still add room but with empty username
 					roomResponse := room.ToResponse()
 
-					// Populate participant details even if creator not found
+					// Populate participant details even if creator not found with live presence
+					presence := hub.UsersPresence(room.Participants)
 					var participantInfos []models.ParticipantInfo
 					for _, participantID := range room.Participants {
 						var participant models.User
 						participantFilter := bson.M{"unique_id": participantID}
 						if err := users.FindOne(ctx, participantFilter).Decode(&participant); err == nil {
-							participantInfos = append(participantInfos, models.ParticipantInfo{
-								UserID:    participant.UniqueID,
-								Username:  participant.Username,
-								AvatarURL: participant.AvatarURL,
-								IsOnline:  participant.IsActive,
-							})
+							participantInfos = append(participantInfos, newParticipantInfo(participant, presence[participantID]))
 						} else {
 							// If participant not found, still add them with basic info
 							participantInfos = append(participantInfos, models.ParticipantInfo{
@@ -118,6 +129,7 @@ func ListRoomsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 								Username:  "Unknown User",
 								AvatarURL: "",
 								IsOnline:  false,
+								Status:    realtime.PresenceOffline,
 							})
 						}
 					}
@@ -132,8 +144,9 @@ func ListRoomsHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 	}
 }
 
-// CreateRoomHandler creates a new study room
-func CreateRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+// CreateRoomHandler creates a new study room. With requireVerifiedEmail,
+// users must verify their email address before creating shared rooms.
+func CreateRoomHandler(mongoClient *database.MongoClient, requireVerifiedEmail bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -166,6 +179,10 @@ func CreateRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			// If user not found, just use the original userIDStr
 			user.UniqueID = userIDStr
 		}
+		if requireVerifiedEmail && !user.IsVerified {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Verify your email address to create shared rooms"})
+			return
+		}
 
 		now := time.Now()
 		roomMap := bson.M{
@@ -225,7 +242,7 @@ func CreateRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 }
 
 // GetRoomHandler returns a specific room by ID
-func GetRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func GetRoomHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		roomID := c.Param("id")
 		if roomID == "" {
@@ -258,18 +275,14 @@ func GetRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			roomResponse := room.ToResponse()
 			roomResponse.CreatorUsername = creator.Username
 
-			// Populate participant details
+			// Populate participant details with live presence
+			presence := hub.UsersPresence(room.Participants)
 			var participantInfos []models.ParticipantInfo
 			for _, participantID := range room.Participants {
 				var participant models.User
 				participantFilter := bson.M{"unique_id": participantID}
 				if err := users.FindOne(ctx, participantFilter).Decode(&participant); err == nil {
-					participantInfos = append(participantInfos, models.ParticipantInfo{
-						UserID:    participant.UniqueID,
-						Username:  participant.Username,
-						AvatarURL: participant.AvatarURL,
-						IsOnline:  participant.IsActive,
-					})
+					participantInfos = append(participantInfos, newParticipantInfo(participant, presence[participantID]))
 				} else {
 					// If participant not found, still add them with basic info
 					participantInfos = append(participantInfos, models.ParticipantInfo{
@@ -277,6 +290,7 @@ func GetRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 						Username:  "Unknown User",
 						AvatarURL: "",
 						IsOnline:  false,
+						Status:    realtime.PresenceOffline,
 					})
 				}
 			}
@@ -287,18 +301,14 @@ func GetRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			// If creator not found, still return room but with empty username
 			roomResponse := room.ToResponse()
 
-			// Populate participant details even if creator not found
+			// Populate participant details even if creator not found with live presence
+			presence := hub.UsersPresence(room.Participants)
 			var participantInfos []models.ParticipantInfo
 			for _, participantID := range room.Participants {
 				var participant models.User
 				participantFilter := bson.M{"unique_id": participantID}
 				if err := users.FindOne(ctx, participantFilter).Decode(&participant); err == nil {
-					participantInfos = append(participantInfos, models.ParticipantInfo{
-						UserID:    participant.UniqueID,
-						Username:  participant.Username,
-						AvatarURL: participant.AvatarURL,
-						IsOnline:  participant.IsActive,
-					})
+					participantInfos = append(participantInfos, newParticipantInfo(participant, presence[participantID]))
 				} else {
 					// If participant not found, still add them with basic info
 					participantInfos = append(participantInfos, models.ParticipantInfo{
@@ -306,6 +316,7 @@ func GetRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 						Username:  "Unknown User",
 						AvatarURL: "",
 						IsOnline:  false,
+						Status:    realtime.PresenceOffline,
 					})
 				}
 			}
@@ -739,7 +750,7 @@ func LeaveRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 }
 
 // InviteUserToRoomHandler invites a user to join a room
-func InviteUserToRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+func InviteUserToRoomHandler(mongoClient *database.MongoClient, hub *realtime.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -822,11 +833,13 @@ func InviteUserToRoomHandler(mongoClient *database.MongoClient) gin.HandlerFunc
 			room.Name,
 		)
 
-		_, err = notifications.InsertOne(ctx, roomInvitationNotification)
+		res, err := notifications.InsertOne(ctx, roomInvitationNotification)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation notification"})
 			return
 		}
+		roomInvitationNotification.ID, _ = res.InsertedID.(primitive.ObjectID)
+		hub.NotifyUser(targetUser.UniqueID, roomInvitationNotification)
 
 		c.JSON(http.StatusOK, gin.H{"message": "User invited to room successfully"})
 	}
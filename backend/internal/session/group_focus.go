@@ -0,0 +1,112 @@
+package session
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// RoomTimerSessions connects the shared timers of rooms to study sessions
+type RoomTimerSessions struct {
+	mongoClient *database.MongoClient
+	timing      TimingConfig
+}
+
+// NewRoomTimerSessions creates the link between room timers and sessions
+func NewRoomTimerSessions(mongoClient *database.MongoClient, timing TimingConfig) *RoomTimerSessions {
+	return &RoomTimerSessions{mongoClient: mongoClient, timing: timing}
+}
+
+// Preset returns one of the user's pomodoro presets by name, the first if
+// name is empty. It reports false for names the user has no preset for.
+func (s *RoomTimerSessions) Preset(ctx context.Context, userID, name string) (models.PomodoroPreset, bool, error) {
+	preset, err := userPreset(ctx, s.mongoClient, s.timing, userID, name)
+	if err == errUnknownPreset {
+		return models.PomodoroPreset{}, false, nil
+	} else if err != nil {
+		return models.PomodoroPreset{}, false, err
+	}
+	return preset, true, nil
+}
+
+// CreditGroupFocus records a completed focus block of a room's timer in the
+// active sessions in that room of the given users. Only users whose
+// heartbeats show they studied through every stretch the timer ran are
+// credited; it returns how many were.
+func (s *RoomTimerSessions) CreditGroupFocus(ctx context.Context, block models.GroupFocusBlock, userIDs []string) (int, error) {
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	sessions := s.mongoClient.GetCollection(database.CollectionNames.Sessions)
+	cursor, err := sessions.Find(ctx, bson.M{
+		"user_id":   bson.M{"$in": userIDs},
+		"room_id":   block.RoomID,
+		"is_active": true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var active []models.Session
+	if err := cursor.All(ctx, &active); err != nil {
+		return 0, err
+	}
+
+	credited := 0
+	for _, session := range active {
+		if session.StartTime.After(block.StartedAt) || !s.timing.studiedThroughBlock(session.Heartbeats, block) {
+			continue
+		}
+		result, err := sessions.UpdateOne(ctx,
+			bson.M{
+				"_id":         session.ID,
+				"is_active":   true,
+				"group_focus": bson.M{"$not": bson.M{"$elemMatch": bson.M{"room_id": block.RoomID, "started_at": block.StartedAt}}},
+			},
+			bson.M{"$push": bson.M{"group_focus": block}, "$set": bson.M{"updated_at": time.Now()}},
+		)
+		if err != nil {
+			return credited, err
+		}
+		credited += int(result.ModifiedCount)
+	}
+	return credited, nil
+}
+
+// studiedThroughBlock reports whether the heartbeats show the user active
+// whenever the block's timer ran. Pauses do not count.
+func (c TimingConfig) studiedThroughBlock(heartbeats []time.Time, block models.GroupFocusBlock) bool {
+	for _, interval := range block.Intervals() {
+		if !c.studiedThrough(heartbeats, interval.StartedAt, interval.EndedAt) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupFocusCredit counts the group focus blocks of a session that earn a
+// pomodoro. Blocks overlapping a focus block the session completed on its
+// own timer are not counted twice.
+func groupFocusCredit(session *models.Session) int {
+	credit := 0
+	for _, block := range session.GroupFocus {
+		overlaps := false
+		for _, segment := range session.Segments {
+			if segment.Type != models.SegmentFocus || !segment.Completed || segment.EndedAt == nil {
+				continue
+			}
+			if segment.StartedAt.Before(block.EndedAt) && block.StartedAt.Before(*segment.EndedAt) {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			credit++
+		}
+	}
+	return credit
+}
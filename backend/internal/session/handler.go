@@ -10,12 +10,14 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
+	"github.com/studyplatform/backend/internal/xp"
 	"github.com/studyplatform/backend/pkg/database"
 	"github.com/studyplatform/backend/pkg/models"
 )
 
-// StartSessionHandler starts a new study session
-func StartSessionHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+// StartSessionHandler starts a new study session. Users study in one
+// session at a time, so a session still active is ended first.
+func StartSessionHandler(mongoClient *database.MongoClient, ledger *xp.Ledger, timing TimingConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -35,17 +37,54 @@ func StartSessionHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 		sessions := mongoClient.GetCollection(database.CollectionNames.Sessions)
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
+
+		preset, err := userPreset(ctx, mongoClient, timing, userIDStr, req.Preset)
+		if err == errUnknownPreset {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown pomodoro preset"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// End the previous session where the user last studied in it
+		var previous models.Session
+		err = sessions.FindOne(ctx, bson.M{"user_id": userIDStr, "is_active": true}).Decode(&previous)
+		if err == nil {
+			previous, err = closeSession(ctx, mongoClient, ledger, timing, previous, time.Now(), models.SessionEndReplaced, models.ReportedTiming{}, nil)
+			if err != nil && err != errSessionNotActive {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end previous session"})
+				return
+			}
+		} else if err != mongo.ErrNoDocuments {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// Sessions start with a focus block
+		now := time.Now()
+		first := models.Segment{
+			Type:      models.SegmentFocus,
+			StartedAt: now,
+			Planned:   int64(preset.Length(models.SegmentFocus).Seconds()),
+		}
 		sessionMap := bson.M{
 			"user_id":            userIDStr,
 			"room_id":            req.RoomID,
-			"start_time":         time.Now(),
+			"start_time":         now,
 			"is_active":          true,
 			"xp_earned":          0,
 			"pomodoro_completed": 0,
+			"paused_time":        0,
+			"preset":             preset,
+			"segments":           []models.Segment{first},
 			"inactivity_periods": []bson.M{},
 		}
 		res, err := sessions.InsertOne(ctx, sessionMap)
-		if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Another session was started at the same time"})
+			return
+		} else if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
 			return
 		}
@@ -58,12 +97,18 @@ func StartSessionHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch created session"})
 			return
 		}
-		c.JSON(http.StatusCreated, gin.H{"session": session.ToResponse()})
+
+		response := segmentResponse(session, now)
+		if !previous.ID.IsZero() && !previous.IsActive {
+			response["endedSession"] = previous.ToResponse()
+		}
+		c.JSON(http.StatusCreated, response)
 	}
 }
 
-// EndSessionHandler ends a study session
-func EndSessionHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+// CurrentSessionHandler returns the user's active session, if any, with
+// the time the server measured so far
+func CurrentSessionHandler(mongoClient *database.MongoClient, timing TimingConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -76,14 +121,51 @@ func EndSessionHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			return
 		}
 
-		var req struct {
-			SessionID        string            `json:"sessionId" binding:"required"`
-			Duration         int64             `json:"duration" binding:"required"` // In seconds
-			InactiveDuration int64             `json:"inactiveDuration"`            // In seconds
-			PomodoroCount    int               `json:"pomodoroCount"`               // Number of completed pomodoros
-			ActivityData     []models.Activity `json:"activityData"`
+		sessions := mongoClient.GetCollection(database.CollectionNames.Sessions)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var session models.Session
+		err := sessions.FindOne(ctx, bson.M{"user_id": userIDStr, "is_active": true}).Decode(&session)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusOK, gin.H{"session": nil})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
 		}
 
+		// Segments that ran out since the last change are shown as the timer
+		// has moved on; they are written when the session next changes
+		now := time.Now()
+		timing.advance(&session, now)
+		measured := timing.Measure(session.StartTime, now, session.Heartbeats)
+		response := segmentResponse(session, now)
+		response["elapsed"] = int64(measured.Duration.Seconds())
+		response["inactiveTime"] = int64(measured.Inactive.Seconds())
+		response["abandonsAt"] = lastSeen(session).Add(timing.AbandonAfter)
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// EndSessionHandler ends a study session. Its duration and inactive time
+// are measured from the start time and the recorded heartbeats; what the
+// client reports is only compared with them, and sessions whose reports
+// diverge are flagged.
+func EndSessionHandler(mongoClient *database.MongoClient, ledger *xp.Ledger, timing TimingConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		var req models.EndSessionRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
 			return
@@ -96,7 +178,6 @@ func EndSessionHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 		}
 
 		sessions := mongoClient.GetCollection(database.CollectionNames.Sessions)
-		users := mongoClient.GetCollection(database.CollectionNames.Users)
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
@@ -111,59 +192,26 @@ func EndSessionHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 			return
 		}
 
-		// Calculate XP earned
-		xpEarned := calculateXPEarned(req.Duration, req.InactiveDuration, req.PomodoroCount)
-
-		// Update session
-		endTime := time.Now()
-		sessionUpdate := bson.M{
-			"$set": bson.M{
-				"end_time":           endTime,
-				"duration":           req.Duration,
-				"inactive_time":      req.InactiveDuration,
-				"xp_earned":          xpEarned,
-				"is_active":          false,
-				"pomodoro_completed": req.PomodoroCount,
-				"activities":         req.ActivityData,
-				"updated_at":         time.Now(),
-			},
-		}
-
-		_, err = sessions.UpdateOne(ctx, bson.M{"_id": sessionObjID}, sessionUpdate)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
-			return
-		}
-
-		// Update user XP
-		userUpdate := bson.M{
-			"$inc": bson.M{"xp": xpEarned},
-			"$set": bson.M{"last_active": time.Now()},
-		}
-
-		_, err = users.UpdateOne(ctx, bson.M{"unique_id": userIDStr}, userUpdate)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user XP"})
+		session, err = closeSession(ctx, mongoClient, ledger, timing, session, time.Now(), models.SessionEndUser, req.Reported(), req.ActivityData)
+		if err == errSessionNotActive {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Active session not found"})
 			return
-		}
-
-		// Get updated session
-		err = sessions.FindOne(ctx, bson.M{"_id": sessionObjID}).Decode(&session)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch updated session"})
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end session"})
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"session":  session.ToResponse(),
-			"xpEarned": xpEarned,
+			"xpEarned": session.XPEarned,
 			"message":  "Session ended successfully",
 		})
 	}
 }
 
-// ActivityPingHandler updates user activity to prevent session timeout
-func ActivityPingHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+// ActivityPingHandler records a heartbeat of an active session. The server
+// times sessions from these, so clients ping while the user studies.
+func ActivityPingHandler(mongoClient *database.MongoClient, timing TimingConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
@@ -190,7 +238,7 @@ func ActivityPingHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 
 		var req struct {
 			ActivityType string `json:"activityType" binding:"required"`
-			Timestamp    string `json:"timestamp"`
+			Timestamp    string `json:"timestamp"` // ignored; heartbeats use server time
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -202,28 +250,49 @@ func ActivityPingHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		// Create activity record
-		activity := models.Activity{
-			Type:      req.ActivityType,
-			Timestamp: time.Now(),
-			Details:   "User activity ping",
+		now := time.Now()
+		filter := bson.M{"_id": sessionObjID, "user_id": userIDStr, "is_active": true}
+
+		// Record the heartbeat unless one was recorded moments ago, which
+		// keeps sessions of eager clients small
+		recorded := bson.M{
+			"_id":       sessionObjID,
+			"user_id":   userIDStr,
+			"is_active": true,
+			"$or": []bson.M{
+				{"last_ping_at": bson.M{"$exists": false}},
+				{"last_ping_at": bson.M{"$lte": now.Add(-timing.PingInterval)}},
+			},
 		}
-
-		// Update session with new activity
 		update := bson.M{
-			"$push": bson.M{"activities": activity},
-			"$set":  bson.M{"updated_at": time.Now()},
+			"$push": bson.M{
+				"heartbeats": pushLatest([]time.Time{now}, maxHeartbeats),
+				"activities": pushLatest([]models.Activity{{
+					Type:      req.ActivityType,
+					Timestamp: now,
+					Details:   "User activity ping",
+				}}, maxActivities),
+			},
+			"$set": bson.M{"last_ping_at": now, "updated_at": now},
 		}
 
-		result, err := sessions.UpdateOne(ctx, bson.M{"_id": sessionObjID, "user_id": userIDStr, "is_active": true}, update)
+		result, err := sessions.UpdateOne(ctx, recorded, update)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
 			return
 		}
 
-		if result.ModifiedCount == 0 {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Active session not found"})
-			return
+		if result.MatchedCount == 0 {
+			// Either too soon after the last heartbeat or not an active session
+			count, err := sessions.CountDocuments(ctx, filter)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			if count == 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Active session not found"})
+				return
+			}
 		}
 
 		c.JSON(http.StatusOK, gin.H{"message": "Activity recorded"})
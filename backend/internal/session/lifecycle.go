@@ -0,0 +1,263 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/internal/xp"
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// errSessionNotActive is returned when a session was ended concurrently
+var errSessionNotActive = errors.New("session is not active")
+
+// A session keeps only its most recent heartbeats and activities, so one
+// left open for days stays a bounded document. maxHeartbeats is a day of
+// heartbeats at the default PingInterval.
+const (
+	maxHeartbeats = 8640
+	maxActivities = 1000
+)
+
+// pushLatest appends values to an array field, dropping the oldest entries
+// beyond max
+func pushLatest(values interface{}, max int) bson.M {
+	return bson.M{"$each": values, "$slice": -max}
+}
+
+// closeSession ends an active session at end, measuring it from its
+// heartbeats, and awards the user's XP in the same transaction. Sessions
+// with segments earn XP for the time spent in focus blocks and a pomodoro
+// per completed focus block, of their own timer or the room's. Only one
+// caller can close a session; the others get errSessionNotActive.
+func closeSession(ctx context.Context, mongoClient *database.MongoClient, ledger *xp.Ledger, timing TimingConfig, session models.Session, end time.Time, reason string, reported models.ReportedTiming, activities []models.Activity) (models.Session, error) {
+	measured := timing.Measure(session.StartTime, end, session.Heartbeats)
+	studied := measured
+	pomodoros := 0
+	if len(session.Segments) > 0 {
+		timing.finishSegments(&session, end)
+		studied = timing.studied(&session, end)
+		pomodoros = studied.MaxPomodoros + groupFocusCredit(&session)
+		measured.MaxPomodoros = pomodoros
+	} else {
+		// Sessions started before segments existed
+		pomodoros = creditedPomodoros(measured, reported) + groupFocusCredit(&session)
+	}
+	flags := timing.Flags(measured, reported)
+	if len(flags) > 0 {
+		logger.Warn("Session timing reported by client diverges",
+			logger.Field("user_id", session.UserID),
+			logger.Field("session_id", session.ID.Hex()),
+			logger.Field("flags", flags),
+			logger.Field("measured_duration", int64(measured.Duration.Seconds())),
+			logger.Field("measured_inactive", int64(measured.Inactive.Seconds())),
+		)
+	}
+
+	duration := int64(measured.Duration.Seconds())
+	inactive := int64(measured.Inactive.Seconds())
+	xpEarned := calculateXPEarned(int64(studied.Duration.Seconds()), int64(studied.Inactive.Seconds()), pomodoros)
+
+	set := bson.M{
+		"end_time":           end,
+		"end_reason":         reason,
+		"duration":           duration,
+		"inactive_time":      inactive,
+		"xp_earned":          xpEarned,
+		"is_active":          false,
+		"pomodoro_completed": pomodoros,
+		"updated_at":         time.Now(),
+	}
+	if len(session.Segments) > 0 {
+		set["segments"] = session.Segments
+		set["paused_time"] = session.PausedTime
+	}
+	if reported != (models.ReportedTiming{}) {
+		set["reported"] = reported
+	}
+	if len(flags) > 0 {
+		set["flags"] = flags
+	}
+	update := bson.M{"$set": set}
+	if len(activities) > 0 {
+		update["$push"] = bson.M{"activities": pushLatest(activities, maxActivities)}
+	}
+
+	sessions := mongoClient.GetCollection(database.CollectionNames.Sessions)
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+	var closed models.Session
+	write := func(ctx context.Context) error {
+		err := sessions.FindOneAndUpdate(ctx,
+			bson.M{"_id": session.ID, "is_active": true},
+			update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&closed)
+		if err == mongo.ErrNoDocuments {
+			return errSessionNotActive
+		} else if err != nil {
+			return err
+		}
+		_, err = users.UpdateOne(ctx, bson.M{"unique_id": session.UserID}, bson.M{"$max": bson.M{"last_active": end}})
+		return err
+	}
+	_, err := ledger.AwardWith(ctx, models.XPHistory{
+		UserID:    session.UserID,
+		Key:       "session:" + session.ID.Hex(),
+		XP:        xpEarned,
+		Source:    models.XPSourceSession,
+		SessionID: session.ID.Hex(),
+	}, write)
+	if err == xp.ErrUserNotFound {
+		// Sessions of deleted users still close
+		_, err = ledger.AwardWith(ctx, models.XPHistory{}, write)
+	} else if err == xp.ErrAlreadyAwarded {
+		// Whoever closed the session first was awarded its XP
+		err = errSessionNotActive
+	}
+	if err != nil {
+		return models.Session{}, err
+	}
+	return closed, nil
+}
+
+// lastSeen is the last time a session is known to have been in use
+func lastSeen(session models.Session) time.Time {
+	if session.LastPingAt != nil && session.LastPingAt.After(session.StartTime) {
+		return *session.LastPingAt
+	}
+	return session.StartTime
+}
+
+// Reaper closes sessions whose clients went away without ending them
+type Reaper struct {
+	mongoClient *database.MongoClient
+	ledger      *xp.Ledger
+	timing      TimingConfig
+	stop        chan struct{}
+}
+
+// NewReaper creates a reaper for abandoned sessions
+func NewReaper(mongoClient *database.MongoClient, ledger *xp.Ledger, timing TimingConfig) *Reaper {
+	return &Reaper{
+		mongoClient: mongoClient,
+		ledger:      ledger,
+		timing:      timing,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Start closes abandoned sessions every ReapInterval until Stop is called
+func (r *Reaper) Start() {
+	ticker := time.NewTicker(r.timing.ReapInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.reap()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the reaper
+func (r *Reaper) Stop() {
+	close(r.stop)
+}
+
+// reap closes every session without a ping for AbandonAfter. They end at
+// their last ping, so only the verified active part earns XP.
+func (r *Reaper) reap() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timing.ReapInterval)
+	defer cancel()
+
+	cutoff := time.Now().Add(-r.timing.AbandonAfter)
+	sessions := r.mongoClient.GetCollection(database.CollectionNames.Sessions)
+	cursor, err := sessions.Find(ctx, bson.M{
+		"is_active": true,
+		"$or": []bson.M{
+			{"last_ping_at": bson.M{"$lt": cutoff}},
+			{"last_ping_at": bson.M{"$exists": false}, "start_time": bson.M{"$lt": cutoff}},
+		},
+	})
+	if err != nil {
+		logger.Error("Failed to find abandoned sessions", logger.Field("error", err))
+		return
+	}
+	defer cursor.Close(ctx)
+
+	closed := 0
+	for cursor.Next(ctx) {
+		var session models.Session
+		if err := cursor.Decode(&session); err != nil {
+			logger.Error("Failed to decode abandoned session", logger.Field("error", err))
+			continue
+		}
+		_, err := closeSession(ctx, r.mongoClient, r.ledger, r.timing, session, lastSeen(session), models.SessionEndAbandoned, models.ReportedTiming{}, nil)
+		if err == errSessionNotActive {
+			continue
+		} else if err != nil {
+			logger.Error("Failed to close abandoned session", logger.Field("session_id", session.ID.Hex()), logger.Field("error", err))
+			continue
+		}
+		closed++
+	}
+	if closed > 0 {
+		logger.Info("Closed abandoned sessions", logger.Field("count", closed))
+	}
+}
+
+// EnsureSessionIndexes creates the indexes of study sessions. Users may
+// have one active session at a time, so active sessions beyond a user's
+// newest are closed before the index enforcing it is built.
+func EnsureSessionIndexes(mongoClient *database.MongoClient, ledger *xp.Ledger, timing TimingConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sessions := mongoClient.GetCollection(database.CollectionNames.Sessions)
+	cursor, err := sessions.Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"is_active": true}},
+		{"$sort": bson.M{"start_time": -1}},
+		{"$group": bson.M{"_id": "$user_id", "sessions": bson.M{"$push": "$$ROOT"}, "count": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	var duplicates []struct {
+		Sessions []models.Session `bson:"sessions"`
+	}
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return err
+	}
+	for _, user := range duplicates {
+		for _, session := range user.Sessions[1:] {
+			_, err := closeSession(ctx, mongoClient, ledger, timing, session, lastSeen(session), models.SessionEndReplaced, models.ReportedTiming{}, nil)
+			if err != nil && err != errSessionNotActive {
+				return err
+			}
+		}
+	}
+
+	_, err = sessions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// At most one active session per user
+			Keys:    bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("active_user").SetUnique(true).SetPartialFilterExpression(bson.M{"is_active": true}),
+		},
+		{
+			Keys:    bson.D{{Key: "is_active", Value: 1}, {Key: "last_ping_at", Value: 1}},
+			Options: options.Index().SetName("active_last_ping"),
+		},
+	})
+	return err
+}
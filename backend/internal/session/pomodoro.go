@@ -0,0 +1,249 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// userPreset looks up one of the user's pomodoro presets by name
+func userPreset(ctx context.Context, mongoClient *database.MongoClient, timing TimingConfig, userID, name string) (models.PomodoroPreset, error) {
+	var user models.User
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+	err := users.FindOne(ctx,
+		bson.M{"unique_id": userID},
+		options.FindOne().SetProjection(bson.M{"pomodoro_presets": 1}),
+	).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return models.PomodoroPreset{}, err
+	}
+	return findPreset(timing.Presets(user), name)
+}
+
+// GetPomodoroPresetsHandler returns the user's pomodoro presets
+func GetPomodoroPresetsHandler(mongoClient *database.MongoClient, timing TimingConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var user models.User
+		err := users.FindOne(ctx,
+			bson.M{"unique_id": userIDStr},
+			options.FindOne().SetProjection(bson.M{"pomodoro_presets": 1}),
+		).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"presets": timing.Presets(user), "default": timing.DefaultPreset()})
+	}
+}
+
+// UpdatePomodoroPresetsHandler replaces the user's pomodoro presets. The
+// first is used when a session starts without naming one; an empty list
+// restores the default.
+func UpdatePomodoroPresetsHandler(mongoClient *database.MongoClient, timing TimingConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		var req models.UpdatePomodoroPresetsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+		if err := validatePresets(req.Presets); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Preset names must be unique"})
+			return
+		}
+
+		users := mongoClient.GetCollection(database.CollectionNames.Users)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		update := bson.M{"$set": bson.M{"pomodoro_presets": req.Presets, "updated_at": time.Now()}}
+		if len(req.Presets) == 0 {
+			update = bson.M{"$unset": bson.M{"pomodoro_presets": ""}, "$set": bson.M{"updated_at": time.Now()}}
+		}
+		result, err := users.UpdateOne(ctx, bson.M{"unique_id": userIDStr}, update)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update presets"})
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"presets": timing.Presets(models.User{PomodoroPresets: req.Presets})})
+	}
+}
+
+// StartSegmentHandler ends the running segment of a session and starts a
+// focus block or break
+func StartSegmentHandler(mongoClient *database.MongoClient, timing TimingConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.StartSegmentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+		updateSegments(c, mongoClient, timing, func(session *models.Session, now time.Time) error {
+			return timing.startSegment(session, req.Type, now)
+		})
+	}
+}
+
+// PauseSessionHandler pauses a session's timer
+func PauseSessionHandler(mongoClient *database.MongoClient, timing TimingConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		updateSegments(c, mongoClient, timing, timing.pause)
+	}
+}
+
+// ResumeSessionHandler resumes a paused session where it was paused
+func ResumeSessionHandler(mongoClient *database.MongoClient, timing TimingConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		updateSegments(c, mongoClient, timing, timing.resume)
+	}
+}
+
+// SkipSegmentHandler ends the running segment early and starts the next
+func SkipSegmentHandler(mongoClient *database.MongoClient, timing TimingConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		updateSegments(c, mongoClient, timing, timing.skip)
+	}
+}
+
+// updateSegments applies a change to the segments of the user's active
+// session in the path. Changes are written only if no other one was made
+// since the session was read. Changing the timer is activity, so it also
+// counts as a heartbeat.
+func updateSegments(c *gin.Context, mongoClient *database.MongoClient, timing TimingConfig, change func(*models.Session, time.Time) error) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userIDStr, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+		return
+	}
+
+	sessionObjID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	sessions := mongoClient.GetCollection(database.CollectionNames.Sessions)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var session models.Session
+	err = sessions.FindOne(ctx, bson.M{"_id": sessionObjID, "user_id": userIDStr, "is_active": true}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Active session not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	now := time.Now()
+	read := len(session.Segments)
+	session.Heartbeats = append(session.Heartbeats, now)
+	switch err := change(&session, now); err {
+	case nil:
+	case errSessionPaused:
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is already paused"})
+		return
+	case errSessionNotPaused:
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is not paused"})
+		return
+	case errNoSegments:
+		c.JSON(http.StatusConflict, gin.H{"error": "Session has no running segment"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
+		return
+	}
+
+	// Segments are only ever appended, so their count tells whether the
+	// session changed in between
+	filter := bson.M{
+		"_id":       sessionObjID,
+		"user_id":   userIDStr,
+		"is_active": true,
+		"segments":  bson.M{"$size": read},
+	}
+	if read == 0 {
+		filter["segments"] = bson.M{"$in": bson.A{nil, bson.A{}}}
+	}
+	result, err := sessions.UpdateOne(ctx, filter, bson.M{
+		"$set": bson.M{
+			"segments":           session.Segments,
+			"pomodoro_completed": session.PomodoroCompleted,
+			"paused_time":        int64(pausedTime(session.Segments, now).Seconds()),
+			"last_ping_at":       now,
+			"updated_at":         now,
+		},
+		"$push": bson.M{"heartbeats": pushLatest([]time.Time{now}, maxHeartbeats)},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session was changed at the same time, try again"})
+		return
+	}
+
+	c.JSON(http.StatusOK, segmentResponse(session, now))
+}
+
+// segmentResponse describes a session with its running segment
+func segmentResponse(session models.Session, now time.Time) gin.H {
+	response := gin.H{"session": session.ToResponse(), "segment": nil}
+	if segment := openSegment(&session); segment != nil {
+		response["segment"] = segment
+		if segment.Planned > 0 {
+			response["segmentEndsAt"] = segment.StartedAt.Add(time.Duration(segment.Planned) * time.Second)
+		}
+	}
+	return response
+}
@@ -0,0 +1,286 @@
+package session
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+var (
+	errSessionPaused    = errors.New("session is paused")
+	errSessionNotPaused = errors.New("session is not paused")
+	errNoSegments       = errors.New("session has no segments")
+	errDuplicatePreset  = errors.New("preset names must be unique")
+	errUnknownPreset    = errors.New("unknown pomodoro preset")
+)
+
+const (
+	defaultPresetName = "Classic"
+	// maxAutoSegments bounds how many segments advance starts at once
+	maxAutoSegments = 1000
+)
+
+// DefaultPreset is the preset of users who have not set up their own
+func (c TimingConfig) DefaultPreset() models.PomodoroPreset {
+	return models.PomodoroPreset{
+		Name:           defaultPresetName,
+		Focus:          int(c.PomodoroLength / time.Minute),
+		ShortBreak:     5,
+		LongBreak:      15,
+		LongBreakEvery: 4,
+	}
+}
+
+// Presets returns a user's presets, or the default one if they have none
+func (c TimingConfig) Presets(user models.User) []models.PomodoroPreset {
+	if len(user.PomodoroPresets) == 0 {
+		return []models.PomodoroPreset{c.DefaultPreset()}
+	}
+	return user.PomodoroPresets
+}
+
+// findPreset picks a preset by name, case-insensitively; an empty name
+// picks the first
+func findPreset(presets []models.PomodoroPreset, name string) (models.PomodoroPreset, error) {
+	if name == "" && len(presets) > 0 {
+		return presets[0], nil
+	}
+	for _, preset := range presets {
+		if strings.EqualFold(preset.Name, name) {
+			return preset, nil
+		}
+	}
+	return models.PomodoroPreset{}, errUnknownPreset
+}
+
+// validatePresets checks what binding cannot: that names are unique
+func validatePresets(presets []models.PomodoroPreset) error {
+	seen := make(map[string]bool, len(presets))
+	for _, preset := range presets {
+		name := strings.ToLower(strings.TrimSpace(preset.Name))
+		if seen[name] {
+			return errDuplicatePreset
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// sessionPreset is the preset a session runs on. Sessions started before
+// presets existed use the default.
+func (c TimingConfig) sessionPreset(session *models.Session) models.PomodoroPreset {
+	if session.Preset != nil {
+		return *session.Preset
+	}
+	return c.DefaultPreset()
+}
+
+// openSegment returns the running segment, or nil
+func openSegment(session *models.Session) *models.Segment {
+	if n := len(session.Segments); n > 0 && session.Segments[n-1].EndedAt == nil {
+		return &session.Segments[n-1]
+	}
+	return nil
+}
+
+// completedFocus counts the focus segments that earned a pomodoro
+func completedFocus(segments []models.Segment) int {
+	count := 0
+	for _, segment := range segments {
+		if segment.Type == models.SegmentFocus && segment.Completed {
+			count++
+		}
+	}
+	return count
+}
+
+// pausedTime sums the time spent in pauses up to end
+func pausedTime(segments []models.Segment, end time.Time) time.Duration {
+	var paused time.Duration
+	for _, segment := range segments {
+		if segment.Type != models.SegmentPaused {
+			continue
+		}
+		to := end
+		if segment.EndedAt != nil && segment.EndedAt.Before(end) {
+			to = *segment.EndedAt
+		}
+		if to.After(segment.StartedAt) {
+			paused += to.Sub(segment.StartedAt)
+		}
+	}
+	return paused
+}
+
+// nextType is the segment that follows the last focus block or break: a
+// break after focus, long after every LongBreakEvery completed blocks, and
+// focus after a break
+func nextType(session *models.Session, preset models.PomodoroPreset) string {
+	for i := len(session.Segments) - 1; i >= 0; i-- {
+		switch session.Segments[i].Type {
+		case models.SegmentPaused:
+			continue
+		case models.SegmentFocus:
+			completed := completedFocus(session.Segments)
+			if completed > 0 && preset.LongBreakEvery > 0 && completed%preset.LongBreakEvery == 0 {
+				return models.SegmentLongBreak
+			}
+			return models.SegmentShortBreak
+		}
+		return models.SegmentFocus
+	}
+	return models.SegmentFocus
+}
+
+// beginSegment starts a segment at the given time
+func beginSegment(session *models.Session, segmentType string, at time.Time, planned time.Duration) {
+	session.Segments = append(session.Segments, models.Segment{
+		Type:      segmentType,
+		StartedAt: at,
+		Planned:   int64(planned.Seconds()),
+	})
+}
+
+// endSegment ends the running segment at the given time. Focus blocks only
+// complete when the heartbeats show the user studied through them.
+func (c TimingConfig) endSegment(session *models.Session, at time.Time) {
+	segment := openSegment(session)
+	if segment == nil {
+		return
+	}
+	if at.Before(segment.StartedAt) {
+		at = segment.StartedAt
+	}
+	segment.EndedAt = &at
+	ran := at.Sub(segment.StartedAt)
+	switch segment.Type {
+	case models.SegmentPaused:
+		segment.Completed = false
+	case models.SegmentFocus:
+		segment.Completed = ran >= time.Duration(segment.Planned)*time.Second && c.studiedThrough(session.Heartbeats, segment.StartedAt, at)
+	default:
+		segment.Completed = ran >= time.Duration(segment.Planned)*time.Second
+	}
+	session.PomodoroCompleted = completedFocus(session.Segments)
+}
+
+// studiedThrough reports whether the heartbeats show the user active from
+// start to end
+func (c TimingConfig) studiedThrough(heartbeats []time.Time, start, end time.Time) bool {
+	return c.Measure(start, end, heartbeats).Inactive <= c.MinTolerance
+}
+
+// advance moves a session's timer to now: every focus block or break whose
+// planned length has passed ends on time and the next one starts where it
+// ended. Pauses hold the timer.
+func (c TimingConfig) advance(session *models.Session, now time.Time) {
+	preset := c.sessionPreset(session)
+	for i := 0; i < maxAutoSegments; i++ {
+		segment := openSegment(session)
+		if segment == nil || segment.Type == models.SegmentPaused || segment.Planned <= 0 {
+			return
+		}
+		end := segment.StartedAt.Add(time.Duration(segment.Planned) * time.Second)
+		if end.After(now) {
+			return
+		}
+		c.endSegment(session, end)
+		next := nextType(session, preset)
+		beginSegment(session, next, end, preset.Length(next))
+	}
+}
+
+// startSegment ends the running segment and starts one of the given type
+func (c TimingConfig) startSegment(session *models.Session, segmentType string, now time.Time) error {
+	c.advance(session, now)
+	c.endSegment(session, now)
+	beginSegment(session, segmentType, now, c.sessionPreset(session).Length(segmentType))
+	return nil
+}
+
+// pause holds the timer until resume
+func (c TimingConfig) pause(session *models.Session, now time.Time) error {
+	c.advance(session, now)
+	segment := openSegment(session)
+	if segment == nil {
+		return errNoSegments
+	}
+	if segment.Type == models.SegmentPaused {
+		return errSessionPaused
+	}
+	c.endSegment(session, now)
+	beginSegment(session, models.SegmentPaused, now, 0)
+	return nil
+}
+
+// resume ends a pause and continues the segment it interrupted for the
+// time that was left of it
+func (c TimingConfig) resume(session *models.Session, now time.Time) error {
+	segment := openSegment(session)
+	if segment == nil || segment.Type != models.SegmentPaused {
+		return errSessionNotPaused
+	}
+	c.endSegment(session, now)
+
+	preset := c.sessionPreset(session)
+	n := len(session.Segments)
+	if n >= 2 {
+		interrupted := session.Segments[n-2]
+		if interrupted.Type != models.SegmentPaused && interrupted.EndedAt != nil && !interrupted.Completed {
+			left := time.Duration(interrupted.Planned)*time.Second - interrupted.EndedAt.Sub(interrupted.StartedAt)
+			if left > 0 {
+				beginSegment(session, interrupted.Type, now, left)
+				return nil
+			}
+		}
+	}
+	next := nextType(session, preset)
+	beginSegment(session, next, now, preset.Length(next))
+	return nil
+}
+
+// skip ends the running segment early and starts the next one. A skipped
+// focus block earns no pomodoro.
+func (c TimingConfig) skip(session *models.Session, now time.Time) error {
+	c.advance(session, now)
+	if openSegment(session) == nil {
+		return errNoSegments
+	}
+	c.endSegment(session, now)
+	preset := c.sessionPreset(session)
+	next := nextType(session, preset)
+	beginSegment(session, next, now, preset.Length(next))
+	return nil
+}
+
+// finishSegments ends a session's timer at end
+func (c TimingConfig) finishSegments(session *models.Session, end time.Time) {
+	c.advance(session, end)
+	c.endSegment(session, end)
+	session.PausedTime = int64(pausedTime(session.Segments, end).Seconds())
+}
+
+// studied measures the time a session spent in focus blocks, each measured
+// from the heartbeats within it. Breaks and pauses are not study time.
+func (c TimingConfig) studied(session *models.Session, end time.Time) Timing {
+	if len(session.Segments) == 0 {
+		return c.Measure(session.StartTime, end, session.Heartbeats)
+	}
+	var timing Timing
+	for _, segment := range session.Segments {
+		if segment.Type != models.SegmentFocus {
+			continue
+		}
+		to := end
+		if segment.EndedAt != nil && segment.EndedAt.Before(end) {
+			to = *segment.EndedAt
+		}
+		measured := c.Measure(segment.StartedAt, to, session.Heartbeats)
+		timing.Duration += measured.Duration
+		timing.Inactive += measured.Inactive
+	}
+	timing.MaxPomodoros = completedFocus(session.Segments)
+	return timing
+}
@@ -0,0 +1,162 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// newSegmentedSession starts a session on the default preset with pings
+// every minute for the given time
+func newSegmentedSession(config TimingConfig, start time.Time, pinged time.Duration) *models.Session {
+	preset := config.DefaultPreset()
+	session := &models.Session{StartTime: start, Preset: &preset}
+	beginSegment(session, models.SegmentFocus, start, preset.Length(models.SegmentFocus))
+	for at := time.Minute; at <= pinged; at += time.Minute {
+		session.Heartbeats = append(session.Heartbeats, start.Add(at))
+	}
+	return session
+}
+
+func segmentTypes(session *models.Session) []string {
+	var types []string
+	for _, segment := range session.Segments {
+		types = append(types, segment.Type)
+	}
+	return types
+}
+
+func TestTimingConfig_Advance(t *testing.T) {
+	config := DefaultTimingConfig()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	session := newSegmentedSession(config, start, 4*time.Hour)
+
+	config.advance(session, start.Add(20*time.Minute))
+	assert.Equal(t, []string{"focus"}, segmentTypes(session))
+
+	// Four focus blocks later the long break comes
+	config.advance(session, start.Add(2*time.Hour))
+	assert.Equal(t, []string{"focus", "short_break", "focus", "short_break", "focus", "short_break", "focus", "long_break"}, segmentTypes(session))
+	assert.Equal(t, 4, session.PomodoroCompleted)
+	assert.Equal(t, start.Add(25*time.Minute), session.Segments[1].StartedAt, "the break starts when the focus block ends")
+	assert.Nil(t, openSegment(session).EndedAt)
+}
+
+func TestTimingConfig_FocusNeedsActivity(t *testing.T) {
+	config := DefaultTimingConfig()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	// Pings stop after ten minutes of the first block
+	session := newSegmentedSession(config, start, 10*time.Minute)
+	config.advance(session, start.Add(26*time.Minute))
+	require.Len(t, session.Segments, 2)
+	assert.False(t, session.Segments[0].Completed)
+	assert.Equal(t, 0, session.PomodoroCompleted)
+	assert.Equal(t, models.SegmentShortBreak, session.Segments[1].Type)
+}
+
+func TestTimingConfig_PauseAndResume(t *testing.T) {
+	config := DefaultTimingConfig()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	session := newSegmentedSession(config, start, 2*time.Hour)
+
+	require.NoError(t, config.pause(session, start.Add(10*time.Minute)))
+	assert.Equal(t, errSessionPaused, config.pause(session, start.Add(11*time.Minute)))
+
+	// Pauses hold the timer
+	config.advance(session, start.Add(time.Hour))
+	assert.Equal(t, []string{"focus", "paused"}, segmentTypes(session))
+
+	require.NoError(t, config.resume(session, start.Add(40*time.Minute)))
+	assert.Equal(t, errSessionNotPaused, config.resume(session, start.Add(41*time.Minute)))
+	resumed := openSegment(session)
+	assert.Equal(t, models.SegmentFocus, resumed.Type)
+	assert.Equal(t, int64((15 * time.Minute).Seconds()), resumed.Planned, "the rest of the interrupted block")
+
+	config.advance(session, start.Add(56*time.Minute))
+	assert.Equal(t, []string{"focus", "paused", "focus", "short_break"}, segmentTypes(session))
+	assert.Equal(t, 1, session.PomodoroCompleted)
+	assert.Equal(t, 30*time.Minute, pausedTime(session.Segments, start.Add(time.Hour)))
+}
+
+func TestTimingConfig_SkipAndStart(t *testing.T) {
+	config := DefaultTimingConfig()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	session := newSegmentedSession(config, start, time.Hour)
+
+	// A skipped block earns nothing
+	require.NoError(t, config.skip(session, start.Add(5*time.Minute)))
+	assert.Equal(t, []string{"focus", "short_break"}, segmentTypes(session))
+	assert.Equal(t, 0, session.PomodoroCompleted)
+
+	require.NoError(t, config.skip(session, start.Add(6*time.Minute)))
+	assert.Equal(t, models.SegmentFocus, openSegment(session).Type)
+
+	require.NoError(t, config.startSegment(session, models.SegmentLongBreak, start.Add(7*time.Minute)))
+	assert.Equal(t, models.SegmentLongBreak, openSegment(session).Type)
+	assert.Equal(t, int64((15 * time.Minute).Seconds()), openSegment(session).Planned)
+
+	// Sessions without segments have nothing to skip or pause
+	legacy := &models.Session{StartTime: start}
+	assert.Equal(t, errNoSegments, config.skip(legacy, start))
+	assert.Equal(t, errNoSegments, config.pause(legacy, start))
+}
+
+func TestTimingConfig_Studied(t *testing.T) {
+	config := DefaultTimingConfig()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	session := newSegmentedSession(config, start, 2*time.Hour)
+
+	require.NoError(t, config.pause(session, start.Add(10*time.Minute)))
+	require.NoError(t, config.resume(session, start.Add(30*time.Minute)))
+	config.finishSegments(session, start.Add(60*time.Minute))
+
+	studied := config.studied(session, start.Add(60*time.Minute))
+	assert.Equal(t, 35*time.Minute, studied.Duration, "pauses and breaks are not study time")
+	assert.Equal(t, time.Duration(0), studied.Inactive)
+	assert.Equal(t, 1, studied.MaxPomodoros)
+	assert.Equal(t, int64((20 * time.Minute).Seconds()), session.PausedTime)
+	assert.Nil(t, openSegment(session))
+}
+
+func TestPresets(t *testing.T) {
+	config := DefaultTimingConfig()
+	presets := config.Presets(models.User{})
+	require.Len(t, presets, 1)
+	assert.Equal(t, 25, presets[0].Focus)
+
+	custom := []models.PomodoroPreset{
+		{Name: "Deep work", Focus: 50, ShortBreak: 10, LongBreak: 30, LongBreakEvery: 2},
+		{Name: "Sprint", Focus: 15, ShortBreak: 3, LongBreak: 10, LongBreakEvery: 4},
+	}
+	preset, err := findPreset(custom, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Deep work", preset.Name)
+	preset, err = findPreset(custom, "sprint")
+	require.NoError(t, err)
+	assert.Equal(t, 15, preset.Focus)
+	_, err = findPreset(custom, "Classic")
+	assert.Equal(t, errUnknownPreset, err)
+
+	assert.NoError(t, validatePresets(custom))
+	assert.Equal(t, errDuplicatePreset, validatePresets(append(custom, models.PomodoroPreset{Name: " sprint"})))
+}
+
+func TestGroupFocusCredit(t *testing.T) {
+	config := DefaultTimingConfig()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	session := newSegmentedSession(config, start, 2*time.Hour)
+	config.advance(session, start.Add(26*time.Minute))
+
+	// The room's first block overlaps the user's own, the second does not
+	session.GroupFocus = []models.GroupFocusBlock{
+		{RoomID: "room1", StartedAt: start.Add(time.Minute), EndedAt: start.Add(26 * time.Minute)},
+		{RoomID: "room1", StartedAt: start.Add(31 * time.Minute), EndedAt: start.Add(56 * time.Minute)},
+	}
+	assert.Equal(t, 1, groupFocusCredit(session))
+	assert.Equal(t, 2, groupFocusCredit(&models.Session{GroupFocus: session.GroupFocus}))
+}
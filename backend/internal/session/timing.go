@@ -0,0 +1,148 @@
+package session
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// TimingConfig controls how the server measures a session from its start
+// time and the heartbeats clients send while the user studies
+type TimingConfig struct {
+	// PingGrace is how long after a heartbeat the user still counts as
+	// active. Longer gaps between heartbeats count as inactive beyond it.
+	PingGrace time.Duration
+	// PingInterval is the shortest spacing of recorded heartbeats; pings
+	// arriving faster are acknowledged but not stored
+	PingInterval time.Duration
+	// PomodoroLength is the active time one completed pomodoro needs
+	PomodoroLength time.Duration
+	// AbandonAfter is how long after its last ping a session is considered
+	// abandoned and closed by the reaper, which looks every ReapInterval
+	AbandonAfter time.Duration
+	ReapInterval time.Duration
+	// MinTolerance and ToleranceRatio bound how far client-reported
+	// durations may be off before the session is flagged: the larger of
+	// the two applies
+	MinTolerance   time.Duration
+	ToleranceRatio float64
+}
+
+// DefaultTimingConfig returns the configuration used when nothing is set
+func DefaultTimingConfig() TimingConfig {
+	return TimingConfig{
+		PingGrace:      5 * time.Minute,
+		PingInterval:   10 * time.Second,
+		PomodoroLength: 25 * time.Minute,
+		AbandonAfter:   30 * time.Minute,
+		ReapInterval:   time.Minute,
+		MinTolerance:   2 * time.Minute,
+		ToleranceRatio: 0.1,
+	}
+}
+
+// LoadTimingConfig reads SESSION_PING_GRACE, SESSION_POMODORO_LENGTH and
+// SESSION_ABANDON_AFTER, keeping defaults for missing or invalid values
+func LoadTimingConfig() TimingConfig {
+	config := DefaultTimingConfig()
+	if value, err := time.ParseDuration(os.Getenv("SESSION_PING_GRACE")); err == nil && value > 0 {
+		config.PingGrace = value
+	}
+	if value, err := time.ParseDuration(os.Getenv("SESSION_POMODORO_LENGTH")); err == nil && value > 0 {
+		config.PomodoroLength = value
+	}
+	// Sessions are not abandoned while pings still keep them active
+	if value, err := time.ParseDuration(os.Getenv("SESSION_ABANDON_AFTER")); err == nil && value >= config.PingGrace {
+		config.AbandonAfter = value
+	}
+	return config
+}
+
+// Timing is what the server measured of a session
+type Timing struct {
+	Duration time.Duration
+	Inactive time.Duration
+	// MaxPomodoros is how many pomodoros fit in the active time
+	MaxPomodoros int
+}
+
+// Active is the time the user was studying
+func (t Timing) Active() time.Duration {
+	return t.Duration - t.Inactive
+}
+
+// Measure times a session from its start to its end. The start, every
+// heartbeat and the end each keep the user active for PingGrace; the rest
+// of every gap between them is inactive.
+func (c TimingConfig) Measure(start, end time.Time, heartbeats []time.Time) Timing {
+	if end.Before(start) {
+		end = start
+	}
+
+	points := make([]time.Time, 0, len(heartbeats)+2)
+	points = append(points, start)
+	for _, heartbeat := range heartbeats {
+		if heartbeat.After(start) && heartbeat.Before(end) {
+			points = append(points, heartbeat)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Before(points[j]) })
+	points = append(points, end)
+
+	timing := Timing{Duration: end.Sub(start)}
+	for i := 1; i < len(points); i++ {
+		if gap := points[i].Sub(points[i-1]); gap > c.PingGrace {
+			timing.Inactive += gap - c.PingGrace
+		}
+	}
+	if c.PomodoroLength > 0 {
+		timing.MaxPomodoros = int(timing.Active() / c.PomodoroLength)
+	}
+	return timing
+}
+
+// tolerance is how far a reported duration may be from the measured one
+func (c TimingConfig) tolerance(measured time.Duration) time.Duration {
+	tolerance := time.Duration(float64(measured) * c.ToleranceRatio)
+	if tolerance < c.MinTolerance {
+		tolerance = c.MinTolerance
+	}
+	return tolerance
+}
+
+// Flags compares what the client reported with what the server measured
+// and names each value that diverges beyond the tolerance. Values the
+// client did not report are not compared.
+func (c TimingConfig) Flags(timing Timing, reported models.ReportedTiming) []string {
+	var flags []string
+	tolerance := c.tolerance(timing.Duration)
+
+	if reported.Duration != nil && absDuration(time.Duration(*reported.Duration)*time.Second-timing.Duration) > tolerance {
+		flags = append(flags, models.SessionFlagDurationMismatch)
+	}
+	if reported.InactiveDuration != nil && absDuration(time.Duration(*reported.InactiveDuration)*time.Second-timing.Inactive) > tolerance {
+		flags = append(flags, models.SessionFlagInactiveMismatch)
+	}
+	if reported.PomodoroCount != nil && *reported.PomodoroCount > timing.MaxPomodoros {
+		flags = append(flags, models.SessionFlagPomodoroOverclaim)
+	}
+	return flags
+}
+
+// creditedPomodoros caps the pomodoros a client reported to those that fit
+// in the measured session
+func creditedPomodoros(timing Timing, reported models.ReportedTiming) int {
+	if reported.PomodoroCount == nil || *reported.PomodoroCount < 0 {
+		return 0
+	}
+	return min(*reported.PomodoroCount, timing.MaxPomodoros)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
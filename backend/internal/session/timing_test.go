@@ -0,0 +1,114 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+func TestTimingConfig_Measure(t *testing.T) {
+	config := DefaultTimingConfig()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	// Pinging every few minutes keeps the whole session active
+	var heartbeats []time.Time
+	for i := 1; i < 20; i++ {
+		heartbeats = append(heartbeats, start.Add(time.Duration(i)*3*time.Minute))
+	}
+	timing := config.Measure(start, start.Add(60*time.Minute), heartbeats)
+	assert.Equal(t, 60*time.Minute, timing.Duration)
+	assert.Equal(t, time.Duration(0), timing.Inactive)
+	assert.Equal(t, 2, timing.MaxPomodoros)
+
+	// A 30 minute gap counts as inactive beyond the grace period
+	heartbeats = []time.Time{start.Add(4 * time.Minute), start.Add(34 * time.Minute), start.Add(38 * time.Minute)}
+	timing = config.Measure(start, start.Add(40*time.Minute), heartbeats)
+	assert.Equal(t, 40*time.Minute, timing.Duration)
+	assert.Equal(t, 25*time.Minute, timing.Inactive)
+	assert.Equal(t, 15*time.Minute, timing.Active())
+	assert.Equal(t, 0, timing.MaxPomodoros)
+}
+
+func TestTimingConfig_MeasureWithoutHeartbeats(t *testing.T) {
+	config := DefaultTimingConfig()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	// A session left open for a day earns the grace period at most
+	timing := config.Measure(start, start.Add(24*time.Hour), nil)
+	assert.Equal(t, 24*time.Hour, timing.Duration)
+	assert.Equal(t, config.PingGrace, timing.Active())
+
+	// Heartbeats outside the session and in any order are handled
+	heartbeats := []time.Time{start.Add(8 * time.Minute), start.Add(-time.Hour), start.Add(4 * time.Minute), start.Add(2 * time.Hour)}
+	timing = config.Measure(start, start.Add(10*time.Minute), heartbeats)
+	assert.Equal(t, time.Duration(0), timing.Inactive)
+
+	timing = config.Measure(start, start.Add(-time.Minute), nil)
+	assert.Equal(t, time.Duration(0), timing.Duration)
+}
+
+func TestTimingConfig_Flags(t *testing.T) {
+	config := DefaultTimingConfig()
+	timing := Timing{Duration: 60 * time.Minute, Inactive: 10 * time.Minute, MaxPomodoros: 2}
+	seconds := func(d time.Duration) *int64 { s := int64(d.Seconds()); return &s }
+	count := func(n int) *int { return &n }
+
+	// Honest reports within the tolerance pass
+	assert.Empty(t, config.Flags(timing, models.ReportedTiming{
+		Duration:         seconds(64 * time.Minute),
+		InactiveDuration: seconds(8 * time.Minute),
+		PomodoroCount:    count(2),
+	}))
+	assert.Empty(t, config.Flags(timing, models.ReportedTiming{}), "nothing reported, nothing compared")
+
+	assert.Equal(t,
+		[]string{models.SessionFlagDurationMismatch, models.SessionFlagInactiveMismatch, models.SessionFlagPomodoroOverclaim},
+		config.Flags(timing, models.ReportedTiming{
+			Duration:         seconds(999999 * time.Second),
+			InactiveDuration: seconds(0),
+			PomodoroCount:    count(40),
+		}),
+	)
+
+	// Short sessions get the minimum tolerance
+	short := Timing{Duration: 5 * time.Minute}
+	assert.Empty(t, config.Flags(short, models.ReportedTiming{Duration: seconds(6 * time.Minute)}))
+	assert.Equal(t, []string{models.SessionFlagDurationMismatch}, config.Flags(short, models.ReportedTiming{Duration: seconds(8 * time.Minute)}))
+}
+
+func TestCreditedPomodoros(t *testing.T) {
+	timing := Timing{Duration: time.Hour, MaxPomodoros: 2}
+	count := func(n int) *int { return &n }
+
+	assert.Equal(t, 0, creditedPomodoros(timing, models.ReportedTiming{}))
+	assert.Equal(t, 1, creditedPomodoros(timing, models.ReportedTiming{PomodoroCount: count(1)}))
+	assert.Equal(t, 2, creditedPomodoros(timing, models.ReportedTiming{PomodoroCount: count(40)}))
+	assert.Equal(t, 0, creditedPomodoros(timing, models.ReportedTiming{PomodoroCount: count(-3)}))
+}
+
+func TestLoadTimingConfig(t *testing.T) {
+	t.Setenv("SESSION_PING_GRACE", "2m")
+	t.Setenv("SESSION_POMODORO_LENGTH", "invalid")
+
+	config := LoadTimingConfig()
+	assert.Equal(t, 2*time.Minute, config.PingGrace)
+	assert.Equal(t, 25*time.Minute, config.PomodoroLength)
+}
+
+func TestLastSeen(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	session := models.Session{StartTime: start}
+	assert.Equal(t, start, lastSeen(session))
+
+	ping := start.Add(12 * time.Minute)
+	session.LastPingAt = &ping
+	assert.Equal(t, ping, lastSeen(session))
+
+	// Clocks off before the start do not move it back
+	early := start.Add(-time.Minute)
+	session.LastPingAt = &early
+	assert.Equal(t, start, lastSeen(session))
+}
@@ -2,6 +2,7 @@ package todo
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
+	"github.com/studyplatform/backend/internal/xp"
 	"github.com/studyplatform/backend/pkg/database"
 	"github.com/studyplatform/backend/pkg/models"
 )
@@ -238,9 +240,33 @@ func DeleteTodoHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 	}
 }
 
-// CompleteTodoHandler marks a todo as complete
-func CompleteTodoHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
+const (
+	// completedTodoXP is awarded once per todo to its creator or an assignee
+	// who completes it
+	completedTodoXP = 10
+	// maxDailyTodoXP bounds the XP completing todos earns a user in a UTC
+	// day, so creating and completing throwaway todos does not pay
+	maxDailyTodoXP = 100
+)
+
+// errTodoChanged is returned when a todo was toggled by someone else since
+// it was read
+var errTodoChanged = errors.New("todo changed")
+
+// CompleteTodoHandler toggles whether a todo is complete
+func CompleteTodoHandler(mongoClient *database.MongoClient, ledger *xp.Ledger) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
 		todoID := c.Param("id")
 		if todoID == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Todo ID required"})
@@ -282,13 +308,56 @@ func CompleteTodoHandler(mongoClient *database.MongoClient) gin.HandlerFunc {
 				"updated_at":   time.Now(),
 			},
 		}
+		toggle := func(ctx context.Context) error {
+			result, err := todos.UpdateOne(ctx, bson.M{"_id": objID, "completed": todo.Completed}, update)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errTodoChanged
+			}
+			return nil
+		}
 
-		_, err = todos.UpdateOne(ctx, bson.M{"_id": objID}, update)
-		if err != nil {
+		xpEarned := 0
+		if newCompleted && isTodoMember(todo, userIDStr) {
+			// Completing a todo again or past the daily cap earns nothing;
+			// it is still completed
+			_, err = ledger.AwardCapped(ctx, models.XPHistory{
+				UserID: userIDStr,
+				Key:    "todo:" + todoID,
+				XP:     completedTodoXP,
+				Source: models.XPSourceTodo,
+			}, maxDailyTodoXP, toggle)
+			if err == nil {
+				xpEarned = completedTodoXP
+			} else if err == xp.ErrAlreadyAwarded || err == xp.ErrDailyCapReached {
+				err = toggle(ctx)
+			}
+		} else {
+			err = toggle(ctx)
+		}
+		if err == errTodoChanged {
+			c.JSON(http.StatusConflict, gin.H{"error": "Todo was changed, try again"})
+			return
+		} else if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update todo"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Todo completion status updated"})
+		c.JSON(http.StatusOK, gin.H{"message": "Todo completion status updated", "xpEarned": xpEarned})
+	}
+}
+
+// isTodoMember reports whether the user created the todo or is assigned to it
+func isTodoMember(todo models.Todo, userID string) bool {
+	if todo.CreatorID == userID {
+		return true
+	}
+	for _, assigneeID := range todo.AssigneeIDs {
+		if assigneeID == userID {
+			return true
+		}
 	}
+	return false
 }
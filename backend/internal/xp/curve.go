@@ -0,0 +1,60 @@
+package xp
+
+import (
+	"math"
+	"os"
+	"strconv"
+)
+
+// LevelCurve decides the level a total of XP reaches. Level 1 needs no
+// XP; going from level L to L+1 takes Base * L^Growth more.
+type LevelCurve struct {
+	Base     int
+	Growth   float64
+	MaxLevel int
+}
+
+// DefaultLevelCurve returns the curve used when nothing is set
+func DefaultLevelCurve() LevelCurve {
+	return LevelCurve{Base: 100, Growth: 1.5, MaxLevel: 100}
+}
+
+// LoadLevelCurve reads XP_LEVEL_BASE, XP_LEVEL_GROWTH and XP_MAX_LEVEL,
+// keeping defaults for missing or invalid values
+func LoadLevelCurve() LevelCurve {
+	curve := DefaultLevelCurve()
+	if value, err := strconv.Atoi(os.Getenv("XP_LEVEL_BASE")); err == nil && value > 0 {
+		curve.Base = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("XP_LEVEL_GROWTH"), 64); err == nil && value >= 0 && value <= 4 {
+		curve.Growth = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("XP_MAX_LEVEL")); err == nil && value > 0 {
+		curve.MaxLevel = value
+	}
+	return curve
+}
+
+// step is the XP needed to go from level to the next
+func (c LevelCurve) step(level int) int {
+	return int(math.Round(float64(c.Base) * math.Pow(float64(level), c.Growth)))
+}
+
+// Threshold is the total XP needed to reach level
+func (c LevelCurve) Threshold(level int) int {
+	total := 0
+	for l := 1; l < level && l < c.MaxLevel; l++ {
+		total += c.step(l)
+	}
+	return total
+}
+
+// Level is the level reached with xp
+func (c LevelCurve) Level(xp int) int {
+	level, next := 1, c.step(1)
+	for level < c.MaxLevel && xp >= next {
+		level++
+		next += c.step(level)
+	}
+	return level
+}
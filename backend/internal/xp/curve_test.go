@@ -0,0 +1,42 @@
+package xp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelCurve(t *testing.T) {
+	curve := DefaultLevelCurve()
+	assert.Equal(t, 0, curve.Threshold(1))
+	assert.Equal(t, 100, curve.Threshold(2))
+	assert.Equal(t, 383, curve.Threshold(3))
+	assert.Equal(t, 903, curve.Threshold(4))
+
+	assert.Equal(t, 1, curve.Level(0))
+	assert.Equal(t, 1, curve.Level(-20))
+	assert.Equal(t, 1, curve.Level(99))
+	assert.Equal(t, 2, curve.Level(100))
+	assert.Equal(t, 3, curve.Level(902))
+	assert.Equal(t, 4, curve.Level(903))
+
+	// Every level starts at its threshold
+	for level := 1; level <= curve.MaxLevel; level++ {
+		assert.Equal(t, level, curve.Level(curve.Threshold(level)))
+	}
+
+	capped := LevelCurve{Base: 10, Growth: 0, MaxLevel: 5}
+	assert.Equal(t, 40, capped.Threshold(5))
+	assert.Equal(t, 5, capped.Level(1000000))
+}
+
+func TestLoadLevelCurve(t *testing.T) {
+	t.Setenv("XP_LEVEL_BASE", "250")
+	t.Setenv("XP_LEVEL_GROWTH", "invalid")
+	t.Setenv("XP_MAX_LEVEL", "-1")
+
+	curve := LoadLevelCurve()
+	assert.Equal(t, 250, curve.Base)
+	assert.Equal(t, 1.5, curve.Growth)
+	assert.Equal(t, 100, curve.MaxLevel)
+}
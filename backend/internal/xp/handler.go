@@ -0,0 +1,59 @@
+package xp
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// historyLimit is how many ledger entries GetXPHandler returns
+const historyLimit = 50
+
+// GetXPHandler returns the user's XP, level and latest ledger entries
+func GetXPHandler(ledger *Ledger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		userIDStr, ok := userID.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID in context"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		balance, err := ledger.Balance(ctx, userIDStr)
+		if err == ErrUserNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		history, err := ledger.History(ctx, userIDStr, historyLimit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		level := ledger.curve.Level(balance)
+		response := gin.H{
+			"xp":          balance,
+			"level":       level,
+			"levelXP":     ledger.curve.Threshold(level),
+			"nextLevelXP": nil,
+			"history":     history,
+		}
+		if level < ledger.curve.MaxLevel {
+			response["nextLevelXP"] = ledger.curve.Threshold(level + 1)
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,593 @@
+package xp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/logger"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+var (
+	// ErrAlreadyAwarded is returned for a key the user was awarded XP for
+	// before; nothing changes
+	ErrAlreadyAwarded = errors.New("xp already awarded")
+	// ErrUserNotFound is returned when awarding XP to an unknown user
+	ErrUserNotFound = errors.New("user not found")
+	// ErrInsufficientXP is returned when taking away more XP than the user
+	// has
+	ErrInsufficientXP = errors.New("insufficient xp")
+	// ErrDailyCapReached is returned by AwardCapped when the award would
+	// take the user past the day's cap for its source; nothing changes
+	ErrDailyCapReached = errors.New("daily xp cap reached")
+)
+
+// Notifier pushes a stored notification to the connections of a user
+type Notifier interface {
+	NotifyUser(userID string, notification models.Notification)
+}
+
+// ledgerBackend stores the ledger's entries, users' totals and daily
+// counters. Entries are pending from insert until claim; a key counts once
+// per user.
+type ledgerBackend interface {
+	// transactional reports whether run makes its writes all or nothing
+	transactional() bool
+	// run calls fn in a transaction when the server supports them
+	run(ctx context.Context, fn func(ctx context.Context) error) error
+	// balance returns the user's XP, or ErrUserNotFound
+	balance(ctx context.Context, userID string) (int, error)
+	// insert records an entry, or returns ErrAlreadyAwarded for a used key
+	insert(ctx context.Context, entry models.XPHistory) error
+	find(ctx context.Context, userID, key string) (models.XPHistory, error)
+	// withdraw removes an entry while it is still pending
+	withdraw(ctx context.Context, id primitive.ObjectID) error
+	// reserveDaily adds xp to the user's counter for source on day unless
+	// it would pass max
+	reserveDaily(ctx context.Context, userID, source string, day time.Time, xp, max int) (bool, error)
+	releaseDaily(ctx context.Context, userID, source string, day time.Time, xp int) error
+	// claim clears an entry's pending flag and reports whether it was set
+	claim(ctx context.Context, id primitive.ObjectID) (bool, error)
+	// addXP adds xp to the user's total and returns the new total and the
+	// level stored so far
+	addXP(ctx context.Context, userID string, xp int, now time.Time) (int, int, error)
+	setLevel(ctx context.Context, userID string, level int) error
+	setBalance(ctx context.Context, id primitive.ObjectID, balance, level int) error
+	notify(ctx context.Context, notification *models.Notification) error
+	// pending returns the entries still pending that were created before
+	pending(ctx context.Context, before time.Time) ([]models.XPHistory, error)
+	// history returns the latest applied entries of a user, newest first
+	history(ctx context.Context, userID string, limit int64) ([]models.XPHistory, error)
+}
+
+// Ledger awards XP. Every award is an entry of the xp_history collection,
+// written in one transaction with the user's total and level. Standalone
+// servers cannot run transactions; there the entry is written before the
+// total, so its unique key still keeps an award from counting twice.
+type Ledger struct {
+	backend  ledgerBackend
+	curve    LevelCurve
+	notifier Notifier
+	now      func() time.Time
+}
+
+// NewLedger creates the XP ledger
+func NewLedger(mongoClient *database.MongoClient, curve LevelCurve) *Ledger {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transactions, err := mongoClient.SupportsTransactions(ctx)
+	if err != nil {
+		logger.Warn("Failed to check MongoDB for transaction support", logger.Field("error", err))
+	} else if !transactions {
+		logger.Warn("MongoDB is not a replica set; XP is awarded without transactions")
+	}
+	return newLedger(&mongoLedgerBackend{mongoClient: mongoClient, transactions: transactions}, curve, time.Now)
+}
+
+func newLedger(backend ledgerBackend, curve LevelCurve, now func() time.Time) *Ledger {
+	return &Ledger{backend: backend, curve: curve, now: now}
+}
+
+// SetNotifier pushes level up notifications to connected users. It must
+// be called before awards are made concurrently.
+func (l *Ledger) SetNotifier(notifier Notifier) {
+	l.notifier = notifier
+}
+
+// Award adds an entry with the UserID, Key, XP, Source, SessionID and
+// AdjustedBy of grant to the ledger and returns it as written. A key counts once per
+// user: awarding it again returns the first entry and ErrAlreadyAwarded.
+// Crossing a level boundary notifies the user.
+func (l *Ledger) Award(ctx context.Context, grant models.XPHistory) (models.XPHistory, error) {
+	return l.award(ctx, grant, 0, nil)
+}
+
+// AwardWith awards grant in one transaction with the writes of with, so
+// that both or neither happen. with runs once the key was found unused,
+// and again if the transaction is retried; its error aborts the award.
+// Grants of no XP only run with. Without transactions a failed with still
+// withdraws the award, but writes it made before failing are kept.
+func (l *Ledger) AwardWith(ctx context.Context, grant models.XPHistory, with func(ctx context.Context) error) (models.XPHistory, error) {
+	return l.award(ctx, grant, 0, with)
+}
+
+// AwardCapped is AwardWith for XP of which a user may earn at most
+// dailyCap from grant's source per UTC day. An award that would pass the
+// cap returns ErrDailyCapReached without running with.
+func (l *Ledger) AwardCapped(ctx context.Context, grant models.XPHistory, dailyCap int, with func(ctx context.Context) error) (models.XPHistory, error) {
+	return l.award(ctx, grant, dailyCap, with)
+}
+
+func (l *Ledger) award(ctx context.Context, grant models.XPHistory, dailyCap int, with func(ctx context.Context) error) (models.XPHistory, error) {
+	if grant.XP == 0 && with == nil {
+		return models.XPHistory{}, nil
+	}
+
+	var entry models.XPHistory
+	var levelUp *models.Notification
+	err := l.backend.run(ctx, func(ctx context.Context) error {
+		var err error
+		entry, levelUp, err = l.write(ctx, grant, dailyCap, with)
+		return err
+	})
+	if err == ErrAlreadyAwarded {
+		first, err := l.backend.find(ctx, grant.UserID, grant.Key)
+		if err != nil {
+			return models.XPHistory{}, err
+		}
+		return first, ErrAlreadyAwarded
+	} else if err != nil {
+		return models.XPHistory{}, err
+	}
+
+	if levelUp != nil && l.notifier != nil {
+		l.notifier.NotifyUser(grant.UserID, *levelUp)
+	}
+	return entry, nil
+}
+
+// write records grant as a pending entry, which claims its key, counts it
+// towards the daily cap, runs with and then adds the entry to the user's
+// total. Without transactions a failure takes back what was written.
+func (l *Ledger) write(ctx context.Context, grant models.XPHistory, dailyCap int, with func(ctx context.Context) error) (models.XPHistory, *models.Notification, error) {
+	if grant.XP == 0 {
+		return models.XPHistory{}, nil, with(ctx)
+	}
+
+	balance, err := l.backend.balance(ctx, grant.UserID)
+	if err != nil {
+		return models.XPHistory{}, nil, err
+	}
+	if balance+grant.XP < 0 {
+		return models.XPHistory{}, nil, ErrInsufficientXP
+	}
+
+	now := l.now()
+	entry := models.XPHistory{
+		ID:         primitive.NewObjectID(),
+		UserID:     grant.UserID,
+		Key:        grant.Key,
+		XP:         grant.XP,
+		Source:     grant.Source,
+		SessionID:  grant.SessionID,
+		AdjustedBy: grant.AdjustedBy,
+		Pending:    true,
+		CreatedAt:  now,
+	}
+	if err := l.backend.insert(ctx, entry); err != nil {
+		return models.XPHistory{}, nil, err
+	}
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	reserved := false
+	undo := func() {
+		if l.backend.transactional() {
+			return
+		}
+		if reserved {
+			l.backend.releaseDaily(ctx, grant.UserID, grant.Source, day, grant.XP)
+		}
+		l.backend.withdraw(ctx, entry.ID)
+	}
+
+	if dailyCap > 0 {
+		if grant.XP <= dailyCap {
+			reserved, err = l.backend.reserveDaily(ctx, grant.UserID, grant.Source, day, grant.XP, dailyCap)
+		}
+		if err == nil && !reserved {
+			err = ErrDailyCapReached
+		}
+		if err != nil {
+			undo()
+			return models.XPHistory{}, nil, err
+		}
+	}
+
+	if with != nil {
+		if err := with(ctx); err != nil {
+			undo()
+			return models.XPHistory{}, nil, err
+		}
+	}
+
+	levelUp, err := l.apply(ctx, &entry)
+	return entry, levelUp, err
+}
+
+// apply adds a pending entry's XP to the user's total and records the
+// balance and level it results in. Entries already applied are left alone.
+func (l *Ledger) apply(ctx context.Context, entry *models.XPHistory) (*models.Notification, error) {
+	// Taking the pending flag first keeps two instances from both applying
+	// an entry left over from a crash
+	claimed, err := l.backend.claim(ctx, entry.ID)
+	if err != nil || !claimed {
+		return nil, err
+	}
+	entry.Pending = false
+
+	total, stored, err := l.backend.addXP(ctx, entry.UserID, entry.XP, l.now())
+	if err != nil {
+		return nil, err
+	}
+	level := l.curve.Level(total)
+	if level != stored {
+		if err := l.backend.setLevel(ctx, entry.UserID, level); err != nil {
+			return nil, err
+		}
+	}
+	entry.Balance, entry.Level = total, level
+	if err := l.backend.setBalance(ctx, entry.ID, entry.Balance, entry.Level); err != nil {
+		return nil, err
+	}
+
+	// The level before is derived the same way, so a changed curve does not
+	// announce levels the user had already reached
+	if level <= l.curve.Level(total-entry.XP) {
+		return nil, nil
+	}
+	notification := models.CreateXPLevelUpNotification(entry.UserID, level)
+	if err := l.backend.notify(ctx, &notification); err != nil {
+		return nil, err
+	}
+	return &notification, nil
+}
+
+// ApplyPending adds entries that were recorded but never added to their
+// user's total, which happens when the server stopped halfway through an
+// award made without a transaction. Entries younger than a minute may
+// still be in progress and are left alone.
+func (l *Ledger) ApplyPending(ctx context.Context) error {
+	pending, err := l.backend.pending(ctx, l.now().Add(-time.Minute))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range pending {
+		if _, err := l.apply(ctx, &entry); err != nil && err != ErrUserNotFound {
+			return err
+		}
+	}
+	if len(pending) > 0 {
+		logger.Info("Applied pending XP ledger entries", logger.Field("entries", len(pending)))
+	}
+	return nil
+}
+
+// Balance returns the user's XP, or ErrUserNotFound
+func (l *Ledger) Balance(ctx context.Context, userID string) (int, error) {
+	return l.backend.balance(ctx, userID)
+}
+
+// History returns the latest entries of a user's ledger, newest first
+func (l *Ledger) History(ctx context.Context, userID string, limit int64) ([]models.XPHistory, error) {
+	return l.backend.history(ctx, userID, limit)
+}
+
+// mongoLedgerBackend keeps entries in xp_history, totals in users and
+// daily counters in counters
+type mongoLedgerBackend struct {
+	mongoClient  *database.MongoClient
+	transactions bool
+}
+
+func (b *mongoLedgerBackend) collection(name string) *mongo.Collection {
+	return b.mongoClient.GetCollection(name)
+}
+
+func (b *mongoLedgerBackend) transactional() bool {
+	return b.transactions
+}
+
+func (b *mongoLedgerBackend) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !b.transactions {
+		return fn(ctx)
+	}
+
+	session, err := b.mongoClient.Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+func (b *mongoLedgerBackend) balance(ctx context.Context, userID string) (int, error) {
+	var user models.User
+	err := b.collection(database.CollectionNames.Users).FindOne(ctx,
+		bson.M{"unique_id": userID},
+		options.FindOne().SetProjection(bson.M{"xp": 1}),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrUserNotFound
+	}
+	return user.XP, err
+}
+
+func (b *mongoLedgerBackend) insert(ctx context.Context, entry models.XPHistory) error {
+	_, err := b.collection(database.CollectionNames.XPHistory).InsertOne(ctx, entry)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyAwarded
+	}
+	return err
+}
+
+func (b *mongoLedgerBackend) find(ctx context.Context, userID, key string) (models.XPHistory, error) {
+	var entry models.XPHistory
+	err := b.collection(database.CollectionNames.XPHistory).FindOne(ctx, bson.M{"user_id": userID, "key": key}).Decode(&entry)
+	return entry, err
+}
+
+func (b *mongoLedgerBackend) withdraw(ctx context.Context, id primitive.ObjectID) error {
+	_, err := b.collection(database.CollectionNames.XPHistory).DeleteOne(ctx, bson.M{"_id": id, "pending": true})
+	return err
+}
+
+// dailyCounterID returns the counters document ID of a user's XP from a
+// source on a day
+func dailyCounterID(userID, source string, day time.Time) string {
+	return "xp_daily:" + userID + ":" + source + ":" + day.Format("2006-01-02")
+}
+
+func (b *mongoLedgerBackend) reserveDaily(ctx context.Context, userID, source string, day time.Time, xp, max int) (bool, error) {
+	// Once the counter is past the cap the filter misses and the upsert
+	// collides with the existing counter
+	_, err := b.collection(database.CollectionNames.Counters).UpdateOne(ctx,
+		bson.M{"_id": dailyCounterID(userID, source, day), "xp": bson.M{"$lte": max - xp}},
+		bson.M{
+			"$inc":         bson.M{"xp": xp},
+			"$setOnInsert": bson.M{"expires_at": day.Add(48 * time.Hour)},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *mongoLedgerBackend) releaseDaily(ctx context.Context, userID, source string, day time.Time, xp int) error {
+	_, err := b.collection(database.CollectionNames.Counters).UpdateOne(ctx,
+		bson.M{"_id": dailyCounterID(userID, source, day)},
+		bson.M{"$inc": bson.M{"xp": -xp}},
+	)
+	return err
+}
+
+func (b *mongoLedgerBackend) claim(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	result, err := b.collection(database.CollectionNames.XPHistory).UpdateOne(ctx,
+		bson.M{"_id": id, "pending": true},
+		bson.M{"$unset": bson.M{"pending": ""}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (b *mongoLedgerBackend) addXP(ctx context.Context, userID string, xp int, now time.Time) (int, int, error) {
+	var user models.User
+	err := b.collection(database.CollectionNames.Users).FindOneAndUpdate(ctx,
+		bson.M{"unique_id": userID},
+		bson.M{"$inc": bson.M{"xp": xp}, "$set": bson.M{"updated_at": now}},
+		options.FindOneAndUpdate().
+			SetReturnDocument(options.After).
+			SetProjection(bson.M{"xp": 1, "level": 1}),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return 0, 0, ErrUserNotFound
+	}
+	return user.XP, user.Level, err
+}
+
+func (b *mongoLedgerBackend) setLevel(ctx context.Context, userID string, level int) error {
+	_, err := b.collection(database.CollectionNames.Users).UpdateOne(ctx, bson.M{"unique_id": userID}, bson.M{"$set": bson.M{"level": level}})
+	return err
+}
+
+func (b *mongoLedgerBackend) setBalance(ctx context.Context, id primitive.ObjectID, balance, level int) error {
+	_, err := b.collection(database.CollectionNames.XPHistory).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"balance": balance, "level": level}})
+	return err
+}
+
+func (b *mongoLedgerBackend) notify(ctx context.Context, notification *models.Notification) error {
+	res, err := b.collection(database.CollectionNames.Notifications).InsertOne(ctx, notification)
+	if err != nil {
+		return err
+	}
+	notification.ID, _ = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (b *mongoLedgerBackend) pending(ctx context.Context, before time.Time) ([]models.XPHistory, error) {
+	cursor, err := b.collection(database.CollectionNames.XPHistory).Find(ctx, bson.M{"pending": true, "created_at": bson.M{"$lt": before}})
+	if err != nil {
+		return nil, err
+	}
+	var pending []models.XPHistory
+	if err := cursor.All(ctx, &pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (b *mongoLedgerBackend) history(ctx context.Context, userID string, limit int64) ([]models.XPHistory, error) {
+	cursor, err := b.collection(database.CollectionNames.XPHistory).Find(ctx,
+		bson.M{"user_id": userID, "pending": bson.M{"$ne": true}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	entries := []models.XPHistory{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// EnsureLedgerIndexes creates the indexes of the XP ledger and moves users
+// onto it: XP earned before the ledger existed becomes an opening balance
+// entry, and every user's level is set from the curve.
+func EnsureLedgerIndexes(mongoClient *database.MongoClient, curve LevelCurve) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	history := mongoClient.GetCollection(database.CollectionNames.XPHistory)
+	// Entries written before keys existed each get their own
+	_, err := history.UpdateMany(ctx,
+		bson.M{"key": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"key": bson.M{"$concat": bson.A{"legacy:", bson.M{"$toString": "$_id"}}}}}}},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = history.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "key", Value: 1}},
+			Options: options.Index().SetName("user_key").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("user_created"),
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetName("pending_created").SetPartialFilterExpression(bson.M{"pending": true}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Daily XP counters are removed by MongoDB once their day is over
+	counters := mongoClient.GetCollection(database.CollectionNames.Counters)
+	_, err = counters.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetName("expires_at").SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := openBalances(ctx, mongoClient, curve); err != nil {
+		return err
+	}
+	return syncLevels(ctx, mongoClient, curve)
+}
+
+// openBalances records the XP of users who never had a level as an
+// opening balance, less what their legacy entries already account for
+func openBalances(ctx context.Context, mongoClient *database.MongoClient, curve LevelCurve) error {
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+	history := mongoClient.GetCollection(database.CollectionNames.XPHistory)
+
+	cursor, err := users.Find(ctx,
+		bson.M{"level": bson.M{"$not": bson.M{"$gte": 1}}, "xp": bson.M{"$ne": 0}},
+		options.Find().SetProjection(bson.M{"unique_id": 1, "xp": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	var unopened []models.User
+	if err := cursor.All(ctx, &unopened); err != nil {
+		return err
+	}
+
+	opened := 0
+	for _, user := range unopened {
+		if user.UniqueID == "" {
+			continue
+		}
+		var sums []struct {
+			XP int `bson:"xp"`
+		}
+		cursor, err := history.Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"user_id": user.UniqueID}}},
+			{{Key: "$group", Value: bson.M{"_id": nil, "xp": bson.M{"$sum": "$xp"}}}},
+		})
+		if err != nil {
+			return err
+		}
+		if err := cursor.All(ctx, &sums); err != nil {
+			return err
+		}
+		balance := user.XP
+		if len(sums) > 0 {
+			balance -= sums[0].XP
+		}
+		if balance == 0 {
+			continue
+		}
+
+		_, err = history.InsertOne(ctx, models.XPHistory{
+			UserID:    user.UniqueID,
+			Key:       models.XPSourceOpening,
+			XP:        balance,
+			Source:    models.XPSourceOpening,
+			Balance:   user.XP,
+			Level:     curve.Level(user.XP),
+			CreatedAt: time.Now(),
+		})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		opened++
+	}
+	if opened > 0 {
+		logger.Info("Opened XP ledger balances", logger.Field("users", opened))
+	}
+	return nil
+}
+
+// syncLevels sets every user's level from the curve, so a changed curve
+// applies to everyone. No notifications are sent.
+func syncLevels(ctx context.Context, mongoClient *database.MongoClient, curve LevelCurve) error {
+	branches := bson.A{}
+	for level := curve.MaxLevel; level > 1; level-- {
+		branches = append(branches, bson.M{
+			"case": bson.M{"$gte": bson.A{"$xp", curve.Threshold(level)}},
+			"then": level,
+		})
+	}
+	level := interface{}(1)
+	if len(branches) > 0 {
+		level = bson.M{"$switch": bson.M{"branches": branches, "default": 1}}
+	}
+
+	// Unchanged users are not written
+	users := mongoClient.GetCollection(database.CollectionNames.Users)
+	_, err := users.UpdateMany(ctx, bson.M{}, mongo.Pipeline{{{Key: "$set", Value: bson.M{"level": level}}}})
+	return err
+}
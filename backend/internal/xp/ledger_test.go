@@ -0,0 +1,309 @@
+package xp
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// fakeLedgerState is everything fakeLedgerBackend stores
+type fakeLedgerState struct {
+	users    map[string]*models.User
+	entries  []models.XPHistory
+	counters map[string]int
+	notified []models.Notification
+}
+
+func (s fakeLedgerState) copy() fakeLedgerState {
+	copied := fakeLedgerState{
+		users:    make(map[string]*models.User, len(s.users)),
+		entries:  append([]models.XPHistory(nil), s.entries...),
+		counters: make(map[string]int, len(s.counters)),
+		notified: append([]models.Notification(nil), s.notified...),
+	}
+	for userID, user := range s.users {
+		u := *user
+		copied.users[userID] = &u
+	}
+	for id, xp := range s.counters {
+		copied.counters[id] = xp
+	}
+	return copied
+}
+
+// fakeLedgerBackend keeps the ledger in memory. With transactions a failed
+// run restores the state from before it.
+type fakeLedgerBackend struct {
+	fakeLedgerState
+	transactions bool
+}
+
+func newFakeLedgerBackend(transactions bool, userIDs ...string) *fakeLedgerBackend {
+	b := &fakeLedgerBackend{
+		fakeLedgerState: fakeLedgerState{
+			users:    make(map[string]*models.User),
+			counters: make(map[string]int),
+		},
+		transactions: transactions,
+	}
+	for _, userID := range userIDs {
+		b.users[userID] = &models.User{UniqueID: userID, Level: 1}
+	}
+	return b
+}
+
+func (b *fakeLedgerBackend) entry(id primitive.ObjectID) *models.XPHistory {
+	for i := range b.entries {
+		if b.entries[i].ID == id {
+			return &b.entries[i]
+		}
+	}
+	return nil
+}
+
+func (b *fakeLedgerBackend) transactional() bool {
+	return b.transactions
+}
+
+func (b *fakeLedgerBackend) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !b.transactions {
+		return fn(ctx)
+	}
+	before := b.fakeLedgerState.copy()
+	err := fn(ctx)
+	if err != nil {
+		b.fakeLedgerState = before
+	}
+	return err
+}
+
+func (b *fakeLedgerBackend) balance(ctx context.Context, userID string) (int, error) {
+	user, ok := b.users[userID]
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	return user.XP, nil
+}
+
+func (b *fakeLedgerBackend) insert(ctx context.Context, entry models.XPHistory) error {
+	if _, err := b.find(ctx, entry.UserID, entry.Key); err == nil {
+		return ErrAlreadyAwarded
+	}
+	b.entries = append(b.entries, entry)
+	return nil
+}
+
+func (b *fakeLedgerBackend) find(ctx context.Context, userID, key string) (models.XPHistory, error) {
+	for _, entry := range b.entries {
+		if entry.UserID == userID && entry.Key == key {
+			return entry, nil
+		}
+	}
+	return models.XPHistory{}, errors.New("entry not found")
+}
+
+func (b *fakeLedgerBackend) withdraw(ctx context.Context, id primitive.ObjectID) error {
+	for i, entry := range b.entries {
+		if entry.ID == id && entry.Pending {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (b *fakeLedgerBackend) reserveDaily(ctx context.Context, userID, source string, day time.Time, xp, max int) (bool, error) {
+	id := dailyCounterID(userID, source, day)
+	if b.counters[id]+xp > max {
+		return false, nil
+	}
+	b.counters[id] += xp
+	return true, nil
+}
+
+func (b *fakeLedgerBackend) releaseDaily(ctx context.Context, userID, source string, day time.Time, xp int) error {
+	b.counters[dailyCounterID(userID, source, day)] -= xp
+	return nil
+}
+
+func (b *fakeLedgerBackend) claim(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	entry := b.entry(id)
+	if entry == nil || !entry.Pending {
+		return false, nil
+	}
+	entry.Pending = false
+	return true, nil
+}
+
+func (b *fakeLedgerBackend) addXP(ctx context.Context, userID string, xp int, now time.Time) (int, int, error) {
+	user, ok := b.users[userID]
+	if !ok {
+		return 0, 0, ErrUserNotFound
+	}
+	user.XP += xp
+	return user.XP, user.Level, nil
+}
+
+func (b *fakeLedgerBackend) setLevel(ctx context.Context, userID string, level int) error {
+	b.users[userID].Level = level
+	return nil
+}
+
+func (b *fakeLedgerBackend) setBalance(ctx context.Context, id primitive.ObjectID, balance, level int) error {
+	if entry := b.entry(id); entry != nil {
+		entry.Balance, entry.Level = balance, level
+	}
+	return nil
+}
+
+func (b *fakeLedgerBackend) notify(ctx context.Context, notification *models.Notification) error {
+	notification.ID = primitive.NewObjectID()
+	b.notified = append(b.notified, *notification)
+	return nil
+}
+
+func (b *fakeLedgerBackend) pending(ctx context.Context, before time.Time) ([]models.XPHistory, error) {
+	var pending []models.XPHistory
+	for _, entry := range b.entries {
+		if entry.Pending && entry.CreatedAt.Before(before) {
+			pending = append(pending, entry)
+		}
+	}
+	return pending, nil
+}
+
+func (b *fakeLedgerBackend) history(ctx context.Context, userID string, limit int64) ([]models.XPHistory, error) {
+	entries := []models.XPHistory{}
+	for _, entry := range b.entries {
+		if entry.UserID == userID && !entry.Pending {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedAt.After(entries[j].CreatedAt) })
+	if int64(len(entries)) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func TestLedger_AwardIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	backend := newFakeLedgerBackend(true, "alice")
+	ledger := newLedger(backend, DefaultLevelCurve(), func() time.Time { return now })
+
+	first, err := ledger.Award(ctx, models.XPHistory{UserID: "alice", Key: "session:1", XP: 120, Source: models.XPSourceSession})
+	require.NoError(t, err)
+	assert.Equal(t, 120, first.Balance)
+	assert.Equal(t, 2, first.Level)
+	require.Len(t, backend.notified, 1, "crossing level 2 notifies")
+
+	now = now.Add(time.Minute)
+	again, err := ledger.Award(ctx, models.XPHistory{UserID: "alice", Key: "session:1", XP: 50, Source: models.XPSourceSession})
+	assert.Equal(t, ErrAlreadyAwarded, err)
+	assert.Equal(t, first.ID, again.ID, "the first entry is returned")
+	assert.Equal(t, 120, again.XP)
+
+	balance, err := ledger.Balance(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 120, balance)
+	assert.Len(t, backend.entries, 1)
+}
+
+func TestLedger_FailedWithRollsBack(t *testing.T) {
+	for _, transactions := range []bool{true, false} {
+		ctx := context.Background()
+		backend := newFakeLedgerBackend(transactions, "alice")
+		ledger := newLedger(backend, DefaultLevelCurve(), time.Now)
+
+		failure := errors.New("toggle failed")
+		_, err := ledger.AwardCapped(ctx, models.XPHistory{UserID: "alice", Key: "todo:1", XP: 10, Source: models.XPSourceTodo}, 100,
+			func(ctx context.Context) error { return failure })
+		assert.Equal(t, failure, err, "transactions: %v", transactions)
+
+		balance, _ := ledger.Balance(ctx, "alice")
+		assert.Zero(t, balance, "transactions: %v", transactions)
+		assert.Empty(t, backend.entries, "transactions: %v", transactions)
+		for _, xp := range backend.counters {
+			assert.Zero(t, xp, "the daily cap is released, transactions: %v", transactions)
+		}
+
+		// The key is free for another try
+		_, err = ledger.AwardCapped(ctx, models.XPHistory{UserID: "alice", Key: "todo:1", XP: 10, Source: models.XPSourceTodo}, 100,
+			func(ctx context.Context) error { return nil })
+		require.NoError(t, err, "transactions: %v", transactions)
+		balance, _ = ledger.Balance(ctx, "alice")
+		assert.Equal(t, 10, balance, "transactions: %v", transactions)
+	}
+}
+
+func TestLedger_AwardCappedPerDay(t *testing.T) {
+	for _, transactions := range []bool{true, false} {
+		ctx := context.Background()
+		now := time.Date(2026, 3, 2, 23, 0, 0, 0, time.UTC)
+		backend := newFakeLedgerBackend(transactions, "alice")
+		ledger := newLedger(backend, DefaultLevelCurve(), func() time.Time { return now })
+
+		award := func(key string) error {
+			_, err := ledger.AwardCapped(ctx, models.XPHistory{UserID: "alice", Key: key, XP: 10, Source: models.XPSourceTodo}, 25, nil)
+			return err
+		}
+		require.NoError(t, award("todo:1"))
+		require.NoError(t, award("todo:2"))
+		assert.Equal(t, ErrDailyCapReached, award("todo:3"), "transactions: %v", transactions)
+		_, err := backend.find(ctx, "alice", "todo:3")
+		assert.Error(t, err, "a capped award leaves no entry, transactions: %v", transactions)
+
+		// Other sources and uncapped awards are not counted
+		_, err = ledger.Award(ctx, models.XPHistory{UserID: "alice", Key: "manual:1", XP: 10, Source: models.XPSourceTodo})
+		require.NoError(t, err)
+
+		now = now.Add(2 * time.Hour)
+		require.NoError(t, award("todo:3"), "a new day has its own cap, transactions: %v", transactions)
+
+		balance, _ := ledger.Balance(ctx, "alice")
+		assert.Equal(t, 40, balance, "transactions: %v", transactions)
+	}
+}
+
+func TestLedger_ApplyPendingAppliesOnce(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	backend := newFakeLedgerBackend(false, "alice", "bob")
+	ledger := newLedger(backend, DefaultLevelCurve(), func() time.Time { return now })
+
+	// Left behind by a server that stopped before adding them to the totals
+	backend.entries = []models.XPHistory{
+		{ID: primitive.NewObjectID(), UserID: "alice", Key: "session:1", XP: 30, Pending: true, CreatedAt: now.Add(-time.Hour)},
+		{ID: primitive.NewObjectID(), UserID: "bob", Key: "session:2", XP: 20, Pending: true, CreatedAt: now.Add(-10 * time.Second)},
+	}
+
+	require.NoError(t, ledger.ApplyPending(ctx))
+	require.NoError(t, ledger.ApplyPending(ctx))
+
+	alice, _ := ledger.Balance(ctx, "alice")
+	assert.Equal(t, 30, alice)
+	assert.False(t, backend.entries[0].Pending)
+	assert.Equal(t, 30, backend.entries[0].Balance)
+
+	// Recent entries may still be in progress
+	bob, _ := ledger.Balance(ctx, "bob")
+	assert.Zero(t, bob)
+	assert.True(t, backend.entries[1].Pending)
+
+	now = now.Add(time.Minute)
+	require.NoError(t, ledger.ApplyPending(ctx))
+	require.NoError(t, ledger.ApplyPending(ctx))
+	bob, _ = ledger.Balance(ctx, "bob")
+	assert.Equal(t, 20, bob)
+	alice, _ = ledger.Balance(ctx, "alice")
+	assert.Equal(t, 30, alice)
+}
@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+const (
+	// AccessTokenPrefix starts every personal access token, which tells
+	// them apart from JWTs and makes leaked tokens easy to scan for
+	AccessTokenPrefix = "spat_"
+	// MaxAccessTokensPerUser bounds how many tokens a user may hold
+	MaxAccessTokensPerUser = 50
+	accessTokenBytes       = 32
+	// accessTokenPrefixLength is how much of a token is kept in the clear
+	// so users can tell their tokens apart
+	accessTokenPrefixLength = len(AccessTokenPrefix) + 6
+	// accessTokenTouchInterval bounds how often last-used tracking writes
+	// to the database for a busy token
+	accessTokenTouchInterval = time.Minute
+)
+
+// Scope limits what a personal access token may do
+type Scope string
+
+// Scopes name a resource and whether it may be read or also written
+const (
+	ScopeProfileRead   Scope = "profile:read"
+	ScopeSessionsRead  Scope = "sessions:read"
+	ScopeSessionsWrite Scope = "sessions:write"
+	ScopeTodosRead     Scope = "todos:read"
+	ScopeTodosWrite    Scope = "todos:write"
+	ScopeNotesRead     Scope = "notes:read"
+	ScopeNotesWrite    Scope = "notes:write"
+)
+
+// Scopes lists every scope a token can be given
+func Scopes() []Scope {
+	return []Scope{
+		ScopeProfileRead,
+		ScopeSessionsRead, ScopeSessionsWrite,
+		ScopeTodosRead, ScopeTodosWrite,
+		ScopeNotesRead, ScopeNotesWrite,
+	}
+}
+
+// Errors returned by the access token store
+var (
+	ErrInvalidAccessToken  = errors.New("invalid or expired access token")
+	ErrInvalidScope        = errors.New("unknown scope")
+	ErrTooManyAccessTokens = errors.New("too many access tokens")
+	ErrAccessTokenNotFound = errors.New("access token not found")
+)
+
+// ParseScopes checks that every name is a known scope and drops duplicates
+func ParseScopes(names []string) ([]string, error) {
+	known := make(map[Scope]bool)
+	for _, scope := range Scopes() {
+		known[scope] = true
+	}
+
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, name := range names {
+		if !known[Scope(name)] {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			scopes = append(scopes, name)
+		}
+	}
+	return scopes, nil
+}
+
+// HasScope reports whether the granted scopes include the required one. A
+// write scope includes reading the same resource.
+func HasScope(granted []string, required Scope) bool {
+	for _, name := range granted {
+		if Scope(name) == required {
+			return true
+		}
+		if resource, access, ok := strings.Cut(name, ":"); ok && access == "write" && Scope(resource+":read") == required {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAccessToken reports whether a bearer token is a personal access token
+// rather than a JWT
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, AccessTokenPrefix)
+}
+
+// accessTokenBackend persists personal access tokens
+type accessTokenBackend interface {
+	insert(ctx context.Context, token *models.PersonalAccessToken) error
+	count(ctx context.Context, userID string) (int64, error)
+	list(ctx context.Context, userID string) ([]models.PersonalAccessToken, error)
+	// findByHash returns nil when no token has the hash
+	findByHash(ctx context.Context, hash string) (*models.PersonalAccessToken, error)
+	touch(ctx context.Context, id primitive.ObjectID, at time.Time, ip string) error
+	remove(ctx context.Context, userID string, id primitive.ObjectID) (bool, error)
+}
+
+// AccessTokenStore creates, lists, revokes and authenticates personal
+// access tokens
+type AccessTokenStore struct {
+	backend accessTokenBackend
+	now     func() time.Time
+}
+
+// NewAccessTokenStore creates an access token store backed by MongoDB
+func NewAccessTokenStore(mongoClient *database.MongoClient) *AccessTokenStore {
+	return newAccessTokenStore(&mongoAccessTokenBackend{mongoClient: mongoClient}, time.Now)
+}
+
+func newAccessTokenStore(backend accessTokenBackend, now func() time.Time) *AccessTokenStore {
+	return &AccessTokenStore{backend: backend, now: now}
+}
+
+// Create issues a token for the user. The token itself is only returned
+// here. It never expires when ttl is zero.
+func (s *AccessTokenStore) Create(ctx context.Context, userID, name string, scopes []string, ttl time.Duration) (string, models.PersonalAccessToken, error) {
+	scopes, err := ParseScopes(scopes)
+	if err != nil {
+		return "", models.PersonalAccessToken{}, err
+	}
+	if len(scopes) == 0 {
+		return "", models.PersonalAccessToken{}, fmt.Errorf("%w: none given", ErrInvalidScope)
+	}
+
+	count, err := s.backend.count(ctx, userID)
+	if err != nil {
+		return "", models.PersonalAccessToken{}, err
+	}
+	if count >= MaxAccessTokensPerUser {
+		return "", models.PersonalAccessToken{}, ErrTooManyAccessTokens
+	}
+
+	raw := make([]byte, accessTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", models.PersonalAccessToken{}, err
+	}
+	token := AccessTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	record := models.PersonalAccessToken{
+		UserID:    userID,
+		Name:      strings.TrimSpace(name),
+		TokenHash: HashToken(token),
+		Prefix:    token[:accessTokenPrefixLength],
+		Scopes:    scopes,
+		CreatedAt: s.now(),
+	}
+	if ttl > 0 {
+		expiresAt := record.CreatedAt.Add(ttl)
+		record.ExpiresAt = &expiresAt
+	}
+	if err := s.backend.insert(ctx, &record); err != nil {
+		return "", models.PersonalAccessToken{}, err
+	}
+	return token, record, nil
+}
+
+// List returns the user's tokens that have not expired, newest first
+func (s *AccessTokenStore) List(ctx context.Context, userID string) ([]models.PersonalAccessToken, error) {
+	tokens, err := s.backend.list(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// MongoDB removes expired tokens only about once a minute
+	now := s.now()
+	active := make([]models.PersonalAccessToken, 0, len(tokens))
+	for _, token := range tokens {
+		if token.ExpiresAt == nil || token.ExpiresAt.After(now) {
+			active = append(active, token)
+		}
+	}
+	return active, nil
+}
+
+// Revoke deletes one of the user's tokens
+func (s *AccessTokenStore) Revoke(ctx context.Context, userID string, id primitive.ObjectID) error {
+	removed, err := s.backend.remove(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrAccessTokenNotFound
+	}
+	return nil
+}
+
+// Authenticate returns the stored token a request presented and records
+// its use. Unknown and expired tokens give ErrInvalidAccessToken.
+func (s *AccessTokenStore) Authenticate(ctx context.Context, token, ip string) (*models.PersonalAccessToken, error) {
+	if !IsAccessToken(token) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	record, err := s.backend.findByHash(ctx, HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	if record == nil || (record.ExpiresAt != nil && !record.ExpiresAt.After(now)) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) >= accessTokenTouchInterval || record.LastUsedIP != ip {
+		if err := s.backend.touch(ctx, record.ID, now, ip); err != nil {
+			return nil, err
+		}
+		record.LastUsedAt = &now
+		record.LastUsedIP = ip
+	}
+	return record, nil
+}
+
+// mongoAccessTokenBackend keeps tokens in the personal_access_tokens
+// collection
+type mongoAccessTokenBackend struct {
+	mongoClient *database.MongoClient
+}
+
+func (b *mongoAccessTokenBackend) collection() *mongo.Collection {
+	return b.mongoClient.GetCollection(database.CollectionNames.AccessTokens)
+}
+
+func (b *mongoAccessTokenBackend) insert(ctx context.Context, token *models.PersonalAccessToken) error {
+	res, err := b.collection().InsertOne(ctx, token)
+	if err != nil {
+		return err
+	}
+	token.ID, _ = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (b *mongoAccessTokenBackend) count(ctx context.Context, userID string) (int64, error) {
+	return b.collection().CountDocuments(ctx, bson.M{"user_id": userID})
+}
+
+func (b *mongoAccessTokenBackend) list(ctx context.Context, userID string) ([]models.PersonalAccessToken, error) {
+	cursor, err := b.collection().Find(ctx, bson.M{"user_id": userID}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var tokens []models.PersonalAccessToken
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (b *mongoAccessTokenBackend) findByHash(ctx context.Context, hash string) (*models.PersonalAccessToken, error) {
+	var token models.PersonalAccessToken
+	err := b.collection().FindOne(ctx, bson.M{"token_hash": hash}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (b *mongoAccessTokenBackend) touch(ctx context.Context, id primitive.ObjectID, at time.Time, ip string) error {
+	_, err := b.collection().UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"last_used_at": at, "last_used_ip": ip}},
+	)
+	return err
+}
+
+func (b *mongoAccessTokenBackend) remove(ctx context.Context, userID string, id primitive.ObjectID) (bool, error) {
+	res, err := b.collection().DeleteOne(ctx, bson.M{"_id": id, "user_id": userID})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount == 1, nil
+}
+
+// EnsureAccessTokenIndexes creates the indexes of personal access tokens,
+// which MongoDB removes once they expire
+func EnsureAccessTokenIndexes(mongoClient *database.MongoClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tokens := mongoClient.GetCollection(database.CollectionNames.AccessTokens)
+	_, err := tokens.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetName("token_hash").SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
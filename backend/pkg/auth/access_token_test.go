@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// fakeAccessTokenBackend keeps tokens in memory and counts writes
+type fakeAccessTokenBackend struct {
+	tokens  map[primitive.ObjectID]models.PersonalAccessToken
+	touches int
+}
+
+func newFakeAccessTokenBackend() *fakeAccessTokenBackend {
+	return &fakeAccessTokenBackend{tokens: make(map[primitive.ObjectID]models.PersonalAccessToken)}
+}
+
+func (b *fakeAccessTokenBackend) insert(ctx context.Context, token *models.PersonalAccessToken) error {
+	token.ID = primitive.NewObjectID()
+	b.tokens[token.ID] = *token
+	return nil
+}
+
+func (b *fakeAccessTokenBackend) count(ctx context.Context, userID string) (int64, error) {
+	var count int64
+	for _, token := range b.tokens {
+		if token.UserID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (b *fakeAccessTokenBackend) list(ctx context.Context, userID string) ([]models.PersonalAccessToken, error) {
+	var tokens []models.PersonalAccessToken
+	for _, token := range b.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (b *fakeAccessTokenBackend) findByHash(ctx context.Context, hash string) (*models.PersonalAccessToken, error) {
+	for _, token := range b.tokens {
+		if token.TokenHash == hash {
+			return &token, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *fakeAccessTokenBackend) touch(ctx context.Context, id primitive.ObjectID, at time.Time, ip string) error {
+	token := b.tokens[id]
+	token.LastUsedAt = &at
+	token.LastUsedIP = ip
+	b.tokens[id] = token
+	b.touches++
+	return nil
+}
+
+func (b *fakeAccessTokenBackend) remove(ctx context.Context, userID string, id primitive.ObjectID) (bool, error) {
+	token, ok := b.tokens[id]
+	if !ok || token.UserID != userID {
+		return false, nil
+	}
+	delete(b.tokens, id)
+	return true, nil
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes([]string{"sessions:write", "todos:read", "sessions:write"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sessions:write", "todos:read"}, scopes)
+
+	_, err = ParseScopes([]string{"sessions:write", "admin"})
+	assert.True(t, errors.Is(err, ErrInvalidScope))
+}
+
+func TestHasScope(t *testing.T) {
+	granted := []string{"sessions:write", "todos:read"}
+	assert.True(t, HasScope(granted, ScopeSessionsWrite))
+	assert.True(t, HasScope(granted, ScopeSessionsRead), "write includes read")
+	assert.True(t, HasScope(granted, ScopeTodosRead))
+	assert.False(t, HasScope(granted, ScopeTodosWrite), "read does not include write")
+	assert.False(t, HasScope(granted, ScopeNotesRead))
+	assert.False(t, HasScope(nil, ScopeProfileRead))
+}
+
+func TestAccessTokenStore_CreateAndAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	backend := newFakeAccessTokenBackend()
+	store := newAccessTokenStore(backend, func() time.Time { return now })
+
+	token, record, err := store.Create(ctx, "user-1", "  CLI timer ", []string{"sessions:write"}, 0)
+	require.NoError(t, err)
+	assert.True(t, IsAccessToken(token))
+	assert.True(t, strings.HasPrefix(token, record.Prefix))
+	assert.Equal(t, "CLI timer", record.Name)
+	assert.Nil(t, record.ExpiresAt)
+	assert.Equal(t, HashToken(token), backend.tokens[record.ID].TokenHash, "only the hash is stored")
+
+	authenticated, err := store.Authenticate(ctx, token, "203.0.113.7")
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", authenticated.UserID)
+	assert.Equal(t, []string{"sessions:write"}, authenticated.Scopes)
+	assert.Equal(t, now, *backend.tokens[record.ID].LastUsedAt)
+	assert.Equal(t, "203.0.113.7", backend.tokens[record.ID].LastUsedIP)
+
+	// Busy tokens are not written on every request
+	now = now.Add(10 * time.Second)
+	_, err = store.Authenticate(ctx, token, "203.0.113.7")
+	require.NoError(t, err)
+	assert.Equal(t, 1, backend.touches)
+	now = now.Add(time.Minute)
+	_, err = store.Authenticate(ctx, token, "203.0.113.7")
+	require.NoError(t, err)
+	assert.Equal(t, 2, backend.touches)
+
+	_, err = store.Authenticate(ctx, token+"x", "203.0.113.7")
+	assert.Equal(t, ErrInvalidAccessToken, err)
+	_, err = store.Authenticate(ctx, "eyJhbGciOi.jwt.token", "203.0.113.7")
+	assert.Equal(t, ErrInvalidAccessToken, err)
+}
+
+func TestAccessTokenStore_Expiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := newAccessTokenStore(newFakeAccessTokenBackend(), func() time.Time { return now })
+
+	token, record, err := store.Create(ctx, "user-1", "CI", []string{"todos:read"}, 24*time.Hour)
+	require.NoError(t, err)
+	require.NotNil(t, record.ExpiresAt)
+	assert.Equal(t, now.Add(24*time.Hour), *record.ExpiresAt)
+
+	_, err = store.Authenticate(ctx, token, "203.0.113.7")
+	require.NoError(t, err)
+
+	now = now.Add(24 * time.Hour)
+	_, err = store.Authenticate(ctx, token, "203.0.113.7")
+	assert.Equal(t, ErrInvalidAccessToken, err)
+
+	tokens, err := store.List(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+}
+
+func TestAccessTokenStore_Revoke(t *testing.T) {
+	ctx := context.Background()
+	store := newAccessTokenStore(newFakeAccessTokenBackend(), time.Now)
+
+	token, record, err := store.Create(ctx, "user-1", "CLI", []string{"notes:read"}, 0)
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrAccessTokenNotFound, store.Revoke(ctx, "user-2", record.ID), "users only revoke their own tokens")
+	require.NoError(t, store.Revoke(ctx, "user-1", record.ID))
+	assert.Equal(t, ErrAccessTokenNotFound, store.Revoke(ctx, "user-1", record.ID))
+
+	_, err = store.Authenticate(ctx, token, "203.0.113.7")
+	assert.Equal(t, ErrInvalidAccessToken, err)
+}
+
+func TestAccessTokenStore_Limits(t *testing.T) {
+	ctx := context.Background()
+	store := newAccessTokenStore(newFakeAccessTokenBackend(), time.Now)
+
+	_, _, err := store.Create(ctx, "user-1", "none", nil, 0)
+	assert.True(t, errors.Is(err, ErrInvalidScope))
+
+	for i := 0; i < MaxAccessTokensPerUser; i++ {
+		_, _, err := store.Create(ctx, "user-1", "token", []string{"profile:read"}, 0)
+		require.NoError(t, err)
+	}
+	_, _, err = store.Create(ctx, "user-1", "one too many", []string{"profile:read"}, 0)
+	assert.Equal(t, ErrTooManyAccessTokens, err)
+}
@@ -2,10 +2,14 @@ package auth
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+
+	"github.com/studyplatform/backend/pkg/logger"
 )
 
 // TokenType defines the type of JWT token
@@ -16,6 +20,18 @@ const (
 	AccessToken TokenType = "access"
 	// RefreshToken is a long-lived token used to obtain new access tokens
 	RefreshToken TokenType = "refresh"
+	// EmailVerificationToken confirms the user owns their email address
+	EmailVerificationToken TokenType = "email_verification"
+	// PasswordResetToken lets the user choose a new password
+	PasswordResetToken TokenType = "password_reset"
+	// MFAPendingToken proves the password was checked while the second
+	// factor of a login is still outstanding
+	MFAPendingToken TokenType = "mfa_pending"
+	// OIDCLoginToken hands a login through an external identity provider
+	// over to the frontend, which exchanges it for a session
+	OIDCLoginToken TokenType = "oidc_login"
+	// AccountUnlockToken lifts a lockout caused by failed logins
+	AccountUnlockToken TokenType = "account_unlock"
 )
 
 // Claims represents the JWT claims
@@ -24,6 +40,13 @@ type Claims struct {
 	Username  string    `json:"username"`
 	Email     string    `json:"email"`
 	TokenType TokenType `json:"token_type"`
+	SessionID string    `json:"sid,omitempty"` // device session the token belongs to
+	// TokenVersion must match the user's token version; bumping it revokes
+	// every token issued before
+	TokenVersion int `json:"ver"`
+	// Roles are the user's roles when the token was issued. Changing them
+	// bumps the token version so tokens never carry stale roles.
+	Roles []string `json:"roles,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -35,12 +58,20 @@ type Config struct {
 	RefreshExpiry time.Duration
 }
 
-// Manager handles JWT token operations
+// Manager handles JWT token operations. Tokens are signed with the key set
+// when one is configured and with the HMAC secrets otherwise.
 type Manager struct {
 	config Config
+	keys   *KeySet
+	// hmacCutoff is when signing keys replaced the HMAC secrets. HMAC-signed
+	// tokens issued before it are accepted for one refresh token lifetime
+	// after it; when zero they are refused.
+	hmacCutoff time.Time
+	now        func() time.Time
 }
 
-// NewManager creates a new JWT manager with environment variables
+// NewManager creates a new JWT manager using HMAC secrets from environment
+// variables
 func NewManager() *Manager {
 	accessSecret := os.Getenv("JWT_SECRET")
 	if accessSecret == "" {
@@ -78,6 +109,89 @@ func NewManager() *Manager {
 	}
 }
 
+// LoadManager creates a JWT manager from environment variables. Tokens are
+// signed with the keys listed in JWT_SIGNING_KEYS; replaced keys keep
+// verifying tokens for JWT_KEY_GRACE_PERIOD (default: the refresh token
+// lifetime). Without signing keys it falls back to HMAC secrets, which is
+// refused in production. While JWT_SECRET is still set, tokens it signed
+// before JWT_HMAC_CUTOFF (default: the activation of the oldest key) are
+// accepted for one refresh token lifetime after it.
+func LoadManager() (*Manager, error) {
+	manager := NewManager()
+
+	gracePeriod := manager.config.RefreshExpiry
+	if gracePeriodStr := os.Getenv("JWT_KEY_GRACE_PERIOD"); gracePeriodStr != "" {
+		duration, err := time.ParseDuration(gracePeriodStr)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid JWT_KEY_GRACE_PERIOD %q", gracePeriodStr)
+		}
+		gracePeriod = duration
+	}
+
+	keys, err := LoadKeySet(gracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		if os.Getenv("ENV") == "production" {
+			return nil, errors.New("JWT_SIGNING_KEYS must be configured in production")
+		}
+		return manager, nil
+	}
+
+	manager.keys = keys
+	if os.Getenv("JWT_SECRET") == "" {
+		return manager, nil
+	}
+	manager.hmacCutoff = keys.keys[0].ActiveFrom
+	if cutoffStr := os.Getenv("JWT_HMAC_CUTOFF"); cutoffStr != "" {
+		cutoff, err := time.Parse(time.RFC3339, cutoffStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_HMAC_CUTOFF %q", cutoffStr)
+		}
+		manager.hmacCutoff = cutoff
+	}
+	if manager.hmacCutoff.IsZero() {
+		return nil, errors.New("JWT_HMAC_CUTOFF must be set while JWT_SECRET is")
+	}
+	return manager, nil
+}
+
+// UsesSigningKeys reports whether tokens are signed with asymmetric keys
+func (m *Manager) UsesSigningKeys() bool {
+	return m.keys != nil
+}
+
+// JWKS returns the public keys that verify tokens issued by this manager.
+// The set is empty when tokens are signed with HMAC secrets.
+func (m *Manager) JWKS() JWKS {
+	if m.keys == nil {
+		return JWKS{Keys: []JWK{}}
+	}
+	return m.keys.JWKS(m.clock())
+}
+
+// clock returns the current time used for key rotation
+func (m *Manager) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// sign signs the claims with the current signing key, or with the HMAC
+// secret when no keys are configured
+func (m *Manager) sign(claims Claims, secret string) (string, error) {
+	if m.keys == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	}
+
+	key := m.keys.signingKey(m.clock())
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
 // GenerateAccessToken creates a new access token
 func (m *Manager) GenerateAccessToken(userID, username, email string) (string, error) {
 	now := time.Now()
@@ -87,14 +201,14 @@ func (m *Manager) GenerateAccessToken(userID, username, email string) (string, e
 		Email:     email,
 		TokenType: AccessToken,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
 			ExpiresAt: jwt.NewNumericDate(now.Add(m.config.AccessExpiry)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(m.config.AccessSecret))
+	return m.sign(claims, m.config.AccessSecret)
 }
 
 // GenerateRefreshToken creates a new refresh token
@@ -106,14 +220,97 @@ func (m *Manager) GenerateRefreshToken(userID, username, email string) (string,
 		Email:     email,
 		TokenType: RefreshToken,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
 			ExpiresAt: jwt.NewNumericDate(now.Add(m.config.RefreshExpiry)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(m.config.RefreshSecret))
+	return m.sign(claims, m.config.RefreshSecret)
+}
+
+// GenerateActionToken creates a short-lived token for a one-off action such
+// as verifying an email address. It is single use once consumed through the
+// revocation store.
+func (m *Manager) GenerateActionToken(tokenType TokenType, userID, email string, ttl time.Duration) (string, error) {
+	now := m.clock()
+	claims := Claims{
+		UserID:    userID,
+		Email:     email,
+		TokenType: tokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+	return m.sign(claims, m.config.AccessSecret)
+}
+
+// ValidateActionToken validates a token created by GenerateActionToken
+func (m *Manager) ValidateActionToken(tokenString string, tokenType TokenType) (*Claims, error) {
+	return m.validateToken(tokenString, m.config.AccessSecret, tokenType)
+}
+
+// TokenPair is an access token and refresh token issued for a device session
+type TokenPair struct {
+	AccessToken      string
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// GenerateTokenPair creates an access and refresh token bound to a session
+// and the user's current token version and roles
+func (m *Manager) GenerateTokenPair(userID, username, email, sessionID string, tokenVersion int, roles []string) (TokenPair, error) {
+	now := time.Now()
+	accessClaims := Claims{
+		UserID:       userID,
+		Username:     username,
+		Email:        email,
+		TokenType:    AccessToken,
+		SessionID:    sessionID,
+		TokenVersion: tokenVersion,
+		Roles:        roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(m.config.AccessExpiry)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+	accessToken, err := m.sign(accessClaims, m.config.AccessSecret)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshExpiresAt := now.Add(m.config.RefreshExpiry)
+	refreshClaims := Claims{
+		UserID:       userID,
+		Username:     username,
+		Email:        email,
+		TokenType:    RefreshToken,
+		SessionID:    sessionID,
+		TokenVersion: tokenVersion,
+		Roles:        roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(refreshExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+	refreshToken, err := m.sign(refreshClaims, m.config.RefreshSecret)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+	}, nil
 }
 
 // ValidateAccessToken validates an access token and returns the claims
@@ -129,10 +326,7 @@ func (m *Manager) ValidateRefreshToken(tokenString string) (*Claims, error) {
 // validateToken validates a token against its secret and expected type
 func (m *Manager) validateToken(tokenString, secret string, expectedType TokenType) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return []byte(secret), nil
+		return m.verificationKey(token, secret)
 	})
 
 	if err != nil {
@@ -143,8 +337,49 @@ func (m *Manager) validateToken(tokenString, secret string, expectedType TokenTy
 		if claims.TokenType != expectedType {
 			return nil, errors.New("invalid token type")
 		}
+		if _, hmac := token.Method.(*jwt.SigningMethodHMAC); hmac && m.keys != nil {
+			logger.Warn("Accepted legacy HMAC-signed token",
+				logger.Field("user_id", claims.UserID),
+				logger.Field("token_type", string(claims.TokenType)),
+			)
+		}
 		return claims, nil
 	}
 
 	return nil, errors.New("invalid token claims")
 }
+
+// verificationKey picks the key that must have signed the token. Tokens
+// signed with a key pair name it in the kid header; the algorithm must match
+// the key, so a public key can never be used as an HMAC secret.
+func (m *Manager) verificationKey(token *jwt.Token, secret string) (interface{}, error) {
+	if kid, ok := token.Header["kid"].(string); ok && m.keys != nil {
+		key, found := m.keys.verificationKey(kid, m.clock())
+		if !found {
+			return nil, errors.New("unknown signing key")
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.PrivateKey.Public(), nil
+	}
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, errors.New("unexpected signing method")
+	}
+	if m.keys != nil && !m.acceptsLegacyHMAC(token) {
+		return nil, errors.New("token has no signing key ID")
+	}
+	return []byte(secret), nil
+}
+
+// acceptsLegacyHMAC reports whether an HMAC-signed token may still be
+// verified after the switch to signing keys: it must have been issued before
+// the cutoff, and no more than one refresh token lifetime has passed since
+func (m *Manager) acceptsLegacyHMAC(token *jwt.Token) bool {
+	if m.hmacCutoff.IsZero() || !m.clock().Before(m.hmacCutoff.Add(m.config.RefreshExpiry)) {
+		return false
+	}
+	claims, ok := token.Claims.(*Claims)
+	return ok && claims.IssuedAt != nil && claims.IssuedAt.Before(m.hmacCutoff)
+}
@@ -157,6 +157,42 @@ func TestValidateToken(t *testing.T) {
 	assert.Equal(t, RefreshToken, claims.TokenType)
 }
 
+func TestGenerateTokenPair(t *testing.T) {
+	manager := &Manager{
+		config: Config{
+			AccessSecret:  "test_secret",
+			RefreshSecret: "test_refresh_secret",
+			AccessExpiry:  time.Hour,
+			RefreshExpiry: 24 * time.Hour,
+		},
+	}
+
+	pair, err := manager.GenerateTokenPair("user123", "testuser", "test@example.com", "session123", 2, []string{"moderator"})
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), pair.RefreshExpiresAt, time.Second)
+
+	accessClaims, err := manager.ValidateAccessToken(pair.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "session123", accessClaims.SessionID)
+	assert.Equal(t, 2, accessClaims.TokenVersion)
+	assert.Equal(t, []string{"moderator"}, accessClaims.Roles)
+	assert.NotEmpty(t, accessClaims.ID)
+
+	refreshClaims, err := manager.ValidateRefreshToken(pair.RefreshToken)
+	require.NoError(t, err)
+	assert.Equal(t, "session123", refreshClaims.SessionID)
+	assert.Equal(t, "user123", refreshClaims.UserID)
+	assert.Equal(t, []string{"moderator"}, refreshClaims.Roles)
+	assert.NotEmpty(t, refreshClaims.ID)
+
+	// Tokens rotated within the same second still differ
+	next, err := manager.GenerateTokenPair("user123", "testuser", "test@example.com", "session123", 2, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, pair.RefreshToken, next.RefreshToken)
+	assert.NotEqual(t, HashToken(pair.RefreshToken), HashToken(next.RefreshToken))
+	assert.Len(t, HashToken(pair.RefreshToken), 64)
+}
+
 func TestValidateToken_InvalidToken(t *testing.T) {
 	manager := &Manager{
 		config: Config{
@@ -248,3 +284,39 @@ func TestClaims_Expired(t *testing.T) {
 	err := claims.Valid()
 	assert.Error(t, err)
 }
+
+func TestActionTokens(t *testing.T) {
+	manager := &Manager{
+		config: Config{
+			AccessSecret:  "test_secret",
+			RefreshSecret: "test_refresh_secret",
+			AccessExpiry:  time.Hour,
+		},
+	}
+
+	token, err := manager.GenerateActionToken(PasswordResetToken, "user123", "test@example.com", time.Hour)
+	require.NoError(t, err)
+
+	claims, err := manager.ValidateActionToken(token, PasswordResetToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user123", claims.UserID)
+	assert.Equal(t, "test@example.com", claims.Email)
+	assert.NotEmpty(t, claims.ID)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), claims.ExpiresAt.Time, time.Second)
+
+	// Action tokens are not interchangeable with each other or with access tokens
+	_, err = manager.ValidateActionToken(token, EmailVerificationToken)
+	assert.Error(t, err)
+	_, err = manager.ValidateAccessToken(token)
+	assert.Error(t, err)
+
+	accessToken, err := manager.GenerateAccessToken("user123", "testuser", "test@example.com")
+	require.NoError(t, err)
+	_, err = manager.ValidateActionToken(accessToken, PasswordResetToken)
+	assert.Error(t, err)
+
+	expired, err := manager.GenerateActionToken(EmailVerificationToken, "user123", "test@example.com", -time.Minute)
+	require.NoError(t, err)
+	_, err = manager.ValidateActionToken(expired, EmailVerificationToken)
+	assert.Error(t, err)
+}
@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Supported asymmetric signing algorithms
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// minRSAKeyBits is the smallest RSA key accepted for signing
+const minRSAKeyBits = 2048
+
+// SigningKey is a private key used to sign tokens, identified by kid
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	// ActiveFrom is when the key starts signing tokens. Keys are published
+	// in the JWKS before then so verifiers can fetch them ahead of rotation.
+	ActiveFrom time.Time
+}
+
+// method returns the JWT signing method of the key
+func (k SigningKey) method() jwt.SigningMethod {
+	if k.Algorithm == AlgorithmEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// KeySet holds the signing keys in rotation order. The newest active key
+// signs new tokens; a key replaced by a newer one still verifies tokens for
+// the grace period, which should cover the longest token lifetime.
+type KeySet struct {
+	keys        []SigningKey // oldest first
+	gracePeriod time.Duration
+}
+
+// NewKeySet validates the keys and orders them by activation time
+func NewKeySet(keys []SigningKey, gracePeriod time.Duration) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("signing key has no ID")
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("duplicate signing key ID %q", key.ID)
+		}
+		seen[key.ID] = true
+
+		switch private := key.PrivateKey.(type) {
+		case *rsa.PrivateKey:
+			if key.Algorithm != AlgorithmRS256 {
+				return nil, fmt.Errorf("signing key %q: RSA keys must use %s", key.ID, AlgorithmRS256)
+			}
+			if private.N.BitLen() < minRSAKeyBits {
+				return nil, fmt.Errorf("signing key %q: RSA keys must be at least %d bits", key.ID, minRSAKeyBits)
+			}
+		case ed25519.PrivateKey:
+			if key.Algorithm != AlgorithmEdDSA {
+				return nil, fmt.Errorf("signing key %q: Ed25519 keys must use %s", key.ID, AlgorithmEdDSA)
+			}
+		default:
+			return nil, fmt.Errorf("signing key %q: unsupported key type %T", key.ID, key.PrivateKey)
+		}
+	}
+
+	sorted := append([]SigningKey(nil), keys...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ActiveFrom.Before(sorted[j].ActiveFrom)
+	})
+	return &KeySet{keys: sorted, gracePeriod: gracePeriod}, nil
+}
+
+// signingKey returns the newest key active at now. Before any key is active
+// the oldest one is used, so a set with only scheduled keys still works.
+func (s *KeySet) signingKey(now time.Time) SigningKey {
+	current := s.keys[0]
+	for _, key := range s.keys[1:] {
+		if !key.ActiveFrom.After(now) {
+			current = key
+		}
+	}
+	return current
+}
+
+// retiredAt returns when the key at index i was replaced by a newer active
+// key, or false while it is still current
+func (s *KeySet) retiredAt(i int, now time.Time) (time.Time, bool) {
+	for _, next := range s.keys[i+1:] {
+		if !next.ActiveFrom.After(now) {
+			return next.ActiveFrom, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// published returns the keys that verify tokens at now: the current key,
+// scheduled keys and retired keys still within their grace period
+func (s *KeySet) published(now time.Time) []SigningKey {
+	var keys []SigningKey
+	for i, key := range s.keys {
+		if retired, ok := s.retiredAt(i, now); ok && !now.Before(retired.Add(s.gracePeriod)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// verificationKey returns the published key with the given ID
+func (s *KeySet) verificationKey(id string, now time.Time) (SigningKey, bool) {
+	for _, key := range s.published(now) {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n,omitempty"`   // RSA modulus
+	E         string `json:"e,omitempty"`   // RSA public exponent
+	Curve     string `json:"crv,omitempty"` // OKP curve
+	X         string `json:"x,omitempty"`   // OKP public key
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys verifiers should accept at now
+func (s *KeySet) JWKS(now time.Time) JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range s.published(now) {
+		jwk := JWK{Use: "sig", Algorithm: key.Algorithm, KeyID: key.ID}
+		switch public := key.PrivateKey.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+// LoadKeySet reads signing keys from JWT_SIGNING_KEYS, a comma-separated
+// list of "kid=path" entries. An entry may be scheduled with
+// "kid=path@2024-07-01T00:00:00Z". The files hold PEM-encoded RSA or
+// Ed25519 private keys. It returns nil when no keys are configured.
+func LoadKeySet(gracePeriod time.Duration) (*KeySet, error) {
+	var keys []SigningKey
+	for _, entry := range strings.Split(os.Getenv("JWT_SIGNING_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, path, ok := strings.Cut(entry, "=")
+		if !ok || id == "" || path == "" {
+			return nil, fmt.Errorf("invalid JWT_SIGNING_KEYS entry %q, expected kid=path", entry)
+		}
+
+		var activeFrom time.Time
+		if keyPath, at, scheduled := strings.Cut(path, "@"); scheduled {
+			parsed, err := time.Parse(time.RFC3339, at)
+			if err != nil {
+				return nil, fmt.Errorf("signing key %q: invalid activation time: %w", id, err)
+			}
+			path, activeFrom = keyPath, parsed
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %w", id, err)
+		}
+		key, err := ParseSigningKey(id, data)
+		if err != nil {
+			return nil, err
+		}
+		key.ActiveFrom = activeFrom
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return NewKeySet(keys, gracePeriod)
+}
+
+// ParseSigningKey parses a PEM-encoded PKCS#8 or PKCS#1 private key and picks
+// the algorithm from its type
+func ParseSigningKey(id string, data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("signing key %q: no PEM data found", id)
+	}
+
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("signing key %q: unsupported PEM type %q", id, block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("signing key %q: %w", id, err)
+	}
+
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		return SigningKey{ID: id, Algorithm: AlgorithmRS256, PrivateKey: private}, nil
+	case ed25519.PrivateKey:
+		return SigningKey{ID: id, Algorithm: AlgorithmEdDSA, PrivateKey: private}, nil
+	}
+	return SigningKey{}, fmt.Errorf("signing key %q: unsupported key type %T", id, private)
+}
@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRSAKey(t *testing.T, id string, activeFrom time.Time) SigningKey {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return SigningKey{ID: id, Algorithm: AlgorithmRS256, PrivateKey: private, ActiveFrom: activeFrom}
+}
+
+func newEd25519Key(t *testing.T, id string, activeFrom time.Time) SigningKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return SigningKey{ID: id, Algorithm: AlgorithmEdDSA, PrivateKey: private, ActiveFrom: activeFrom}
+}
+
+func TestNewKeySet_Validation(t *testing.T) {
+	_, err := NewKeySet(nil, time.Hour)
+	assert.Error(t, err)
+
+	key := newEd25519Key(t, "a", time.Time{})
+	_, err = NewKeySet([]SigningKey{key, key}, time.Hour)
+	assert.Error(t, err, "duplicate kid")
+
+	mismatched := key
+	mismatched.Algorithm = AlgorithmRS256
+	_, err = NewKeySet([]SigningKey{mismatched}, time.Hour)
+	assert.Error(t, err)
+
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = NewKeySet([]SigningKey{{ID: "weak", Algorithm: AlgorithmRS256, PrivateKey: weak}}, time.Hour)
+	assert.Error(t, err)
+}
+
+func TestKeySet_Rotation(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rotation := start.Add(30 * 24 * time.Hour)
+	grace := 7 * 24 * time.Hour
+
+	keys, err := NewKeySet([]SigningKey{
+		newEd25519Key(t, "next", rotation),
+		newEd25519Key(t, "first", time.Time{}),
+	}, grace)
+	require.NoError(t, err)
+
+	ids := func(now time.Time) []string {
+		var ids []string
+		for _, key := range keys.published(now) {
+			ids = append(ids, key.ID)
+		}
+		return ids
+	}
+
+	// The scheduled key is published before it signs anything
+	assert.Equal(t, "first", keys.signingKey(start).ID)
+	assert.Equal(t, []string{"first", "next"}, ids(start))
+
+	// After rotation the old key only verifies, until the grace period ends
+	assert.Equal(t, "next", keys.signingKey(rotation).ID)
+	assert.Equal(t, []string{"first", "next"}, ids(rotation.Add(grace-time.Second)))
+	_, ok := keys.verificationKey("first", rotation.Add(grace-time.Second))
+	assert.True(t, ok)
+
+	assert.Equal(t, []string{"next"}, ids(rotation.Add(grace)))
+	_, ok = keys.verificationKey("first", rotation.Add(grace))
+	assert.False(t, ok)
+}
+
+func TestKeySet_JWKS(t *testing.T) {
+	rsaKey := newRSAKey(t, "rsa-1", time.Time{})
+	edKey := newEd25519Key(t, "ed-1", time.Now().Add(time.Hour)) // scheduled
+	keys, err := NewKeySet([]SigningKey{rsaKey, edKey}, time.Hour)
+	require.NoError(t, err)
+
+	jwks := keys.JWKS(time.Now())
+	require.Len(t, jwks.Keys, 2)
+
+	byID := map[string]JWK{}
+	for _, jwk := range jwks.Keys {
+		byID[jwk.KeyID] = jwk
+	}
+
+	rsaJWK := byID["rsa-1"]
+	assert.Equal(t, "RSA", rsaJWK.KeyType)
+	assert.Equal(t, "RS256", rsaJWK.Algorithm)
+	assert.Equal(t, "sig", rsaJWK.Use)
+	assert.Equal(t, "AQAB", rsaJWK.E)
+	modulus, err := base64.RawURLEncoding.DecodeString(rsaJWK.N)
+	require.NoError(t, err)
+	assert.Equal(t, 0, new(big.Int).SetBytes(modulus).Cmp(rsaKey.PrivateKey.(*rsa.PrivateKey).N))
+
+	edJWK := byID["ed-1"]
+	assert.Equal(t, "OKP", edJWK.KeyType)
+	assert.Equal(t, "Ed25519", edJWK.Curve)
+	assert.Equal(t, "EdDSA", edJWK.Algorithm)
+	x, err := base64.RawURLEncoding.DecodeString(edJWK.X)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(edKey.PrivateKey.Public().(ed25519.PublicKey)), x)
+}
+
+func writeKeyFile(t *testing.T, dir, name string, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+	return path
+}
+
+func TestLoadKeySet(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey := newRSAKey(t, "", time.Time{})
+	edKey := newEd25519Key(t, "", time.Time{})
+	rsaPath := writeKeyFile(t, dir, "rsa.pem", rsaKey.PrivateKey)
+	edPath := writeKeyFile(t, dir, "ed.pem", edKey.PrivateKey)
+
+	t.Setenv("JWT_SIGNING_KEYS", "")
+	keys, err := LoadKeySet(time.Hour)
+	require.NoError(t, err)
+	assert.Nil(t, keys)
+
+	t.Setenv("JWT_SIGNING_KEYS", "2024-01="+rsaPath+", 2024-07="+edPath+"@2024-07-01T00:00:00Z")
+	keys, err = LoadKeySet(time.Hour)
+	require.NoError(t, err)
+	require.Len(t, keys.keys, 2)
+	assert.Equal(t, AlgorithmRS256, keys.signingKey(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)).Algorithm)
+	current := keys.signingKey(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, "2024-07", current.ID)
+	assert.Equal(t, AlgorithmEdDSA, current.Algorithm)
+
+	for _, value := range []string{"missing-path", "k=" + filepath.Join(dir, "none.pem"), "k=" + edPath + "@tomorrow"} {
+		t.Setenv("JWT_SIGNING_KEYS", value)
+		_, err = LoadKeySet(time.Hour)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestManager_SigningKeys(t *testing.T) {
+	start := time.Now()
+	rotation := start.Add(time.Hour)
+	keys, err := NewKeySet([]SigningKey{
+		newRSAKey(t, "old", time.Time{}),
+		newEd25519Key(t, "new", rotation),
+	}, 24*time.Hour)
+	require.NoError(t, err)
+
+	now := start
+	manager := &Manager{
+		config: Config{AccessSecret: "test_secret", AccessExpiry: 48 * time.Hour, RefreshExpiry: 48 * time.Hour},
+		keys:   keys,
+		now:    func() time.Time { return now },
+	}
+
+	oldToken, err := manager.GenerateAccessToken("user123", "testuser", "test@example.com")
+	require.NoError(t, err)
+	parsed, _, err := new(jwt.Parser).ParseUnverified(oldToken, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, "old", parsed.Header["kid"])
+	assert.Equal(t, "RS256", parsed.Header["alg"])
+
+	now = rotation
+	pair, err := manager.GenerateTokenPair("user123", "testuser", "test@example.com", "session123", 0, nil)
+	require.NoError(t, err)
+	parsed, _, err = new(jwt.Parser).ParseUnverified(pair.AccessToken, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, "new", parsed.Header["kid"])
+	assert.Equal(t, "EdDSA", parsed.Header["alg"])
+
+	_, err = manager.ValidateAccessToken(pair.AccessToken)
+	assert.NoError(t, err)
+	_, err = manager.ValidateRefreshToken(pair.RefreshToken)
+	assert.NoError(t, err)
+
+	// Tokens of the replaced key are accepted during the grace period only
+	_, err = manager.ValidateAccessToken(oldToken)
+	assert.NoError(t, err)
+	now = rotation.Add(24 * time.Hour)
+	_, err = manager.ValidateAccessToken(oldToken)
+	assert.Error(t, err)
+
+	// HMAC tokens are refused unless issued before the cutoff, and only for
+	// one refresh token lifetime after it
+	hmacManager := &Manager{config: manager.config}
+	hmacToken, err := hmacManager.GenerateAccessToken("user123", "testuser", "test@example.com")
+	require.NoError(t, err)
+	_, err = manager.ValidateAccessToken(hmacToken)
+	assert.Error(t, err)
+	manager.hmacCutoff = start.Add(time.Minute)
+	_, err = manager.ValidateAccessToken(hmacToken)
+	assert.NoError(t, err)
+	now = manager.hmacCutoff.Add(48 * time.Hour)
+	_, err = manager.ValidateAccessToken(hmacToken)
+	assert.Error(t, err, "the legacy window has closed")
+	now = rotation
+	manager.hmacCutoff = start.Add(-time.Minute)
+	_, err = manager.ValidateAccessToken(hmacToken)
+	assert.Error(t, err, "issued after the cutoff")
+
+	// A kid must not turn a token into an HMAC one keyed with public data
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: "attacker", TokenType: AccessToken})
+	forged.Header["kid"] = "new"
+	forgedString, err := forged.SignedString([]byte("anything"))
+	require.NoError(t, err)
+	_, err = manager.ValidateAccessToken(forgedString)
+	assert.Error(t, err)
+}
+
+func TestLoadManager(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_HMAC_CUTOFF", "")
+	t.Setenv("JWT_SIGNING_KEYS", "")
+	t.Setenv("ENV", "production")
+	_, err := LoadManager()
+	assert.Error(t, err, "production requires signing keys")
+
+	t.Setenv("ENV", "development")
+	manager, err := LoadManager()
+	require.NoError(t, err)
+	assert.False(t, manager.UsesSigningKeys())
+	assert.Empty(t, manager.JWKS().Keys)
+
+	dir := t.TempDir()
+	path := writeKeyFile(t, dir, "ed.pem", newEd25519Key(t, "", time.Time{}).PrivateKey)
+	t.Setenv("ENV", "production")
+	t.Setenv("JWT_SIGNING_KEYS", "k1="+path)
+	t.Setenv("JWT_KEY_GRACE_PERIOD", "2h")
+	manager, err = LoadManager()
+	require.NoError(t, err)
+	assert.True(t, manager.UsesSigningKeys())
+	assert.Equal(t, 2*time.Hour, manager.keys.gracePeriod)
+	require.Len(t, manager.JWKS().Keys, 1)
+	assert.Equal(t, "k1", manager.JWKS().Keys[0].KeyID)
+
+	assert.True(t, manager.hmacCutoff.IsZero())
+
+	// Keeping the HMAC secret needs a cutoff for the tokens it signed
+	t.Setenv("JWT_SECRET", "legacy_secret")
+	_, err = LoadManager()
+	assert.Error(t, err)
+	t.Setenv("JWT_HMAC_CUTOFF", "2024-07-01T00:00:00Z")
+	manager, err = LoadManager()
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), manager.hmacCutoff)
+	t.Setenv("JWT_HMAC_CUTOFF", "July")
+	_, err = LoadManager()
+	assert.Error(t, err)
+
+	t.Setenv("JWT_KEY_GRACE_PERIOD", "soon")
+	_, err = LoadManager()
+	assert.Error(t, err)
+}
@@ -0,0 +1,344 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// Errors returned by the MFA store
+var (
+	ErrMFAUserNotFound = errors.New("user not found")
+	ErrMFAEnabled      = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled   = errors.New("two-factor authentication is not enabled")
+	ErrMFANotSetUp     = errors.New("two-factor setup was not started")
+	ErrMFASetupChanged = errors.New("two-factor setup changed")
+	ErrInvalidMFACode  = errors.New("invalid code")
+)
+
+// MFACheck describes a code accepted by MFAStore.Verify
+type MFACheck struct {
+	RecoveryCode      bool // a recovery code rather than a TOTP code
+	RecoveryCodesLeft int
+}
+
+// mfaBackend persists users' two-factor settings. Updates that use a code
+// only match while the code is unused, so two requests racing with the
+// same code cannot both succeed.
+type mfaBackend interface {
+	// load returns nil when the user has no settings
+	load(ctx context.Context, userID string) (*models.MFA, error)
+	setPending(ctx context.Context, userID, secret string, now time.Time) (bool, error)
+	// enable replaces the settings while the pending secret is unchanged
+	enable(ctx context.Context, userID, pendingSecret string, mfa models.MFA) (bool, error)
+	useStep(ctx context.Context, userID string, step int64) (bool, error)
+	useRecoveryCode(ctx context.Context, userID, hash string, at time.Time) (bool, error)
+	replaceRecoveryCodes(ctx context.Context, userID string, step int64, codes []models.RecoveryCode, now time.Time) (bool, error)
+	// fail counts a wrong code and returns the count
+	fail(ctx context.Context, userID string) (int, error)
+	resetFailures(ctx context.Context, userID string) error
+	disable(ctx context.Context, userID string, now time.Time) error
+}
+
+// MFAStore enrolls users in TOTP two-factor authentication and checks their
+// codes
+type MFAStore struct {
+	backend mfaBackend
+	now     func() time.Time
+}
+
+// NewMFAStore creates an MFA store backed by the users collection
+func NewMFAStore(mongoClient *database.MongoClient) *MFAStore {
+	return newMFAStore(&mongoMFABackend{mongoClient: mongoClient}, time.Now)
+}
+
+func newMFAStore(backend mfaBackend, now func() time.Time) *MFAStore {
+	return &MFAStore{backend: backend, now: now}
+}
+
+// Setup starts enrollment with a new secret, replacing one set up before.
+// Nothing changes for logins until Enable confirms a code.
+func (s *MFAStore) Setup(ctx context.Context, userID string) (string, error) {
+	mfa, err := s.backend.load(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if mfa.IsEnabled() {
+		return "", ErrMFAEnabled
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	found, err := s.backend.setPending(ctx, userID, secret, s.now())
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", ErrMFAUserNotFound
+	}
+	return secret, nil
+}
+
+// Enable turns on two-factor authentication once code proves the user's
+// authenticator holds the pending secret. It returns the recovery codes,
+// which are not stored in the clear.
+func (s *MFAStore) Enable(ctx context.Context, userID, code string) ([]string, error) {
+	mfa, err := s.backend.load(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if mfa.IsEnabled() {
+		return nil, ErrMFAEnabled
+	}
+	if mfa == nil || mfa.PendingSecret == "" {
+		return nil, ErrMFANotSetUp
+	}
+
+	now := s.now()
+	step, ok := VerifyTOTP(mfa.PendingSecret, code, now, 0)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	// Matching the pending secret keeps a concurrent setup from enabling a
+	// secret the user never saw
+	enabled, err := s.backend.enable(ctx, userID, mfa.PendingSecret, models.MFA{
+		Enabled:       true,
+		Secret:        mfa.PendingSecret,
+		LastUsedStep:  step,
+		RecoveryCodes: recoveryCodeRecords(hashes),
+		EnabledAt:     &now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrMFASetupChanged
+	}
+	return codes, nil
+}
+
+// Verify checks a TOTP or recovery code of a user with two-factor
+// authentication and marks it used. Wrong and used codes get
+// ErrInvalidMFACode; accepted ones clear the failures counted by Fail.
+func (s *MFAStore) Verify(ctx context.Context, userID, code string) (MFACheck, error) {
+	mfa, err := s.backend.load(ctx, userID)
+	if err != nil {
+		return MFACheck{}, err
+	}
+	if !mfa.IsEnabled() {
+		return MFACheck{}, ErrMFANotEnabled
+	}
+
+	now := s.now()
+	if step, ok := VerifyTOTP(mfa.Secret, code, now, mfa.LastUsedStep); ok {
+		used, err := s.backend.useStep(ctx, userID, step)
+		if err != nil {
+			return MFACheck{}, err
+		}
+		if !used {
+			return MFACheck{}, ErrInvalidMFACode
+		}
+		return MFACheck{RecoveryCodesLeft: mfa.RecoveryCodesLeft()}, nil
+	}
+
+	used, err := s.backend.useRecoveryCode(ctx, userID, HashRecoveryCode(code), now)
+	if err != nil {
+		return MFACheck{}, err
+	}
+	if !used {
+		return MFACheck{}, ErrInvalidMFACode
+	}
+	return MFACheck{RecoveryCode: true, RecoveryCodesLeft: mfa.RecoveryCodesLeft() - 1}, nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes, used or not, with new
+// ones and clears the failures counted by Fail. Only a TOTP code will do: a
+// recovery code should not mint new ones.
+func (s *MFAStore) RegenerateRecoveryCodes(ctx context.Context, userID, code string) ([]string, error) {
+	mfa, err := s.backend.load(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !mfa.IsEnabled() {
+		return nil, ErrMFANotEnabled
+	}
+
+	now := s.now()
+	step, ok := VerifyTOTP(mfa.Secret, code, now, mfa.LastUsedStep)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	replaced, err := s.backend.replaceRecoveryCodes(ctx, userID, step, recoveryCodeRecords(hashes), now)
+	if err != nil {
+		return nil, err
+	}
+	if !replaced {
+		return nil, ErrInvalidMFACode
+	}
+	return codes, nil
+}
+
+// Fail counts a wrong password or code entered with two-factor
+// authentication enabled and returns how many there were since the last
+// accepted code
+func (s *MFAStore) Fail(ctx context.Context, userID string) (int, error) {
+	return s.backend.fail(ctx, userID)
+}
+
+// ResetFailures forgets the wrong codes counted by Fail
+func (s *MFAStore) ResetFailures(ctx context.Context, userID string) error {
+	return s.backend.resetFailures(ctx, userID)
+}
+
+// Disable turns off two-factor authentication and forgets its secret and
+// recovery codes
+func (s *MFAStore) Disable(ctx context.Context, userID string) error {
+	return s.backend.disable(ctx, userID, s.now())
+}
+
+// recoveryCodeRecords returns the stored form of freshly generated codes
+func recoveryCodeRecords(hashes []string) []models.RecoveryCode {
+	records := make([]models.RecoveryCode, len(hashes))
+	for i, hash := range hashes {
+		records[i] = models.RecoveryCode{Hash: hash}
+	}
+	return records
+}
+
+// mongoMFABackend keeps two-factor settings in the mfa field of users
+type mongoMFABackend struct {
+	mongoClient *database.MongoClient
+}
+
+func (b *mongoMFABackend) users() *mongo.Collection {
+	return b.mongoClient.GetCollection(database.CollectionNames.Users)
+}
+
+func (b *mongoMFABackend) load(ctx context.Context, userID string) (*models.MFA, error) {
+	var user models.User
+	err := b.users().FindOne(ctx,
+		bson.M{"unique_id": userID},
+		options.FindOne().SetProjection(bson.M{"mfa": 1}),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrMFAUserNotFound
+	}
+	return user.MFA, err
+}
+
+func (b *mongoMFABackend) setPending(ctx context.Context, userID, secret string, now time.Time) (bool, error) {
+	result, err := b.users().UpdateOne(ctx, bson.M{"unique_id": userID}, bson.M{
+		"$set": bson.M{"mfa.pending_secret": secret, "updated_at": now},
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (b *mongoMFABackend) enable(ctx context.Context, userID, pendingSecret string, mfa models.MFA) (bool, error) {
+	result, err := b.users().UpdateOne(ctx,
+		bson.M{"unique_id": userID, "mfa.pending_secret": pendingSecret},
+		bson.M{"$set": bson.M{"mfa": mfa, "updated_at": *mfa.EnabledAt}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (b *mongoMFABackend) useStep(ctx context.Context, userID string, step int64) (bool, error) {
+	result, err := b.users().UpdateOne(ctx,
+		bson.M{"unique_id": userID, "mfa.enabled": true, "mfa.last_used_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"mfa.last_used_step": step, "mfa.failed_attempts": 0}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (b *mongoMFABackend) useRecoveryCode(ctx context.Context, userID, hash string, at time.Time) (bool, error) {
+	result, err := b.users().UpdateOne(ctx,
+		bson.M{
+			"unique_id":   userID,
+			"mfa.enabled": true,
+			"mfa.recovery_codes": bson.M{"$elemMatch": bson.M{
+				"hash":    hash,
+				"used_at": nil,
+			}},
+		},
+		bson.M{"$set": bson.M{"mfa.recovery_codes.$.used_at": at, "mfa.failed_attempts": 0}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (b *mongoMFABackend) replaceRecoveryCodes(ctx context.Context, userID string, step int64, codes []models.RecoveryCode, now time.Time) (bool, error) {
+	result, err := b.users().UpdateOne(ctx,
+		bson.M{"unique_id": userID, "mfa.enabled": true, "mfa.last_used_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{
+			"mfa.last_used_step":  step,
+			"mfa.recovery_codes":  codes,
+			"mfa.failed_attempts": 0,
+			"updated_at":          now,
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (b *mongoMFABackend) fail(ctx context.Context, userID string) (int, error) {
+	var user models.User
+	err := b.users().FindOneAndUpdate(ctx,
+		bson.M{"unique_id": userID, "mfa.enabled": true},
+		bson.M{"$inc": bson.M{"mfa.failed_attempts": 1}},
+		options.FindOneAndUpdate().
+			SetReturnDocument(options.After).
+			SetProjection(bson.M{"mfa.failed_attempts": 1}),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrMFANotEnabled
+	} else if err != nil {
+		return 0, err
+	}
+	return user.MFA.FailedAttempts, nil
+}
+
+func (b *mongoMFABackend) resetFailures(ctx context.Context, userID string) error {
+	_, err := b.users().UpdateOne(ctx,
+		bson.M{"unique_id": userID, "mfa.enabled": true},
+		bson.M{"$set": bson.M{"mfa.failed_attempts": 0}},
+	)
+	return err
+}
+
+func (b *mongoMFABackend) disable(ctx context.Context, userID string, now time.Time) error {
+	_, err := b.users().UpdateOne(ctx, bson.M{"unique_id": userID}, bson.M{
+		"$unset": bson.M{"mfa": ""},
+		"$set":   bson.M{"updated_at": now},
+	})
+	return err
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// fakeMFABackend keeps two-factor settings in memory; users without an
+// entry do not exist
+type fakeMFABackend struct {
+	users map[string]*models.MFA
+}
+
+func newFakeMFABackend(userIDs ...string) *fakeMFABackend {
+	b := &fakeMFABackend{users: make(map[string]*models.MFA)}
+	for _, userID := range userIDs {
+		b.users[userID] = nil
+	}
+	return b
+}
+
+func (b *fakeMFABackend) load(ctx context.Context, userID string) (*models.MFA, error) {
+	mfa, ok := b.users[userID]
+	if !ok {
+		return nil, ErrMFAUserNotFound
+	}
+	if mfa == nil {
+		return nil, nil
+	}
+	copied := *mfa
+	copied.RecoveryCodes = append([]models.RecoveryCode(nil), mfa.RecoveryCodes...)
+	return &copied, nil
+}
+
+func (b *fakeMFABackend) setPending(ctx context.Context, userID, secret string, now time.Time) (bool, error) {
+	mfa, ok := b.users[userID]
+	if !ok {
+		return false, nil
+	}
+	if mfa == nil {
+		mfa = &models.MFA{}
+		b.users[userID] = mfa
+	}
+	mfa.PendingSecret = secret
+	return true, nil
+}
+
+func (b *fakeMFABackend) enable(ctx context.Context, userID, pendingSecret string, mfa models.MFA) (bool, error) {
+	current := b.users[userID]
+	if current == nil || current.PendingSecret != pendingSecret {
+		return false, nil
+	}
+	b.users[userID] = &mfa
+	return true, nil
+}
+
+func (b *fakeMFABackend) useStep(ctx context.Context, userID string, step int64) (bool, error) {
+	mfa := b.users[userID]
+	if !mfa.IsEnabled() || mfa.LastUsedStep >= step {
+		return false, nil
+	}
+	mfa.LastUsedStep = step
+	mfa.FailedAttempts = 0
+	return true, nil
+}
+
+func (b *fakeMFABackend) useRecoveryCode(ctx context.Context, userID, hash string, at time.Time) (bool, error) {
+	mfa := b.users[userID]
+	if !mfa.IsEnabled() {
+		return false, nil
+	}
+	for i, code := range mfa.RecoveryCodes {
+		if code.Hash == hash && code.UsedAt == nil {
+			mfa.RecoveryCodes[i].UsedAt = &at
+			mfa.FailedAttempts = 0
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *fakeMFABackend) replaceRecoveryCodes(ctx context.Context, userID string, step int64, codes []models.RecoveryCode, now time.Time) (bool, error) {
+	mfa := b.users[userID]
+	if !mfa.IsEnabled() || mfa.LastUsedStep >= step {
+		return false, nil
+	}
+	mfa.LastUsedStep = step
+	mfa.RecoveryCodes = codes
+	mfa.FailedAttempts = 0
+	return true, nil
+}
+
+func (b *fakeMFABackend) fail(ctx context.Context, userID string) (int, error) {
+	mfa := b.users[userID]
+	if !mfa.IsEnabled() {
+		return 0, ErrMFANotEnabled
+	}
+	mfa.FailedAttempts++
+	return mfa.FailedAttempts, nil
+}
+
+func (b *fakeMFABackend) resetFailures(ctx context.Context, userID string) error {
+	if mfa := b.users[userID]; mfa.IsEnabled() {
+		mfa.FailedAttempts = 0
+	}
+	return nil
+}
+
+func (b *fakeMFABackend) disable(ctx context.Context, userID string, now time.Time) error {
+	b.users[userID] = nil
+	return nil
+}
+
+// wrongTOTPCode returns a code that is not valid around now
+func wrongTOTPCode(t *testing.T, secret string, now time.Time) string {
+	for _, code := range []string{"000000", "111111", "222222", "333333"} {
+		if _, ok := VerifyTOTP(secret, code, now, 0); !ok {
+			return code
+		}
+	}
+	t.Fatal("no wrong code found")
+	return ""
+}
+
+func TestMFAStore_LoginFlow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	backend := newFakeMFABackend("user123")
+	store := newMFAStore(backend, clock)
+	revocations := newRevocationStore(newFakeRevocationBackend(), clock)
+	manager := &Manager{
+		config: Config{AccessSecret: "test_secret", AccessExpiry: time.Hour, RefreshExpiry: time.Hour},
+		now:    clock,
+	}
+
+	// Enroll
+	_, err := store.Enable(ctx, "user123", "123456")
+	assert.ErrorIs(t, err, ErrMFANotSetUp)
+	secret, err := store.Setup(ctx, "user123")
+	require.NoError(t, err)
+	_, err = store.Enable(ctx, "user123", wrongTOTPCode(t, secret, now))
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+
+	enrollCode, err := TOTPCode(secret, now)
+	require.NoError(t, err)
+	recoveryCodes, err := store.Enable(ctx, "user123", enrollCode)
+	require.NoError(t, err)
+	assert.Len(t, recoveryCodes, RecoveryCodeCount)
+	assert.Equal(t, now, *backend.users["user123"].EnabledAt)
+
+	_, err = store.Setup(ctx, "user123")
+	assert.ErrorIs(t, err, ErrMFAEnabled)
+
+	// Login: the password was accepted, so a pending login is issued
+	pending, err := manager.GenerateActionToken(MFAPendingToken, "user123", "test@example.com", 5*time.Minute)
+	require.NoError(t, err)
+	claims, err := manager.ValidateActionToken(pending, MFAPendingToken)
+	require.NoError(t, err)
+	now = now.Add(40 * time.Second)
+
+	// The code that confirmed enrollment cannot be used to sign in
+	_, err = store.Verify(ctx, "user123", enrollCode)
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+	_, err = store.Verify(ctx, "user123", wrongTOTPCode(t, secret, now))
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+	failures, err := store.Fail(ctx, "user123")
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+
+	// Verify
+	code, err := TOTPCode(secret, now)
+	require.NoError(t, err)
+	check, err := store.Verify(ctx, "user123", code)
+	require.NoError(t, err)
+	assert.False(t, check.RecoveryCode)
+	assert.Zero(t, backend.users["user123"].FailedAttempts)
+	require.NoError(t, revocations.Consume(ctx, claims))
+
+	// Replaying the code or the pending login is rejected, also within the
+	// code's period
+	now = now.Add(5 * time.Second)
+	_, err = store.Verify(ctx, "user123", code)
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+	assert.ErrorIs(t, revocations.Consume(ctx, claims), ErrTokenRevoked)
+
+	// The next period's code works
+	now = now.Add(30 * time.Second)
+	code, err = TOTPCode(secret, now)
+	require.NoError(t, err)
+	_, err = store.Verify(ctx, "user123", code)
+	assert.NoError(t, err)
+
+	// Recovery codes work once and are stamped with the clock
+	check, err = store.Verify(ctx, "user123", recoveryCodes[0])
+	require.NoError(t, err)
+	assert.True(t, check.RecoveryCode)
+	assert.Equal(t, RecoveryCodeCount-1, check.RecoveryCodesLeft)
+	assert.Equal(t, now, *backend.users["user123"].RecoveryCodes[0].UsedAt)
+	_, err = store.Verify(ctx, "user123", recoveryCodes[0])
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+}
+
+func TestMFAStore_RegenerateRecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := newMFAStore(newFakeMFABackend("user123"), func() time.Time { return now })
+
+	_, err := store.RegenerateRecoveryCodes(ctx, "user123", "123456")
+	assert.ErrorIs(t, err, ErrMFANotEnabled)
+	_, err = store.Setup(ctx, "missing")
+	assert.ErrorIs(t, err, ErrMFAUserNotFound)
+
+	secret, err := store.Setup(ctx, "user123")
+	require.NoError(t, err)
+	code, err := TOTPCode(secret, now)
+	require.NoError(t, err)
+	oldCodes, err := store.Enable(ctx, "user123", code)
+	require.NoError(t, err)
+
+	// A recovery code does not mint new ones, nor does a used TOTP code
+	_, err = store.RegenerateRecoveryCodes(ctx, "user123", oldCodes[0])
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+	_, err = store.RegenerateRecoveryCodes(ctx, "user123", code)
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+
+	now = now.Add(30 * time.Second)
+	code, err = TOTPCode(secret, now)
+	require.NoError(t, err)
+	newCodes, err := store.RegenerateRecoveryCodes(ctx, "user123", code)
+	require.NoError(t, err)
+	assert.Len(t, newCodes, RecoveryCodeCount)
+
+	_, err = store.Verify(ctx, "user123", oldCodes[1])
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+	_, err = store.Verify(ctx, "user123", newCodes[1])
+	assert.NoError(t, err)
+
+	require.NoError(t, store.Disable(ctx, "user123"))
+	_, err = store.Verify(ctx, "user123", newCodes[2])
+	assert.ErrorIs(t, err, ErrMFANotEnabled)
+}
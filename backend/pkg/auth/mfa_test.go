@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors
+var rfc6238Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode_RFC6238(t *testing.T) {
+	// The RFC lists 8-digit values; 6-digit codes are their last six digits
+	for unix, expected := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		code, err := TOTPCode(rfc6238Secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		assert.Equal(t, expected, code, unix)
+	}
+
+	_, err := TOTPCode("not base32!", time.Unix(59, 0))
+	assert.Error(t, err)
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	require.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	now := time.Unix(1700000000, 0)
+	code, err := TOTPCode(secret, now)
+	require.NoError(t, err)
+
+	step, ok := VerifyTOTP(secret, code, now, 0)
+	require.True(t, ok)
+	assert.Equal(t, totpStep(now), step)
+
+	// One period of drift either way is tolerated
+	_, ok = VerifyTOTP(secret, code, now.Add(totpPeriod), 0)
+	assert.True(t, ok)
+	_, ok = VerifyTOTP(secret, code, now.Add(-totpPeriod), 0)
+	assert.True(t, ok)
+	_, ok = VerifyTOTP(secret, code, now.Add(2*totpPeriod), 0)
+	assert.False(t, ok, "expired")
+
+	// A used code is refused, the next one is accepted
+	_, ok = VerifyTOTP(secret, code, now.Add(10*time.Second), step)
+	assert.False(t, ok, "replayed")
+	next, err := TOTPCode(secret, now.Add(totpPeriod))
+	require.NoError(t, err)
+	nextStep, ok := VerifyTOTP(secret, next, now.Add(totpPeriod), step)
+	assert.True(t, ok)
+	assert.Equal(t, step+1, nextStep)
+
+	_, ok = VerifyTOTP(secret, " "+code[:3]+" "+code[3:]+" ", now, 0)
+	assert.True(t, ok, "spaces are ignored")
+	_, ok = VerifyTOTP(secret, "12345", now, 0)
+	assert.False(t, ok)
+	_, ok = VerifyTOTP(secret, "", now, 0)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri, err := url.Parse(TOTPURI("Study Platform", "jane@example.com", "JBSWY3DPEHPK3PXP"))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Study Platform:jane@example.com", uri.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", uri.Query().Get("secret"))
+	assert.Equal(t, "Study Platform", uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+	assert.Equal(t, "30", uri.Query().Get("period"))
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes()
+	require.NoError(t, err)
+	require.Len(t, codes, RecoveryCodeCount)
+	require.Len(t, hashes, RecoveryCodeCount)
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, code)
+		assert.False(t, seen[code], "codes are unique")
+		seen[code] = true
+
+		assert.Equal(t, hashes[i], HashRecoveryCode(code))
+		assert.Equal(t, hashes[i], HashRecoveryCode(strings.ToUpper(strings.ReplaceAll(code, "-", " "))), "case and separators are ignored")
+		assert.NotContains(t, hashes[i], code)
+	}
+}
+
+func TestMFAPendingToken(t *testing.T) {
+	now := time.Now()
+	manager := &Manager{
+		config: Config{AccessSecret: "test_secret", AccessExpiry: time.Hour, RefreshExpiry: time.Hour},
+		now:    func() time.Time { return now },
+	}
+
+	token, err := manager.GenerateActionToken(MFAPendingToken, "user123", "test@example.com", 5*time.Minute)
+	require.NoError(t, err)
+
+	claims, err := manager.ValidateActionToken(token, MFAPendingToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user123", claims.UserID)
+
+	_, err = manager.ValidateAccessToken(token)
+	assert.Error(t, err, "a pending login is not signed in")
+
+	// Issued more than five minutes ago
+	now = now.Add(-10 * time.Minute)
+	expired, err := manager.GenerateActionToken(MFAPendingToken, "user123", "test@example.com", 5*time.Minute)
+	require.NoError(t, err)
+	_, err = manager.ValidateActionToken(expired, MFAPendingToken)
+	assert.Error(t, err)
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Password policy defaults
+const (
+	defaultPasswordMinLength = 8
+	// bcrypt ignores everything after 72 bytes
+	defaultPasswordMaxLength = 72
+	// breachedPrefixLength is how many hex characters of the SHA-1 hash select
+	// a range, as in the Pwned Passwords range API
+	breachedPrefixLength = 5
+)
+
+// PolicyError explains why a password was refused. Its message is shown to
+// the user.
+type PolicyError struct {
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+// PasswordPolicy decides which new passwords are acceptable
+type PasswordPolicy struct {
+	MinLength int // in characters
+	MaxLength int // in bytes, as bcrypt counts them
+	Breached  *BreachedPasswords
+}
+
+// DefaultPasswordPolicy returns the policy used when nothing is configured
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength: defaultPasswordMinLength,
+		MaxLength: defaultPasswordMaxLength,
+	}
+}
+
+// LoadPasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH and
+// PASSWORD_BREACHED_LIST from the environment. The breached list is either
+// a file of "SHA1:COUNT" lines or a directory of range files named by the
+// first five hex characters of the hash and holding "SUFFIX:COUNT" lines, the
+// format served by the Pwned Passwords range API.
+func LoadPasswordPolicy() (PasswordPolicy, error) {
+	policy := DefaultPasswordPolicy()
+
+	if value, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && value > 0 {
+		policy.MinLength = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("PASSWORD_MAX_LENGTH")); err == nil && value > 0 && value <= defaultPasswordMaxLength {
+		policy.MaxLength = value
+	}
+
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		breached, err := OpenBreachedPasswords(path)
+		if err != nil {
+			return PasswordPolicy{}, err
+		}
+		policy.Breached = breached
+	}
+	return policy, nil
+}
+
+// Validate returns a *PolicyError when the password may not be used by the
+// account with the given email and username
+func (p PasswordPolicy) Validate(password, email, username string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &PolicyError{Message: fmt.Sprintf("Password must be at least %d characters long", p.MinLength)}
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		return &PolicyError{Message: fmt.Sprintf("Password must be at most %d bytes long", p.MaxLength)}
+	}
+
+	normalized := strings.ToLower(strings.TrimSpace(password))
+	if (email != "" && normalized == strings.ToLower(email)) || (username != "" && normalized == strings.ToLower(username)) {
+		return &PolicyError{Message: "Password must not be your email or username"}
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return &PolicyError{Message: "This password has appeared in a data breach; choose a different one"}
+		}
+	}
+	return nil
+}
+
+// BreachedPasswords looks passwords up in a local copy of a breached
+// password list. Lookups go through the hash prefix, so a directory of range
+// files only has to read the one range a password falls in.
+type BreachedPasswords struct {
+	dir    string                         // directory of range files, if any
+	ranges map[string]map[string]struct{} // hash suffixes by prefix, for a single file
+}
+
+// OpenBreachedPasswords opens a breached password list file or directory
+func OpenBreachedPasswords(path string) (*BreachedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("breached password list: %w", err)
+	}
+	if info.IsDir() {
+		return &BreachedPasswords{dir: path}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("breached password list: %w", err)
+	}
+	defer file.Close()
+
+	ranges := make(map[string]map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hash := hashFromLine(scanner.Text())
+		if len(hash) != sha1.Size*2 {
+			continue
+		}
+		prefix, suffix := hash[:breachedPrefixLength], hash[breachedPrefixLength:]
+		if ranges[prefix] == nil {
+			ranges[prefix] = make(map[string]struct{})
+		}
+		ranges[prefix][suffix] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("breached password list: %w", err)
+	}
+	return &BreachedPasswords{ranges: ranges}, nil
+}
+
+// Contains reports whether the password is on the list
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:breachedPrefixLength], hash[breachedPrefixLength:]
+
+	if b.dir == "" {
+		_, found := b.ranges[prefix][suffix]
+		return found, nil
+	}
+
+	file, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if hashFromLine(scanner.Text()) == suffix {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// hashFromLine returns the upper-case hash of a "HASH:COUNT" line
+func hashFromLine(line string) string {
+	hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return strings.ToUpper(hash)
+}
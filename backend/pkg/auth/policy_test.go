@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestPasswordPolicy_Validate(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+
+	assert.NoError(t, policy.Validate("correct horse battery", "jane@example.com", "jane"))
+
+	var policyErr *PolicyError
+	err := policy.Validate("short", "jane@example.com", "jane")
+	require.ErrorAs(t, err, &policyErr)
+	assert.Equal(t, "Password must be at least 8 characters long", policyErr.Message)
+
+	assert.Error(t, policy.Validate(strings.Repeat("a", 73), "jane@example.com", "jane"), "bcrypt truncates after 72 bytes")
+	assert.NoError(t, policy.Validate("pässwörd", "jane@example.com", "jane"), "length counts characters")
+
+	assert.Error(t, policy.Validate("Jane@Example.com", "jane@example.com", "jane"))
+	assert.Error(t, policy.Validate("JaneDoe2024", "jane@example.com", "janedoe2024"))
+}
+
+func TestBreachedPasswords_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	content := sha1Hex("password123") + ":2254650\n" +
+		strings.ToLower(sha1Hex("letmein!")) + ":1000\n" +
+		"not a hash\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	breached, err := OpenBreachedPasswords(path)
+	require.NoError(t, err)
+
+	for password, expected := range map[string]bool{
+		"password123":         true,
+		"letmein!":            true,
+		"unlisted passphrase": false,
+	} {
+		found, err := breached.Contains(password)
+		require.NoError(t, err)
+		assert.Equal(t, expected, found, password)
+	}
+
+	policy := DefaultPasswordPolicy()
+	policy.Breached = breached
+	assert.Error(t, policy.Validate("password123", "jane@example.com", "jane"))
+}
+
+func TestBreachedPasswords_RangeDirectory(t *testing.T) {
+	dir := t.TempDir()
+	hash := sha1Hex("password123")
+	content := "0018A45C4D1DEF81644B54AB7F969B88D65:1\n" + hash[5:] + ":2254650\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(content), 0o600))
+
+	breached, err := OpenBreachedPasswords(dir)
+	require.NoError(t, err)
+
+	found, err := breached.Contains("password123")
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = breached.Contains("unlisted passphrase")
+	require.NoError(t, err)
+	assert.False(t, found, "missing range files mean no match")
+
+	_, err = OpenBreachedPasswords(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestLoadPasswordPolicy(t *testing.T) {
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("PASSWORD_MAX_LENGTH", "100")
+	t.Setenv("PASSWORD_BREACHED_LIST", "")
+
+	policy, err := LoadPasswordPolicy()
+	require.NoError(t, err)
+	assert.Equal(t, 12, policy.MinLength)
+	assert.Equal(t, 72, policy.MaxLength, "cannot exceed what bcrypt hashes")
+	assert.Nil(t, policy.Breached)
+
+	t.Setenv("PASSWORD_BREACHED_LIST", filepath.Join(t.TempDir(), "missing.txt"))
+	_, err = LoadPasswordPolicy()
+	assert.Error(t, err)
+}
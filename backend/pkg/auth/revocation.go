@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+)
+
+const (
+	// revocationCacheSize bounds the users and token IDs kept in memory
+	revocationCacheSize = 10000
+	// revocationCacheTTL bounds how long another instance may keep accepting
+	// a token revoked elsewhere; revocations made locally apply at once
+	revocationCacheTTL = 30 * time.Second
+)
+
+// Errors returned when a validly signed token must no longer be accepted
+var (
+	ErrTokenRevoked    = errors.New("token has been revoked")
+	ErrAccountDisabled = errors.New("account is disabled")
+)
+
+// userTokenState is what token checks need to know about a user
+type userTokenState struct {
+	Found           bool
+	Active          bool
+	TokenVersion    int
+	RevokedSessions map[string]bool
+}
+
+// revocationBackend persists revocations
+type revocationBackend interface {
+	loadUser(ctx context.Context, userID string) (userTokenState, error)
+	isDenied(ctx context.Context, tokenID string) (bool, error)
+	deny(ctx context.Context, tokenID, userID string, expiresAt time.Time) error
+	// consume denylists a token unless it already is, reporting whether it did
+	consume(ctx context.Context, tokenID, userID string, expiresAt time.Time) (bool, error)
+	bumpVersion(ctx context.Context, userID string) error
+}
+
+// RevocationStore decides whether validly signed tokens are still accepted.
+// A token is rejected when its jti was denylisted, when its token version is
+// older than the user's (bumped on password changes and "sign out
+// everywhere"), when its device session was revoked, or when the account was
+// deactivated. Lookups are cached in memory in front of MongoDB.
+type RevocationStore struct {
+	backend revocationBackend
+	users   *lruCache // userTokenState by user ID
+	denied  *lruCache // bool by token ID
+	now     func() time.Time
+}
+
+// NewRevocationStore creates a revocation store backed by MongoDB
+func NewRevocationStore(mongoClient *database.MongoClient) *RevocationStore {
+	return newRevocationStore(&mongoRevocationBackend{mongoClient: mongoClient}, time.Now)
+}
+
+func newRevocationStore(backend revocationBackend, now func() time.Time) *RevocationStore {
+	return &RevocationStore{
+		backend: backend,
+		users:   newLRUCache(revocationCacheSize, revocationCacheTTL),
+		denied:  newLRUCache(revocationCacheSize, revocationCacheTTL),
+		now:     now,
+	}
+}
+
+// Check returns an error when the token's claims must no longer be accepted
+func (s *RevocationStore) Check(ctx context.Context, claims *Claims) error {
+	if claims.ID != "" {
+		denied, err := s.isDenied(ctx, claims.ID)
+		if err != nil {
+			return err
+		}
+		if denied {
+			return ErrTokenRevoked
+		}
+	}
+
+	state, err := s.userState(ctx, claims.UserID)
+	if err != nil {
+		return err
+	}
+	if !state.Found || claims.TokenVersion < state.TokenVersion {
+		return ErrTokenRevoked
+	}
+	if !state.Active {
+		return ErrAccountDisabled
+	}
+	if claims.SessionID != "" && state.RevokedSessions[claims.SessionID] {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// CheckUser returns an error when credentials of the user, such as personal
+// access tokens, must no longer be accepted
+func (s *RevocationStore) CheckUser(ctx context.Context, userID string) error {
+	state, err := s.userState(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !state.Found {
+		return ErrTokenRevoked
+	}
+	if !state.Active {
+		return ErrAccountDisabled
+	}
+	return nil
+}
+
+// RevokeToken denylists a single token until it expires
+func (s *RevocationStore) RevokeToken(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" {
+		return errors.New("token has no ID")
+	}
+
+	expiresAt := s.now().Add(revocationCacheTTL)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	if err := s.backend.deny(ctx, claims.ID, claims.UserID, expiresAt); err != nil {
+		return err
+	}
+	s.denied.set(claims.ID, true, s.now())
+	return nil
+}
+
+// Consume marks a single-use token as used. It returns ErrTokenRevoked when
+// the token was used or revoked before, so concurrent uses succeed once.
+func (s *RevocationStore) Consume(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" {
+		return errors.New("token has no ID")
+	}
+
+	expiresAt := s.now().Add(revocationCacheTTL)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	consumed, err := s.backend.consume(ctx, claims.ID, claims.UserID, expiresAt)
+	if err != nil {
+		return err
+	}
+	s.denied.set(claims.ID, true, s.now())
+	if !consumed {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// RevokeUserTokens invalidates every token issued to the user so far
+func (s *RevocationStore) RevokeUserTokens(ctx context.Context, userID string) error {
+	if err := s.backend.bumpVersion(ctx, userID); err != nil {
+		return err
+	}
+	s.Invalidate(userID)
+	return nil
+}
+
+// Invalidate drops the cached state of a user after their sessions or
+// account status changed
+func (s *RevocationStore) Invalidate(userID string) {
+	s.users.delete(userID)
+}
+
+func (s *RevocationStore) isDenied(ctx context.Context, tokenID string) (bool, error) {
+	if value, ok := s.denied.get(tokenID, s.now()); ok {
+		return value.(bool), nil
+	}
+	denied, err := s.backend.isDenied(ctx, tokenID)
+	if err != nil {
+		return false, err
+	}
+	s.denied.set(tokenID, denied, s.now())
+	return denied, nil
+}
+
+func (s *RevocationStore) userState(ctx context.Context, userID string) (userTokenState, error) {
+	if value, ok := s.users.get(userID, s.now()); ok {
+		return value.(userTokenState), nil
+	}
+	state, err := s.backend.loadUser(ctx, userID)
+	if err != nil {
+		return userTokenState{}, err
+	}
+	s.users.set(userID, state, s.now())
+	return state, nil
+}
+
+// mongoRevocationBackend reads token versions and sessions from the users
+// collection and keeps denylisted token IDs in revoked_tokens
+type mongoRevocationBackend struct {
+	mongoClient *database.MongoClient
+}
+
+func (b *mongoRevocationBackend) loadUser(ctx context.Context, userID string) (userTokenState, error) {
+	users := b.mongoClient.GetCollection(database.CollectionNames.Users)
+
+	var user struct {
+		IsActive      *bool `bson:"is_active"`
+		TokenVersion  int   `bson:"token_version"`
+		RefreshTokens []struct {
+			ID        string `bson:"id"`
+			IsRevoked bool   `bson:"is_revoked"`
+		} `bson:"refresh_tokens"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{
+		"is_active":                 1,
+		"token_version":             1,
+		"refresh_tokens.id":         1,
+		"refresh_tokens.is_revoked": 1,
+	})
+	err := users.FindOne(ctx, bson.M{"unique_id": userID}, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return userTokenState{}, nil
+	} else if err != nil {
+		return userTokenState{}, err
+	}
+
+	state := userTokenState{
+		Found: true,
+		// Accounts created before is_active existed are active
+		Active:          user.IsActive == nil || *user.IsActive,
+		TokenVersion:    user.TokenVersion,
+		RevokedSessions: make(map[string]bool),
+	}
+	for _, session := range user.RefreshTokens {
+		if session.IsRevoked {
+			state.RevokedSessions[session.ID] = true
+		}
+	}
+	return state, nil
+}
+
+func (b *mongoRevocationBackend) isDenied(ctx context.Context, tokenID string) (bool, error) {
+	revoked := b.mongoClient.GetCollection(database.CollectionNames.RevokedTokens)
+	err := revoked.FindOne(ctx, bson.M{"jti": tokenID}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *mongoRevocationBackend) deny(ctx context.Context, tokenID, userID string, expiresAt time.Time) error {
+	revoked := b.mongoClient.GetCollection(database.CollectionNames.RevokedTokens)
+	_, err := revoked.UpdateOne(ctx,
+		bson.M{"jti": tokenID},
+		bson.M{"$setOnInsert": bson.M{
+			"jti":        tokenID,
+			"user_id":    userID,
+			"expires_at": expiresAt,
+			"created_at": time.Now(),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (b *mongoRevocationBackend) consume(ctx context.Context, tokenID, userID string, expiresAt time.Time) (bool, error) {
+	revoked := b.mongoClient.GetCollection(database.CollectionNames.RevokedTokens)
+	_, err := revoked.InsertOne(ctx, bson.M{
+		"jti":        tokenID,
+		"user_id":    userID,
+		"expires_at": expiresAt,
+		"created_at": time.Now(),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *mongoRevocationBackend) bumpVersion(ctx context.Context, userID string) error {
+	users := b.mongoClient.GetCollection(database.CollectionNames.Users)
+	_, err := users.UpdateOne(ctx, bson.M{"unique_id": userID}, bson.M{
+		"$inc": bson.M{"token_version": 1},
+		"$set": bson.M{"updated_at": time.Now()},
+	})
+	return err
+}
+
+// EnsureRevocationIndexes creates the denylist indexes. Entries are removed
+// by MongoDB once the token they revoke has expired.
+func EnsureRevocationIndexes(mongoClient *database.MongoClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	revoked := mongoClient.GetCollection(database.CollectionNames.RevokedTokens)
+	_, err := revoked.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "jti", Value: 1}},
+			Options: options.Index().SetName("jti").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRevocationBackend keeps revocations in memory and counts lookups
+type fakeRevocationBackend struct {
+	users       map[string]userTokenState
+	denied      map[string]bool
+	userLoads   int
+	deniedLoads int
+}
+
+func newFakeRevocationBackend() *fakeRevocationBackend {
+	return &fakeRevocationBackend{
+		users:  make(map[string]userTokenState),
+		denied: make(map[string]bool),
+	}
+}
+
+func (b *fakeRevocationBackend) loadUser(ctx context.Context, userID string) (userTokenState, error) {
+	b.userLoads++
+	return b.users[userID], nil
+}
+
+func (b *fakeRevocationBackend) isDenied(ctx context.Context, tokenID string) (bool, error) {
+	b.deniedLoads++
+	return b.denied[tokenID], nil
+}
+
+func (b *fakeRevocationBackend) deny(ctx context.Context, tokenID, userID string, expiresAt time.Time) error {
+	b.denied[tokenID] = true
+	return nil
+}
+
+func (b *fakeRevocationBackend) consume(ctx context.Context, tokenID, userID string, expiresAt time.Time) (bool, error) {
+	if b.denied[tokenID] {
+		return false, nil
+	}
+	b.denied[tokenID] = true
+	return true, nil
+}
+
+func (b *fakeRevocationBackend) bumpVersion(ctx context.Context, userID string) error {
+	state := b.users[userID]
+	state.TokenVersion++
+	b.users[userID] = state
+	return nil
+}
+
+func testClaims(tokenID string, version int, sessionID string) *Claims {
+	return &Claims{
+		UserID:       "user-1",
+		SessionID:    sessionID,
+		TokenVersion: version,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+func TestRevocationStore_Check(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeRevocationBackend()
+	backend.users["user-1"] = userTokenState{
+		Found:           true,
+		Active:          true,
+		TokenVersion:    1,
+		RevokedSessions: map[string]bool{"old-session": true},
+	}
+	store := newRevocationStore(backend, time.Now)
+
+	assert.NoError(t, store.Check(ctx, testClaims("t1", 1, "session")))
+	assert.NoError(t, store.Check(ctx, testClaims("t2", 2, "")), "newer versions are accepted")
+	assert.Equal(t, ErrTokenRevoked, store.Check(ctx, testClaims("t3", 0, "session")), "older token version")
+	assert.Equal(t, ErrTokenRevoked, store.Check(ctx, testClaims("t4", 1, "old-session")), "revoked session")
+
+	unknown := testClaims("t5", 0, "")
+	unknown.UserID = "deleted-user"
+	assert.Equal(t, ErrTokenRevoked, store.Check(ctx, unknown))
+
+	backend.users["user-1"] = userTokenState{Found: true, Active: false, TokenVersion: 1}
+	store.Invalidate("user-1")
+	assert.Equal(t, ErrAccountDisabled, store.Check(ctx, testClaims("t6", 1, "")))
+}
+
+func TestRevocationStore_RevokeToken(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeRevocationBackend()
+	backend.users["user-1"] = userTokenState{Found: true, Active: true}
+	store := newRevocationStore(backend, time.Now)
+
+	claims := testClaims("t1", 0, "")
+	require.NoError(t, store.Check(ctx, claims))
+	require.NoError(t, store.RevokeToken(ctx, claims))
+	assert.Equal(t, ErrTokenRevoked, store.Check(ctx, claims))
+	assert.NoError(t, store.Check(ctx, testClaims("t2", 0, "")), "other tokens stay valid")
+
+	// Another instance sees the revocation through the shared backend
+	other := newRevocationStore(backend, time.Now)
+	assert.Equal(t, ErrTokenRevoked, other.Check(ctx, claims))
+
+	assert.Error(t, store.RevokeToken(ctx, testClaims("", 0, "")))
+}
+
+func TestRevocationStore_RevokeUserTokens(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeRevocationBackend()
+	backend.users["user-1"] = userTokenState{Found: true, Active: true}
+	store := newRevocationStore(backend, time.Now)
+
+	claims := testClaims("t1", 0, "session")
+	require.NoError(t, store.Check(ctx, claims))
+	require.NoError(t, store.RevokeUserTokens(ctx, "user-1"))
+	assert.Equal(t, ErrTokenRevoked, store.Check(ctx, claims))
+	assert.NoError(t, store.Check(ctx, testClaims("t2", 1, "session")), "tokens issued afterwards are accepted")
+}
+
+func TestRevocationStore_Cache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	backend := newFakeRevocationBackend()
+	backend.users["user-1"] = userTokenState{Found: true, Active: true}
+	store := newRevocationStore(backend, func() time.Time { return now })
+
+	claims := testClaims("t1", 0, "")
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Check(ctx, claims))
+	}
+	assert.Equal(t, 1, backend.userLoads)
+	assert.Equal(t, 1, backend.deniedLoads)
+
+	// Changes made elsewhere are picked up once the cache entry expires
+	backend.users["user-1"] = userTokenState{Found: true, Active: true, TokenVersion: 1}
+	assert.NoError(t, store.Check(ctx, claims))
+	now = now.Add(revocationCacheTTL + time.Second)
+	assert.Equal(t, ErrTokenRevoked, store.Check(ctx, claims))
+	assert.Equal(t, 2, backend.userLoads)
+}
+
+func TestLRUCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newLRUCache(2, time.Minute)
+
+	cache.set("a", 1, now)
+	cache.set("b", 2, now)
+	_, ok := cache.get("a", now) // a becomes the most recently used
+	require.True(t, ok)
+	cache.set("c", 3, now)
+
+	_, ok = cache.get("b", now)
+	assert.False(t, ok, "least recently used entry is evicted")
+	value, ok := cache.get("a", now)
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+
+	_, ok = cache.get("c", now.Add(2*time.Minute))
+	assert.False(t, ok, "expired entries are dropped")
+
+	cache.delete("a")
+	_, ok = cache.get("a", now)
+	assert.False(t, ok)
+
+	for i := 0; i < 10; i++ {
+		cache.set(fmt.Sprint(i), i, now)
+	}
+	assert.Equal(t, 2, cache.order.Len())
+}
+
+func TestRevocationStore_Consume(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeRevocationBackend()
+	backend.users["user-1"] = userTokenState{Found: true, Active: true}
+	store := newRevocationStore(backend, time.Now)
+
+	claims := testClaims("reset-1", 0, "")
+	require.NoError(t, store.Consume(ctx, claims))
+	assert.Equal(t, ErrTokenRevoked, store.Consume(ctx, claims), "single use")
+	assert.Equal(t, ErrTokenRevoked, store.Check(ctx, claims))
+
+	// A revoked token cannot be consumed either
+	revoked := testClaims("reset-2", 0, "")
+	require.NoError(t, store.RevokeToken(ctx, revoked))
+	assert.Equal(t, ErrTokenRevoked, store.Consume(ctx, revoked))
+}
@@ -0,0 +1,63 @@
+package auth
+
+// Role names a set of permissions granted to a user. Users without roles
+// may use everything that is not restricted to staff.
+type Role string
+
+const (
+	// RoleAdmin may do everything
+	RoleAdmin Role = "admin"
+	// RoleModerator looks after user content and rooms
+	RoleModerator Role = "moderator"
+)
+
+// Permission is a capability a route can require
+type Permission string
+
+const (
+	// PermViewStats allows reading operational statistics
+	PermViewStats Permission = "stats:view"
+	// PermDebug allows the debugging endpoints
+	PermDebug Permission = "debug"
+	// PermManageXP allows adjusting XP directly
+	PermManageXP Permission = "xp:manage"
+	// PermModerate allows acting on other users' content and rooms
+	PermModerate Permission = "content:moderate"
+)
+
+// rolePermissions lists what each role may do. Admins are not listed as
+// they hold every permission.
+var rolePermissions = map[Role][]Permission{
+	RoleModerator: {PermModerate, PermViewStats},
+}
+
+// Roles lists every known role
+func Roles() []Role {
+	return []Role{RoleAdmin, RoleModerator}
+}
+
+// ParseRole returns the role with the given name
+func ParseRole(name string) (Role, bool) {
+	for _, role := range Roles() {
+		if string(role) == name {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+// HasPermission reports whether any of the roles grants the permission.
+// Unknown role names grant nothing.
+func HasPermission(roles []string, permission Permission) bool {
+	for _, name := range roles {
+		if Role(name) == RoleAdmin {
+			return true
+		}
+		for _, granted := range rolePermissions[Role(name)] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasPermission(t *testing.T) {
+	assert.False(t, HasPermission(nil, PermViewStats))
+	assert.False(t, HasPermission([]string{"unknown"}, PermViewStats))
+
+	moderator := []string{string(RoleModerator)}
+	assert.True(t, HasPermission(moderator, PermModerate))
+	assert.True(t, HasPermission(moderator, PermViewStats))
+	assert.False(t, HasPermission(moderator, PermDebug))
+	assert.False(t, HasPermission(moderator, PermManageXP))
+
+	admin := []string{string(RoleAdmin)}
+	for _, permission := range []Permission{PermViewStats, PermDebug, PermManageXP, PermModerate} {
+		assert.True(t, HasPermission(admin, permission), permission)
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	role, ok := ParseRole("moderator")
+	assert.True(t, ok)
+	assert.Equal(t, RoleModerator, role)
+
+	_, ok = ParseRole("superuser")
+	assert.False(t, ok)
+}
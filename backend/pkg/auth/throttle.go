@@ -0,0 +1,459 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/studyplatform/backend/pkg/database"
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// LoginThrottleConfig controls how failed logins slow down and lock out
+// further attempts
+type LoginThrottleConfig struct {
+	// AccountLockoutThreshold is how many failures lock an account
+	AccountLockoutThreshold int
+	// IPLockoutThreshold is how many failures, across accounts, lock an IP
+	// address. Schools share addresses, so it is much higher.
+	IPLockoutThreshold int
+	// CaptchaThreshold and IPCaptchaThreshold are the failures after which
+	// clients are asked to show a CAPTCHA
+	CaptchaThreshold   int
+	IPCaptchaThreshold int
+	// FreeAttempts is how many failures an account has before each further
+	// attempt must wait, BaseDelay doubling with every failure up to MaxDelay
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	// LockoutDuration is how long a lockout lasts unless lifted earlier
+	LockoutDuration time.Duration
+	// FailureWindow is how long after the last failure the count is kept
+	FailureWindow time.Duration
+}
+
+// DefaultLoginThrottleConfig returns the configuration used when nothing is
+// set
+func DefaultLoginThrottleConfig() LoginThrottleConfig {
+	return LoginThrottleConfig{
+		AccountLockoutThreshold: 10,
+		IPLockoutThreshold:      100,
+		CaptchaThreshold:        3,
+		IPCaptchaThreshold:      20,
+		FreeAttempts:            3,
+		BaseDelay:               time.Second,
+		MaxDelay:                5 * time.Minute,
+		LockoutDuration:         30 * time.Minute,
+		FailureWindow:           24 * time.Hour,
+	}
+}
+
+// LoadLoginThrottleConfig reads LOGIN_LOCKOUT_THRESHOLD,
+// LOGIN_IP_LOCKOUT_THRESHOLD, LOGIN_CAPTCHA_THRESHOLD and
+// LOGIN_LOCKOUT_DURATION, keeping defaults for missing or invalid values
+func LoadLoginThrottleConfig() LoginThrottleConfig {
+	config := DefaultLoginThrottleConfig()
+
+	if value, err := strconv.Atoi(os.Getenv("LOGIN_LOCKOUT_THRESHOLD")); err == nil && value > 0 {
+		config.AccountLockoutThreshold = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("LOGIN_IP_LOCKOUT_THRESHOLD")); err == nil && value > 0 {
+		config.IPLockoutThreshold = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("LOGIN_CAPTCHA_THRESHOLD")); err == nil && value > 0 {
+		config.CaptchaThreshold = value
+	}
+	if value, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT_DURATION")); err == nil && value > 0 {
+		config.LockoutDuration = value
+	}
+	return config
+}
+
+// delay returns how long to wait after the given number of failures
+func (c LoginThrottleConfig) delay(failures int) time.Duration {
+	if failures < c.FreeAttempts {
+		return 0
+	}
+	delay := c.BaseDelay
+	for i := c.FreeAttempts; i < failures && delay < c.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxDelay {
+		delay = c.MaxDelay
+	}
+	return delay
+}
+
+// loginAttempts is the failure count of an account or IP address
+type loginAttempts struct {
+	Key         string     `bson:"key"`
+	Failures    int        `bson:"failures"`
+	LastFailure time.Time  `bson:"last_failure"`
+	LockedUntil *time.Time `bson:"locked_until,omitempty"`
+	ExpiresAt   time.Time  `bson:"expires_at"`
+}
+
+// lockedAt reports whether a lockout is in force at now
+func (a loginAttempts) lockedAt(now time.Time) bool {
+	return a.LockedUntil != nil && now.Before(*a.LockedUntil)
+}
+
+// loginThrottleBackend persists failure counts and audit entries
+type loginThrottleBackend interface {
+	// load returns the attempts for key, or the zero value when there are none
+	load(ctx context.Context, key string) (loginAttempts, error)
+	// reserve counts a failure and returns the attempts from before it, in
+	// one atomic step
+	reserve(ctx context.Context, key string, now, expiresAt time.Time) (loginAttempts, error)
+	// release takes back a reserved failure, restoring the time of the
+	// previous one
+	release(ctx context.Context, key string, lastFailure time.Time) error
+	lock(ctx context.Context, key string, until time.Time) error
+	reset(ctx context.Context, key string) error
+	audit(ctx context.Context, entry models.AuditEntry) error
+}
+
+// LoginCheck tells whether a login may be attempted now
+type LoginCheck struct {
+	RetryAfter      time.Duration // how long to wait; zero when an attempt is allowed
+	Locked          bool          // the account or address is locked out
+	CaptchaRequired bool          // the client should solve a CAPTCHA first
+}
+
+// Allowed reports whether the password may be checked now
+func (c LoginCheck) Allowed() bool {
+	return c.RetryAfter <= 0
+}
+
+// LoginFailure is the state after a failed login
+type LoginFailure struct {
+	LoginCheck
+	AccountLocked bool // this failure locked the account
+}
+
+// LoginReservation is a login attempt counted as failed while its password
+// or code is checked. It is settled with Fail, Succeed or Release.
+type LoginReservation struct {
+	email string
+	ip    string
+	// account and address are the attempts from before this one
+	account loginAttempts
+	address loginAttempts
+}
+
+// LoginThrottle tracks failed logins per account and per IP address. Each
+// account failure beyond a few doubles the wait before the next attempt,
+// and enough failures lock the account or address for a while. Counts are
+// kept in MongoDB, so restarts and other instances see them. Attempts are
+// counted as failed before the password is checked, so parallel attempts
+// cannot all pass the throttle on the same count.
+type LoginThrottle struct {
+	backend loginThrottleBackend
+	config  LoginThrottleConfig
+	now     func() time.Time
+}
+
+// NewLoginThrottle creates a login throttle backed by MongoDB
+func NewLoginThrottle(mongoClient *database.MongoClient, config LoginThrottleConfig) *LoginThrottle {
+	return newLoginThrottle(&mongoLoginThrottleBackend{mongoClient: mongoClient}, config, time.Now)
+}
+
+func newLoginThrottle(backend loginThrottleBackend, config LoginThrottleConfig, now func() time.Time) *LoginThrottle {
+	return &LoginThrottle{backend: backend, config: config, now: now}
+}
+
+// Config returns the throttle's configuration
+func (t *LoginThrottle) Config() LoginThrottleConfig {
+	return t.config
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// current returns the attempts for key, forgetting failures older than the
+// failure window
+func (t *LoginThrottle) current(ctx context.Context, key string, now time.Time) (loginAttempts, error) {
+	attempts, err := t.backend.load(ctx, key)
+	if err != nil {
+		return loginAttempts{}, err
+	}
+	if !attempts.lockedAt(now) && now.Sub(attempts.LastFailure) > t.config.FailureWindow {
+		return loginAttempts{Key: key}, nil
+	}
+	return attempts, nil
+}
+
+// evaluate decides whether the next attempt is allowed
+func (t *LoginThrottle) evaluate(account, ip loginAttempts, now time.Time) LoginCheck {
+	var check LoginCheck
+	wait := func(until time.Time) {
+		if remaining := until.Sub(now); remaining > check.RetryAfter {
+			check.RetryAfter = remaining
+		}
+	}
+
+	for _, attempts := range []loginAttempts{account, ip} {
+		if attempts.lockedAt(now) {
+			check.Locked = true
+			wait(*attempts.LockedUntil)
+		}
+	}
+	// Only accounts back off; an address may be shared by a whole school
+	if account.Failures > 0 {
+		wait(account.LastFailure.Add(t.config.delay(account.Failures)))
+	}
+	check.CaptchaRequired = account.Failures >= t.config.CaptchaThreshold || ip.Failures >= t.config.IPCaptchaThreshold
+	return check
+}
+
+// Check returns whether a login for email from ip may be attempted now
+func (t *LoginThrottle) Check(ctx context.Context, email, ip string) (LoginCheck, error) {
+	now := t.now()
+	account, err := t.current(ctx, accountKey(email), now)
+	if err != nil {
+		return LoginCheck{}, err
+	}
+	attempts, err := t.current(ctx, ipKey(ip), now)
+	if err != nil {
+		return LoginCheck{}, err
+	}
+	return t.evaluate(account, attempts, now), nil
+}
+
+// Reserve counts a login for email from ip as failed before its password
+// or code is checked. The attempt is only allowed if the throttle allowed
+// one at the count before it; otherwise the failure is taken back and the
+// reservation is nil.
+func (t *LoginThrottle) Reserve(ctx context.Context, email, ip string) (*LoginReservation, LoginCheck, error) {
+	now := t.now()
+	reservation := &LoginReservation{email: email, ip: ip}
+
+	account, err := t.reserve(ctx, accountKey(email), now)
+	if err != nil {
+		return nil, LoginCheck{}, err
+	}
+	reservation.account = account
+	address, err := t.reserve(ctx, ipKey(ip), now)
+	if err != nil {
+		t.backend.release(ctx, accountKey(email), account.LastFailure)
+		return nil, LoginCheck{}, err
+	}
+	reservation.address = address
+
+	check := t.evaluate(account, address, now)
+	if !check.Allowed() {
+		return nil, check, t.Release(ctx, reservation)
+	}
+	return reservation, check, nil
+}
+
+// Fail settles a reserved login as failed, locking the account or address
+// when it reached its threshold. userID is empty when no account uses the
+// email; the failure counts all the same, so responses do not reveal which
+// addresses have accounts.
+func (t *LoginThrottle) Fail(ctx context.Context, reservation *LoginReservation, userID string) (LoginFailure, error) {
+	now := t.now()
+	email, ip := reservation.email, reservation.ip
+	var failure LoginFailure
+
+	account, err := t.backend.load(ctx, accountKey(email))
+	if err != nil {
+		return LoginFailure{}, err
+	}
+	if account.Failures >= t.config.AccountLockoutThreshold && !account.lockedAt(now) {
+		until := now.Add(t.config.LockoutDuration)
+		if err := t.backend.lock(ctx, account.Key, until); err != nil {
+			return LoginFailure{}, err
+		}
+		account.LockedUntil = &until
+		failure.AccountLocked = true
+		t.backend.audit(ctx, models.AuditEntry{
+			Event:     models.AuditEventLoginLocked,
+			UserID:    userID,
+			IP:        ip,
+			CreatedAt: now,
+			Data:      map[string]interface{}{"email": strings.ToLower(email), "failures": account.Failures, "locked_until": until},
+		})
+	}
+
+	address, err := t.backend.load(ctx, ipKey(ip))
+	if err != nil {
+		return LoginFailure{}, err
+	}
+	if address.Failures >= t.config.IPLockoutThreshold && !address.lockedAt(now) {
+		until := now.Add(t.config.LockoutDuration)
+		if err := t.backend.lock(ctx, address.Key, until); err != nil {
+			return LoginFailure{}, err
+		}
+		address.LockedUntil = &until
+		t.backend.audit(ctx, models.AuditEntry{
+			Event:     models.AuditEventLoginIPLocked,
+			IP:        ip,
+			CreatedAt: now,
+			Data:      map[string]interface{}{"failures": address.Failures, "locked_until": until},
+		})
+	}
+
+	failure.LoginCheck = t.evaluate(account, address, now)
+	return failure, nil
+}
+
+// reserve counts a failure for key and returns the attempts from before it,
+// starting over when the previous ones fell out of the failure window
+func (t *LoginThrottle) reserve(ctx context.Context, key string, now time.Time) (loginAttempts, error) {
+	attempts, err := t.backend.load(ctx, key)
+	if err != nil {
+		return loginAttempts{}, err
+	}
+	if attempts.Failures > 0 && !attempts.lockedAt(now) && now.Sub(attempts.LastFailure) > t.config.FailureWindow {
+		if err := t.backend.reset(ctx, key); err != nil {
+			return loginAttempts{}, err
+		}
+	}
+	before, err := t.backend.reserve(ctx, key, now, now.Add(t.config.FailureWindow))
+	if err != nil {
+		return loginAttempts{}, err
+	}
+	if !before.lockedAt(now) && now.Sub(before.LastFailure) > t.config.FailureWindow {
+		return loginAttempts{Key: key}, nil
+	}
+	return before, nil
+}
+
+// Release takes back a reserved login that neither failed nor completed,
+// such as a correct password still waiting for its second factor
+func (t *LoginThrottle) Release(ctx context.Context, reservation *LoginReservation) error {
+	if err := t.backend.release(ctx, accountKey(reservation.email), reservation.account.LastFailure); err != nil {
+		return err
+	}
+	return t.backend.release(ctx, ipKey(reservation.ip), reservation.address.LastFailure)
+}
+
+// Succeed settles a reserved login as successful, clearing the account's
+// failures. Address failures are kept, or an attacker could reset them with
+// their own account.
+func (t *LoginThrottle) Succeed(ctx context.Context, reservation *LoginReservation) error {
+	if err := t.backend.reset(ctx, accountKey(reservation.email)); err != nil {
+		return err
+	}
+	return t.backend.release(ctx, ipKey(reservation.ip), reservation.address.LastFailure)
+}
+
+// Unlock lifts an account lockout and clears its failures
+func (t *LoginThrottle) Unlock(ctx context.Context, email, userID, ip string) error {
+	if err := t.backend.reset(ctx, accountKey(email)); err != nil {
+		return err
+	}
+	return t.backend.audit(ctx, models.AuditEntry{
+		Event:     models.AuditEventLoginUnlocked,
+		UserID:    userID,
+		IP:        ip,
+		CreatedAt: t.now(),
+		Data:      map[string]interface{}{"email": strings.ToLower(email)},
+	})
+}
+
+// mongoLoginThrottleBackend stores failure counts in the login_attempts
+// collection and audit entries in audit_log
+type mongoLoginThrottleBackend struct {
+	mongoClient *database.MongoClient
+}
+
+func (b *mongoLoginThrottleBackend) load(ctx context.Context, key string) (loginAttempts, error) {
+	var attempts loginAttempts
+	err := b.mongoClient.GetCollection(database.CollectionNames.LoginAttempts).FindOne(ctx, bson.M{"key": key}).Decode(&attempts)
+	if err == mongo.ErrNoDocuments {
+		return loginAttempts{Key: key}, nil
+	}
+	return attempts, err
+}
+
+func (b *mongoLoginThrottleBackend) reserve(ctx context.Context, key string, now, expiresAt time.Time) (loginAttempts, error) {
+	var attempts loginAttempts
+	// expires_at never moves before a lockout ends, see lock
+	err := b.mongoClient.GetCollection(database.CollectionNames.LoginAttempts).FindOneAndUpdate(ctx,
+		bson.M{"key": key},
+		bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"last_failure": now},
+			"$max": bson.M{"expires_at": expiresAt},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+	).Decode(&attempts)
+	if err == mongo.ErrNoDocuments {
+		return loginAttempts{Key: key}, nil
+	}
+	return attempts, err
+}
+
+func (b *mongoLoginThrottleBackend) release(ctx context.Context, key string, lastFailure time.Time) error {
+	_, err := b.mongoClient.GetCollection(database.CollectionNames.LoginAttempts).UpdateOne(ctx,
+		bson.M{"key": key, "failures": bson.M{"$gt": 0}},
+		bson.M{
+			"$inc": bson.M{"failures": -1},
+			"$set": bson.M{"last_failure": lastFailure},
+		},
+	)
+	return err
+}
+
+func (b *mongoLoginThrottleBackend) lock(ctx context.Context, key string, until time.Time) error {
+	_, err := b.mongoClient.GetCollection(database.CollectionNames.LoginAttempts).UpdateOne(ctx,
+		bson.M{"key": key},
+		bson.M{
+			"$set": bson.M{"locked_until": until},
+			"$max": bson.M{"expires_at": until},
+		},
+	)
+	return err
+}
+
+func (b *mongoLoginThrottleBackend) reset(ctx context.Context, key string) error {
+	_, err := b.mongoClient.GetCollection(database.CollectionNames.LoginAttempts).DeleteOne(ctx, bson.M{"key": key})
+	return err
+}
+
+func (b *mongoLoginThrottleBackend) audit(ctx context.Context, entry models.AuditEntry) error {
+	_, err := b.mongoClient.GetCollection(database.CollectionNames.AuditLog).InsertOne(ctx, entry)
+	return err
+}
+
+// EnsureLoginThrottleIndexes creates the indexes of failure counts, which
+// MongoDB removes once they expire, and of the audit log
+func EnsureLoginThrottleIndexes(mongoClient *database.MongoClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	attempts := mongoClient.GetCollection(database.CollectionNames.LoginAttempts)
+	_, err := attempts.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetName("key").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	audit := mongoClient.GetCollection(database.CollectionNames.AuditLog)
+	_, err = audit.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "event", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/studyplatform/backend/pkg/models"
+)
+
+// fakeLoginThrottleBackend keeps failure counts and audit entries in memory
+type fakeLoginThrottleBackend struct {
+	attempts map[string]loginAttempts
+	audited  []models.AuditEntry
+}
+
+func newFakeLoginThrottleBackend() *fakeLoginThrottleBackend {
+	return &fakeLoginThrottleBackend{attempts: make(map[string]loginAttempts)}
+}
+
+func (b *fakeLoginThrottleBackend) load(ctx context.Context, key string) (loginAttempts, error) {
+	attempts, ok := b.attempts[key]
+	if !ok {
+		return loginAttempts{Key: key}, nil
+	}
+	return attempts, nil
+}
+
+func (b *fakeLoginThrottleBackend) reserve(ctx context.Context, key string, now, expiresAt time.Time) (loginAttempts, error) {
+	before, _ := b.load(ctx, key)
+	attempts := before
+	attempts.Failures++
+	attempts.LastFailure = now
+	if expiresAt.After(attempts.ExpiresAt) {
+		attempts.ExpiresAt = expiresAt
+	}
+	b.attempts[key] = attempts
+	return before, nil
+}
+
+func (b *fakeLoginThrottleBackend) release(ctx context.Context, key string, lastFailure time.Time) error {
+	attempts, ok := b.attempts[key]
+	if ok && attempts.Failures > 0 {
+		attempts.Failures--
+		attempts.LastFailure = lastFailure
+		b.attempts[key] = attempts
+	}
+	return nil
+}
+
+// failLogin reserves a login attempt and settles it as failed
+func failLogin(t *testing.T, throttle *LoginThrottle, email, userID, ip string) LoginFailure {
+	ctx := context.Background()
+	reservation, check, err := throttle.Reserve(ctx, email, ip)
+	require.NoError(t, err)
+	require.True(t, check.Allowed(), "the attempt is throttled")
+	failure, err := throttle.Fail(ctx, reservation, userID)
+	require.NoError(t, err)
+	return failure
+}
+
+func (b *fakeLoginThrottleBackend) lock(ctx context.Context, key string, until time.Time) error {
+	attempts := b.attempts[key]
+	attempts.LockedUntil = &until
+	b.attempts[key] = attempts
+	return nil
+}
+
+func (b *fakeLoginThrottleBackend) reset(ctx context.Context, key string) error {
+	delete(b.attempts, key)
+	return nil
+}
+
+func (b *fakeLoginThrottleBackend) audit(ctx context.Context, entry models.AuditEntry) error {
+	b.audited = append(b.audited, entry)
+	return nil
+}
+
+func TestLoginThrottleConfig_Delay(t *testing.T) {
+	config := DefaultLoginThrottleConfig()
+	for failures, expected := range map[int]time.Duration{
+		0:  0,
+		2:  0,
+		3:  time.Second,
+		4:  2 * time.Second,
+		6:  8 * time.Second,
+		20: 5 * time.Minute,
+	} {
+		assert.Equal(t, expected, config.delay(failures), failures)
+	}
+}
+
+func TestLoginThrottle_BackoffAndLockout(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	backend := newFakeLoginThrottleBackend()
+	throttle := newLoginThrottle(backend, DefaultLoginThrottleConfig(), func() time.Time { return now })
+
+	// The first failures cost nothing
+	for i := 0; i < 2; i++ {
+		failure := failLogin(t, throttle, "Jane@Example.com", "user-1", "203.0.113.7")
+		assert.True(t, failure.Allowed())
+		assert.False(t, failure.CaptchaRequired)
+	}
+
+	// The third asks for a CAPTCHA and a one second wait
+	failure := failLogin(t, throttle, "jane@example.com", "user-1", "203.0.113.7")
+	assert.True(t, failure.CaptchaRequired)
+	assert.Equal(t, time.Second, failure.RetryAfter)
+
+	check, err := throttle.Check(ctx, "jane@example.com", "198.51.100.1")
+	require.NoError(t, err)
+	assert.False(t, check.Allowed(), "the wait applies from any address")
+	now = now.Add(time.Second)
+	check, err = throttle.Check(ctx, "jane@example.com", "198.51.100.1")
+	require.NoError(t, err)
+	assert.True(t, check.Allowed())
+
+	// Waits double until the account locks on the tenth failure
+	for i := 4; i < 10; i++ {
+		failure = failLogin(t, throttle, "jane@example.com", "user-1", "203.0.113.7")
+		assert.False(t, failure.AccountLocked)
+		assert.Equal(t, time.Second<<(i-3), failure.RetryAfter, i)
+		now = now.Add(failure.RetryAfter)
+	}
+	failure = failLogin(t, throttle, "jane@example.com", "user-1", "203.0.113.7")
+	assert.True(t, failure.AccountLocked)
+	assert.True(t, failure.Locked)
+	assert.Equal(t, 30*time.Minute, failure.RetryAfter)
+
+	require.Len(t, backend.audited, 1)
+	assert.Equal(t, models.AuditEventLoginLocked, backend.audited[0].Event)
+	assert.Equal(t, "user-1", backend.audited[0].UserID)
+	assert.Equal(t, "203.0.113.7", backend.audited[0].IP)
+
+	now = now.Add(29 * time.Minute)
+	check, err = throttle.Check(ctx, "jane@example.com", "203.0.113.7")
+	require.NoError(t, err)
+	assert.True(t, check.Locked)
+	assert.Equal(t, time.Minute, check.RetryAfter)
+
+	// Unlocking through the emailed link clears everything
+	require.NoError(t, throttle.Unlock(ctx, "jane@example.com", "user-1", "203.0.113.7"))
+	check, err = throttle.Check(ctx, "jane@example.com", "203.0.113.7")
+	require.NoError(t, err)
+	assert.True(t, check.Allowed())
+	assert.False(t, check.CaptchaRequired)
+	assert.Equal(t, models.AuditEventLoginUnlocked, backend.audited[1].Event)
+}
+
+func TestLoginThrottle_SucceedResetsAccountOnly(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	backend := newFakeLoginThrottleBackend()
+	config := DefaultLoginThrottleConfig()
+	config.IPCaptchaThreshold = 3
+	throttle := newLoginThrottle(backend, config, func() time.Time { return now })
+
+	for i := 0; i < 3; i++ {
+		failLogin(t, throttle, "jane@example.com", "user-1", "203.0.113.7")
+	}
+	now = now.Add(time.Second)
+	reservation, check, err := throttle.Reserve(ctx, "jane@example.com", "203.0.113.7")
+	require.NoError(t, err)
+	require.True(t, check.Allowed())
+	require.NoError(t, throttle.Succeed(ctx, reservation))
+
+	check, err = throttle.Check(ctx, "jane@example.com", "198.51.100.1")
+	require.NoError(t, err)
+	assert.True(t, check.Allowed())
+	assert.False(t, check.CaptchaRequired)
+
+	check, err = throttle.Check(ctx, "someone@example.com", "203.0.113.7")
+	require.NoError(t, err)
+	assert.True(t, check.Allowed(), "addresses do not back off")
+	assert.True(t, check.CaptchaRequired, "address failures are kept")
+}
+
+func TestLoginThrottle_ReserveCountsParallelAttempts(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	backend := newFakeLoginThrottleBackend()
+	throttle := newLoginThrottle(backend, DefaultLoginThrottleConfig(), func() time.Time { return now })
+
+	// Attempts whose passwords are still being checked count as failures,
+	// so only the free attempts can run side by side
+	var reservations []*LoginReservation
+	for i := 0; i < 3; i++ {
+		reservation, check, err := throttle.Reserve(ctx, "jane@example.com", "203.0.113.7")
+		require.NoError(t, err)
+		require.True(t, check.Allowed(), i)
+		reservations = append(reservations, reservation)
+	}
+	reservation, check, err := throttle.Reserve(ctx, "jane@example.com", "203.0.113.7")
+	require.NoError(t, err)
+	assert.Nil(t, reservation)
+	assert.False(t, check.Allowed(), "the fourth attempt waits for the others")
+	assert.Equal(t, 3, backend.attempts[accountKey("jane@example.com")].Failures, "refused attempts are not counted")
+
+	// A correct password waiting for its second factor is taken back
+	require.NoError(t, throttle.Release(ctx, reservations[0]))
+	_, err = throttle.Fail(ctx, reservations[1], "user-1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, backend.attempts[accountKey("jane@example.com")].Failures)
+	assert.Equal(t, 2, backend.attempts[ipKey("203.0.113.7")].Failures)
+
+	// A successful login clears the account but not the address
+	require.NoError(t, throttle.Succeed(ctx, reservations[2]))
+	assert.NotContains(t, backend.attempts, accountKey("jane@example.com"))
+	assert.Equal(t, 1, backend.attempts[ipKey("203.0.113.7")].Failures)
+}
+
+func TestLoginThrottle_IPLockout(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	backend := newFakeLoginThrottleBackend()
+	config := DefaultLoginThrottleConfig()
+	config.IPLockoutThreshold = 5
+	throttle := newLoginThrottle(backend, config, func() time.Time { return now })
+
+	// Spraying one password over many accounts
+	for i := 0; i < 5; i++ {
+		failLogin(t, throttle, "user"+string(rune('a'+i))+"@example.com", "", "203.0.113.7")
+	}
+
+	check, err := throttle.Check(ctx, "fresh@example.com", "203.0.113.7")
+	require.NoError(t, err)
+	assert.True(t, check.Locked)
+	assert.False(t, check.Allowed())
+
+	check, err = throttle.Check(ctx, "fresh@example.com", "198.51.100.1")
+	require.NoError(t, err)
+	assert.True(t, check.Allowed())
+
+	require.Len(t, backend.audited, 1)
+	assert.Equal(t, models.AuditEventLoginIPLocked, backend.audited[0].Event)
+}
+
+func TestLoginThrottle_FailureWindow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	backend := newFakeLoginThrottleBackend()
+	throttle := newLoginThrottle(backend, DefaultLoginThrottleConfig(), func() time.Time { return now })
+
+	for i := 0; i < 5; i++ {
+		failure := failLogin(t, throttle, "jane@example.com", "user-1", "203.0.113.7")
+		now = now.Add(failure.RetryAfter)
+	}
+
+	now = now.Add(25 * time.Hour)
+	check, err := throttle.Check(ctx, "jane@example.com", "203.0.113.7")
+	require.NoError(t, err)
+	assert.True(t, check.Allowed())
+	assert.False(t, check.CaptchaRequired)
+
+	failure := failLogin(t, throttle, "jane@example.com", "user-1", "203.0.113.7")
+	assert.True(t, failure.Allowed(), "old failures no longer count")
+	assert.Equal(t, 1, backend.attempts[accountKey("jane@example.com")].Failures)
+}
+
+func TestLoadLoginThrottleConfig(t *testing.T) {
+	t.Setenv("LOGIN_LOCKOUT_THRESHOLD", "5")
+	t.Setenv("LOGIN_IP_LOCKOUT_THRESHOLD", "invalid")
+	t.Setenv("LOGIN_CAPTCHA_THRESHOLD", "2")
+	t.Setenv("LOGIN_LOCKOUT_DURATION", "1h")
+
+	config := LoadLoginThrottleConfig()
+	assert.Equal(t, 5, config.AccountLockoutThreshold)
+	assert.Equal(t, 100, config.IPLockoutThreshold)
+	assert.Equal(t, 2, config.CaptchaThreshold)
+	assert.Equal(t, time.Hour, config.LockoutDuration)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -71,6 +72,20 @@ func (m *MongoClient) Close() error {
 	return nil
 }
 
+// SupportsTransactions reports whether the server is a replica set member
+// or a sharded cluster router; standalone servers cannot run transactions
+func (m *MongoClient) SupportsTransactions(ctx context.Context) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := m.Client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false, err
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid", nil
+}
+
 // GetCollection returns a collection from the database
 func (m *MongoClient) GetCollection(collectionName string) *mongo.Collection {
 	return m.Database.Collection(collectionName)
@@ -88,6 +103,16 @@ var CollectionNames = struct {
 	Notifications    string
 	RealTimeChannels string
 	ChatMessages     string
+	ChatCursors      string
+	Counters         string
+	CallSessions     string
+	RevokedTokens    string
+	OIDCLogins       string
+	LoginAttempts    string
+	AuditLog         string
+	AccessTokens     string
+	RoomTimers       string
+	XPHistory        string
 }{
 	Users:            "users",
 	Rooms:            "rooms",
@@ -99,4 +124,14 @@ var CollectionNames = struct {
 	Notifications:    "notifications",
 	RealTimeChannels: "realtime_channels",
 	ChatMessages:     "chat_messages",
+	ChatCursors:      "chat_cursors",
+	Counters:         "counters",
+	CallSessions:     "call_sessions",
+	RevokedTokens:    "revoked_tokens",
+	OIDCLogins:       "oidc_logins",
+	LoginAttempts:    "login_attempts",
+	AuditLog:         "audit_log",
+	AccessTokens:     "personal_access_tokens",
+	RoomTimers:       "room_timers",
+	XPHistory:        "xp_history",
 }
@@ -137,6 +137,10 @@ func TestCollectionNames(t *testing.T) {
 	assert.NotEmpty(t, CollectionNames.Notifications)
 	assert.NotEmpty(t, CollectionNames.RealTimeChannels)
 	assert.NotEmpty(t, CollectionNames.ChatMessages)
+	assert.NotEmpty(t, CollectionNames.ChatCursors)
+	assert.NotEmpty(t, CollectionNames.Counters)
+	assert.NotEmpty(t, CollectionNames.CallSessions)
+	assert.NotEmpty(t, CollectionNames.RevokedTokens)
 
 	// Test that collection names are unique
 	names := []string{
@@ -150,6 +154,10 @@ func TestCollectionNames(t *testing.T) {
 		CollectionNames.Notifications,
 		CollectionNames.RealTimeChannels,
 		CollectionNames.ChatMessages,
+		CollectionNames.ChatCursors,
+		CollectionNames.Counters,
+		CollectionNames.CallSessions,
+		CollectionNames.RevokedTokens,
 	}
 
 	seen := make(map[string]bool)
@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/studyplatform/backend/pkg/logger"
+)
+
+// Message is an email with plain text and HTML bodies
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// LoadMailer returns an SMTP mailer configured by SMTP_HOST, SMTP_PORT,
+// SMTP_USERNAME, SMTP_PASSWORD and MAIL_FROM, or a LogMailer when SMTP_HOST
+// is unset, which is refused in production
+func LoadMailer() (Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		if os.Getenv("ENV") == "production" {
+			return nil, errors.New("SMTP_HOST must be configured in production")
+		}
+		return LogMailer{}, nil
+	}
+
+	port := 587
+	if value, err := strconv.Atoi(os.Getenv("SMTP_PORT")); err == nil && value > 0 {
+		port = value
+	}
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Study Platform <no-reply@studyplatform.local>"
+	}
+
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}, nil
+}
+
+// LogMailer drops emails, logging only their recipient and subject. It is
+// meant for development; the bodies carry tokens and are never logged.
+type LogMailer struct{}
+
+// Send logs that the message was not sent
+func (LogMailer) Send(ctx context.Context, message Message) error {
+	logger.Info("Email not sent, no SMTP server configured",
+		logger.Field("to", message.To),
+		logger.Field("subject", message.Subject),
+	)
+	return nil
+}
@@ -0,0 +1,208 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smtpSink is a minimal SMTP server that records the messages it receives
+type smtpSink struct {
+	listener net.Listener
+	messages chan string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	sink := &smtpSink{listener: listener, messages: make(chan string, 1)}
+	t.Cleanup(func() { listener.Close() })
+	go sink.serve()
+	return sink
+}
+
+func (s *smtpSink) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpSink) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 sink ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			reply("250-sink")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(command, "AUTH"):
+			reply("235 authenticated")
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 send data")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.messages <- data.String()
+			reply("250 queued")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	message, err := Render(TemplateResetPassword, "jane@example.com", map[string]string{
+		"Username":  "<jane>",
+		"Link":      "https://app.example.com/reset-password?token=abc",
+		"ExpiresIn": "1 hour",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", message.To)
+	assert.Equal(t, "Reset your password", message.Subject)
+	assert.Contains(t, message.Text, "Hi <jane>,")
+	assert.Contains(t, message.Text, "https://app.example.com/reset-password?token=abc")
+	assert.NotContains(t, message.Text, "Reset your password", "subject block is not rendered in the body")
+	assert.Contains(t, message.HTML, "Hi &lt;jane&gt;,", "HTML is escaped")
+	assert.Contains(t, message.HTML, `href="https://app.example.com/reset-password?token=abc"`)
+
+	message, err = Render(TemplateVerifyEmail, "jane@example.com", map[string]string{
+		"Username": "jane", "Email": "jane@example.com", "Link": "https://x", "ExpiresIn": "24 hours",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Verify your email address", message.Subject)
+
+	message, err = Render(TemplatePasswordChanged, "jane@example.com", map[string]string{
+		"Username": "jane", "ChangedAt": "May 1, 2024 at 10:00 UTC", "IP": "203.0.113.7", "Link": "https://x/forgot-password",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Your password was changed", message.Subject)
+	assert.Contains(t, message.Text, "203.0.113.7")
+
+	message, err = Render(TemplateAccountLocked, "jane@example.com", map[string]string{
+		"Username": "jane", "Failures": "10", "IP": "203.0.113.7", "LockedUntil": "May 1, 2024 at 10:30 UTC", "Link": "https://x/unlock-account?token=abc",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Your account was locked", message.Subject)
+	assert.Contains(t, message.HTML, `href="https://x/unlock-account?token=abc"`)
+
+	_, err = Render("unknown", "jane@example.com", nil)
+	assert.Error(t, err)
+}
+
+func TestSMTPMailer_Send(t *testing.T) {
+	sink := newSMTPSink(t)
+	host, port, err := net.SplitHostPort(sink.listener.Addr().String())
+	require.NoError(t, err)
+
+	portNumber, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	mailer := &SMTPMailer{Host: host, Port: portNumber, From: "Study Platform <no-reply@example.com>", Username: "user", Password: "secret"}
+
+	err = mailer.Send(context.Background(), Message{
+		To:      "jane@example.com",
+		Subject: "Grüße",
+		Text:    "Hello Jane",
+		HTML:    "<p>Hello Jane</p>",
+	})
+	require.NoError(t, err)
+
+	var raw string
+	select {
+	case raw = <-sink.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(raw))
+	require.NoError(t, err)
+	assert.Equal(t, `"Study Platform" <no-reply@example.com>`, parsed.Header.Get("From"))
+	assert.Equal(t, "<jane@example.com>", parsed.Header.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Grüße", subject)
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(part)
+		require.NoError(t, err)
+		bodies = append(bodies, part.Header.Get("Content-Type")+": "+string(body))
+	}
+	assert.Equal(t, []string{
+		"text/plain; charset=utf-8: Hello Jane",
+		"text/html; charset=utf-8: <p>Hello Jane</p>",
+	}, bodies)
+}
+
+func TestSMTPMailer_InvalidAddress(t *testing.T) {
+	mailer := &SMTPMailer{Host: "127.0.0.1", Port: 1, From: "no-reply@example.com"}
+	err := mailer.Send(context.Background(), Message{To: "not an address", Text: "hi"})
+	assert.Error(t, err)
+}
+
+func TestLoadMailer(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	t.Setenv("ENV", "development")
+	loaded, err := LoadMailer()
+	require.NoError(t, err)
+	assert.IsType(t, LogMailer{}, loaded)
+
+	t.Setenv("ENV", "production")
+	_, err = LoadMailer()
+	assert.Error(t, err, "production requires an SMTP server")
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_PORT", "2525")
+	t.Setenv("MAIL_FROM", "Study <study@example.com>")
+	loaded, err = LoadMailer()
+	require.NoError(t, err)
+	mailer, ok := loaded.(*SMTPMailer)
+	require.True(t, ok)
+	assert.Equal(t, "smtp.example.com", mailer.Host)
+	assert.Equal(t, 2525, mailer.Port)
+	assert.Equal(t, "Study <study@example.com>", mailer.From)
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"strings"
@@ -15,23 +16,36 @@ import (
 
 // Middleware holds all middleware handlers
 type Middleware struct {
-	jwtManager *auth.Manager
+	jwtManager   *auth.Manager
+	revocations  *auth.RevocationStore
+	accessTokens *auth.AccessTokenStore
 }
 
-// NewMiddleware creates a new middleware instance
-func NewMiddleware() *Middleware {
+// NewMiddleware creates a new middleware instance. When revocations is nil,
+// validly signed tokens are accepted until they expire; when accessTokens is
+// nil, personal access tokens are refused.
+func NewMiddleware(jwtManager *auth.Manager, revocations *auth.RevocationStore, accessTokens *auth.AccessTokenStore) *Middleware {
 	return &Middleware{
-		jwtManager: auth.NewManager(),
+		jwtManager:   jwtManager,
+		revocations:  revocations,
+		accessTokens: accessTokens,
 	}
 }
 
-// CORS returns a CORS middleware configuration
-func CORS() gin.HandlerFunc {
-	// Get allowed origins from environment
+// AllowedOrigins returns the origins listed in ALLOWED_ORIGINS, or the local
+// development origins when it is unset. A single "*" allows every origin.
+func AllowedOrigins() []string {
 	allowedOrigins := strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",")
 	if len(allowedOrigins) == 0 || (len(allowedOrigins) == 1 && allowedOrigins[0] == "") {
 		allowedOrigins = []string{"http://localhost:3000", "http://localhost:5173", "http://127.0.0.1:3000", "http://127.0.0.1:5173"} // Default values
 	}
+	return allowedOrigins
+}
+
+// CORS returns a CORS middleware configuration
+func CORS() gin.HandlerFunc {
+	// Get allowed origins from environment
+	allowedOrigins := AllowedOrigins()
 
 	// Log the allowed origins for debugging
 	logger.Info("CORS Configuration", logger.Field("allowedOrigins", allowedOrigins))
@@ -91,8 +105,10 @@ func (m *Middleware) Logger() gin.HandlerFunc {
 	}
 }
 
-// Auth verifies the JWT token in the request
-func (m *Middleware) Auth() gin.HandlerFunc {
+// Auth verifies the JWT token in the request. Personal access tokens are
+// accepted instead only when the route names scopes, all of which the token
+// must hold.
+func (m *Middleware) Auth(scopes ...auth.Scope) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -110,6 +126,11 @@ func (m *Middleware) Auth() gin.HandlerFunc {
 		}
 
 		tokenString := parts[1]
+		if auth.IsAccessToken(tokenString) {
+			m.authenticateAccessToken(c, tokenString, scopes)
+			return
+		}
+
 		claims, err := m.jwtManager.ValidateAccessToken(tokenString)
 		if err != nil {
 			logger.Warn("JWT validation failed", logger.Field("error", err))
@@ -118,14 +139,123 @@ func (m *Middleware) Auth() gin.HandlerFunc {
 			return
 		}
 
+		// Reject tokens revoked since they were issued
+		if m.revocations != nil {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+			err := m.revocations.Check(ctx, claims)
+			cancel()
+			switch err {
+			case nil:
+			case auth.ErrTokenRevoked:
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+				c.Abort()
+				return
+			case auth.ErrAccountDisabled:
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Account is disabled"})
+				c.Abort()
+				return
+			default:
+				logger.Error("Token revocation check failed", logger.Field("error", err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify token"})
+				c.Abort()
+				return
+			}
+		}
+
 		// Set user info in context
 		c.Set("userID", claims.UserID)
 		c.Set("username", claims.Username)
 		c.Set("email", claims.Email)
+		c.Set("sessionID", claims.SessionID)
+		c.Set("roles", claims.Roles)
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// authenticateAccessToken authenticates a request made with a personal
+// access token
+func (m *Middleware) authenticateAccessToken(c *gin.Context, tokenString string, scopes []auth.Scope) {
+	if m.accessTokens == nil || len(scopes) == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Personal access tokens cannot be used for this endpoint"})
+		c.Abort()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	token, err := m.accessTokens.Authenticate(ctx, tokenString, c.ClientIP())
+	if err == auth.ErrInvalidAccessToken {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		c.Abort()
+		return
+	} else if err != nil {
+		logger.Error("Access token check failed", logger.Field("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify token"})
+		c.Abort()
+		return
+	}
+
+	// Tokens stop working with the account they belong to
+	if m.revocations != nil {
+		switch err := m.revocations.CheckUser(ctx, token.UserID); err {
+		case nil:
+		case auth.ErrTokenRevoked:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			c.Abort()
+			return
+		case auth.ErrAccountDisabled:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Account is disabled"})
+			c.Abort()
+			return
+		default:
+			logger.Error("Token revocation check failed", logger.Field("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify token"})
+			c.Abort()
+			return
+		}
+	}
+
+	for _, scope := range scopes {
+		if !auth.HasScope(token.Scopes, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient scope", "requiredScopes": scopes})
+			c.Abort()
+			return
+		}
+	}
+
+	// Access tokens carry no roles and no device session
+	c.Set("userID", token.UserID)
+	c.Set("accessTokenID", token.ID.Hex())
+	c.Set("scopes", token.Scopes)
+	c.Next()
+}
+
+// RequirePermission lets requests through only when one of the user's roles
+// grants the permission. It must run after Auth.
+func (m *Middleware) RequirePermission(permission auth.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !auth.HasPermission(c.GetStringSlice("roles"), permission) {
+			forbid(c)
+			return
+		}
 		c.Next()
 	}
 }
 
+// forbid refuses a request from a user lacking the required role
+func forbid(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	logger.Warn("Access denied",
+		logger.Field("user_id", userID),
+		logger.Field("method", c.Request.Method),
+		logger.Field("path", c.Request.URL.Path),
+	)
+	c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	c.Abort()
+}
+
 // Recovery recovers from any panics and logs the error
 func (m *Middleware) Recovery() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PersonalAccessToken lets scripts and integrations call the API on a
+// user's behalf with a limited set of scopes. Only a SHA-256 hash of the
+// token is stored; it is shown to the user once when created.
+type PersonalAccessToken struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     string             `bson:"user_id" json:"-"`
+	Name       string             `bson:"name" json:"name"`
+	TokenHash  string             `bson:"token_hash" json:"-"`
+	Prefix     string             `bson:"prefix" json:"prefix"` // start of the token, to tell tokens apart
+	Scopes     []string           `bson:"scopes" json:"scopes"`
+	CreatedAt  time.Time          `bson:"created_at" json:"createdAt"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"lastUsedAt"`
+	LastUsedIP string             `bson:"last_used_ip,omitempty" json:"lastUsedIp,omitempty"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty" json:"expiresAt"` // nil for tokens that do not expire
+}
+
+// CreateAccessTokenRequest represents a request to create a personal
+// access token
+type CreateAccessTokenRequest struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Scopes        []string `json:"scopes" binding:"required,min=1"`
+	ExpiresInDays int      `json:"expiresInDays" binding:"omitempty,min=1,max=365"`
+}
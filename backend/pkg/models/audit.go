@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEntry records a security-relevant event. Entries are only ever
+// inserted.
+type AuditEntry struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	Event     string                 `bson:"event" json:"event"`
+	UserID    string                 `bson:"user_id,omitempty" json:"userId,omitempty"`
+	IP        string                 `bson:"ip,omitempty" json:"ip,omitempty"`
+	CreatedAt time.Time              `bson:"created_at" json:"createdAt"`
+	Data      map[string]interface{} `bson:"data,omitempty" json:"data,omitempty"`
+}
+
+// Audit events
+const (
+	AuditEventLoginLocked   = "login_locked"    // an account was locked after failed logins
+	AuditEventLoginIPLocked = "login_ip_locked" // an IP address was locked after failed logins
+	AuditEventLoginUnlocked = "login_unlocked"  // an account was unlocked through the emailed link
+	AuditEventRoleGranted   = "role_granted"    // a role was granted to a user
+	AuditEventRoleRevoked   = "role_revoked"    // a role was taken from a user
+)
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CallSession represents a video call in a room. A room has at most one
+// active call; participants join and leave it over the WebSocket.
+type CallSession struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	RoomID       string             `bson:"room_id" json:"roomId"`
+	StartedBy    string             `bson:"started_by" json:"startedBy"`
+	Participants []CallParticipant  `bson:"participants" json:"participants"` // Everyone who joined, including those who left
+	IsActive     bool               `bson:"is_active" json:"isActive"`
+	StartedAt    time.Time          `bson:"started_at" json:"startedAt"`
+	EndedAt      *time.Time         `bson:"ended_at,omitempty" json:"endedAt,omitempty"`
+}
+
+// CallParticipant represents one user's stay in a call
+type CallParticipant struct {
+	UserID        string     `bson:"user_id" json:"userId"`
+	Username      string     `bson:"username" json:"username"`
+	Muted         bool       `bson:"muted" json:"muted"`
+	CameraOn      bool       `bson:"camera_on" json:"cameraOn"`
+	ScreenSharing bool       `bson:"screen_sharing" json:"screenSharing"`
+	JoinedAt      time.Time  `bson:"joined_at" json:"joinedAt"`
+	LeftAt        *time.Time `bson:"left_at" json:"leftAt,omitempty"` // Stored as null while in the call
+}
+
+// CallSessionForResponse represents a call session for API responses
+type CallSessionForResponse struct {
+	ID           string            `json:"id"`
+	RoomID       string            `json:"roomId"`
+	StartedBy    string            `json:"startedBy"`
+	Participants []CallParticipant `json:"participants"` // Current participants only
+	IsActive     bool              `json:"isActive"`
+	StartedAt    time.Time         `json:"startedAt"`
+	EndedAt      *time.Time        `json:"endedAt,omitempty"`
+}
+
+// ActiveParticipants returns the participants currently in the call
+func (cs *CallSession) ActiveParticipants() []CallParticipant {
+	participants := []CallParticipant{}
+	for _, participant := range cs.Participants {
+		if participant.LeftAt == nil {
+			participants = append(participants, participant)
+		}
+	}
+	return participants
+}
+
+// HasParticipant reports whether the user is currently in the call
+func (cs *CallSession) HasParticipant(userID string) bool {
+	for _, participant := range cs.Participants {
+		if participant.UserID == userID && participant.LeftAt == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ToResponse converts a CallSession to a CallSessionForResponse
+func (cs *CallSession) ToResponse() CallSessionForResponse {
+	return CallSessionForResponse{
+		ID:           cs.ID.Hex(),
+		RoomID:       cs.RoomID,
+		StartedBy:    cs.StartedBy,
+		Participants: cs.ActiveParticipants(),
+		IsActive:     cs.IsActive,
+		StartedAt:    cs.StartedAt,
+		EndedAt:      cs.EndedAt,
+	}
+}
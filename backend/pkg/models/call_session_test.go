@@ -0,0 +1,36 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCallSession_ToResponse(t *testing.T) {
+	now := time.Now()
+	left := now.Add(time.Minute)
+	session := CallSession{
+		ID:        primitive.NewObjectID(),
+		RoomID:    "room1",
+		StartedBy: "alice",
+		Participants: []CallParticipant{
+			{UserID: "alice", Username: "alice", JoinedAt: now},
+			{UserID: "bob", Username: "bob", JoinedAt: now, LeftAt: &left},
+			{UserID: "bob", Username: "bob", JoinedAt: left, Muted: true},
+			{UserID: "carol", Username: "carol", JoinedAt: now, LeftAt: &left},
+		},
+		IsActive:  true,
+		StartedAt: now,
+	}
+
+	assert.True(t, session.HasParticipant("alice"))
+	assert.True(t, session.HasParticipant("bob"))
+	assert.False(t, session.HasParticipant("carol"))
+
+	response := session.ToResponse()
+	assert.Equal(t, session.ID.Hex(), response.ID)
+	assert.Len(t, response.Participants, 2)
+	assert.True(t, response.Participants[1].Muted)
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"sort"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -13,8 +14,32 @@ type ChatMessage struct {
 	UserID    string             `bson:"user_id" json:"userId"`
 	Username  string             `bson:"username" json:"username"`
 	Content   string             `bson:"content" json:"content"`
+	Sequence  int64              `bson:"sequence" json:"sequence"` // Monotonic per room, starting at 1
 	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
 	CreatedAt time.Time          `bson:"created_at" json:"createdAt"`
+
+	ReplyTo    string   `bson:"reply_to,omitempty" json:"replyTo,omitempty"`       // ID of the thread's root message
+	ReplyCount int      `bson:"reply_count,omitempty" json:"replyCount,omitempty"` // Replies in the thread, on root messages
+	Mentions   []string `bson:"mentions,omitempty" json:"mentions,omitempty"`      // IDs of mentioned users
+
+	EditHistory []ChatMessageEdit   `bson:"edit_history,omitempty" json:"editHistory,omitempty"` // Previous versions, oldest first
+	EditedAt    *time.Time          `bson:"edited_at,omitempty" json:"editedAt,omitempty"`
+	DeletedAt   *time.Time          `bson:"deleted_at,omitempty" json:"deletedAt,omitempty"`
+	DeletedBy   string              `bson:"deleted_by,omitempty" json:"deletedBy,omitempty"`
+	Reactions   map[string][]string `bson:"reactions,omitempty" json:"reactions,omitempty"` // Emoji -> user IDs
+}
+
+// ChatMessageEdit records the content of a chat message before an edit
+type ChatMessageEdit struct {
+	Content  string    `bson:"content" json:"content"`
+	EditedAt time.Time `bson:"edited_at" json:"editedAt"`
+}
+
+// ChatReaction is the aggregate of one emoji reaction on a chat message
+type ChatReaction struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	UserIDs []string `json:"userIds"`
 }
 
 // ChatMessageForResponse represents a chat message for API responses
@@ -24,8 +49,19 @@ type ChatMessageForResponse struct {
 	UserID    string    `json:"userId"`
 	Username  string    `json:"username"`
 	Content   string    `json:"content"`
+	Sequence  int64     `json:"sequence"`
 	Timestamp time.Time `json:"timestamp"`
 	CreatedAt time.Time `json:"createdAt"`
+
+	ReplyTo    string   `json:"replyTo,omitempty"`
+	ReplyCount int      `json:"replyCount"`
+	Mentions   []string `json:"mentions,omitempty"`
+
+	EditHistory []ChatMessageEdit `json:"editHistory,omitempty"`
+	EditedAt    *time.Time        `json:"editedAt,omitempty"`
+	DeletedAt   *time.Time        `json:"deletedAt,omitempty"`
+	IsDeleted   bool              `json:"isDeleted"`
+	Reactions   []ChatReaction    `json:"reactions"`
 }
 
 // ToResponse converts a ChatMessage to a ChatMessageForResponse
@@ -36,7 +72,50 @@ func (cm *ChatMessage) ToResponse() ChatMessageForResponse {
 		UserID:    cm.UserID,
 		Username:  cm.Username,
 		Content:   cm.Content,
+		Sequence:  cm.Sequence,
 		Timestamp: cm.Timestamp,
 		CreatedAt: cm.CreatedAt,
+
+		ReplyTo:    cm.ReplyTo,
+		ReplyCount: cm.ReplyCount,
+		Mentions:   cm.Mentions,
+
+		EditHistory: cm.EditHistory,
+		EditedAt:    cm.EditedAt,
+		DeletedAt:   cm.DeletedAt,
+		IsDeleted:   cm.DeletedAt != nil,
+		Reactions:   cm.ReactionSummary(),
+	}
+}
+
+// ReactionSummary aggregates reactions per emoji, most popular first
+func (cm *ChatMessage) ReactionSummary() []ChatReaction {
+	reactions := make([]ChatReaction, 0, len(cm.Reactions))
+	for emoji, userIDs := range cm.Reactions {
+		if len(userIDs) == 0 {
+			continue
+		}
+		reactions = append(reactions, ChatReaction{
+			Emoji:   emoji,
+			Count:   len(userIDs),
+			UserIDs: userIDs,
+		})
 	}
+
+	sort.Slice(reactions, func(i, j int) bool {
+		if reactions[i].Count != reactions[j].Count {
+			return reactions[i].Count > reactions[j].Count
+		}
+		return reactions[i].Emoji < reactions[j].Emoji
+	})
+	return reactions
+}
+
+// ChatCursor records the last chat sequence a user acknowledged in a room
+type ChatCursor struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID            string             `bson:"user_id" json:"userId"`
+	RoomID            string             `bson:"room_id" json:"roomId"`
+	LastAckedSequence int64              `bson:"last_acked_sequence" json:"lastAckedSequence"`
+	UpdatedAt         time.Time          `bson:"updated_at" json:"updatedAt"`
 }
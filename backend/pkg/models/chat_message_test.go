@@ -0,0 +1,49 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestChatMessage_ToResponse(t *testing.T) {
+	now := time.Now()
+	message := ChatMessage{
+		ID:        primitive.NewObjectID(),
+		RoomID:    "room1",
+		UserID:    "user1",
+		Username:  "testuser",
+		Content:   "updated",
+		Sequence:  7,
+		Timestamp: now,
+		CreatedAt: now,
+		EditHistory: []ChatMessageEdit{
+			{Content: "original", EditedAt: now},
+		},
+		EditedAt: &now,
+		Reactions: map[string][]string{
+			"🎉":  {"user2"},
+			"👍":  {"user1", "user2"},
+			"❤️": {},
+		},
+	}
+
+	response := message.ToResponse()
+
+	assert.Equal(t, message.ID.Hex(), response.ID)
+	assert.Equal(t, int64(7), response.Sequence)
+	assert.Equal(t, &now, response.EditedAt)
+	assert.False(t, response.IsDeleted)
+	assert.Len(t, response.EditHistory, 1)
+
+	// Empty reactions are dropped and the rest are ordered by count
+	assert.Equal(t, []ChatReaction{
+		{Emoji: "👍", Count: 2, UserIDs: []string{"user1", "user2"}},
+		{Emoji: "🎉", Count: 1, UserIDs: []string{"user2"}},
+	}, response.Reactions)
+
+	message.DeletedAt = &now
+	assert.True(t, message.ToResponse().IsDeleted)
+}
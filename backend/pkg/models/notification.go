@@ -43,7 +43,9 @@ const (
 	NotificationTypeRoomInvitation = "room_invitation"
 	NotificationTypeRoomJoined     = "room_joined"
 	NotificationTypeXPLevelUp      = "xp_level_up"
+	NotificationTypeMention        = "mention"
 	NotificationTypeSystem         = "system"
+	NotificationTypeSecurity       = "security"
 )
 
 // ToResponse converts a Notification to NotificationForResponse
@@ -183,3 +185,78 @@ func CreateXPLevelUpNotification(userID string, newLevel int) Notification {
 		},
 	}
 }
+
+// CreatePasswordChangedNotification tells the user their password changed
+func CreatePasswordChangedNotification(userID, ip string) Notification {
+	return Notification{
+		UserID:    userID,
+		Type:      NotificationTypeSecurity,
+		Title:     "Password Changed",
+		Message:   "Your password was changed and your other devices were signed out. If this wasn't you, reset your password now.",
+		IsRead:    false,
+		CreatedAt: time.Now(),
+		Data: map[string]interface{}{
+			"event": "password_changed",
+			"ip":    ip,
+		},
+	}
+}
+
+// CreateAccountLockedNotification creates a security notification for an
+// account locked after failed logins
+func CreateAccountLockedNotification(userID, ip string, lockedUntil time.Time) Notification {
+	return Notification{
+		UserID:    userID,
+		Type:      NotificationTypeSecurity,
+		Title:     "Account Locked",
+		Message:   "Logins to your account were blocked after too many failed attempts. Check your email to unlock it.",
+		IsRead:    false,
+		CreatedAt: time.Now(),
+		Data: map[string]interface{}{
+			"event":       "account_locked",
+			"ip":          ip,
+			"lockedUntil": lockedUntil,
+		},
+	}
+}
+
+// CreateMFAChangedNotification creates a security notification for two-factor
+// authentication being turned on or off
+func CreateMFAChangedNotification(userID string, enabled bool, ip string) Notification {
+	title, message, event := "Two-Factor Authentication Enabled", "Logins now need a code from your authenticator app.", "mfa_enabled"
+	if !enabled {
+		title, message, event = "Two-Factor Authentication Disabled", "Logins no longer need a code from your authenticator app. If this wasn't you, change your password now.", "mfa_disabled"
+	}
+	return Notification{
+		UserID:    userID,
+		Type:      NotificationTypeSecurity,
+		Title:     title,
+		Message:   message,
+		IsRead:    false,
+		CreatedAt: time.Now(),
+		Data: map[string]interface{}{
+			"event": event,
+			"ip":    ip,
+		},
+	}
+}
+
+// CreateMentionNotification creates a chat mention notification
+func CreateMentionNotification(userID, mentionerID, mentionerUsername, roomID, messageID, content string) Notification {
+	return Notification{
+		UserID:    userID,
+		Type:      NotificationTypeMention,
+		Title:     "New Mention",
+		Message:   mentionerUsername + " mentioned you in a room chat",
+		TargetID:  messageID,
+		IsRead:    false,
+		CreatedAt: time.Now(),
+		Data: map[string]interface{}{
+			"mentionerUsername": mentionerUsername,
+			"mentionerID":       mentionerID,
+			"roomID":            roomID,
+			"messageID":         messageID,
+			"content":           content,
+		},
+	}
+}
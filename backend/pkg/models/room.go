@@ -47,10 +47,12 @@ type RoomForResponse struct {
 
 // ParticipantInfo represents participant information for room responses
 type ParticipantInfo struct {
-	UserID    string `json:"userId"`
-	Username  string `json:"username"`
-	AvatarURL string `json:"avatarUrl,omitempty"`
-	IsOnline  bool   `json:"isOnline"`
+	UserID    string    `json:"userId"`
+	Username  string    `json:"username"`
+	AvatarURL string    `json:"avatarUrl,omitempty"`
+	IsOnline  bool      `json:"isOnline"`
+	Status    string    `json:"status"`   // online, away, in_call, focusing or offline
+	LastSeen  time.Time `json:"lastSeen"` // now for online users
 }
 
 // CreateRoomRequest represents the create room request body
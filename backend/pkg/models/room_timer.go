@@ -0,0 +1,111 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RoomTimer is a pomodoro timer shared by everyone in a room. The server
+// owns its state; a room has at most one.
+type RoomTimer struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	RoomID         string             `bson:"room_id" json:"roomId"`
+	Preset         PomodoroPreset     `bson:"preset" json:"preset"`
+	Phase          string             `bson:"phase" json:"phase"` // focus, short_break or long_break
+	PhaseStartedAt time.Time          `bson:"phase_started_at" json:"phaseStartedAt"`
+	PhaseEndsAt    time.Time          `bson:"phase_ends_at" json:"phaseEndsAt"`
+	PausedAt       *time.Time         `bson:"paused_at,omitempty" json:"pausedAt,omitempty"`
+	ResumedAt      *time.Time         `bson:"resumed_at,omitempty" json:"-"` // when the phase last resumed after a pause
+	PhaseRan       []TimerInterval    `bson:"phase_ran,omitempty" json:"-"`  // stretches of the phase that ended in a pause
+	Remaining      int64              `bson:"remaining" json:"-"`            // In seconds, left of the phase while paused
+	CompletedFocus int                `bson:"completed_focus" json:"completedFocus"`
+	StartedBy      string             `bson:"started_by" json:"startedBy"`
+	StartedAt      time.Time          `bson:"started_at" json:"startedAt"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updatedAt"`
+	Revision       int64              `bson:"revision" json:"revision"` // bumped on every change
+}
+
+// RoomTimerForResponse represents a room timer for API responses and
+// WebSocket messages
+type RoomTimerForResponse struct {
+	RoomID         string         `json:"roomId"`
+	Preset         PomodoroPreset `json:"preset"`
+	Phase          string         `json:"phase"`
+	PhaseStartedAt time.Time      `json:"phaseStartedAt"`
+	PhaseEndsAt    *time.Time     `json:"phaseEndsAt,omitempty"` // unset while paused
+	Paused         bool           `json:"paused"`
+	Remaining      int64          `json:"remaining"` // In seconds
+	CompletedFocus int            `json:"completedFocus"`
+	StartedBy      string         `json:"startedBy"`
+	StartedAt      time.Time      `json:"startedAt"`
+	Revision       int64          `json:"revision"`
+	ServerTime     time.Time      `json:"serverTime"` // lets clients correct for clock skew
+}
+
+// RoomTimerRequest starts a room timer with one of the user's presets
+type RoomTimerRequest struct {
+	Preset string `json:"preset"`
+}
+
+// GroupFocusBlock is a focus block of a room timer that a session was
+// credited for
+type GroupFocusBlock struct {
+	RoomID    string          `bson:"room_id" json:"roomId"`
+	StartedAt time.Time       `bson:"started_at" json:"startedAt"`
+	EndedAt   time.Time       `bson:"ended_at" json:"endedAt"`
+	Ran       []TimerInterval `bson:"ran,omitempty" json:"ran,omitempty"` // set when the block was paused
+}
+
+// TimerInterval is a stretch of time a room timer ran without a pause
+type TimerInterval struct {
+	StartedAt time.Time `bson:"started_at" json:"startedAt"`
+	EndedAt   time.Time `bson:"ended_at" json:"endedAt"`
+}
+
+// Intervals are the stretches of the block the timer ran: the whole block
+// unless it was paused
+func (b GroupFocusBlock) Intervals() []TimerInterval {
+	if len(b.Ran) == 0 {
+		return []TimerInterval{{StartedAt: b.StartedAt, EndedAt: b.EndedAt}}
+	}
+	return b.Ran
+}
+
+// IsPaused reports whether the timer is held
+func (t *RoomTimer) IsPaused() bool {
+	return t.PausedAt != nil
+}
+
+// RemainingAt is the time left of the current phase
+func (t *RoomTimer) RemainingAt(now time.Time) time.Duration {
+	if t.IsPaused() {
+		return time.Duration(t.Remaining) * time.Second
+	}
+	if remaining := t.PhaseEndsAt.Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// ToResponse converts a RoomTimer to a RoomTimerForResponse as of now
+func (t *RoomTimer) ToResponse(now time.Time) RoomTimerForResponse {
+	response := RoomTimerForResponse{
+		RoomID:         t.RoomID,
+		Preset:         t.Preset,
+		Phase:          t.Phase,
+		PhaseStartedAt: t.PhaseStartedAt,
+		Paused:         t.IsPaused(),
+		Remaining:      int64(t.RemainingAt(now).Seconds()),
+		CompletedFocus: t.CompletedFocus,
+		StartedBy:      t.StartedBy,
+		StartedAt:      t.StartedAt,
+		Revision:       t.Revision,
+		ServerTime:     now,
+	}
+	if !t.IsPaused() {
+		endsAt := t.PhaseEndsAt
+		response.PhaseEndsAt = &endsAt
+	}
+	return response
+}
@@ -18,8 +18,98 @@ type Session struct {
 	IsActive     bool               `bson:"is_active" json:"isActive"`
 	InactiveTime int64              `bson:"inactive_time" json:"inactiveTime"` // In seconds
 	Activities   []Activity         `bson:"activities" json:"activities"`
+	// Heartbeats are the server times of activity pings, from which the
+	// session is timed
+	Heartbeats        []time.Time     `bson:"heartbeats,omitempty" json:"-"`
+	LastPingAt        *time.Time      `bson:"last_ping_at,omitempty" json:"lastPingAt,omitempty"`
+	PomodoroCompleted int             `bson:"pomodoro_completed" json:"pomodoroCompleted"`
+	Reported          *ReportedTiming `bson:"reported,omitempty" json:"reported,omitempty"` // what the client claimed when ending
+	Flags             []string        `bson:"flags,omitempty" json:"flags,omitempty"`       // why the client's claims were not trusted
+	EndReason         string          `bson:"end_reason,omitempty" json:"endReason,omitempty"`
+	// Segments split the session into focus blocks, breaks and pauses,
+	// timed by the Preset chosen when it started
+	Segments   []Segment       `bson:"segments,omitempty" json:"segments,omitempty"`
+	Preset     *PomodoroPreset `bson:"preset,omitempty" json:"preset,omitempty"`
+	PausedTime int64           `bson:"paused_time" json:"pausedTime"` // In seconds
+	// GroupFocus are the focus blocks of the room's shared timer the user
+	// studied through
+	GroupFocus []GroupFocusBlock `bson:"group_focus,omitempty" json:"groupFocus,omitempty"`
 }
 
+// Segment is a stretch of a session spent in one way
+type Segment struct {
+	Type      string     `bson:"type" json:"type"`
+	StartedAt time.Time  `bson:"started_at" json:"startedAt"`
+	EndedAt   *time.Time `bson:"ended_at,omitempty" json:"endedAt,omitempty"` // nil while it runs
+	Planned   int64      `bson:"planned" json:"planned"`                      // In seconds, 0 for pauses
+	// Completed is set when the segment ran its planned length and, for
+	// focus segments, the user was active throughout
+	Completed bool `bson:"completed" json:"completed"`
+}
+
+// Segment types
+const (
+	SegmentFocus      = "focus"
+	SegmentShortBreak = "short_break"
+	SegmentLongBreak  = "long_break"
+	SegmentPaused     = "paused"
+)
+
+// PomodoroPreset sets the lengths of a session's focus blocks and breaks
+type PomodoroPreset struct {
+	Name           string `bson:"name" json:"name" binding:"required,max=40"`
+	Focus          int    `bson:"focus" json:"focus" binding:"required,min=1,max=180"`                    // In minutes
+	ShortBreak     int    `bson:"short_break" json:"shortBreak" binding:"required,min=1,max=60"`          // In minutes
+	LongBreak      int    `bson:"long_break" json:"longBreak" binding:"required,min=1,max=120"`           // In minutes
+	LongBreakEvery int    `bson:"long_break_every" json:"longBreakEvery" binding:"required,min=1,max=12"` // focus blocks per long break
+}
+
+// Length is how long a segment of the given type lasts; pauses have none
+func (p PomodoroPreset) Length(segmentType string) time.Duration {
+	switch segmentType {
+	case SegmentFocus:
+		return time.Duration(p.Focus) * time.Minute
+	case SegmentShortBreak:
+		return time.Duration(p.ShortBreak) * time.Minute
+	case SegmentLongBreak:
+		return time.Duration(p.LongBreak) * time.Minute
+	}
+	return 0
+}
+
+// UpdatePomodoroPresetsRequest replaces a user's pomodoro presets
+type UpdatePomodoroPresetsRequest struct {
+	Presets []PomodoroPreset `json:"presets" binding:"max=10,dive"`
+}
+
+// StartSegmentRequest starts a segment of the given type
+type StartSegmentRequest struct {
+	Type string `json:"type" binding:"required,oneof=focus short_break long_break"`
+}
+
+// ReportedTiming is what a client claims about a session it ends. The
+// server measures sessions itself; claims only serve to flag clients whose
+// numbers diverge. Fields are nil when not reported.
+type ReportedTiming struct {
+	Duration         *int64 `bson:"duration,omitempty" json:"duration,omitempty"`                  // In seconds
+	InactiveDuration *int64 `bson:"inactive_duration,omitempty" json:"inactiveDuration,omitempty"` // In seconds
+	PomodoroCount    *int   `bson:"pomodoro_count,omitempty" json:"pomodoroCount,omitempty"`
+}
+
+// Reasons a session ended
+const (
+	SessionEndUser      = "user"      // the user ended it
+	SessionEndAbandoned = "abandoned" // no pings arrived for a while
+	SessionEndReplaced  = "replaced"  // the user started another session
+)
+
+// Session flags
+const (
+	SessionFlagDurationMismatch  = "duration_mismatch"  // reported duration differs from the measured one
+	SessionFlagInactiveMismatch  = "inactive_mismatch"  // reported inactive time differs from the gaps between pings
+	SessionFlagPomodoroOverclaim = "pomodoro_overclaim" // more pomodoros reported than fit in the active time
+)
+
 // Activity represents a user activity during a session
 type Activity struct {
 	Type      string    `bson:"type" json:"type"` // "material_view", "todo_complete", "note_create", etc.
@@ -39,6 +129,17 @@ type SessionForResponse struct {
 	IsActive     bool       `json:"isActive"`
 	InactiveTime int64      `json:"inactiveTime"` // In seconds
 	Activities   []Activity `json:"activities"`
+
+	LastPingAt        *time.Time `json:"lastPingAt,omitempty"`
+	PomodoroCompleted int        `json:"pomodoroCompleted"`
+	Flagged           bool       `json:"flagged"`
+	Flags             []string   `json:"flags,omitempty"`
+	EndReason         string     `json:"endReason,omitempty"`
+
+	Segments   []Segment         `json:"segments,omitempty"`
+	Preset     *PomodoroPreset   `json:"preset,omitempty"`
+	PausedTime int64             `json:"pausedTime"` // In seconds
+	GroupFocus []GroupFocusBlock `json:"groupFocus,omitempty"`
 }
 
 // SessionSummary represents a summary of a user's sessions
@@ -54,11 +155,27 @@ type SessionSummary struct {
 // StartSessionRequest represents the start session request body
 type StartSessionRequest struct {
 	RoomID string `json:"roomId" binding:"required"`
+	Preset string `json:"preset"` // name of one of the user's presets; the first by default
 }
 
-// EndSessionRequest represents the end session request body
+// EndSessionRequest represents the end session request body. The timing
+// fields are the client's own measurements; they are compared with the
+// server's but never credited as they are.
 type EndSessionRequest struct {
-	SessionID string `json:"sessionId" binding:"required"`
+	SessionID        string     `json:"sessionId" binding:"required"`
+	Duration         *int64     `json:"duration"`         // In seconds
+	InactiveDuration *int64     `json:"inactiveDuration"` // In seconds
+	PomodoroCount    *int       `json:"pomodoroCount"`    // Number of completed pomodoros
+	ActivityData     []Activity `json:"activityData"`
+}
+
+// Reported returns the timing the client claimed
+func (r EndSessionRequest) Reported() ReportedTiming {
+	return ReportedTiming{
+		Duration:         r.Duration,
+		InactiveDuration: r.InactiveDuration,
+		PomodoroCount:    r.PomodoroCount,
+	}
 }
 
 // ActivityRequest represents the activity request body
@@ -80,5 +197,16 @@ func (s *Session) ToResponse() SessionForResponse {
 		IsActive:     s.IsActive,
 		InactiveTime: s.InactiveTime,
 		Activities:   s.Activities,
+
+		LastPingAt:        s.LastPingAt,
+		PomodoroCompleted: s.PomodoroCompleted,
+		Flagged:           len(s.Flags) > 0,
+		Flags:             s.Flags,
+		EndReason:         s.EndReason,
+
+		Segments:   s.Segments,
+		Preset:     s.Preset,
+		PausedTime: s.PausedTime,
+		GroupFocus: s.GroupFocus,
 	}
 }
@@ -8,26 +8,79 @@ import (
 
 // User represents a user in the system
 type User struct {
-	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	UniqueID      string             `bson:"unique_id" json:"uniqueId"`
-	Username      string             `bson:"username" json:"username"`
-	Email         string             `bson:"email" json:"email"`
-	PasswordHash  string             `bson:"password_hash" json:"-"`
-	FirstName     string             `bson:"first_name" json:"firstName"`
-	LastName      string             `bson:"last_name" json:"lastName"`
-	AvatarURL     string             `bson:"avatar_url" json:"avatarUrl"`
-	Bio           string             `bson:"bio" json:"bio"`
-	XP            int                `bson:"xp" json:"xp"`
-	Level         int                `bson:"level" json:"level"`
-	Friends       []Friend           `bson:"friends" json:"friends"`
-	JoinedRooms   []string           `bson:"joined_rooms" json:"joinedRooms"`
-	CreatedRooms  []string           `bson:"created_rooms" json:"createdRooms"`
-	RefreshTokens []RefreshToken     `bson:"refresh_tokens" json:"-"`
-	CreatedAt     time.Time          `bson:"created_at" json:"createdAt"`
-	UpdatedAt     time.Time          `bson:"updated_at" json:"updatedAt"`
-	LastActive    time.Time          `bson:"last_active" json:"lastActive"`
-	IsActive      bool               `bson:"is_active" json:"isActive"`
-	IsVerified    bool               `bson:"is_verified" json:"isVerified"`
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UniqueID          string             `bson:"unique_id" json:"uniqueId"`
+	Username          string             `bson:"username" json:"username"`
+	Email             string             `bson:"email" json:"email"`
+	PasswordHash      string             `bson:"password_hash" json:"-"`
+	FirstName         string             `bson:"first_name" json:"firstName"`
+	LastName          string             `bson:"last_name" json:"lastName"`
+	AvatarURL         string             `bson:"avatar_url" json:"avatarUrl"`
+	Bio               string             `bson:"bio" json:"bio"`
+	XP                int                `bson:"xp" json:"xp"`
+	Level             int                `bson:"level" json:"level"`
+	Friends           []Friend           `bson:"friends" json:"friends"`
+	JoinedRooms       []string           `bson:"joined_rooms" json:"joinedRooms"`
+	CreatedRooms      []string           `bson:"created_rooms" json:"createdRooms"`
+	RefreshTokens     []RefreshToken     `bson:"refresh_tokens" json:"-"`
+	TokenVersion      int                `bson:"token_version" json:"-"` // bumped to revoke all issued tokens
+	Roles             []string           `bson:"roles,omitempty" json:"roles"`
+	CreatedAt         time.Time          `bson:"created_at" json:"createdAt"`
+	UpdatedAt         time.Time          `bson:"updated_at" json:"updatedAt"`
+	LastActive        time.Time          `bson:"last_active" json:"lastActive"`
+	IsActive          bool               `bson:"is_active" json:"isActive"`
+	IsVerified        bool               `bson:"is_verified" json:"isVerified"`
+	VerifiedAt        *time.Time         `bson:"verified_at,omitempty" json:"verifiedAt,omitempty"`
+	PasswordChangedAt *time.Time         `bson:"password_changed_at,omitempty" json:"-"` // last change or reset
+	MFA               *MFA               `bson:"mfa,omitempty" json:"-"`
+	Identities        []ExternalIdentity `bson:"external_identities,omitempty" json:"-"`
+	PomodoroPresets   []PomodoroPreset   `bson:"pomodoro_presets,omitempty" json:"-"` // served by /sessions/presets
+}
+
+// ExternalIdentity links the user to an account at an external identity
+// provider such as Google
+type ExternalIdentity struct {
+	Provider string    `bson:"provider"`
+	Subject  string    `bson:"subject"` // the provider's stable user ID
+	Email    string    `bson:"email"`
+	LinkedAt time.Time `bson:"linked_at"`
+}
+
+// MFA holds a user's TOTP two-factor authentication settings
+type MFA struct {
+	Enabled        bool           `bson:"enabled"`
+	Secret         string         `bson:"secret,omitempty"`
+	PendingSecret  string         `bson:"pending_secret,omitempty"` // set up but not yet confirmed with a code
+	LastUsedStep   int64          `bson:"last_used_step"`           // time step of the last accepted code, so codes work once
+	FailedAttempts int            `bson:"failed_attempts"`
+	RecoveryCodes  []RecoveryCode `bson:"recovery_codes,omitempty"`
+	EnabledAt      *time.Time     `bson:"enabled_at,omitempty"`
+}
+
+// IsEnabled reports whether logins need a second factor
+func (m *MFA) IsEnabled() bool {
+	return m != nil && m.Enabled
+}
+
+// RecoveryCodesLeft counts the recovery codes that have not been used
+func (m *MFA) RecoveryCodesLeft() int {
+	if m == nil {
+		return 0
+	}
+	left := 0
+	for _, code := range m.RecoveryCodes {
+		if code.UsedAt == nil {
+			left++
+		}
+	}
+	return left
+}
+
+// RecoveryCode is a one-time code that replaces a TOTP code when the
+// authenticator is unavailable. Only a SHA-256 hash of it is stored.
+type RecoveryCode struct {
+	Hash   string     `bson:"hash"`
+	UsedAt *time.Time `bson:"used_at,omitempty"`
 }
 
 // UserForResponse represents a user object for API responses
@@ -47,16 +100,52 @@ type UserForResponse struct {
 	CreatedAt    time.Time `json:"createdAt"`
 	IsActive     bool      `json:"isActive"`
 	IsVerified   bool      `json:"isVerified"`
+	MFAEnabled   bool      `json:"mfaEnabled"`
+	Roles        []string  `json:"roles"`
 }
 
-// RefreshToken represents a refresh token
+// RefreshToken represents a device session and the refresh token currently
+// issued to it. Only a SHA-256 hash of the token is stored; each refresh
+// rotates it, so presenting an older token of the session reveals reuse.
 type RefreshToken struct {
-	Token     string    `bson:"token"`
-	ExpiresAt time.Time `bson:"expires_at"`
-	CreatedAt time.Time `bson:"created_at"`
-	IP        string    `bson:"ip"`
-	UserAgent string    `bson:"user_agent"`
-	IsRevoked bool      `bson:"is_revoked"`
+	ID         string     `bson:"id"` // session ID, carried in the token's sid claim
+	TokenHash  string     `bson:"token_hash"`
+	ExpiresAt  time.Time  `bson:"expires_at"`
+	CreatedAt  time.Time  `bson:"created_at"`
+	LastUsedAt time.Time  `bson:"last_used_at"`
+	IP         string     `bson:"ip"`
+	UserAgent  string     `bson:"user_agent"`
+	IsRevoked  bool       `bson:"is_revoked"`
+	RevokedAt  *time.Time `bson:"revoked_at,omitempty"`
+}
+
+// DeviceSessionForResponse represents a device session for API responses
+type DeviceSessionForResponse struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+// IsActive reports whether the session can still be refreshed
+func (t RefreshToken) IsActive(now time.Time) bool {
+	return !t.IsRevoked && now.Before(t.ExpiresAt)
+}
+
+// ToResponse converts a RefreshToken to a DeviceSessionForResponse
+func (t RefreshToken) ToResponse(currentSessionID string) DeviceSessionForResponse {
+	return DeviceSessionForResponse{
+		ID:         t.ID,
+		IP:         t.IP,
+		UserAgent:  t.UserAgent,
+		CreatedAt:  t.CreatedAt,
+		LastUsedAt: t.LastUsedAt,
+		ExpiresAt:  t.ExpiresAt,
+		Current:    t.ID == currentSessionID,
+	}
 }
 
 // Friend represents a friend relationship or request
@@ -93,19 +182,46 @@ type UpdateProfileRequest struct {
 
 // UpdateXPRequest represents the update XP request body
 type UpdateXPRequest struct {
-	XP        int    `json:"xp" binding:"required"`
-	Source    string `json:"source" binding:"required"` // "session", "pomodoro", "activity"
+	UserID    string `json:"userId" binding:"required"`                    // the user whose XP changes
+	XP        int    `json:"xp" binding:"required,min=-100000,max=100000"` // negative to take XP away
+	Source    string `json:"source" binding:"required"`                    // see IsManualXPSource
 	SessionID string `json:"sessionId,omitempty"`
+	// IdempotencyKey makes retries of the same adjustment count once
+	IdempotencyKey string `json:"idempotencyKey,omitempty" binding:"max=100"`
+}
+
+// XP sources recorded by the server
+const (
+	XPSourceSession    = "session"
+	XPSourceTodo       = "todo"
+	XPSourceAdjustment = "adjustment"      // changed by an admin for another reason
+	XPSourceOpening    = "opening_balance" // XP earned before the ledger existed
+)
+
+// IsManualXPSource reports whether admins may record an adjustment under
+// source. Opening balances are only written by the server.
+func IsManualXPSource(source string) bool {
+	switch source {
+	case XPSourceSession, XPSourceTodo, XPSourceAdjustment:
+		return true
+	}
+	return false
 }
 
-// XPHistory represents an XP earning event
+// XPHistory is an entry of a user's XP ledger. Entries are never changed
+// or removed once applied; a user's XP is the sum of theirs.
 type XPHistory struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	UserID    string             `bson:"user_id" json:"userId"`
-	XP        int                `bson:"xp" json:"xp"`
-	Source    string             `bson:"source" json:"source"`
-	SessionID string             `bson:"session_id,omitempty" json:"sessionId,omitempty"`
-	CreatedAt time.Time          `bson:"created_at" json:"createdAt"`
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     string             `bson:"user_id" json:"userId"`
+	Key        string             `bson:"key" json:"-"` // unique per user, so an award counts once
+	XP         int                `bson:"xp" json:"xp"`
+	Source     string             `bson:"source" json:"source"`
+	SessionID  string             `bson:"session_id,omitempty" json:"sessionId,omitempty"`
+	AdjustedBy string             `bson:"adjusted_by,omitempty" json:"adjustedBy,omitempty"` // the admin who made a manual adjustment
+	Balance    int                `bson:"balance" json:"balance"`                            // the user's XP after this entry
+	Level      int                `bson:"level" json:"level"`
+	Pending    bool               `bson:"pending,omitempty" json:"-"` // recorded but not yet added to the user's XP
+	CreatedAt  time.Time          `bson:"created_at" json:"createdAt"`
 }
 
 // ChangePasswordRequest represents the change password request body
@@ -114,6 +230,50 @@ type ChangePasswordRequest struct {
 	NewPassword     string `json:"newPassword" binding:"required,min=8"`
 }
 
+// VerifyEmailRequest represents the email verification request body
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ForgotPasswordRequest represents the forgot password request body
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ResetPasswordRequest represents the password reset request body
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required,min=8"`
+}
+
+// UnlockAccountRequest represents the unlock account request body
+type UnlockAccountRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// MFALoginRequest completes a login that needs a second factor
+type MFALoginRequest struct {
+	MFAToken string `json:"mfaToken" binding:"required"`
+	Code     string `json:"code" binding:"required"` // TOTP or recovery code
+}
+
+// MFACodeRequest represents a request confirmed with a TOTP code
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// DisableMFARequest represents the disable two-factor request body
+type DisableMFARequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"` // TOTP or recovery code
+}
+
+// OIDCCompleteRequest exchanges the code from an identity provider login
+// for a session
+type OIDCCompleteRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
 // ToResponse converts a User to a UserForResponse
 func (u *User) ToResponse() UserForResponse {
 	// Count accepted friends
@@ -124,6 +284,11 @@ func (u *User) ToResponse() UserForResponse {
 		}
 	}
 
+	roles := u.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+
 	return UserForResponse{
 		ID:           u.ID.Hex(),
 		UniqueID:     u.UniqueID,
@@ -140,5 +305,7 @@ func (u *User) ToResponse() UserForResponse {
 		CreatedAt:    u.CreatedAt,
 		IsActive:     u.IsActive,
 		IsVerified:   u.IsVerified,
+		MFAEnabled:   u.MFA.IsEnabled(),
+		Roles:        roles,
 	}
 }
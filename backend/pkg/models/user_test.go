@@ -31,6 +31,7 @@ func TestUser_ToResponse(t *testing.T) {
 		LastActive:   now,
 		IsActive:     true,
 		IsVerified:   true,
+		Roles:        []string{"moderator"},
 	}
 
 	response := user.ToResponse()
@@ -50,6 +51,7 @@ func TestUser_ToResponse(t *testing.T) {
 	assert.Equal(t, user.CreatedAt, response.CreatedAt)
 	assert.Equal(t, user.IsActive, response.IsActive)
 	assert.Equal(t, user.IsVerified, response.IsVerified)
+	assert.Equal(t, []string{"moderator"}, response.Roles)
 }
 
 func TestUser_ToResponse_EmptyFields(t *testing.T) {
@@ -94,6 +96,8 @@ func TestUser_ToResponse_EmptyFields(t *testing.T) {
 	assert.Equal(t, user.CreatedAt, response.CreatedAt)
 	assert.Equal(t, user.IsActive, response.IsActive)
 	assert.Equal(t, user.IsVerified, response.IsVerified)
+	assert.NotNil(t, response.Roles)
+	assert.Empty(t, response.Roles)
 }
 
 func TestSignupRequest_Validation(t *testing.T) {
@@ -264,6 +268,15 @@ func TestUpdateXPRequest(t *testing.T) {
 	assert.Equal(t, "session123", request.SessionID)
 }
 
+func TestIsManualXPSource(t *testing.T) {
+	assert.True(t, IsManualXPSource(XPSourceSession))
+	assert.True(t, IsManualXPSource(XPSourceTodo))
+	assert.True(t, IsManualXPSource(XPSourceAdjustment))
+	assert.False(t, IsManualXPSource(XPSourceOpening))
+	assert.False(t, IsManualXPSource("pomodoro"))
+	assert.False(t, IsManualXPSource(""))
+}
+
 func TestFriend_Validation(t *testing.T) {
 	now := time.Now()
 
@@ -282,7 +295,8 @@ func TestRefreshToken_Validation(t *testing.T) {
 	now := time.Now()
 
 	token := RefreshToken{
-		Token:     "refresh_token_123",
+		ID:        "session123",
+		TokenHash: "refresh_token_hash_123",
 		ExpiresAt: now.Add(24 * time.Hour),
 		CreatedAt: now,
 		IP:        "192.168.1.1",
@@ -290,10 +304,27 @@ func TestRefreshToken_Validation(t *testing.T) {
 		IsRevoked: false,
 	}
 
-	assert.Equal(t, "refresh_token_123", token.Token)
+	assert.Equal(t, "refresh_token_hash_123", token.TokenHash)
 	assert.Equal(t, now.Add(24*time.Hour), token.ExpiresAt)
 	assert.Equal(t, now, token.CreatedAt)
 	assert.Equal(t, "192.168.1.1", token.IP)
 	assert.Equal(t, "Mozilla/5.0", token.UserAgent)
 	assert.False(t, token.IsRevoked)
+
+	assert.True(t, token.IsActive(now))
+	assert.False(t, token.IsActive(now.Add(25*time.Hour)))
+	token.IsRevoked = true
+	assert.False(t, token.IsActive(now))
+}
+
+func TestRefreshToken_ToResponse(t *testing.T) {
+	now := time.Now()
+	token := RefreshToken{ID: "session123", TokenHash: "hash", IP: "10.0.0.1", UserAgent: "Firefox", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}
+
+	response := token.ToResponse("session123")
+	assert.Equal(t, "session123", response.ID)
+	assert.Equal(t, "10.0.0.1", response.IP)
+	assert.Equal(t, "Firefox", response.UserAgent)
+	assert.True(t, response.Current)
+	assert.False(t, token.ToResponse("other").Current)
 }
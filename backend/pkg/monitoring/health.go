@@ -65,6 +65,13 @@ type DatabaseMetrics struct {
 	TotalSessions    int64         `json:"total_sessions"`
 }
 
+// Counter is an application counter exported by the metrics endpoint
+type Counter struct {
+	Name  string
+	Help  string
+	Value func() int64
+}
+
 // HealthChecker manages health checks
 type HealthChecker struct {
 	startTime time.Time
@@ -73,6 +80,7 @@ type HealthChecker struct {
 	mongo     *database.MongoClient
 	mu        sync.RWMutex
 	services  map[string]Status
+	counters  []Counter
 }
 
 // NewHealthChecker creates a new health checker instance
@@ -180,6 +188,13 @@ func (hc *HealthChecker) UpdateServiceStatus(serviceName string, status Status)
 	hc.services[serviceName] = status
 }
 
+// RegisterCounter adds an application counter to the metrics endpoint
+func (hc *HealthChecker) RegisterCounter(name, help string, value func() int64) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.counters = append(hc.counters, Counter{Name: name, Help: help, Value: value})
+}
+
 // HealthCheckHandler returns a Gin handler for health checks
 func (hc *HealthChecker) HealthCheckHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -249,6 +264,12 @@ go_uptime_seconds %f
 			time.Since(hc.startTime).Seconds(),
 		)
 
+		hc.mu.RLock()
+		for _, counter := range hc.counters {
+			metrics += fmt.Sprintf("\n# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.Name, counter.Help, counter.Name, counter.Name, counter.Value())
+		}
+		hc.mu.RUnlock()
+
 		c.Header("Content-Type", "text/plain")
 		c.String(http.StatusOK, metrics)
 	}
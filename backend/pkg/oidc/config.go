@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Well-known provider settings
+const (
+	googleIssuer        = "https://accounts.google.com"
+	githubAuthURL       = "https://github.com/login/oauth/authorize"
+	githubTokenURL      = "https://github.com/login/oauth/access_token"
+	githubAPIURL        = "https://api.github.com"
+	defaultCallbackBase = "http://localhost:8080/api/v1/auth/oidc"
+)
+
+// LoadProviders reads the providers named in OIDC_PROVIDERS, a comma
+// separated list such as "google,github,school". Each provider NAME is
+// configured through OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET and
+// optionally OIDC_<NAME>_SCOPES. "google" and "github" know their endpoints;
+// any other name is a generic OpenID Connect provider and needs
+// OIDC_<NAME>_ISSUER. Endpoints can be overridden with OIDC_<NAME>_AUTH_URL,
+// _TOKEN_URL and, for GitHub Enterprise, _API_URL. Callbacks go to
+// OIDC_CALLBACK_BASE_URL/<name>/callback.
+func LoadProviders() (map[string]*Provider, error) {
+	providers := make(map[string]*Provider)
+
+	callbackBase := strings.TrimRight(os.Getenv("OIDC_CALLBACK_BASE_URL"), "/")
+	if callbackBase == "" {
+		callbackBase = defaultCallbackBase
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		env := func(key string) string {
+			return strings.TrimSpace(os.Getenv("OIDC_" + strings.ToUpper(name) + "_" + key))
+		}
+
+		config := Config{
+			Name:         name,
+			Kind:         KindOIDC,
+			Issuer:       env("ISSUER"),
+			ClientID:     env("CLIENT_ID"),
+			ClientSecret: env("CLIENT_SECRET"),
+			RedirectURL:  callbackBase + "/" + name + "/callback",
+			Scopes:       []string{"openid", "email", "profile"},
+			AuthURL:      env("AUTH_URL"),
+			TokenURL:     env("TOKEN_URL"),
+			APIURL:       env("API_URL"),
+		}
+		switch name {
+		case "google":
+			if config.Issuer == "" {
+				config.Issuer = googleIssuer
+			}
+		case "github":
+			config.Kind = KindGitHub
+			config.Scopes = []string{"read:user", "user:email"}
+			if config.AuthURL == "" {
+				config.AuthURL = githubAuthURL
+			}
+			if config.TokenURL == "" {
+				config.TokenURL = githubTokenURL
+			}
+			if config.APIURL == "" {
+				config.APIURL = githubAPIURL
+			}
+		}
+		if scopes := env("SCOPES"); scopes != "" {
+			config.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+		}
+
+		if config.ClientID == "" {
+			return nil, fmt.Errorf("OIDC provider %q: OIDC_%s_CLIENT_ID is required", name, strings.ToUpper(name))
+		}
+		if config.Kind == KindOIDC && config.Issuer == "" {
+			return nil, fmt.Errorf("OIDC provider %q: OIDC_%s_ISSUER is required", name, strings.ToUpper(name))
+		}
+		providers[name] = NewProvider(config, client)
+	}
+	return providers, nil
+}
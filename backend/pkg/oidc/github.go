@@ -0,0 +1,65 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// githubUser is the part of GET /user we use
+type githubUser struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+// githubEmail is an entry of GET /user/emails
+type githubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// githubIdentity reads the user from the GitHub API. GitHub has no ID token;
+// the access token was just obtained over TLS from the token endpoint, which
+// is what vouches for it.
+func (p *Provider) githubIdentity(ctx context.Context, config Config, token Token) (Identity, error) {
+	api := strings.TrimRight(config.APIURL, "/")
+
+	var user githubUser
+	if err := p.getJSON(ctx, api+"/user", token.AccessToken, &user); err != nil {
+		return Identity{}, err
+	}
+	if user.ID == 0 {
+		return Identity{}, fmt.Errorf("oidc: GitHub user has no ID")
+	}
+
+	// The profile email may be hidden or unverified, so use the primary
+	// address from the email list
+	var emails []githubEmail
+	if err := p.getJSON(ctx, api+"/user/emails", token.AccessToken, &emails); err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{
+		Provider: config.Name,
+		Subject:  strconv.FormatInt(user.ID, 10),
+		Username: user.Login,
+		Picture:  user.AvatarURL,
+	}
+	if first, last, found := strings.Cut(strings.TrimSpace(user.Name), " "); found {
+		identity.GivenName, identity.FamilyName = first, last
+	} else {
+		identity.GivenName = first
+	}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = strings.ToLower(email.Email)
+			identity.EmailVerified = email.Verified
+			break
+		}
+	}
+	return identity, nil
+}
@@ -0,0 +1,202 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// keyRefreshInterval limits how often an unknown key ID makes us fetch the
+// provider's key set again
+const keyRefreshInterval = time.Minute
+
+// idTokenClaims are the ID token and UserInfo claims we read
+type idTokenClaims struct {
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"` // some providers send "true"
+	Name          string      `json:"name"`
+	GivenName     string      `json:"given_name"`
+	FamilyName    string      `json:"family_name"`
+	Picture       string      `json:"picture"`
+	Username      string      `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+// emailVerified reads email_verified whether it is a boolean or a string
+func (c idTokenClaims) emailVerified() bool {
+	switch value := c.EmailVerified.(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
+
+// jwk is a public key from a provider's key set
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// publicKey converts the JWK into an RSA or ECDSA public key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+// keyCache holds a provider's signing keys by key ID
+type keyCache struct {
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// key returns the key with the given ID, fetching the key set when the ID is
+// unknown, as happens after the provider rotates its keys
+func (p *Provider) key(ctx context.Context, config Config, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	if p.keys == nil {
+		p.keys = &keyCache{}
+	}
+	cache := p.keys
+	p.mu.Unlock()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if key, ok := cache.keys[kid]; ok {
+		return key, nil
+	}
+	if !cache.fetchedAt.IsZero() && time.Since(cache.fetchedAt) < keyRefreshInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, config.JWKSURL, "", &set); err != nil {
+		return nil, err
+	}
+	cache.keys = make(map[string]crypto.PublicKey)
+	cache.fetchedAt = time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			cache.keys[k.KeyID] = key
+		}
+	}
+
+	if key, ok := cache.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry
+// and nonce and returns the identity it asserts
+func (p *Provider) verifyIDToken(ctx context.Context, config Config, rawToken, nonce string) (Identity, error) {
+	if rawToken == "" {
+		return Identity{}, fmt.Errorf("%w: missing", ErrInvalidIDToken)
+	}
+
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384"}))
+	var claims idTokenClaims
+	_, err := parser.ParseWithClaims(rawToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.key(ctx, config, kid)
+		if err != nil {
+			return nil, err
+		}
+		// The algorithm must suit the key; the parser checks the key type
+		if _, isRSA := key.(*rsa.PublicKey); isRSA != strings.HasPrefix(token.Method.Alg(), "RS") {
+			return nil, errors.New("algorithm does not match key")
+		}
+		return key, nil
+	})
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if claims.Issuer == "" || strings.TrimRight(claims.Issuer, "/") != strings.TrimRight(config.Issuer, "/") {
+		return Identity{}, fmt.Errorf("%w: wrong issuer %q", ErrInvalidIDToken, claims.Issuer)
+	}
+	if !claims.VerifyAudience(config.ClientID, true) {
+		return Identity{}, fmt.Errorf("%w: wrong audience", ErrInvalidIDToken)
+	}
+	if claims.ExpiresAt == nil {
+		return Identity{}, fmt.Errorf("%w: no expiry", ErrInvalidIDToken)
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return Identity{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	if claims.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+
+	username := claims.Username
+	if username == "" {
+		username = claims.Name
+	}
+	return Identity{
+		Provider:      config.Name,
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: claims.emailVerified(),
+		Username:      username,
+		GivenName:     claims.GivenName,
+		FamilyName:    claims.FamilyName,
+		Picture:       claims.Picture,
+	}, nil
+}
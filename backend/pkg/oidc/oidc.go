@@ -0,0 +1,298 @@
+// Package oidc signs users in with external identity providers: any OpenID
+// Connect provider, configured through its discovery document, and GitHub,
+// which only speaks plain OAuth 2.0. All flows use the authorization code
+// grant with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider kinds
+const (
+	// KindOIDC is an OpenID Connect provider such as Google
+	KindOIDC = "oidc"
+	// KindGitHub is GitHub's OAuth 2.0 flow, with the identity read from its API
+	KindGitHub = "github"
+)
+
+// Config describes a provider. For OpenID Connect providers the endpoints
+// are discovered from the issuer unless set explicitly.
+type Config struct {
+	Name         string
+	Kind         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	JWKSURL     string
+	APIURL      string // GitHub API base URL
+}
+
+// Identity is the user as the provider knows them
+type Identity struct {
+	Provider      string
+	Subject       string // stable user ID at the provider
+	Email         string
+	EmailVerified bool
+	Username      string
+	GivenName     string
+	FamilyName    string
+	Picture       string
+}
+
+// Token is the result of exchanging an authorization code
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// Errors returned while signing a user in
+var (
+	ErrDiscovery      = errors.New("oidc: provider discovery failed")
+	ErrExchange       = errors.New("oidc: code exchange failed")
+	ErrInvalidIDToken = errors.New("oidc: invalid ID token")
+)
+
+// discoveryTTL bounds how long endpoints are cached before the
+// discovery document is fetched again
+const discoveryTTL = 24 * time.Hour
+
+// Provider runs the login flow against one identity provider. It is safe for
+// concurrent use.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu           sync.Mutex
+	discoveredAt time.Time
+	keys         *keyCache
+}
+
+// NewProvider returns a provider using the given HTTP client, or
+// http.DefaultClient when nil
+func NewProvider(config Config, client *http.Client) *Provider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Provider{config: config, client: client}
+}
+
+// Name returns the provider's configured name
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// discoveryDocument is the part of the OpenID Provider Metadata we use
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// endpoints returns the provider configuration, discovering missing OpenID
+// Connect endpoints first
+func (p *Provider) endpoints(ctx context.Context) (Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config.Kind != KindOIDC || (p.config.AuthURL != "" && p.config.TokenURL != "" && p.config.JWKSURL != "") {
+		return p.config, nil
+	}
+	if !p.discoveredAt.IsZero() && time.Since(p.discoveredAt) < discoveryTTL {
+		return p.config, nil
+	}
+
+	discoveryURL := strings.TrimRight(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	var doc discoveryDocument
+	if err := p.getJSON(ctx, discoveryURL, "", &doc); err != nil {
+		return Config{}, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	// The document must describe the issuer it was fetched from
+	if strings.TrimRight(doc.Issuer, "/") != strings.TrimRight(p.config.Issuer, "/") {
+		return Config{}, fmt.Errorf("%w: issuer mismatch %q", ErrDiscovery, doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return Config{}, fmt.Errorf("%w: incomplete discovery document", ErrDiscovery)
+	}
+
+	p.config.AuthURL = doc.AuthorizationEndpoint
+	p.config.TokenURL = doc.TokenEndpoint
+	p.config.UserInfoURL = doc.UserInfoEndpoint
+	if p.config.JWKSURL != doc.JWKSURI {
+		p.config.JWKSURL = doc.JWKSURI
+		p.keys = nil
+	}
+	p.discoveredAt = time.Now()
+	return p.config, nil
+}
+
+// AuthCodeURL returns the URL to send the user to. state and nonce must be
+// random values kept for the callback, as must the PKCE verifier.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	config, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", config.ClientID)
+	query.Set("redirect_uri", config.RedirectURL)
+	query.Set("scope", strings.Join(config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("code_challenge", CodeChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	if config.Kind == KindOIDC {
+		query.Set("nonce", nonce)
+	}
+
+	separator := "?"
+	if strings.Contains(config.AuthURL, "?") {
+		separator = "&"
+	}
+	return config.AuthURL + separator + query.Encode(), nil
+}
+
+// Exchange trades an authorization code for tokens
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (Token, error) {
+	config, err := p.endpoints(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", config.RedirectURL)
+	form.Set("client_id", config.ClientID)
+	form.Set("client_secret", config.ClientSecret)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Token{}, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Token{}, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	// GitHub answers errors with 200 and an error field
+	var token struct {
+		Token
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return Token{}, fmt.Errorf("%w: status %d", ErrExchange, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return Token{}, fmt.Errorf("%w: %s %s", ErrExchange, token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return Token{}, fmt.Errorf("%w: no access token", ErrExchange)
+	}
+	return token.Token, nil
+}
+
+// Identity returns the signed-in user. For OpenID Connect providers the ID
+// token must be valid and carry the nonce sent with the authorization
+// request.
+func (p *Provider) Identity(ctx context.Context, token Token, nonce string) (Identity, error) {
+	config, err := p.endpoints(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	if config.Kind == KindGitHub {
+		return p.githubIdentity(ctx, config, token)
+	}
+
+	identity, err := p.verifyIDToken(ctx, config, token.IDToken, nonce)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	// Some providers leave profile claims out of the ID token
+	if identity.Email == "" && config.UserInfoURL != "" {
+		var info idTokenClaims
+		if err := p.getJSON(ctx, config.UserInfoURL, token.AccessToken, &info); err != nil {
+			return Identity{}, err
+		}
+		// The subject must match, or the response is for someone else
+		if info.Subject == identity.Subject {
+			identity.Email = strings.ToLower(info.Email)
+			identity.EmailVerified = info.emailVerified()
+		}
+	}
+	return identity, nil
+}
+
+// getJSON fetches a JSON document, with a bearer token when given
+func (p *Provider) getJSON(ctx context.Context, target, accessToken string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// RandomString returns a URL-safe random string, used for state, nonce and
+// PKCE verifiers
+func RandomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge for a verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
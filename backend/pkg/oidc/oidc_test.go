@@ -0,0 +1,336 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockProvider is a minimal OpenID Connect provider. It issues one code per
+// authorization request and checks the PKCE verifier when it is redeemed.
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu         sync.Mutex
+	challenges map[string]string // code -> code challenge
+	nonces     map[string]string // code -> nonce
+	claims     jwt.MapClaims     // extra or overridden ID token claims
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	m := &mockProvider{t: t, key: key, challenges: map[string]string{}, nonces: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"userinfo_endpoint":      m.server.URL + "/userinfo",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// authorize plays the user approving the login and returns the code the
+// provider would redirect back with
+func (m *mockProvider) authorize(authURL string) string {
+	parsed, err := url.Parse(authURL)
+	require.NoError(m.t, err)
+	query := parsed.Query()
+	require.Equal(m.t, "S256", query.Get("code_challenge_method"))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code := "code-" + query.Get("state")
+	m.challenges[code] = query.Get("code_challenge")
+	m.nonces[code] = query.Get("nonce")
+	return code
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	require.NoError(m.t, r.ParseForm())
+	m.mu.Lock()
+	challenge, ok := m.challenges[r.PostForm.Get("code")]
+	nonce := m.nonces[r.PostForm.Get("code")]
+	delete(m.challenges, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	if !ok || CodeChallenge(r.PostForm.Get("code_verifier")) != challenge || r.PostForm.Get("client_secret") != "secret" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     m.idToken(nonce),
+	})
+}
+
+func (m *mockProvider) idToken(nonce string) string {
+	claims := jwt.MapClaims{
+		"iss":            m.server.URL,
+		"aud":            "client",
+		"sub":            "1234567890",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "Jane@School.edu",
+		"email_verified": true,
+		"given_name":     "Jane",
+		"family_name":    "Doe",
+	}
+	for name, value := range m.claims {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(m.key)
+	require.NoError(m.t, err)
+	return signed
+}
+
+func (m *mockProvider) provider() *Provider {
+	return NewProvider(Config{
+		Name:         "school",
+		Kind:         KindOIDC,
+		Issuer:       m.server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:8080/api/v1/auth/oidc/school/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+	}, m.server.Client())
+}
+
+// login runs the authorization code flow and returns the identity
+func (m *mockProvider) login(p *Provider, nonce string) (Identity, error) {
+	ctx := context.Background()
+	verifier, err := RandomString()
+	require.NoError(m.t, err)
+
+	authURL, err := p.AuthCodeURL(ctx, "state", nonce, verifier)
+	require.NoError(m.t, err)
+	token, err := p.Exchange(ctx, m.authorize(authURL), verifier)
+	require.NoError(m.t, err)
+	return p.Identity(ctx, token, nonce)
+}
+
+func TestProvider_OIDCFlow(t *testing.T) {
+	mock := newMockProvider(t)
+	provider := mock.provider()
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "xyz", "n-0S6", "verifier")
+	require.NoError(t, err)
+	parsed, err := url.Parse(authURL)
+	require.NoError(t, err)
+	assert.Equal(t, mock.server.URL+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path, "endpoint is discovered")
+	query := parsed.Query()
+	assert.Equal(t, "code", query.Get("response_type"))
+	assert.Equal(t, "client", query.Get("client_id"))
+	assert.Equal(t, "openid email profile", query.Get("scope"))
+	assert.Equal(t, "xyz", query.Get("state"))
+	assert.Equal(t, "n-0S6", query.Get("nonce"))
+	assert.Equal(t, CodeChallenge("verifier"), query.Get("code_challenge"))
+
+	identity, err := mock.login(provider, "nonce-1")
+	require.NoError(t, err)
+	assert.Equal(t, Identity{
+		Provider:      "school",
+		Subject:       "1234567890",
+		Email:         "jane@school.edu",
+		EmailVerified: true,
+		GivenName:     "Jane",
+		FamilyName:    "Doe",
+	}, identity)
+}
+
+func TestProvider_Exchange_RequiresVerifier(t *testing.T) {
+	mock := newMockProvider(t)
+	provider := mock.provider()
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	require.NoError(t, err)
+	_, err = provider.Exchange(ctx, mock.authorize(authURL), "another verifier")
+	assert.ErrorIs(t, err, ErrExchange)
+}
+
+func TestProvider_IDTokenValidation(t *testing.T) {
+	mock := newMockProvider(t)
+	provider := mock.provider()
+	config, err := provider.endpoints(context.Background())
+	require.NoError(t, err)
+
+	_, err = provider.verifyIDToken(context.Background(), config, mock.idToken("nonce"), "nonce")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		nonce  string
+	}{
+		{"wrong nonce", nil, "other"},
+		{"no nonce expected", nil, ""},
+		{"wrong audience", jwt.MapClaims{"aud": "someone-else"}, "nonce"},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example.com"}, "nonce"},
+		{"expired", jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}, "nonce"},
+		{"no subject", jwt.MapClaims{"sub": ""}, "nonce"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.claims = tt.claims
+			defer func() { mock.claims = nil }()
+			_, err := provider.verifyIDToken(context.Background(), config, mock.idToken("nonce"), tt.nonce)
+			assert.ErrorIs(t, err, ErrInvalidIDToken)
+		})
+	}
+
+	// Signed by a key the provider does not publish
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": mock.server.URL, "aud": "client", "sub": "1", "nonce": "nonce", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = "k1"
+	forged, err := token.SignedString(otherKey)
+	require.NoError(t, err)
+	_, err = provider.verifyIDToken(context.Background(), config, forged, "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+
+	// HMAC with the public modulus as secret must not pass
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": mock.server.URL, "aud": "client", "sub": "1", "nonce": "nonce", "exp": time.Now().Add(time.Hour).Unix()})
+	hmacToken.Header["kid"] = "k1"
+	forged, err = hmacToken.SignedString(mock.key.N.Bytes())
+	require.NoError(t, err)
+	_, err = provider.verifyIDToken(context.Background(), config, forged, "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+}
+
+func TestProvider_DiscoveryIssuerMismatch(t *testing.T) {
+	mock := newMockProvider(t)
+	provider := NewProvider(Config{Name: "school", Kind: KindOIDC, Issuer: mock.server.URL + "/tenant", ClientID: "client"}, mock.server.Client())
+
+	_, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	assert.ErrorIs(t, err, ErrDiscovery)
+}
+
+func TestProvider_GitHub(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "application/json", r.Header.Get("Accept"))
+		if r.PostForm.Get("code") != "good" {
+			// GitHub reports errors with status 200
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad_verification_code"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "gho_token", "token_type": "bearer"})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer gho_token", r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 42, "login": "octocat", "name": "Mona Lisa Octocat", "avatar_url": "https://avatars/42"})
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"email": "old@example.com", "primary": false, "verified": true},
+			{"email": "Mona@Example.com", "primary": true, "verified": true},
+		})
+	})
+
+	provider := NewProvider(Config{
+		Name:     "github",
+		Kind:     KindGitHub,
+		ClientID: "client",
+		AuthURL:  server.URL + "/login/oauth/authorize",
+		TokenURL: server.URL + "/login/oauth/access_token",
+		APIURL:   server.URL,
+		Scopes:   []string{"read:user", "user:email"},
+	}, server.Client())
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	require.NoError(t, err)
+	parsed, err := url.Parse(authURL)
+	require.NoError(t, err)
+	assert.Empty(t, parsed.Query().Get("nonce"), "GitHub has no ID token to carry a nonce")
+
+	_, err = provider.Exchange(ctx, "bad", "verifier")
+	assert.ErrorIs(t, err, ErrExchange)
+
+	token, err := provider.Exchange(ctx, "good", "verifier")
+	require.NoError(t, err)
+	identity, err := provider.Identity(ctx, token, "")
+	require.NoError(t, err)
+	assert.Equal(t, Identity{
+		Provider:      "github",
+		Subject:       "42",
+		Email:         "mona@example.com",
+		EmailVerified: true,
+		Username:      "octocat",
+		GivenName:     "Mona",
+		FamilyName:    "Lisa Octocat",
+		Picture:       "https://avatars/42",
+	}, identity)
+}
+
+func TestLoadProviders(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "Google, github ,school")
+	t.Setenv("OIDC_CALLBACK_BASE_URL", "https://api.example.com/api/v1/auth/oidc/")
+	t.Setenv("OIDC_GOOGLE_CLIENT_ID", "google-client")
+	t.Setenv("OIDC_GITHUB_CLIENT_ID", "github-client")
+	t.Setenv("OIDC_SCHOOL_CLIENT_ID", "school-client")
+	t.Setenv("OIDC_SCHOOL_ISSUER", "https://login.school.edu")
+	t.Setenv("OIDC_SCHOOL_SCOPES", "openid,email")
+
+	providers, err := LoadProviders()
+	require.NoError(t, err)
+	require.Len(t, providers, 3)
+
+	assert.Equal(t, googleIssuer, providers["google"].config.Issuer)
+	assert.Equal(t, "https://api.example.com/api/v1/auth/oidc/google/callback", providers["google"].config.RedirectURL)
+	assert.Equal(t, KindGitHub, providers["github"].config.Kind)
+	assert.Equal(t, githubAPIURL, providers["github"].config.APIURL)
+	assert.Equal(t, []string{"openid", "email"}, providers["school"].config.Scopes)
+
+	t.Setenv("OIDC_SCHOOL_ISSUER", "")
+	_, err = LoadProviders()
+	assert.Error(t, err, "generic providers need an issuer")
+
+	t.Setenv("OIDC_PROVIDERS", "")
+	providers, err = LoadProviders()
+	require.NoError(t, err)
+	assert.Empty(t, providers)
+}